@@ -0,0 +1,174 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CheckCertificateRequest checks that the CertificateRequest `cr` only
+// requests names which belong to the Services in the request's namespace.
+// These are the cluster-internal DNS names of the namespace, and the DNS
+// names, IP addresses and URIs which the Services in the namespace would
+// get in their certificates. Returns an invalid config error which
+// describes the reason if the request must be denied.
+func CheckCertificateRequest(ctx context.Context, c client.Client, cr *cmapi.CertificateRequest, cfg Config) error {
+	if cr.Spec.IsCA {
+		return invalidConfigErrorf("CA certificates can't be requested from the Service CA")
+	}
+	csr, err := parseCSR(cr.Spec.Request)
+	if err != nil {
+		return invalidConfigErrorf("invalid certificate signing request: %v", err)
+	}
+	if cn := csr.Subject.CommonName; cn != "" && !containsString(csr.DNSNames, strings.ToLower(cn)) {
+		return invalidConfigErrorf("common name %q isn't one of the requested DNS names", cn)
+	}
+
+	owned, err := namespaceSANs(ctx, c, cr.Namespace, cfg)
+	if err != nil {
+		return err
+	}
+	for _, name := range csr.DNSNames {
+		if !dnsNameOwned(strings.ToLower(name), cr.Namespace, cfg, owned) {
+			return invalidConfigErrorf("DNS name %q doesn't belong to a Service in namespace %s", name, cr.Namespace)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !containsString(owned.IPAddresses, ip.String()) {
+			return invalidConfigErrorf("IP address %s doesn't belong to a Service in namespace %s", ip, cr.Namespace)
+		}
+	}
+	for _, u := range csr.URIs {
+		if !containsString(owned.URIs, u.String()) {
+			return invalidConfigErrorf("URI %q doesn't belong to a Service in namespace %s", u, cr.Namespace)
+		}
+	}
+	return nil
+}
+
+// namespaceSANs returns the DNS names, IP addresses and URIs which the
+// Services in `namespace` and the pods of their StatefulSets would get in
+// their certificates besides the names in the cluster domain. Invalid
+// annotations on a Service are ignored, the Service doesn't get a
+// certificate for them either.
+func namespaceSANs(ctx context.Context, c client.Client, namespace string, cfg Config) (subjectAltNames, error) {
+	owned := subjectAltNames{}
+	svcList := corev1.ServiceList{}
+	if err := c.List(ctx, &svcList, client.InNamespace(namespace)); err != nil {
+		return owned, err
+	}
+	for i := range svcList.Items {
+		svc := &svcList.Items[i]
+		owned.DNSNames = appendUnique(owned.DNSNames, svc.Name, fmt.Sprintf("%s.%s", svc.Name, namespace))
+		pods, err := StatefulSetPods(ctx, c, svc)
+		if err != nil {
+			return owned, err
+		}
+		for _, pod := range pods {
+			owned.DNSNames = appendUnique(owned.DNSNames,
+				fmt.Sprintf("%s.%s", pod, svc.Name),
+				fmt.Sprintf("%s.%s.%s", pod, svc.Name, namespace))
+		}
+		if err := checkTemplateDNSNames(ctx, c, svc, cfg); err == nil {
+			names, _ := templateDNSNames(svc, cfg)
+			owned.DNSNames = appendUnique(owned.DNSNames, names...)
+		} else if !IsInvalidConfigError(err) {
+			return owned, err
+		}
+		if ips, err := serviceIPAddresses(svc); err == nil {
+			owned.IPAddresses = appendUnique(owned.IPAddresses, ips...)
+		}
+		if err := checkExternalSANs(ctx, c, svc, cfg); err == nil {
+			sans, _ := externalSANsFromSvc(svc)
+			owned.DNSNames = appendUnique(owned.DNSNames, sans.DNSNames...)
+			owned.IPAddresses = appendUnique(owned.IPAddresses, sans.IPAddresses...)
+		} else if !IsInvalidConfigError(err) {
+			return owned, err
+		}
+		if err := checkExtraSANs(ctx, c, svc, cfg); err != nil {
+			if IsInvalidConfigError(err) {
+				continue
+			}
+			return owned, err
+		}
+		sans, _ := extraSANsFromSvc(svc)
+		owned.DNSNames = appendUnique(owned.DNSNames, sans.DNSNames...)
+		owned.IPAddresses = appendUnique(owned.IPAddresses, sans.IPAddresses...)
+		owned.URIs = appendUnique(owned.URIs, sans.URIs...)
+	}
+	return owned, nil
+}
+
+// dnsNameOwned returns true if DNS name `name` belongs to namespace
+// `namespace`. Names ending in `.<namespace>.svc` or
+// `.<namespace>.svc.<cluster domain>` belong to the namespace, other names
+// must be in `owned`.
+func dnsNameOwned(name, namespace string, cfg Config, owned subjectAltNames) bool {
+	if ns := namespaceForServiceDNSName(name, cfg.ClusterDomain); ns != "" {
+		return ns == namespace
+	}
+	return containsString(owned.DNSNames, name)
+}
+
+// namespaceForServiceDNSName returns the namespace of DNS name `name` if
+// it's a name of the form `<name>.<namespace>.svc` or
+// `<name>.<namespace>.svc.<cluster domain>`. Returns an empty string for
+// other names.
+func namespaceForServiceDNSName(name, clusterDomain string) string {
+	name = strings.TrimPrefix(name, "*.")
+	name = strings.TrimSuffix(name, "."+clusterDomain)
+	labels := strings.Split(name, ".")
+	n := len(labels)
+	if n < 3 || labels[n-1] != "svc" {
+		return ""
+	}
+	return labels[n-2]
+}
+
+// parseCSR parses the PEM encoded certificate signing request
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no PEM encoded certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+// IsCACertificateName returns true if `name` is the name of the CA
+// Certificate of the profile, of its intermediate CA, or of the CA of one of
+// the profile's CA groups
+func (p *CAProfile) IsCACertificateName(name string) bool {
+	// The names of the intermediate CA and of the CA groups start with the
+	// name of the profile's CA Certificate
+	return name == p.CertificateName || strings.HasPrefix(name, p.CertificateName+"-")
+}
+
+// IsCAIssuerRef returns true if `ref` is the issuer which signs the CA
+// certificate of the profile, the root Issuer of its intermediate CA, or
+// the root Issuer of the intermediate CA of one of the profile's CA groups
+func (p *CAProfile) IsCAIssuerRef(ref cmmeta.ObjectReference) bool {
+	if ref.Group == "" {
+		ref.Group = cmapi.SchemeGroupVersion.Group
+	}
+	if ref == p.caIssuerRef() {
+		return true
+	}
+	if ref.Kind != cmapi.IssuerKind || ref.Group != cmapi.SchemeGroupVersion.Group {
+		return false
+	}
+	// The names of the root Issuers of the CA groups and of the staged CA
+	// start with the name of the profile's CA secret
+	return ref.Name == p.rootIssuerName() ||
+		(strings.HasPrefix(ref.Name, p.SecretName+"-") && strings.HasSuffix(ref.Name, "-issuer"))
+}
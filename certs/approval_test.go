@@ -0,0 +1,228 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_CheckCertificateRequest(t *testing.T) {
+	ctx := context.Background()
+	svc := prepareService("app", "test-ns")
+	svc.Spec.ClusterIPs = []string{"198.51.100.10"}
+	svc.Annotations = map[string]string{
+		ExtraSANsAnnotation: "app.example.internal,192.0.2.10,spiffe://cluster.local/ns/test-ns/sa/app",
+	}
+	external := prepareService("ext", "test-ns")
+	external.Spec.Type = corev1.ServiceTypeExternalName
+	external.Spec.ExternalName = "ext.example.com."
+	greedy := prepareService("greedy", "test-ns")
+	greedy.Annotations = map[string]string{
+		ExtraSANsAnnotation: "db.other-ns,greedy.example.internal",
+	}
+	headless := prepareService("web", "test-ns")
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+	headless.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "test-ns",
+		},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: "web",
+		},
+	}
+	otherSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "other-ns",
+			Annotations: map[string]string{
+				ExtraSANsAnnotation: "db.example.internal",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIPs: []string{"198.51.100.20"},
+		},
+	}
+
+	tests := map[string]struct {
+		commonName string
+		dnsNames   []string
+		ips        []string
+		uris       []string
+		isCA       bool
+		invalidCSR bool
+		denied     bool
+	}{
+		"ServiceNames": {
+			commonName: "app.test-ns.svc",
+			dnsNames: []string{
+				"app", "app.test-ns", "app.test-ns.svc", "app.test-ns.svc.cluster.local",
+				"web-0.app.test-ns.svc.cluster.local", "*.app.test-ns.svc",
+			},
+			ips: []string{"198.51.100.10"},
+		},
+		"StatefulSetPodNames": {
+			dnsNames: []string{"web-0.web", "web-0.web.test-ns", "web-0.web.test-ns.svc"},
+		},
+		"UnknownPodShortName": {
+			dnsNames: []string{"web-1.web"},
+			denied:   true,
+		},
+		"ShortNameOfNonHeadlessService": {
+			dnsNames: []string{"web-0.app"},
+			denied:   true,
+		},
+		"NamespaceServiceName": {
+			dnsNames: []string{"test-ns.svc"},
+			denied:   true,
+		},
+		"ExtraSANs": {
+			dnsNames: []string{"app.example.internal"},
+			ips:      []string{"192.0.2.10"},
+			uris:     []string{"spiffe://cluster.local/ns/test-ns/sa/app"},
+		},
+		"ExternalName": {
+			dnsNames: []string{"ext.example.com"},
+		},
+		"UnknownServiceInNamespace": {
+			dnsNames: []string{"unknown.test-ns.svc"},
+		},
+		"OtherNamespace": {
+			dnsNames: []string{"db.other-ns.svc"},
+			denied:   true,
+		},
+		"OtherNamespaceShortName": {
+			dnsNames: []string{"db.other-ns"},
+			denied:   true,
+		},
+		"OtherNamespaceExtraSAN": {
+			dnsNames: []string{"db.example.internal"},
+			denied:   true,
+		},
+		"InvalidExtraSANsIgnored": {
+			dnsNames: []string{"greedy.example.internal"},
+			denied:   true,
+		},
+		"UnclaimedDNSName": {
+			dnsNames: []string{"www.example.com"},
+			denied:   true,
+		},
+		"UnclaimedShortName": {
+			dnsNames: []string{"unknown"},
+			denied:   true,
+		},
+		"OtherNamespaceIP": {
+			ips:    []string{"198.51.100.20"},
+			denied: true,
+		},
+		"UnclaimedURI": {
+			uris:   []string{"spiffe://cluster.local/ns/other-ns/sa/db"},
+			denied: true,
+		},
+		"CommonNameNotInDNSNames": {
+			commonName: "www.example.com",
+			dnsNames:   []string{"app.test-ns.svc"},
+			denied:     true,
+		},
+		"CA": {
+			dnsNames: []string{"app.test-ns.svc"},
+			isCA:     true,
+			denied:   true,
+		},
+		"InvalidCSR": {
+			invalidCSR: true,
+			denied:     true,
+		},
+	}
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{&svc, &external, &greedy, &headless, sts, otherSvc},
+	})
+	for testn, tc := range tests {
+		cr := &cmapi.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-1",
+				Namespace: "test-ns",
+			},
+			Spec: cmapi.CertificateRequestSpec{
+				IsCA:    tc.isCA,
+				Request: []byte("not a CSR"),
+			},
+		}
+		if !tc.invalidCSR {
+			cr.Spec.Request = testCSR(t, tc.commonName, tc.dnsNames, tc.ips, tc.uris)
+		}
+		err := CheckCertificateRequest(ctx, c, cr, DefaultConfig())
+		assert.Equal(t, tc.denied, IsInvalidConfigError(err), testn)
+		if !tc.denied {
+			assert.NoError(t, err, testn)
+		}
+	}
+}
+
+func TestCerts_IsCAIssuerRef(t *testing.T) {
+	profile := DefaultCAProfile()
+	parent := NamedCAProfile("compliance")
+	parent.ParentIssuer = cmmeta.ObjectReference{Name: "vault"}
+	issuer := func(name, kind string) cmmeta.ObjectReference {
+		return cmmeta.ObjectReference{Name: name, Kind: kind, Group: "cert-manager.io"}
+	}
+
+	tests := map[string]struct {
+		profile  CAProfile
+		ref      cmmeta.ObjectReference
+		expected bool
+	}{
+		"SelfSigned":            {profile, issuer(SelfSignedIssuerName, cmapi.IssuerKind), true},
+		"SelfSigned_NoGroup":    {profile, cmmeta.ObjectReference{Name: SelfSignedIssuerName, Kind: cmapi.IssuerKind}, true},
+		"RootIssuer":            {profile, issuer("service-ca-root-issuer", cmapi.IssuerKind), true},
+		"GroupRootIssuer":       {profile, issuer("service-ca-root-team-a-issuer", cmapi.IssuerKind), true},
+		"ServiceIssuer":         {profile, issuer(ServiceIssuerName, cmapi.ClusterIssuerKind), false},
+		"RootIssuer_Cluster":    {profile, issuer("service-ca-root-issuer", cmapi.ClusterIssuerKind), false},
+		"OtherIssuer":           {profile, issuer("letsencrypt", cmapi.IssuerKind), false},
+		"ParentIssuer":          {parent, issuer("vault", cmapi.ClusterIssuerKind), true},
+		"ParentIssuer_SelfSign": {parent, issuer(SelfSignedIssuerName, cmapi.IssuerKind), false},
+	}
+	for testn, tc := range tests {
+		assert.Equal(t, tc.expected, tc.profile.IsCAIssuerRef(tc.ref), testn)
+	}
+}
+
+// testCSR returns a PEM encoded certificate signing request for the given
+// names
+func testCSR(t *testing.T, cn string, dnsNames, ips, uris []string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dnsNames,
+	}
+	for _, ip := range ips {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
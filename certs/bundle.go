@@ -0,0 +1,129 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// caBundle returns the CA bundle which is injected for the CA of the
+// profile. For a self-signed CA, the bundle is the CA certificate. For an
+// intermediate or imported CA, the bundle is the CA certificate followed by
+// its chain up to the root, see chainBundle().
+func caBundle(secret *corev1.Secret, profile CAProfile) (string, error) {
+	if profile.selfSigned() {
+		return string(secret.Data[corev1.TLSCertKey]), nil
+	}
+	bundle, err := chainBundle(secret.Data[corev1.TLSCertKey], secret.Data[cmmeta.TLSCAKey])
+	if err != nil {
+		return "", fmt.Errorf("assembling CA bundle from secret %s: %w", secret.Name, err)
+	}
+	return string(bundle), nil
+}
+
+// chainBundle orders the certificates of an intermediate CA. The first
+// certificate in `tlsCrt` is the CA certificate. The other certificates in
+// `tlsCrt` and the certificates in `caCrt` are candidates for the chain.
+// The bundle starts with the CA certificate, and each following
+// certificate is the issuer of the previous one. The bundle ends with a
+// self-signed root, or with the last certificate whose issuer isn't
+// available. Candidates which aren't part of the chain are dropped.
+func chainBundle(tlsCrt, caCrt []byte) ([]byte, error) {
+	crts, err := parseCertificates(tlsCrt)
+	if err != nil {
+		return nil, err
+	}
+	if len(crts) == 0 {
+		return nil, fmt.Errorf("no certificate found in `%s`", corev1.TLSCertKey)
+	}
+	extra, err := parseCertificates(caCrt)
+	if err != nil {
+		return nil, err
+	}
+	candidates := append(crts[1:], extra...)
+
+	chain := []*x509.Certificate{crts[0]}
+	for cur := crts[0]; !isSelfSigned(cur); {
+		next := findIssuer(cur, candidates, chain)
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		cur = next
+	}
+
+	var buf bytes.Buffer
+	for _, crt := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// parseCertificates parses all certificates in the PEM data. Other PEM
+// blocks are ignored.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	crts := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return crts, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crts = append(crts, crt)
+	}
+}
+
+// findIssuer returns the certificate among `candidates` which signed `crt`,
+// and which isn't part of `chain` yet. Returns nil if there's no such
+// certificate.
+func findIssuer(crt *x509.Certificate, candidates, chain []*x509.Certificate) *x509.Certificate {
+	for _, c := range candidates {
+		if containsCertificate(chain, c) || !bytes.Equal(c.RawSubject, crt.RawIssuer) {
+			continue
+		}
+		if crt.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// issuedBy returns true if the first certificate in `crts` is signed by
+// `ca`, either directly or through a chain of the other certificates in
+// `crts`
+func issuedBy(crts []*x509.Certificate, ca *x509.Certificate) bool {
+	chain := []*x509.Certificate{}
+	for cur := crts[0]; cur != nil; cur = findIssuer(cur, crts[1:], chain) {
+		if cur.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+		chain = append(chain, cur)
+	}
+	return false
+}
+
+func containsCertificate(crts []*x509.Certificate, crt *x509.Certificate) bool {
+	for _, c := range crts {
+		if c.Equal(crt) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSelfSigned(crt *x509.Certificate) bool {
+	return bytes.Equal(crt.RawSubject, crt.RawIssuer) && crt.CheckSignatureFrom(crt) == nil
+}
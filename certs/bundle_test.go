@@ -0,0 +1,162 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testCA struct {
+	crt    *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	keyPEM []byte
+}
+
+// newTestCA creates a CA certificate with common name `cn`, which is
+// signed by `parent`, or self-signed if `parent` is nil
+func newTestCA(t *testing.T, cn string, parent *testCA) *testCA {
+	return newTestCertificate(t, cn, parent, true)
+}
+
+// newTestCertificate creates a certificate with common name `cn`, which is
+// signed by `parent`, or self-signed if `parent` is nil
+func newTestCertificate(t *testing.T, cn string, parent *testCA, isCA bool) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.crt, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCA{
+		crt:    crt,
+		key:    key,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func concat(pems ...[]byte) []byte {
+	res := []byte{}
+	for _, p := range pems {
+		res = append(res, p...)
+	}
+	return res
+}
+
+func TestCerts_chainBundle(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	serviceCA := newTestCA(t, "service-ca", intermediate)
+	unrelated := newTestCA(t, "unrelated", nil)
+
+	tests := map[string]struct {
+		tlsCrt   []byte
+		caCrt    []byte
+		expected []byte
+	}{
+		"ChainInTLSCrt": {
+			tlsCrt:   concat(serviceCA.pem, intermediate.pem, root.pem),
+			caCrt:    root.pem,
+			expected: concat(serviceCA.pem, intermediate.pem, root.pem),
+		},
+		"RootInCACrt": {
+			tlsCrt:   concat(serviceCA.pem, intermediate.pem),
+			caCrt:    root.pem,
+			expected: concat(serviceCA.pem, intermediate.pem, root.pem),
+		},
+		"Unordered": {
+			tlsCrt:   concat(serviceCA.pem, root.pem),
+			caCrt:    concat(unrelated.pem, intermediate.pem),
+			expected: concat(serviceCA.pem, intermediate.pem, root.pem),
+		},
+		"IncompleteChain": {
+			tlsCrt:   serviceCA.pem,
+			caCrt:    concat(unrelated.pem, root.pem),
+			expected: serviceCA.pem,
+		},
+		"RootCA": {
+			tlsCrt:   root.pem,
+			caCrt:    root.pem,
+			expected: root.pem,
+		},
+	}
+
+	for testn, tc := range tests {
+		bundle, err := chainBundle(tc.tlsCrt, tc.caCrt)
+		require.NoError(t, err, testn)
+		assert.Equal(t, string(tc.expected), string(bundle), testn)
+	}
+
+	_, err := chainBundle(nil, root.pem)
+	assert.Error(t, err)
+	_, err = chainBundle([]byte("-----BEGIN CERTIFICATE-----\nZm9v\n-----END CERTIFICATE-----\n"), nil)
+	assert.Error(t, err)
+}
+
+func TestCerts_issuedBy(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	intermediate := newTestCA(t, "intermediate", root)
+	leaf := newTestCertificate(t, "leaf", intermediate, false)
+	unrelated := newTestCA(t, "unrelated", nil)
+
+	crts, err := parseCertificates(concat(leaf.pem, intermediate.pem))
+	require.NoError(t, err)
+	assert.True(t, issuedBy(crts, intermediate.crt))
+	assert.True(t, issuedBy(crts, root.crt))
+	assert.False(t, issuedBy(crts, unrelated.crt))
+	assert.False(t, issuedBy(crts[:1], root.crt))
+}
+
+func TestCerts_caBundle(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	serviceCA := newTestCA(t, "service-ca", root)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: CASecretName,
+		},
+		Data: map[string][]byte{
+			"tls.crt": serviceCA.pem,
+			"ca.crt":  root.pem,
+		},
+	}
+
+	profile := DefaultCAProfile()
+	bundle, err := caBundle(secret, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(serviceCA.pem), bundle)
+
+	profile.ParentIssuer.Name = "corp-ca"
+	bundle, err = caBundle(secret, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(concat(serviceCA.pem, root.pem)), bundle)
+}
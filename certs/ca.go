@@ -3,6 +3,8 @@ package certs
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"time"
 	"unicode/utf8"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
@@ -15,6 +17,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// Default names of the Service CA resources, see DefaultCAProfile()
 const (
 	SelfSignedIssuerName = "service-ca-self-signed"
 	CACertName           = "service-ca-certificate"
@@ -24,20 +27,23 @@ const (
 )
 
 // ensureCA ensures that the Service CA is completely setup on the cluster
-func ensureCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string) error {
+// and matches the CA profile
+func ensureCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
 	log := l.WithValues("caNamespace", caNamespace)
 
-	err := ensureSelfSignedIssuer(ctx, c, log, caNamespace)
+	_, err := ensureProfileCA(ctx, c, log, caNamespace, profile)
 	if err != nil {
 		return err
 	}
 
-	err = ensureCACertificate(ctx, c, log, caNamespace)
-	if err != nil {
-		return err
+	if profile.Intermediate {
+		err := ensureIntermediateCA(ctx, c, log, caNamespace, profile)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = ensureServiceCAIssuer(ctx, c, log, caNamespace)
+	err = ensureServiceCAIssuer(ctx, c, log, caNamespace, profile)
 	if err != nil {
 		return err
 	}
@@ -45,12 +51,68 @@ func ensureCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace s
 	return nil
 }
 
+// ensureProfileCA ensures that the CA certificate of the CA profile is
+// issued. Imported CAs are supplied by the operator, CAs with name
+// constraints are issued by the controller, and all other CAs are issued by
+// cert-manager. Returns how long until the CA needs to be ensured again,
+// because the constrained CA certificate is due for renewal or a staged CA
+// replaces the CA, or zero if there's no such deadline.
+func ensureProfileCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) (time.Duration, error) {
+	if profile.Import {
+		return 0, removeCACertificate(ctx, c, l, caNamespace, profile)
+	}
+	if profile.NameConstraints {
+		return ensureConstrainedCA(ctx, c, l, caNamespace, profile)
+	}
+	if profile.selfSigned() {
+		if err := ensureSelfSignedIssuer(ctx, c, l, caNamespace, profile); err != nil {
+			return 0, err
+		}
+	}
+	if err := migrateCAResources(ctx, c, l, caNamespace, profile); err != nil {
+		return 0, err
+	}
+	return ensureCACertificate(ctx, c, l, caNamespace, profile)
+}
+
+// removeCACertificate deletes the CA Certificate and the staged CA
+// Certificate of the CA profile if they exist, so that cert-manager doesn't
+// overwrite the CA secret of imported CAs and of CAs which the controller
+// issues itself. Returns an invalid config error if any other Certificate
+// writes to the CA secret.
+func removeCACertificate(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	certList := cmapi.CertificateList{}
+	if err := c.List(ctx, &certList, client.InNamespace(caNamespace)); err != nil {
+		return err
+	}
+	staged := profile.stagedProfile()
+	for i := range certList.Items {
+		cert := &certList.Items[i]
+		switch {
+		case cert.Name == profile.CertificateName:
+			l.Info("Removing CA certificate, the CA secret isn't issued by cert-manager")
+			if err := client.IgnoreNotFound(c.Delete(ctx, cert)); err != nil {
+				return err
+			}
+		case cert.Name == staged.CertificateName:
+			l.Info("Removing staged CA certificate, the CA secret isn't issued by cert-manager")
+			if err := deleteCACertificateAndSecret(ctx, c, cert); err != nil {
+				return err
+			}
+		case cert.Spec.SecretName == profile.SecretName:
+			return invalidConfigErrorf("Certificate %s writes to CA secret %s, which isn't issued by cert-manager",
+				cert.Name, profile.SecretName)
+		}
+	}
+	return nil
+}
+
 // ensureSelfSignedIssuer creates a self-signed issuer in `caNamespace` if it
 // doesn't exist
-func ensureSelfSignedIssuer(ctx context.Context, c client.Client, l logr.Logger, caNamespace string) error {
+func ensureSelfSignedIssuer(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
 	iss := cmapi.Issuer{}
 	err := c.Get(ctx, client.ObjectKey{
-		Name:      SelfSignedIssuerName,
+		Name:      profile.SelfSignedIssuerName,
 		Namespace: caNamespace,
 	}, &iss)
 	if err != nil && !errors.IsNotFound(err) {
@@ -59,7 +121,7 @@ func ensureSelfSignedIssuer(ctx context.Context, c client.Client, l logr.Logger,
 	}
 	if errors.IsNotFound(err) {
 		l.Info("Self-signed issuer doesn't exist, creating...")
-		iss.Name = SelfSignedIssuerName
+		iss.Name = profile.SelfSignedIssuerName
 		iss.Namespace = caNamespace
 		iss.Spec.SelfSigned = &cmapi.SelfSignedIssuer{}
 		if err := c.Create(ctx, &iss); err != nil {
@@ -69,97 +131,138 @@ func ensureSelfSignedIssuer(ctx context.Context, c client.Client, l logr.Logger,
 	return nil
 }
 
-// ensureCACertificate creates the Service CA certificate if it doesn't exist
-func ensureCACertificate(ctx context.Context, c client.Client, l logr.Logger, caNamespace string) error {
-	// Create CA cert if not exists (in caNamespace)
-	caCert := cmapi.Certificate{}
-	err := c.Get(ctx, client.ObjectKey{
-		Name:      CACertName,
-		Namespace: caNamespace,
-	}, &caCert)
-	if err != nil && !errors.IsNotFound(err) {
-		l.Error(err, "while fetching service CA certificate")
+// ensureServiceCAIssuer creates the ClusterIssuer for the Service CA if it
+// doesn't exist. If the ClusterIssuer exists but doesn't reference the
+// issuing CA secret of the CA profile, the ClusterIssuer is updated.
+// ClusterIssuers of the CA under a previous name are deleted.
+func ensureServiceCAIssuer(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	if err := deleteRenamedClusterIssuers(ctx, c, l, profile); err != nil {
 		return err
 	}
-	if errors.IsNotFound(err) {
-		l.Info("Service CA certificate doesn't exist, creating...")
-		caCert = newCACertificate(caNamespace)
-		if err := c.Create(ctx, &caCert); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// ensureServiceCAIssuer creates the ClusterIssuer for the Service CA if it
-// doesn't exist
-func ensureServiceCAIssuer(ctx context.Context, c client.Client, l logr.Logger, caNamespace string) error {
 	// Create Service CA clusterissuer, if not exists
 	serviceIssuer := cmapi.ClusterIssuer{}
-	err := c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &serviceIssuer)
+	err := c.Get(ctx, client.ObjectKey{Name: profile.IssuerName}, &serviceIssuer)
 	if err != nil && !errors.IsNotFound(err) {
 		l.Error(err, "while fetching service CA cluster issuer")
 		return err
 	}
+	desired := &cmapi.CAIssuer{
+		SecretName: profile.issuingSecretName(),
+	}
 	if errors.IsNotFound(err) {
 		l.Info("Service CA cluster issuer doesn't exist, creating...")
-		serviceIssuer.Name = ServiceIssuerName
-		serviceIssuer.Spec.CA = &cmapi.CAIssuer{
-			SecretName: CASecretName,
+		serviceIssuer.Name = profile.IssuerName
+		serviceIssuer.Labels = profile.caLabels()
+		serviceIssuer.Spec.CA = desired
+		return c.Create(ctx, &serviceIssuer)
+	}
+	if !reflect.DeepEqual(serviceIssuer.Spec.IssuerConfig, cmapi.IssuerConfig{CA: desired}) || !profile.hasCALabels(&serviceIssuer) {
+		l.Info("Service CA cluster issuer doesn't match CA profile, updating...")
+		serviceIssuer.Labels = mergeLabels(serviceIssuer.Labels, profile.caLabels())
+		serviceIssuer.Spec.IssuerConfig = cmapi.IssuerConfig{CA: desired}
+		return c.Update(ctx, &serviceIssuer)
+	}
+	return nil
+}
+
+// deleteRenamedClusterIssuers deletes the ClusterIssuers of the CA of the
+// profile which don't have the profile's issuer name. The Service
+// controller moves the Certificates to the ClusterIssuer of the profile.
+func deleteRenamedClusterIssuers(ctx context.Context, c client.Client, l logr.Logger, profile CAProfile) error {
+	issList := cmapi.ClusterIssuerList{}
+	if err := c.List(ctx, &issList, client.MatchingLabels{CAProfileLabelKey: profile.Name}); err != nil {
+		return err
+	}
+	for i := range issList.Items {
+		iss := &issList.Items[i]
+		if iss.Name == profile.IssuerName || !profile.hasCALabels(iss) {
+			continue
 		}
-		if err := c.Create(ctx, &serviceIssuer); err != nil {
+		l.Info("Deleting cluster issuer of the CA under its previous name", "clusterIssuer", iss.Name)
+		if err := client.IgnoreNotFound(c.Delete(ctx, iss)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// newCACertificate returns a new Service CA certificate resource
-func newCACertificate(caNamespace string) cmapi.Certificate {
+// newCACertificate returns a new Service CA certificate resource for the CA
+// profile
+func newCACertificate(caNamespace string, profile CAProfile) cmapi.Certificate {
 	return cmapi.Certificate{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      CACertName,
+			Name:      profile.CertificateName,
 			Namespace: caNamespace,
+			Labels:    profile.caLabels(),
 		},
 		Spec: cmapi.CertificateSpec{
-			IsCA:       true,
-			CommonName: CAName,
-			SecretName: CASecretName,
-			// TODO: make the private key config configurable?
+			IsCA:        true,
+			CommonName:  profile.CommonName,
+			Subject:     profile.subject(),
+			SecretName:  profile.SecretName,
+			Duration:    profile.Duration,
+			RenewBefore: profile.RenewBefore,
 			PrivateKey: &cmapi.CertificatePrivateKey{
-				Algorithm: cmapi.ECDSAKeyAlgorithm,
-				Size:      521,
-			},
-			IssuerRef: cmmeta.ObjectReference{
-				Name:  SelfSignedIssuerName,
-				Kind:  "Issuer",
-				Group: "cert-manager.io",
+				Algorithm: profile.KeyAlgorithm,
+				Size:      profile.KeySize,
 			},
+			IssuerRef: profile.caIssuerRef(),
 		},
 	}
 }
 
-// GetServiceCA returns the Service CA certificate as a string
+// GetServiceCA returns the trust bundle of the Service CA as a string. The
+// trust bundle is the CA bundle, followed by the staged CA while a profile
+// change is rolled out, and by the previous CA certificates while a CA
+// rotation is in progress.
 // Intended to be called in the reconcile loop. Returns an error if the CA
 // certificate isn't ready yet.
-func GetServiceCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string) (string, error) {
+func GetServiceCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) (string, error) {
 	log := l.WithValues("caNamespace", caNamespace)
-	caCert := cmapi.Certificate{}
-	if err := initializeServiceCA(ctx, log, c, caNamespace); err != nil {
+	if err := initializeServiceCA(ctx, log, c, caNamespace, profile); err != nil {
+		return "", err
+	}
+	secret, err := readCASecret(ctx, c, log, caNamespace, profile)
+	if err != nil {
 		return "", err
 	}
+	bundle, err := caBundle(secret, profile)
+	if err != nil {
+		return "", err
+	}
+	bundle, err = withStagedCA(ctx, c, caNamespace, profile, bundle)
+	if err != nil {
+		return "", err
+	}
+	cm, err := ensureTrustBundle(ctx, c, log, caNamespace, profile, "", bundle)
+	if err != nil {
+		return "", err
+	}
+	return cm.Data[cmmeta.TLSCAKey], nil
+}
+
+// readCASecret returns the secret of the CA certificate of the CA profile.
+// Returns an error if the CA certificate isn't ready yet.
+func readCASecret(ctx context.Context, c client.Client, log logr.Logger, caNamespace string, profile CAProfile) (*corev1.Secret, error) {
+	if profile.Import {
+		return readImportedCASecret(ctx, c, log, caNamespace, profile)
+	}
+	if profile.NameConstraints {
+		return readConstrainedCASecret(ctx, c, log, caNamespace, profile)
+	}
+	caCert := cmapi.Certificate{}
 	err := c.Get(ctx, client.ObjectKey{
-		Name:      CACertName,
+		Name:      profile.CertificateName,
 		Namespace: caNamespace,
 	}, &caCert)
 	if err != nil {
 		log.Error(err, "fetching CA certificate")
-		return "", err
+		return nil, err
 	}
 
 	if !isCertReady(&caCert) {
 		log.Info("CA certificate not yet ready")
-		return "", fmt.Errorf("CA certificate not yet ready")
+		return nil, fmt.Errorf("CA certificate not yet ready")
 	}
 
 	secret := corev1.Secret{}
@@ -168,27 +271,32 @@ func GetServiceCA(ctx context.Context, c client.Client, l logr.Logger, caNamespa
 		Namespace: caNamespace,
 	}, &secret); err != nil {
 		log.Error(err, "Fetching CA secret")
-		return "", err
+		return nil, err
 	}
 	caBytes, ok := secret.Data["tls.crt"]
 	if !ok {
-		return "", fmt.Errorf("key `tls.crt` missing in CA secret")
+		return nil, fmt.Errorf("key `tls.crt` missing in CA secret")
 	}
 
 	if !utf8.Valid(caBytes) {
-		return "", fmt.Errorf("`tls.crt` in secret is not valid UTF-8")
+		return nil, fmt.Errorf("`tls.crt` in secret is not valid UTF-8")
 	}
 
-	return string(caBytes), nil
+	return &secret, nil
 }
 
 // initializeServiceCA checks that cert-manager CRDs exist and ensures that the service CA is setup
-func initializeServiceCA(ctx context.Context, l logr.Logger, c client.Client, caNamespace string) error {
-	cmcrd := extv1.CustomResourceDefinition{}
-	if err := c.Get(ctx, client.ObjectKey{Name: "certificates.cert-manager.io"}, &cmcrd); err != nil {
+func initializeServiceCA(ctx context.Context, l logr.Logger, c client.Client, caNamespace string, profile CAProfile) error {
+	if err := checkCertManagerCRDs(ctx, c); err != nil {
 		return err
 	}
 
 	// Ensure that service CA exists
-	return ensureCA(ctx, c, l, caNamespace)
+	return ensureCA(ctx, c, l, caNamespace, profile)
+}
+
+// checkCertManagerCRDs checks that the cert-manager CRDs exist
+func checkCertManagerCRDs(ctx context.Context, c client.Client) error {
+	cmcrd := extv1.CustomResourceDefinition{}
+	return c.Get(ctx, client.ObjectKey{Name: "certificates.cert-manager.io"}, &cmcrd)
 }
@@ -50,7 +50,7 @@ func TestCerts_ensureSelfSignedIssuer(t *testing.T) {
 		c := prepareTest(t, testCfg{
 			initObjs: tc.objects,
 		})
-		err := ensureSelfSignedIssuer(ctx, c, l, testCANamespace)
+		err := ensureSelfSignedIssuer(ctx, c, l, testCANamespace, DefaultCAProfile())
 		assert.NoError(t, err)
 		iss := cmapi.Issuer{}
 		err = c.Get(ctx, client.ObjectKey{
@@ -102,7 +102,7 @@ func TestCerts_ensureCACertificate(t *testing.T) {
 		c := prepareTest(t, testCfg{
 			initObjs: tc.objects,
 		})
-		err := ensureCACertificate(ctx, c, l, testCANamespace)
+		_, err := ensureCACertificate(ctx, c, l, testCANamespace, DefaultCAProfile())
 		assert.NoError(t, err)
 		cert := cmapi.Certificate{}
 		err = c.Get(ctx, client.ObjectKey{
@@ -125,6 +125,36 @@ func TestCerts_ensureCACertificate(t *testing.T) {
 	}
 }
 
+func TestCerts_ensureCA_ParentIssuer(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	c := prepareTest(t, testCfg{})
+
+	profile := DefaultCAProfile()
+	profile.ParentIssuer = cmmeta.ObjectReference{
+		Name:  "vault",
+		Kind:  "ClusterIssuer",
+		Group: "cert-manager.io",
+	}
+	err := ensureCA(ctx, c, l, testCANamespace, profile)
+	assert.NoError(t, err)
+
+	cert := cmapi.Certificate{}
+	err = c.Get(ctx, client.ObjectKey{
+		Name:      CACertName,
+		Namespace: testCANamespace,
+	}, &cert)
+	assert.NoError(t, err)
+	assert.Equal(t, profile.ParentIssuer, cert.Spec.IssuerRef)
+	assert.True(t, cert.Spec.IsCA)
+	// No self-signed issuer is created for intermediate CAs
+	err = c.Get(ctx, client.ObjectKey{
+		Name:      SelfSignedIssuerName,
+		Namespace: testCANamespace,
+	}, &cmapi.Issuer{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
 func TestCerts_ensureSeviceCAIssuer(t *testing.T) {
 	ctx := context.Background()
 	l := testr.New(t)
@@ -157,7 +187,7 @@ func TestCerts_ensureSeviceCAIssuer(t *testing.T) {
 		c := prepareTest(t, testCfg{
 			initObjs: tc.objects,
 		})
-		err := ensureServiceCAIssuer(ctx, c, l, testCANamespace)
+		err := ensureServiceCAIssuer(ctx, c, l, testCANamespace, DefaultCAProfile())
 		assert.NoError(t, err)
 		iss := cmapi.ClusterIssuer{}
 		err = c.Get(ctx, client.ObjectKey{
@@ -170,6 +200,41 @@ func TestCerts_ensureSeviceCAIssuer(t *testing.T) {
 	}
 }
 
+func TestCerts_ensureSeviceCAIssuer_ProfileChanged(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&cmapi.ClusterIssuer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: ServiceIssuerName,
+				},
+				Spec: cmapi.IssuerSpec{
+					IssuerConfig: cmapi.IssuerConfig{
+						CA: &cmapi.CAIssuer{
+							SecretName: CASecretName,
+						},
+					},
+				},
+			},
+		},
+	})
+	profile := DefaultCAProfile()
+	profile.SecretName = "custom-ca-root"
+
+	err := ensureServiceCAIssuer(ctx, c, l, testCANamespace, profile)
+	assert.NoError(t, err)
+	iss := cmapi.ClusterIssuer{}
+	err = c.Get(ctx, client.ObjectKey{
+		Name: ServiceIssuerName,
+	}, &iss)
+	assert.NoError(t, err)
+	assert.Equal(t, &cmapi.CAIssuer{
+		SecretName: "custom-ca-root",
+	}, iss.Spec.CA)
+}
+
 func TestCerts_GetServiceCA(t *testing.T) {
 	ctx := context.Background()
 	l := testr.New(t)
@@ -239,7 +304,7 @@ func TestCerts_GetServiceCA(t *testing.T) {
 			initObjs: tc.objects,
 		})
 
-		ca, err := GetServiceCA(ctx, c, l, testCANamespace)
+		ca, err := GetServiceCA(ctx, c, l, testCANamespace, DefaultCAProfile())
 		assert.True(t, tc.errcheck(err), testn)
 		if err == nil {
 			assert.Equal(t, tc.ca, ca)
@@ -0,0 +1,219 @@
+package certs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CleanupAfterAnnotation is the annotation on Certificates and secrets which
+// are no longer used by a Service. The object is deleted once the RFC3339
+// timestamp in the annotation has passed.
+const CleanupAfterAnnotation = "service.syn.tools/cleanup-after"
+
+// now is replaced in tests
+var now = time.Now
+
+// CleanupCertificates removes the Certificates and secrets of a Service
+// which no longer has label `service.syn.tools/serving-cert-secret-name`.
+// The objects are deleted once the cleanup grace period has passed. Returns
+// the time after which the Service must be reconciled again to finish the
+// cleanup, or 0 if no cleanup is pending.
+func CleanupCertificates(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, cfg Config) (time.Duration, error) {
+	certs, err := serviceCertificates(ctx, c, &svc)
+	if err != nil {
+		return 0, err
+	}
+
+	var requeue time.Duration
+	for i := range certs {
+		cert := &certs[i]
+		remaining, err := markForCleanup(ctx, c, cert, cfg.CleanupGracePeriod)
+		if err != nil {
+			return 0, err
+		}
+		if remaining > 0 {
+			requeue = minRequeue(requeue, remaining)
+			continue
+		}
+		l.Info("Deleting certificate of unlabeled service", "certificate", cert.Name)
+		if err := deleteStaleSecrets(ctx, c, cert); err != nil {
+			return 0, err
+		}
+		if err := deleteCertificateAndSecret(ctx, c, cert); err != nil {
+			return 0, err
+		}
+	}
+	return requeue, nil
+}
+
+// CleanupStaleSecrets removes secrets which the Certificates of the Service
+// wrote to before the certificate secret name was changed. The secrets are
+// deleted once the cleanup grace period has passed, so that workloads can
+// switch to the new secret. Returns the time after which the Service must be
+// reconciled again to finish the cleanup, or 0 if no cleanup is pending.
+func CleanupStaleSecrets(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, cfg Config) (time.Duration, error) {
+	certs, err := serviceCertificates(ctx, c, &svc)
+	if err != nil {
+		return 0, err
+	}
+
+	var requeue time.Duration
+	for i := range certs {
+		cert := &certs[i]
+		secrets, err := certificateSecrets(ctx, c, cert)
+		if err != nil {
+			return 0, err
+		}
+		for j := range secrets {
+			secret := &secrets[j]
+			if isCurrentSecret(cert, secret) {
+				// The secret may have been marked for cleanup before
+				// the secret name was changed back
+				if err := unmarkForCleanup(ctx, c, secret); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			remaining, err := markForCleanup(ctx, c, secret, cfg.CleanupGracePeriod)
+			if err != nil {
+				return 0, err
+			}
+			if remaining > 0 {
+				requeue = minRequeue(requeue, remaining)
+				continue
+			}
+			l.Info("Deleting previous certificate secret", "secret", secret.Name)
+			if err := c.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+				return 0, err
+			}
+		}
+	}
+	return requeue, nil
+}
+
+// certificateSecrets returns the secrets which cert-manager wrote for the
+// Certificate, and the secrets with the mapped keys of the Certificate
+func certificateSecrets(ctx context.Context, c client.Client, cert *cmapi.Certificate) ([]corev1.Secret, error) {
+	secrets := []corev1.Secret{}
+	for _, key := range []string{ServiceCertSecretLabelKey, MappedSecretLabelKey} {
+		list := corev1.SecretList{}
+		if err := c.List(ctx, &list, client.InNamespace(cert.Namespace),
+			client.MatchingLabels{key: cert.Name}); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, list.Items...)
+	}
+	return secrets, nil
+}
+
+// isCurrentSecret returns true if the secret is the Certificate's secret,
+// or the secret with the mapped keys of the Certificate's secret
+func isCurrentSecret(cert *cmapi.Certificate, secret *corev1.Secret) bool {
+	if secret.Name == cert.Spec.SecretName {
+		return true
+	}
+	return secret.Labels[MappedSecretLabelKey] == cert.Name &&
+		strings.HasSuffix(cert.Spec.SecretName, IssuedSecretSuffix) &&
+		secret.Name == strings.TrimSuffix(cert.Spec.SecretName, IssuedSecretSuffix)
+}
+
+// serviceCertificates returns the Certificate and the per-pod Certificates
+// which are controlled by the Service
+func serviceCertificates(ctx context.Context, c client.Client, svc *corev1.Service) ([]cmapi.Certificate, error) {
+	certs := []cmapi.Certificate{}
+	cert := cmapi.Certificate{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: svc.Namespace, Name: CertificateName(svc.Name)}, &cert)
+	if err == nil && metav1.IsControlledBy(&cert, svc) {
+		certs = append(certs, cert)
+	} else if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	podCerts := cmapi.CertificateList{}
+	if err := c.List(ctx, &podCerts, client.InNamespace(svc.Namespace),
+		client.MatchingLabels{PodCertServiceLabelKey: svc.Name}); err != nil {
+		return nil, err
+	}
+	for _, cert := range podCerts.Items {
+		if metav1.IsControlledBy(&cert, svc) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// deleteStaleSecrets deletes the secrets which the Certificate wrote to
+// before its secret name was changed
+func deleteStaleSecrets(ctx context.Context, c client.Client, cert *cmapi.Certificate) error {
+	secrets := corev1.SecretList{}
+	if err := c.List(ctx, &secrets, client.InNamespace(cert.Namespace),
+		client.MatchingLabels{ServiceCertSecretLabelKey: cert.Name}); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if secret.Name == cert.Spec.SecretName {
+			continue
+		}
+		if err := c.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// markForCleanup sets annotation `service.syn.tools/cleanup-after` on the
+// object, if it isn't set yet. Returns the time remaining until the object
+// may be deleted.
+func markForCleanup(ctx context.Context, c client.Client, obj client.Object, grace time.Duration) (time.Duration, error) {
+	annotations := obj.GetAnnotations()
+	if v, ok := annotations[CleanupAfterAnnotation]; ok {
+		after, err := time.Parse(time.RFC3339, v)
+		if err == nil {
+			return after.Sub(now()), nil
+		}
+		// Reset invalid timestamps
+	}
+	if grace <= 0 {
+		return 0, nil
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	// Round up to full seconds, as RFC3339 timestamps don't have
+	// sub-second precision
+	after := now().Add(grace + time.Second - 1).Truncate(time.Second)
+	annotations[CleanupAfterAnnotation] = after.UTC().Format(time.RFC3339)
+	obj.SetAnnotations(annotations)
+	if err := c.Update(ctx, obj); err != nil {
+		return 0, err
+	}
+	return after.Sub(now()), nil
+}
+
+// unmarkForCleanup removes annotation `service.syn.tools/cleanup-after` from
+// the object, if it's set
+func unmarkForCleanup(ctx context.Context, c client.Client, obj client.Object) error {
+	annotations := obj.GetAnnotations()
+	if _, ok := annotations[CleanupAfterAnnotation]; !ok {
+		return nil
+	}
+	delete(annotations, CleanupAfterAnnotation)
+	obj.SetAnnotations(annotations)
+	return c.Update(ctx, obj)
+}
+
+func minRequeue(a, b time.Duration) time.Duration {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,222 @@
+package certs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func setNow(t *testing.T, ts time.Time) {
+	orig := now
+	now = func() time.Time { return ts }
+	t.Cleanup(func() { now = orig })
+}
+
+func prepareCertSecret(name, certName string, annotations map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "test-ns",
+			Annotations: annotations,
+			Labels: map[string]string{
+				ServiceCertSecretLabelKey: certName,
+			},
+		},
+	}
+}
+
+func TestCerts_CleanupCertificates(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	setNow(t, start)
+
+	svc := prepareService("test-svc", "test-ns")
+	svc.UID = types.UID("0c7b9a34-2f8e-4d5c-9a11-7e1fb0e0c001")
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CertificateName("test-svc"),
+			Namespace: "test-ns",
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: "test-svc-tls",
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, cert, scheme))
+	podCert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodCertificateName("test-svc", "db-0"),
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				PodCertServiceLabelKey: "test-svc",
+			},
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: PodSecretName("test-svc-tls", "db-0"),
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, podCert, scheme))
+	// A per-pod certificate with the service's label which isn't
+	// controlled by the service
+	foreignSvc := prepareService("test-svc", "test-ns")
+	foreignSvc.UID = types.UID("0c7b9a34-2f8e-4d5c-9a11-7e1fb0e0c002")
+	foreign := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodCertificateName("test-svc", "other"),
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				PodCertServiceLabelKey: "test-svc",
+			},
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&foreignSvc, foreign, scheme))
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			cert,
+			podCert,
+			foreign,
+			prepareCertSecret("test-svc-tls", cert.Name, nil),
+			prepareCertSecret("old-svc-tls", cert.Name, nil),
+			prepareCertSecret(PodSecretName("test-svc-tls", "db-0"), podCert.Name, nil),
+		},
+	})
+	cfg := DefaultConfig()
+
+	requeue, err := CleanupCertificates(ctx, l, c, svc, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, requeue)
+	updated := cmapi.Certificate{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(cert), &updated))
+	assert.Equal(t, "2022-05-01T13:00:00Z", updated.Annotations[CleanupAfterAnnotation])
+
+	// The cleanup timestamp isn't moved by later reconciles
+	setNow(t, start.Add(30*time.Minute))
+	requeue, err = CleanupCertificates(ctx, l, c, svc, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, requeue)
+
+	setNow(t, start.Add(time.Hour))
+	requeue, err = CleanupCertificates(ctx, l, c, svc, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), requeue)
+
+	for _, key := range []client.ObjectKey{
+		client.ObjectKeyFromObject(cert),
+		client.ObjectKeyFromObject(podCert),
+	} {
+		err := c.Get(ctx, key, &cmapi.Certificate{})
+		assert.True(t, apierrors.IsNotFound(err), key.Name)
+	}
+	for _, name := range []string{"test-svc-tls", "old-svc-tls", PodSecretName("test-svc-tls", "db-0")} {
+		err := c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: name}, &corev1.Secret{})
+		assert.True(t, apierrors.IsNotFound(err), name)
+	}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(foreign), &updated))
+	assert.NotContains(t, updated.Annotations, CleanupAfterAnnotation)
+}
+
+func TestCerts_CleanupStaleSecrets(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	setNow(t, start)
+
+	svc := prepareService("test-svc", "test-ns")
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CertificateName("test-svc"),
+			Namespace: "test-ns",
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: "new-tls",
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, cert, scheme))
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			cert,
+			prepareCertSecret("new-tls", cert.Name, map[string]string{
+				CleanupAfterAnnotation: "2022-05-01T11:00:00Z",
+			}),
+			prepareCertSecret("old-tls", cert.Name, nil),
+			prepareCertSecret("older-tls", cert.Name, map[string]string{
+				CleanupAfterAnnotation: "2022-05-01T11:59:00Z",
+			}),
+			prepareCertSecret("unrelated-tls", "other-tls", nil),
+		},
+	})
+	cfg := DefaultConfig()
+	cfg.CleanupGracePeriod = 10 * time.Minute
+
+	requeue, err := CleanupStaleSecrets(ctx, l, c, svc, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, requeue)
+
+	secret := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "new-tls"}, &secret))
+	assert.NotContains(t, secret.Annotations, CleanupAfterAnnotation)
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "old-tls"}, &secret))
+	assert.Equal(t, "2022-05-01T12:10:00Z", secret.Annotations[CleanupAfterAnnotation])
+	err = c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "older-tls"}, &secret)
+	assert.True(t, apierrors.IsNotFound(err))
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "unrelated-tls"}, &secret))
+	assert.NotContains(t, secret.Annotations, CleanupAfterAnnotation)
+}
+
+func TestCerts_CleanupStaleSecrets_MappedSecrets(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	setNow(t, time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	svc := prepareService("test-svc", "test-ns")
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CertificateName("test-svc"),
+			Namespace: "test-ns",
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: "new-tls" + IssuedSecretSuffix,
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, cert, scheme))
+	mapped := func(name string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "test-ns",
+				Labels:    map[string]string{MappedSecretLabelKey: cert.Name},
+			},
+		}
+	}
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			cert,
+			prepareCertSecret("new-tls"+IssuedSecretSuffix, cert.Name, nil),
+			mapped("new-tls"),
+			mapped("old-tls"),
+		},
+	})
+	cfg := DefaultConfig()
+	cfg.CleanupGracePeriod = 0
+
+	_, err := CleanupStaleSecrets(ctx, l, c, svc, cfg)
+	require.NoError(t, err)
+
+	for _, name := range []string{"new-tls" + IssuedSecretSuffix, "new-tls"} {
+		assert.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: name}, &corev1.Secret{}), name)
+	}
+	err = c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "old-tls"}, &corev1.Secret{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
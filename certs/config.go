@@ -0,0 +1,138 @@
+package certs
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Config holds the cluster-wide settings and limits which are applied to
+// all Service certificates
+type Config struct {
+	// DefaultDuration is the certificate lifetime for Services which
+	// don't set annotation `service.syn.tools/cert-duration`
+	DefaultDuration time.Duration
+	// DefaultRenewBefore is the renew-before value for Services which
+	// don't set annotation `service.syn.tools/cert-renew-before`
+	DefaultRenewBefore time.Duration
+	// MinDuration is the shortest certificate lifetime a Service may
+	// request
+	MinDuration time.Duration
+	// MaxDuration is the longest certificate lifetime a Service may
+	// request
+	MaxDuration time.Duration
+	// MinRenewBefore is the shortest renew-before value a Service may
+	// request
+	MinRenewBefore time.Duration
+	// MaxRenewBefore is the longest renew-before value a Service may
+	// request
+	MaxRenewBefore time.Duration
+	// AllowedPrivateKeys lists the private key types which Services may
+	// request
+	AllowedPrivateKeys []PrivateKeySpec
+	// DefaultRotationPolicy is the private key rotation policy for
+	// Services which don't set annotation
+	// `service.syn.tools/private-key-rotation-policy`. If empty,
+	// cert-manager's default applies.
+	DefaultRotationPolicy cmapi.PrivateKeyRotationPolicy
+	// AllowedUsages lists the key usages which Services may request
+	AllowedUsages []cmapi.KeyUsage
+	// ClusterDomain is the DNS domain of the cluster
+	ClusterDomain string
+	// DNSNameTemplates are rendered for each Service to generate
+	// additional DNS names for the Service's certificate
+	DNSNameTemplates []*template.Template
+	// CleanupGracePeriod is how long Certificates and secrets which a
+	// Service no longer uses are kept before they're deleted
+	CleanupGracePeriod time.Duration
+	// PermittedDNSDomains are the DNS domains which the name constraints
+	// of the issuing CA permit. If set, the short DNS names of Services
+	// and pods outside these domains are omitted from the certificates,
+	// and other DNS names and URIs outside these domains are invalid.
+	PermittedDNSDomains []string
+	// PermittedIPRanges are the IP ranges which the name constraints of
+	// the issuing CA permit. If PermittedDNSDomains is set, IP addresses
+	// outside these ranges are invalid.
+	PermittedIPRanges []string
+}
+
+// DefaultConfig returns the Config which is used if the controller isn't
+// configured otherwise
+func DefaultConfig() Config {
+	allowedKeys, _ := ParsePrivateKeySpecs(DefaultAllowedPrivateKeys)
+	allowedUsages, _ := ParseUsages(DefaultAllowedUsages)
+	return Config{
+		DefaultDuration:    2160 * time.Hour,
+		DefaultRenewBefore: 360 * time.Hour,
+		MinDuration:        time.Hour,
+		MaxDuration:        8760 * time.Hour,
+		MinRenewBefore:     5 * time.Minute,
+		MaxRenewBefore:     2160 * time.Hour,
+		AllowedPrivateKeys: allowedKeys,
+		AllowedUsages:      allowedUsages,
+		ClusterDomain:      DefaultClusterDomain,
+		CleanupGracePeriod: time.Hour,
+	}
+}
+
+// Validate checks that the Config is self-consistent
+func (cfg *Config) Validate() error {
+	if cfg.MinDuration > cfg.MaxDuration {
+		return fmt.Errorf("minimum certificate duration %s is longer than maximum duration %s",
+			cfg.MinDuration, cfg.MaxDuration)
+	}
+	if cfg.DefaultDuration < cfg.MinDuration || cfg.DefaultDuration > cfg.MaxDuration {
+		return fmt.Errorf("default certificate duration %s is outside of limits [%s, %s]",
+			cfg.DefaultDuration, cfg.MinDuration, cfg.MaxDuration)
+	}
+	if cfg.MinRenewBefore > cfg.MaxRenewBefore {
+		return fmt.Errorf("minimum certificate renew-before %s is longer than maximum renew-before %s",
+			cfg.MinRenewBefore, cfg.MaxRenewBefore)
+	}
+	if cfg.DefaultRenewBefore < cfg.MinRenewBefore || cfg.DefaultRenewBefore > cfg.MaxRenewBefore {
+		return fmt.Errorf("default certificate renew-before %s is outside of limits [%s, %s]",
+			cfg.DefaultRenewBefore, cfg.MinRenewBefore, cfg.MaxRenewBefore)
+	}
+	if cfg.DefaultRenewBefore >= cfg.DefaultDuration {
+		return fmt.Errorf("default certificate renew-before %s must be shorter than the default duration %s",
+			cfg.DefaultRenewBefore, cfg.DefaultDuration)
+	}
+	if errs := validation.IsDNS1123Subdomain(cfg.ClusterDomain); len(errs) > 0 {
+		return fmt.Errorf("invalid cluster domain %q: %v", cfg.ClusterDomain, errs)
+	}
+	if cfg.CleanupGracePeriod < 0 {
+		return fmt.Errorf("cleanup grace period %s must not be negative", cfg.CleanupGracePeriod)
+	}
+	switch cfg.DefaultRotationPolicy {
+	case "", cmapi.RotationPolicyNever, cmapi.RotationPolicyAlways:
+	default:
+		return fmt.Errorf("unknown default private key rotation policy %q", cfg.DefaultRotationPolicy)
+	}
+	return nil
+}
+
+// InvalidConfigError indicates that the certificate configuration requested
+// by a Service is invalid. Reconciling the Service again won't resolve the
+// error, the Service needs to be changed.
+type InvalidConfigError struct {
+	msg string
+}
+
+func (e *InvalidConfigError) Error() string {
+	return e.msg
+}
+
+func invalidConfigErrorf(format string, a ...interface{}) error {
+	return &InvalidConfigError{msg: fmt.Sprintf(format, a...)}
+}
+
+// IsInvalidConfigError returns true if `err` is or wraps an
+// InvalidConfigError
+func IsInvalidConfigError(err error) bool {
+	var e *InvalidConfigError
+	return errors.As(err, &e)
+}
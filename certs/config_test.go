@@ -0,0 +1,91 @@
+package certs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCerts_ConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		mutate func(*Config)
+		valid  bool
+	}{
+		"DefaultConfig": {
+			mutate: func(*Config) {},
+			valid:  true,
+		},
+		"MinLongerThanMax": {
+			mutate: func(cfg *Config) {
+				cfg.MinDuration = 10000 * time.Hour
+			},
+			valid: false,
+		},
+		"DefaultDurationTooLong": {
+			mutate: func(cfg *Config) {
+				cfg.DefaultDuration = 10000 * time.Hour
+			},
+			valid: false,
+		},
+		"DefaultRenewBeforeTooLong": {
+			mutate: func(cfg *Config) {
+				cfg.DefaultRenewBefore = cfg.DefaultDuration
+			},
+			valid: false,
+		},
+		"DefaultRenewBeforeTooShort": {
+			mutate: func(cfg *Config) {
+				cfg.DefaultRenewBefore = time.Minute
+			},
+			valid: false,
+		},
+		"MinRenewBeforeLongerThanMax": {
+			mutate: func(cfg *Config) {
+				cfg.MinRenewBefore = 3000 * time.Hour
+			},
+			valid: false,
+		},
+		"DefaultRenewBeforeAboveMax": {
+			mutate: func(cfg *Config) {
+				cfg.MaxRenewBefore = 48 * time.Hour
+			},
+			valid: false,
+		},
+		"InvalidClusterDomain": {
+			mutate: func(cfg *Config) {
+				cfg.ClusterDomain = "cluster_local"
+			},
+			valid: false,
+		},
+		"RotationPolicyAlways": {
+			mutate: func(cfg *Config) {
+				cfg.DefaultRotationPolicy = cmapi.RotationPolicyAlways
+			},
+			valid: true,
+		},
+		"RotationPolicyInvalid": {
+			mutate: func(cfg *Config) {
+				cfg.DefaultRotationPolicy = "Sometimes"
+			},
+			valid: false,
+		},
+	}
+
+	for testn, tc := range tests {
+		cfg := DefaultConfig()
+		tc.mutate(&cfg)
+		err := cfg.Validate()
+		assert.Equal(t, tc.valid, err == nil, testn)
+	}
+}
+
+func TestCerts_IsInvalidConfigError(t *testing.T) {
+	err := invalidConfigErrorf("invalid value %q", "foo")
+	assert.True(t, IsInvalidConfigError(err))
+	assert.Equal(t, `invalid value "foo"`, err.Error())
+	assert.True(t, IsInvalidConfigError(fmt.Errorf("wrapped: %w", err)))
+	assert.False(t, IsInvalidConfigError(fmt.Errorf("other error")))
+}
@@ -0,0 +1,592 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AddClusterNameConstraints adds the cluster's DNS domains `domains` and
+// Service IP ranges `ipRanges` to the permitted names of the CA profile's
+// name constraints. Does nothing if name constraints aren't enabled.
+func (p *CAProfile) AddClusterNameConstraints(domains, ipRanges []string) {
+	if !p.NameConstraints {
+		return
+	}
+	p.PermittedDNSDomains = appendUnique(append([]string{}, domains...), p.PermittedDNSDomains...)
+	p.PermittedIPRanges = appendUnique(append([]string{}, ipRanges...), p.PermittedIPRanges...)
+}
+
+// validateNameConstraints checks the permitted names of the CA profile's
+// name constraints
+func (p *CAProfile) validateNameConstraints() error {
+	if p.Import || p.hasParentIssuer() {
+		return fmt.Errorf("CA name constraints require a self-signed CA")
+	}
+	if len(p.PermittedDNSDomains) == 0 {
+		return fmt.Errorf("CA name constraints require at least one permitted DNS domain")
+	}
+	for _, d := range p.PermittedDNSDomains {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(d, ".")); len(errs) > 0 {
+			return fmt.Errorf("invalid permitted DNS domain %q: %v", d, errs)
+		}
+	}
+	_, err := p.permittedIPRanges()
+	return err
+}
+
+// permittedIPRanges parses the permitted IP ranges of the CA profile
+func (p *CAProfile) permittedIPRanges() ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(p.PermittedIPRanges))
+	for _, r := range p.PermittedIPRanges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permitted IP range %q: %w", r, err)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// dropUnpermittedDNSNames returns the DNS names in `names` which the name
+// constraints of the issuing CA permit. Clients reject certificates with
+// names which aren't permitted.
+func (cfg *Config) dropUnpermittedDNSNames(names []string) []string {
+	if len(cfg.PermittedDNSDomains) == 0 {
+		return names
+	}
+	permitted := []string{}
+	for _, name := range names {
+		if dnsNamePermitted(name, cfg.PermittedDNSDomains) {
+			permitted = append(permitted, name)
+		}
+	}
+	return permitted
+}
+
+// dropUnpermittedIPAddresses returns the IP addresses in `ips` which the
+// name constraints of the issuing CA permit, see dropUnpermittedDNSNames()
+func (cfg *Config) dropUnpermittedIPAddresses(ips []string) []string {
+	if len(cfg.PermittedDNSDomains) == 0 {
+		return ips
+	}
+	permitted := []string{}
+	for _, a := range ips {
+		if ip := net.ParseIP(a); ip != nil && ipPermitted(ip, cfg.PermittedIPRanges) {
+			permitted = append(permitted, a)
+		}
+	}
+	return permitted
+}
+
+// checkPermittedSANs returns an invalid config error if one of the DNS
+// names, IP addresses or URIs isn't permitted by the name constraints of
+// the issuing CA. The name constraints always permit at least one DNS
+// domain, so the CA has no name constraints if PermittedDNSDomains is
+// empty.
+func (cfg *Config) checkPermittedSANs(dnsNames, ipAddresses, uris []string) error {
+	if len(cfg.PermittedDNSDomains) == 0 {
+		return nil
+	}
+	for _, name := range dnsNames {
+		if !dnsNamePermitted(name, cfg.PermittedDNSDomains) {
+			return invalidConfigErrorf("DNS name %q isn't permitted by the name constraints of the CA", name)
+		}
+	}
+	for _, a := range ipAddresses {
+		ip := net.ParseIP(a)
+		if ip == nil || !ipPermitted(ip, cfg.PermittedIPRanges) {
+			return invalidConfigErrorf("IP address %q isn't permitted by the name constraints of the CA", a)
+		}
+	}
+	for _, u := range uris {
+		if !uriPermitted(u, cfg.PermittedDNSDomains) {
+			return invalidConfigErrorf("URI %q isn't permitted by the name constraints of the CA", u)
+		}
+	}
+	return nil
+}
+
+// dnsNamePermitted returns true if `name` is in one of the DNS domains. A
+// domain with a leading dot only permits its subdomains, like in X.509 name
+// constraints.
+func dnsNamePermitted(name string, domains []string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	for _, d := range domains {
+		if strings.HasPrefix(d, ".") {
+			if strings.HasSuffix(name, d) {
+				return true
+			}
+			continue
+		}
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// uriPermitted returns true if the host of URI `u` is permitted by the URI
+// name constraints of the DNS domains, see uriDomains(). Like clients, URIs
+// without a host or with an IP address as host aren't permitted.
+func uriPermitted(u string, domains []string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" || net.ParseIP(host) != nil {
+		return false
+	}
+	for _, d := range uriDomains(domains) {
+		if strings.HasPrefix(d, ".") {
+			if strings.HasSuffix(host, d) {
+				return true
+			}
+			continue
+		}
+		if host == d {
+			return true
+		}
+	}
+	return false
+}
+
+// uriDomains returns the URI name constraints which permit the hosts in the
+// DNS domains. Unlike DNS name constraints, a URI constraint without a
+// leading dot only permits that exact host (RFC 5280, section 4.2.1.10), so
+// each domain without a leading dot is permitted together with its
+// subdomains.
+func uriDomains(domains []string) []string {
+	uris := []string{}
+	for _, d := range domains {
+		if strings.HasPrefix(d, ".") {
+			uris = appendUnique(uris, d)
+			continue
+		}
+		uris = appendUnique(uris, d, "."+d)
+	}
+	return uris
+}
+
+func ipPermitted(ip net.IP, ranges []string) bool {
+	for _, r := range ranges {
+		if _, ipNet, err := net.ParseCIDR(r); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureConstrainedCA issues the CA certificate with the name constraints
+// of the CA profile, and stores it in the CA secret. cert-manager can't
+// issue certificates with name constraints, so the controller issues the
+// self-signed CA certificate itself. The CA certificate is reissued with
+// the existing key if its name constraints or duration don't match the
+// profile or it's due for renewal. If the private key or the subject don't
+// match the profile, the certificates issued by the CA wouldn't chain to
+// the reissued CA certificate, so the change is rolled out through a staged
+// CA, see stageConstrainedCA().
+// Returns how long the CA certificate is valid until it's due for renewal,
+// or how long until the staged CA replaces the CA.
+func ensureConstrainedCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) (time.Duration, error) {
+	if err := removeCACertificate(ctx, c, l, caNamespace, profile); err != nil {
+		return 0, err
+	}
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.SecretName, Namespace: caNamespace}, &secret)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "while fetching constrained CA secret")
+		return 0, err
+	}
+	exists := err == nil
+
+	crt, key := parseCAKeyPair(&secret)
+	if crt != nil {
+		if reason := constrainedCAReplaced(profile, crt, key); reason != "" {
+			return stageConstrainedCA(ctx, c, l, caNamespace, profile, &secret, reason)
+		}
+		// The profile change was reverted, or the staged CA replaced
+		// the CA
+		if err := removeStagedConstrainedCA(ctx, c, l, caNamespace, profile); err != nil {
+			return 0, err
+		}
+		reason := constrainedCAOutdated(profile, crt, key)
+		if reason == "" {
+			return renewalDue(profile, crt), nil
+		}
+		l.Info("Constrained CA certificate is outdated, reissuing...", "reason", reason)
+	}
+	if err := writeConstrainedCA(&secret, profile, key); err != nil {
+		return 0, err
+	}
+	if !exists {
+		l.Info("Constrained CA secret doesn't exist, creating...")
+		secret.Name = profile.SecretName
+		secret.Namespace = caNamespace
+		secret.Type = corev1.SecretTypeTLS
+		err = c.Create(ctx, &secret)
+	} else {
+		err = c.Update(ctx, &secret)
+	}
+	if err != nil {
+		return 0, err
+	}
+	crt, _ = parseCAKeyPair(&secret)
+	return renewalDue(profile, crt), nil
+}
+
+// stageConstrainedCA rolls out a change of the private key or the subject
+// of a CA with name constraints like stageCACertificate() does for CAs which
+// cert-manager issues. The staged CA is issued with a new key into the
+// secret of the staged profile. Once the staged CA is added to the trust
+// bundle and the rotation grace period has passed, the staged key pair is
+// moved into the CA secret `current` and the staged secret is deleted.
+func stageConstrainedCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, current *corev1.Secret, reason string) (time.Duration, error) {
+	sp := profile.stagedProfile()
+	staged := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: sp.SecretName, Namespace: caNamespace}, &staged)
+	if err != nil && !errors.IsNotFound(err) {
+		return 0, err
+	}
+	if errors.IsNotFound(err) {
+		l.Info("Constrained CA doesn't match CA profile, staging new CA...", "reason", reason)
+		staged.Name = sp.SecretName
+		staged.Namespace = caNamespace
+		staged.Type = corev1.SecretTypeTLS
+		if err := writeConstrainedCA(&staged, profile, nil); err != nil {
+			return 0, err
+		}
+		return 0, c.Create(ctx, &staged)
+	}
+	stagedCrt, stagedKey := parseCAKeyPair(&staged)
+	if stagedCrt == nil || constrainedCAReplaced(profile, stagedCrt, stagedKey) != "" {
+		l.Info("Staged constrained CA doesn't match CA profile, restaging...")
+		if err := writeConstrainedCA(&staged, profile, stagedKey); err != nil {
+			return 0, err
+		}
+		delete(staged.Annotations, CAStagedAtAnnotation)
+		return 0, c.Update(ctx, &staged)
+	}
+	stagedAt, ok := staged.Annotations[CAStagedAtAnnotation]
+	if !ok {
+		// The trust bundle includes the staged CA from now on, see
+		// stagedCABundle()
+		l.Info("Adding staged constrained CA to the trust bundle")
+		if staged.Annotations == nil {
+			staged.Annotations = map[string]string{}
+		}
+		staged.Annotations[CAStagedAtAnnotation] = now().UTC().Format(time.RFC3339)
+		return profile.rotationGracePeriod(), c.Update(ctx, &staged)
+	}
+	if remaining := remainingGrace(stagedAt, profile.rotationGracePeriod()); remaining > 0 {
+		l.V(1).Info("Waiting for clients to pick up the staged constrained CA", "remaining", remaining)
+		return remaining, nil
+	}
+
+	l.Info("Replacing constrained CA with staged CA")
+	current.Data = staged.Data
+	if err := c.Update(ctx, current); err != nil {
+		return 0, err
+	}
+	if err := client.IgnoreNotFound(c.Delete(ctx, &staged)); err != nil {
+		return 0, err
+	}
+	return renewalDue(profile, stagedCrt), nil
+}
+
+// removeStagedConstrainedCA deletes the staged CA secret of a CA with name
+// constraints if it exists
+func removeStagedConstrainedCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	staged := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.stagedProfile().SecretName, Namespace: caNamespace}, &staged)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	l.Info("Removing staged constrained CA")
+	return client.IgnoreNotFound(c.Delete(ctx, &staged))
+}
+
+// writeConstrainedCA issues the CA certificate of the profile with `key`
+// and stores the key pair in `secret`. A new key is generated if `key` is
+// nil or doesn't match the profile.
+func writeConstrainedCA(secret *corev1.Secret, profile CAProfile, key crypto.Signer) error {
+	if key == nil || !keyMatchesProfile(key, profile) {
+		var err error
+		key, err = generateCAKey(profile)
+		if err != nil {
+			return err
+		}
+	}
+	crtPEM, keyPEM, err := issueConstrainedCA(profile, key)
+	if err != nil {
+		return err
+	}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       crtPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+		cmmeta.TLSCAKey:         crtPEM,
+	}
+	return nil
+}
+
+// readConstrainedCASecret returns the CA secret of a CA with name
+// constraints. Returns an error if the secret doesn't contain a valid CA
+// certificate and matching key.
+func readConstrainedCASecret(ctx context.Context, c client.Client, log logr.Logger, caNamespace string, profile CAProfile) (*corev1.Secret, error) {
+	secret := corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{
+		Name:      profile.SecretName,
+		Namespace: caNamespace,
+	}, &secret); err != nil {
+		log.Error(err, "Fetching constrained CA secret")
+		return nil, err
+	}
+	if err := validateCAKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return nil, fmt.Errorf("constrained CA secret %s/%s: %w", caNamespace, secret.Name, err)
+	}
+	return &secret, nil
+}
+
+// parseCAKeyPair returns the CA certificate and key in the secret. Returns
+// a nil certificate if the secret doesn't hold a valid CA key pair, and a
+// nil key if the secret doesn't hold a usable key.
+func parseCAKeyPair(secret *corev1.Secret) (*x509.Certificate, crypto.Signer) {
+	pair, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, nil
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil
+	}
+	if validateCAKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]) != nil {
+		return nil, key
+	}
+	crt, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, key
+	}
+	return crt, key
+}
+
+// constrainedCAReplaced returns the reason why the CA certificate needs to
+// be replaced by a CA with a new key, or an empty string if the private key
+// and the subject match the profile
+func constrainedCAReplaced(profile CAProfile, crt *x509.Certificate, key crypto.Signer) string {
+	switch {
+	case !keyMatchesProfile(key, profile):
+		return "private key doesn't match profile"
+	case !reflect.DeepEqual(crt.Subject.ToRDNSequence(), constrainedCASubject(profile).ToRDNSequence()):
+		return "subject doesn't match profile"
+	}
+	return ""
+}
+
+// constrainedCAOutdated returns the reason why the CA certificate needs to
+// be reissued, or an empty string if the certificate matches the profile
+// and isn't due for renewal
+func constrainedCAOutdated(profile CAProfile, crt *x509.Certificate, key crypto.Signer) string {
+	if reason := constrainedCAReplaced(profile, crt, key); reason != "" {
+		return reason
+	}
+	tmpl, err := constrainedCATemplate(profile)
+	if err != nil {
+		return err.Error()
+	}
+	switch {
+	case !crt.PermittedDNSDomainsCritical ||
+		!equalSorted(crt.PermittedDNSDomains, tmpl.PermittedDNSDomains) ||
+		!equalSorted(ipNetStrings(crt.PermittedIPRanges), ipNetStrings(tmpl.PermittedIPRanges)) ||
+		!equalSorted(ipNetStrings(crt.ExcludedIPRanges), ipNetStrings(tmpl.ExcludedIPRanges)) ||
+		!equalSorted(crt.PermittedURIDomains, tmpl.PermittedURIDomains):
+		return "name constraints don't match profile"
+	case crt.NotAfter.Sub(crt.NotBefore) != profile.duration():
+		return "duration doesn't match profile"
+	case renewalDue(profile, crt) <= 0:
+		return "certificate is due for renewal"
+	}
+	return ""
+}
+
+// renewalDue returns how long the CA certificate is valid until it's due
+// for renewal. Without a renew-before value, the certificate is renewed
+// after two thirds of its lifetime, like cert-manager does.
+func renewalDue(profile CAProfile, crt *x509.Certificate) time.Duration {
+	renewBefore := crt.NotAfter.Sub(crt.NotBefore) / 3
+	if profile.RenewBefore != nil {
+		renewBefore = profile.RenewBefore.Duration
+	}
+	return crt.NotAfter.Add(-renewBefore).Sub(now())
+}
+
+// constrainedCASubject returns the subject of the CA certificate of the
+// profile
+func constrainedCASubject(profile CAProfile) pkix.Name {
+	return pkix.Name{
+		CommonName:         profile.CommonName,
+		Organization:       profile.Organizations,
+		OrganizationalUnit: profile.OrganizationalUnits,
+		Country:            profile.Countries,
+	}
+}
+
+// constrainedCATemplate returns the template of the CA certificate with the
+// subject and name constraints of the profile. URIs are constrained to the
+// permitted DNS domains, see uriDomains().
+func constrainedCATemplate(profile CAProfile) (*x509.Certificate, error) {
+	ipRanges, err := profile.permittedIPRanges()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := now().UTC().Truncate(time.Second)
+	return &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     constrainedCASubject(profile),
+		NotBefore:                   notBefore,
+		NotAfter:                    notBefore.Add(profile.duration()),
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid:       true,
+		IsCA:                        true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         profile.PermittedDNSDomains,
+		PermittedIPRanges:           ipRanges,
+		ExcludedIPRanges:            excludedIPRanges(ipRanges),
+		PermittedURIDomains:         uriDomains(profile.PermittedDNSDomains),
+	}, nil
+}
+
+// excludedIPRanges returns the IP ranges which exclude the IP versions
+// without permitted ranges. Without permitted ranges of an IP version,
+// clients would accept any address of that version.
+func excludedIPRanges(permitted []*net.IPNet) []*net.IPNet {
+	v4, v6 := false, false
+	for _, r := range permitted {
+		if r.IP.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	excluded := []*net.IPNet{}
+	if !v4 {
+		excluded = append(excluded, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+	}
+	if !v6 {
+		excluded = append(excluded, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+	}
+	return excluded
+}
+
+// issueConstrainedCA issues the self-signed CA certificate of the profile
+// with `key`, and returns the PEM encoded certificate and key
+func issueConstrainedCA(profile CAProfile, key crypto.Signer) ([]byte, []byte, error) {
+	tmpl, err := constrainedCATemplate(profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issuing constrained CA certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// generateCAKey generates a private key of the profile's key type
+func generateCAKey(profile CAProfile) (crypto.Signer, error) {
+	spec, err := profile.privateKeySpec()
+	if err != nil {
+		return nil, err
+	}
+	switch spec.Algorithm {
+	case cmapi.RSAKeyAlgorithm:
+		return rsa.GenerateKey(rand.Reader, spec.Size)
+	case cmapi.ECDSAKeyAlgorithm:
+		return ecdsa.GenerateKey(ecdsaCurve(spec.Size), rand.Reader)
+	default:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+}
+
+// keyMatchesProfile returns true if `key` has the profile's key type
+func keyMatchesProfile(key crypto.Signer, profile CAProfile) bool {
+	spec, err := profile.privateKeySpec()
+	if err != nil {
+		return false
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return spec.Algorithm == cmapi.RSAKeyAlgorithm && k.N.BitLen() == spec.Size
+	case *ecdsa.PrivateKey:
+		return spec.Algorithm == cmapi.ECDSAKeyAlgorithm && k.Curve == ecdsaCurve(spec.Size)
+	case ed25519.PrivateKey:
+		return spec.Algorithm == cmapi.Ed25519KeyAlgorithm
+	}
+	return false
+}
+
+func ecdsaCurve(size int) elliptic.Curve {
+	switch size {
+	case 384:
+		return elliptic.P384()
+	case 521:
+		return elliptic.P521()
+	default:
+		return elliptic.P256()
+	}
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	s := make([]string, 0, len(nets))
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+// equalSorted returns true if `a` and `b` contain the same entries,
+// regardless of order
+func equalSorted(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,325 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func constrainedTestProfile() CAProfile {
+	profile := DefaultCAProfile()
+	profile.NameConstraints = true
+	profile.PermittedDNSDomains = []string{"example.internal"}
+	profile.AddClusterNameConstraints([]string{"cluster.local", "svc"}, []string{"10.96.0.0/12"})
+	return profile
+}
+
+func TestCerts_AddClusterNameConstraints(t *testing.T) {
+	profile := constrainedTestProfile()
+	assert.Equal(t, []string{"cluster.local", "svc", "example.internal"}, profile.PermittedDNSDomains)
+	assert.Equal(t, []string{"10.96.0.0/12"}, profile.PermittedIPRanges)
+
+	unconstrained := DefaultCAProfile()
+	unconstrained.AddClusterNameConstraints([]string{"cluster.local"}, nil)
+	assert.Empty(t, unconstrained.PermittedDNSDomains)
+}
+
+func TestCerts_ensureConstrainedCA(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	setNow(t, start)
+	profile := constrainedTestProfile()
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			// The CA Certificate of a CA without name constraints
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CACertName,
+					Namespace: testCANamespace,
+				},
+				Spec: newCACertificate(testCANamespace, DefaultCAProfile()).Spec,
+			},
+		},
+	})
+	readCA := func() (*x509.Certificate, []byte) {
+		secret, err := readCASecret(ctx, c, l, testCANamespace, profile)
+		require.NoError(t, err)
+		crt, key := parseCAKeyPair(secret)
+		require.NotNil(t, crt)
+		require.NotNil(t, key)
+		return crt, secret.Data[corev1.TLSCertKey]
+	}
+
+	renewIn, err := ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, 1440*time.Hour, renewIn)
+	err = c.Get(ctx, client.ObjectKey{Name: CACertName, Namespace: testCANamespace}, &cmapi.Certificate{})
+	assert.True(t, apierrors.IsNotFound(err), "CA Certificate is removed")
+
+	crt, crtPEM := readCA()
+	assert.Equal(t, "service-ca", crt.Subject.CommonName)
+	assert.True(t, crt.IsCA)
+	assert.True(t, crt.PermittedDNSDomainsCritical)
+	assert.Equal(t, profile.PermittedDNSDomains, crt.PermittedDNSDomains)
+	assert.Equal(t, []string{"10.96.0.0/12"}, ipNetStrings(crt.PermittedIPRanges))
+	assert.Equal(t, []string{"::/0"}, ipNetStrings(crt.ExcludedIPRanges))
+	assert.Equal(t, []string{"cluster.local", ".cluster.local", "svc", ".svc", "example.internal", ".example.internal"},
+		crt.PermittedURIDomains)
+	assert.Equal(t, start.Add(2160*time.Hour), crt.NotAfter)
+
+	// The CA only issues trusted certificates for permitted names
+	pool := x509.NewCertPool()
+	pool.AddCert(crt)
+	secret, err := readCASecret(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	_, key := parseCAKeyPair(secret)
+	for name, trusted := range map[string]bool{
+		"test-svc.test-ns.svc.cluster.local": true,
+		"test-svc.test-ns.svc":               true,
+		"db.example.internal":                true,
+		"test-svc.test-ns":                   false,
+		"www.example.com":                    false,
+	} {
+		leaf := issueTestLeaf(t, crt, key, name)
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: start.Add(time.Minute)})
+		assert.Equal(t, trusted, err == nil, name)
+	}
+
+	// Nothing changes while the CA matches the profile
+	setNow(t, start.Add(time.Hour))
+	renewIn, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, 1439*time.Hour, renewIn)
+	_, unchanged := readCA()
+	assert.Equal(t, crtPEM, unchanged)
+
+	// The CA is reissued with the same key when the constraints change
+	profile.PermittedDNSDomains = append(profile.PermittedDNSDomains, "example.org")
+	_, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	reissued, _ := readCA()
+	assert.Contains(t, reissued.PermittedDNSDomains, "example.org")
+	assert.Equal(t, crt.PublicKey, reissued.PublicKey)
+
+	// The CA is renewed with the same key when it's due for renewal
+	setNow(t, start.Add(1441*time.Hour))
+	renewIn, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, 1440*time.Hour, renewIn)
+	renewed, _ := readCA()
+	assert.Equal(t, start.Add(1441*time.Hour+2160*time.Hour), renewed.NotAfter)
+	assert.Equal(t, crt.PublicKey, renewed.PublicKey)
+
+	// A change of the key type is staged with a new key, the CA isn't
+	// changed
+	start = start.Add(1441 * time.Hour)
+	profile.KeyAlgorithm = cmapi.RSAKeyAlgorithm
+	profile.KeySize = 2048
+	stagedSecretName := CASecretName + StagedCASuffix
+	_, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	current, _ := readCA()
+	assert.Equal(t, crt.PublicKey, current.PublicKey)
+	staged := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: stagedSecretName, Namespace: testCANamespace}, &staged))
+	stagedCrt, _ := parseCAKeyPair(&staged)
+	require.NotNil(t, stagedCrt)
+	assert.Equal(t, x509.RSA, stagedCrt.PublicKeyAlgorithm)
+	bundle, err := withStagedCA(ctx, c, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Empty(t, bundle)
+
+	// The staged CA is added to the trust bundle
+	dueIn, err := ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRotationGracePeriod, dueIn)
+	bundle, err = withStagedCA(ctx, c, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, string(staged.Data[corev1.TLSCertKey]), bundle)
+	current, _ = readCA()
+	assert.Equal(t, crt.PublicKey, current.PublicKey)
+
+	// The staged CA replaces the CA after the grace period
+	setNow(t, start.Add(DefaultRotationGracePeriod))
+	_, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	rekeyed, rekeyedPEM := readCA()
+	assert.Equal(t, x509.RSA, rekeyed.PublicKeyAlgorithm)
+	assert.Equal(t, staged.Data[corev1.TLSCertKey], rekeyedPEM)
+	err = c.Get(ctx, client.ObjectKey{Name: stagedSecretName, Namespace: testCANamespace}, &corev1.Secret{})
+	assert.True(t, apierrors.IsNotFound(err), "staged CA secret is removed")
+
+	// A staged CA is removed when the profile change is reverted
+	profile.CommonName = "service-ca v2"
+	_, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: stagedSecretName, Namespace: testCANamespace}, &corev1.Secret{}))
+	profile.CommonName = "service-ca"
+	_, err = ensureConstrainedCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	err = c.Get(ctx, client.ObjectKey{Name: stagedSecretName, Namespace: testCANamespace}, &corev1.Secret{})
+	assert.True(t, apierrors.IsNotFound(err), "staged CA secret is removed")
+	_, unchanged = readCA()
+	assert.Equal(t, rekeyedPEM, unchanged)
+}
+
+func TestCerts_GetServiceCA_NameConstraints(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	profile := constrainedTestProfile()
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&extv1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "certificates.cert-manager.io",
+				},
+			},
+		},
+	})
+
+	ca, err := GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	crts, err := parseCertificates([]byte(ca))
+	require.NoError(t, err)
+	require.Len(t, crts, 1)
+	assert.True(t, crts[0].PermittedDNSDomainsCritical)
+
+	iss := cmapi.ClusterIssuer{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &iss))
+	assert.Equal(t, CASecretName, iss.Spec.CA.SecretName)
+	err = c.Get(ctx, client.ObjectKey{Name: SelfSignedIssuerName, Namespace: testCANamespace}, &cmapi.Issuer{})
+	assert.True(t, apierrors.IsNotFound(err), "no self-signed issuer")
+}
+
+func TestCerts_updateCertificate_NameConstraints(t *testing.T) {
+	profile := constrainedTestProfile()
+	cfg := DefaultConfig()
+	cfg.PermittedDNSDomains = profile.PermittedDNSDomains
+	cfg.PermittedIPRanges = profile.PermittedIPRanges
+
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Spec.ClusterIPs = []string{"10.96.0.10"}
+	err := updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"test-svc.test-ns.svc",
+		"test-svc.test-ns.svc.cluster.local",
+	}, cert.Spec.DNSNames)
+
+	svc.Annotations = map[string]string{
+		ExtraSANsAnnotation: "db.example.internal",
+	}
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	require.NoError(t, err)
+	assert.Contains(t, cert.Spec.DNSNames, "db.example.internal")
+
+	svc.Annotations[ExtraSANsAnnotation] = "www.example.com"
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	assert.True(t, IsInvalidConfigError(err))
+	assert.EqualError(t, err, `DNS name "www.example.com" isn't permitted by the name constraints of the CA`)
+
+	svc.Annotations[ExtraSANsAnnotation] = "spiffe://cluster.local/ns/test-ns/sa/test"
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"spiffe://cluster.local/ns/test-ns/sa/test"}, cert.Spec.URIs)
+
+	for _, san := range []string{"192.0.2.10", "2001:db8::1", "spiffe://example.com/sa/test", "urn:uuid:test"} {
+		svc.Annotations[ExtraSANsAnnotation] = san
+		err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+		assert.True(t, IsInvalidConfigError(err), san)
+	}
+
+	svc.Annotations = nil
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.96.0.10"}, cert.Spec.IPAddresses)
+
+	// Without permitted IP ranges, no IP addresses are permitted, and the
+	// ClusterIP is left out
+	cfg.PermittedIPRanges = nil
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	require.NoError(t, err)
+	assert.Empty(t, cert.Spec.IPAddresses)
+	svc.Annotations = map[string]string{ExtraSANsAnnotation: "10.96.0.10"}
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+	assert.True(t, IsInvalidConfigError(err))
+	assert.EqualError(t, err, `IP address "10.96.0.10" isn't permitted by the name constraints of the CA`)
+}
+
+func TestCerts_excludedIPRanges(t *testing.T) {
+	parse := func(ranges ...string) []*net.IPNet {
+		nets := []*net.IPNet{}
+		for _, r := range ranges {
+			_, n, err := net.ParseCIDR(r)
+			require.NoError(t, err)
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, ipNetStrings(excludedIPRanges(nil)))
+	assert.Equal(t, []string{"::/0"}, ipNetStrings(excludedIPRanges(parse("10.96.0.0/12"))))
+	assert.Equal(t, []string{"0.0.0.0/0"}, ipNetStrings(excludedIPRanges(parse("fd00::/108"))))
+	assert.Empty(t, excludedIPRanges(parse("10.96.0.0/12", "fd00::/108")))
+}
+
+func TestCerts_dnsNamePermitted(t *testing.T) {
+	domains := []string{"cluster.local", ".example.org"}
+	assert.True(t, dnsNamePermitted("cluster.local", domains))
+	assert.True(t, dnsNamePermitted("a.ns.svc.cluster.local", domains))
+	assert.True(t, dnsNamePermitted("*.a.ns.svc.cluster.local", domains))
+	assert.True(t, dnsNamePermitted("www.example.org", domains))
+	assert.False(t, dnsNamePermitted("example.org", domains))
+	assert.False(t, dnsNamePermitted("notcluster.local", domains))
+}
+
+func TestCerts_uriPermitted(t *testing.T) {
+	domains := []string{"cluster.local", ".example.org"}
+	assert.True(t, uriPermitted("spiffe://cluster.local/ns/test-ns/sa/test", domains))
+	assert.True(t, uriPermitted("https://a.ns.svc.cluster.local/path", domains))
+	assert.True(t, uriPermitted("https://www.example.org", domains))
+	assert.False(t, uriPermitted("https://example.org", domains))
+	assert.False(t, uriPermitted("https://notcluster.local", domains))
+	assert.False(t, uriPermitted("https://10.96.0.1", domains))
+	assert.False(t, uriPermitted("urn:uuid:test", domains))
+	assert.Equal(t, []string{"cluster.local", ".cluster.local", ".example.org"}, uriDomains(domains))
+}
+
+// issueTestLeaf issues a certificate for DNS name `name` from the CA
+func issueTestLeaf(t *testing.T, ca *x509.Certificate, caKey interface{}, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    ca.NotBefore,
+		NotAfter:     ca.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return crt
+}
@@ -20,39 +20,70 @@ import (
 )
 
 // CreateCertificate creates a Certificate resource for an appropriately
-// labeled service
-func CreateCertificate(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, secretName string, scheme *runtime.Scheme) error {
+// labeled service. The certificate is issued by `issuer`. Returns whether the
+// Certificate was created, updated or left unchanged.
+func CreateCertificate(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, secretName string, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) (controllerutil.OperationResult, error) {
 	certName := CertificateName(svc.Name)
 
+	if err := checkExtraSANs(ctx, c, &svc, cfg); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	if err := checkTemplateDNSNames(ctx, c, &svc, cfg); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	if err := checkExternalSANs(ctx, c, &svc, cfg); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	// With a secret key mapping, cert-manager writes a separate secret
+	secretName, err := issuedSecretName(&svc, secretName)
+	if err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	if err := checkSecretOwnership(ctx, c, &svc, certName, secretName); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+
 	cert := cmapi.Certificate{}
-	err := c.Get(ctx, client.ObjectKey{
+	err = c.Get(ctx, client.ObjectKey{
 		Name:      certName,
 		Namespace: svc.Namespace,
 	}, &cert)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			l.V(1).Info("Certificate resource doesn't exist, creating")
-			return newCertificate(ctx, c, certName, secretName, svc, scheme)
+			if err := newCertificate(ctx, c, certName, secretName, svc, scheme, cfg, issuer); err != nil {
+				return controllerutil.OperationResultNone, err
+			}
+			return controllerutil.OperationResultCreated, nil
 		}
 
 		l.V(1).Info("Error looking up certificate resource", "error", err)
 		// Unexpected error, bail
-		return err
+		return controllerutil.OperationResultNone, err
+	}
+	if err := checkCertificateOwnership(&svc, &cert); err != nil {
+		return controllerutil.OperationResultNone, err
 	}
 
 	origCert := cert.DeepCopy()
-	err = updateCertificate(&cert, svc, scheme)
+	// Move the certificate to the new secret if the secret name was
+	// changed. The previous secret is removed by CleanupStaleSecrets.
+	cert.Spec.SecretName = secretName
+	err = updateCertificate(&cert, svc, scheme, cfg, issuer)
 	if err != nil {
-		return err
+		return controllerutil.OperationResultNone, err
 	}
-	if !reflect.DeepEqual(origCert, cert) {
+	if !reflect.DeepEqual(*origCert, cert) {
 		l.V(1).Info("Applying changes to existing certificate")
-		return c.Update(ctx, &cert)
+		if err := c.Update(ctx, &cert); err != nil {
+			return controllerutil.OperationResultNone, err
+		}
+		return controllerutil.OperationResultUpdated, nil
 	}
-	return nil
+	return controllerutil.OperationResultNone, nil
 }
 
-func newCertificate(ctx context.Context, c client.Client, certName, secretName string, svc corev1.Service, scheme *runtime.Scheme) error {
+func newCertificate(ctx context.Context, c client.Client, certName, secretName string, svc corev1.Service, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) error {
 	cert := &cmapi.Certificate{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      certName,
@@ -61,69 +92,157 @@ func newCertificate(ctx context.Context, c client.Client, certName, secretName s
 		Spec: cmapi.CertificateSpec{
 			SecretName: secretName,
 			IsCA:       false,
-			IssuerRef: cmmeta.ObjectReference{
-				Name:  ServiceIssuerName,
-				Kind:  "ClusterIssuer",
-				Group: "cert-manager.io",
-			},
 		},
 	}
 
-	if err := updateCertificate(cert, svc, scheme); err != nil {
+	if err := updateCertificate(cert, svc, scheme, cfg, issuer); err != nil {
 		return err
 	}
 
 	return c.Create(ctx, cert)
 }
 
-func updateCertificate(cert *cmapi.Certificate, svc corev1.Service, scheme *runtime.Scheme) error {
+func updateCertificate(cert *cmapi.Certificate, svc corev1.Service, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) error {
 	svcName := fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)
-	svcDNSNames := []string{
+	svcDNSNames := cfg.dropUnpermittedDNSNames([]string{
 		svc.Name,
 		svcName,
 		fmt.Sprintf("%s.svc", svcName),
-		fmt.Sprintf("%s.svc.cluster.local", svcName),
+		fmt.Sprintf("%s.svc.%s", svcName, cfg.ClusterDomain),
+	})
+	templateNames, err := templateDNSNames(&svc, cfg)
+	if err != nil {
+		return err
+	}
+	wildcardNames, err := headlessWildcardDNSNames(&svc, cfg)
+	if err != nil {
+		return err
+	}
+	svcIPs, err := serviceIPAddresses(&svc)
+	if err != nil {
+		return err
 	}
+	svcIPs = cfg.dropUnpermittedIPAddresses(svcIPs)
 
-	certDuration, err := certDurationFromSvc(&svc)
+	certDuration, err := certDurationFromSvc(&svc, cfg)
 	if err != nil {
-		return fmt.Errorf("Error parsing certificate duration from service: %v", err)
+		return fmt.Errorf("Error parsing certificate duration from service: %w", err)
 	}
-	certRenewBefore, err := certRenewBeforeFromSvc(&svc)
+	certRenewBefore, err := certRenewBeforeFromSvc(&svc, cfg, certDuration.Duration)
 	if err != nil {
-		return fmt.Errorf("Error parsing certificate renew-before from service: %v", err)
+		return fmt.Errorf("Error parsing certificate renew-before from service: %w", err)
+	}
+
+	externalSANs, err := externalSANsFromSvc(&svc)
+	if err != nil {
+		return err
+	}
+	extraSANs, err := extraSANsFromSvc(&svc)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := privateKeyFromSvc(&svc, cfg)
+	if err != nil {
+		return err
+	}
+	usages, err := usagesFromSvc(&svc, cfg)
+	if err != nil {
+		return err
+	}
+	keystores, err := keystoresFromSvc(&svc)
+	if err != nil {
+		return err
+	}
+	outputFormats, err := additionalOutputFormatsFromSvc(&svc)
+	if err != nil {
+		return err
+	}
+	if _, err := secretKeyMappingFromSvc(&svc); err != nil {
+		return err
 	}
 
 	cert.Spec.Duration = certDuration
 	cert.Spec.RenewBefore = certRenewBefore
-	cert.Spec.DNSNames = svcDNSNames
-	cert.Spec.IPAddresses = svc.Spec.ClusterIPs
+	cert.Spec.PrivateKey = privateKey
+	cert.Spec.Usages = usages
+	cert.Spec.Keystores = keystores
+	cert.Spec.AdditionalOutputFormats = outputFormats
+	cert.Spec.IssuerRef = issuer
+	svcDNSNames = appendUnique(svcDNSNames, wildcardNames...)
+	svcDNSNames = appendUnique(svcDNSNames, templateNames...)
+	svcDNSNames = appendUnique(svcDNSNames, externalSANs.DNSNames...)
+	cert.Spec.DNSNames = appendUnique(svcDNSNames, extraSANs.DNSNames...)
+	svcIPs = appendUnique(svcIPs, externalSANs.IPAddresses...)
+	cert.Spec.IPAddresses = appendUnique(svcIPs, extraSANs.IPAddresses...)
+	cert.Spec.URIs = extraSANs.URIs
+	if err := cfg.checkPermittedSANs(cert.Spec.DNSNames, cert.Spec.IPAddresses, cert.Spec.URIs); err != nil {
+		return err
+	}
 	cert.Spec.SecretTemplate = &cmapi.CertificateSecretTemplate{
 		Labels: map[string]string{
 			ServiceCertSecretLabelKey: cert.Name,
+			ServiceNameLabelKey:       svc.Name,
 		},
 	}
 
+	// The service is labeled (again), don't clean up the certificate
+	delete(cert.Annotations, CleanupAfterAnnotation)
+
 	// Set ownerreference on certificate to service
 	controllerutil.SetControllerReference(&svc, cert, scheme)
 
 	return nil
 }
 
-func certDurationFromSvc(svc *corev1.Service) (*metav1.Duration, error) {
-	// TODO: annotation/label on svc
-	d, err := time.ParseDuration("2160h")
+// certDurationFromSvc returns the certificate duration requested in
+// annotation `service.syn.tools/cert-duration`, or the default duration if
+// the annotation isn't present.
+func certDurationFromSvc(svc *corev1.Service, cfg Config) (*metav1.Duration, error) {
+	v, ok := svc.Annotations[CertDurationAnnotation]
+	if !ok {
+		return &metav1.Duration{Duration: cfg.DefaultDuration}, nil
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		return nil, err
+		return nil, invalidConfigErrorf("annotation %s: %v", CertDurationAnnotation, err)
+	}
+	if d < cfg.MinDuration || d > cfg.MaxDuration {
+		return nil, invalidConfigErrorf("annotation %s: duration %s is outside of allowed range [%s, %s]",
+			CertDurationAnnotation, d, cfg.MinDuration, cfg.MaxDuration)
 	}
 	return &metav1.Duration{Duration: d}, nil
 }
 
-func certRenewBeforeFromSvc(svc *corev1.Service) (*metav1.Duration, error) {
-	// TODO: annotation/label on svc
-	d, err := time.ParseDuration("360h")
+// certRenewBeforeFromSvc returns the certificate renew-before value requested
+// in annotation `service.syn.tools/cert-renew-before`. If the annotation
+// isn't present, the default renew-before is used, unless it's not shorter
+// than the certificate duration. In that case, the certificate is renewed
+// after two thirds of its lifetime, but at most the maximum renew-before
+// before expiry.
+func certRenewBeforeFromSvc(svc *corev1.Service, cfg Config, duration time.Duration) (*metav1.Duration, error) {
+	v, ok := svc.Annotations[CertRenewBeforeAnnotation]
+	if !ok {
+		if cfg.DefaultRenewBefore >= duration {
+			d := duration / 3
+			if d > cfg.MaxRenewBefore {
+				d = cfg.MaxRenewBefore
+			}
+			return &metav1.Duration{Duration: d}, nil
+		}
+		return &metav1.Duration{Duration: cfg.DefaultRenewBefore}, nil
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		return nil, err
+		return nil, invalidConfigErrorf("annotation %s: %v", CertRenewBeforeAnnotation, err)
+	}
+	if d < cfg.MinRenewBefore || d > cfg.MaxRenewBefore {
+		return nil, invalidConfigErrorf("annotation %s: renew-before %s is outside of allowed range [%s, %s]",
+			CertRenewBeforeAnnotation, d, cfg.MinRenewBefore, cfg.MaxRenewBefore)
+	}
+	if d >= duration {
+		return nil, invalidConfigErrorf("annotation %s: renew-before %s must be shorter than the certificate duration %s",
+			CertRenewBeforeAnnotation, d, duration)
 	}
 	return &metav1.Duration{Duration: d}, nil
 }
@@ -7,62 +7,158 @@ import (
 	"time"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 	"github.com/go-logr/logr/testr"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
-var scheme = createScheme()
+var (
+	scheme        = createScheme()
+	testIssuerRef = cmmeta.ObjectReference{
+		Name:  ServiceIssuerName,
+		Kind:  "ClusterIssuer",
+		Group: "cert-manager.io",
+	}
+)
 
 func TestCerts_CreateCertificate(t *testing.T) {
 	ctx := context.Background()
 	l := testr.New(t)
 
+	svc := prepareService("test-svc", "test-ns")
+	svc.UID = types.UID("3f9d2c1e-8b7a-4c6d-9e5f-0a1b2c3d4e01")
+	otherSvc := prepareService("other-svc", "test-ns")
+	otherSvc.UID = types.UID("3f9d2c1e-8b7a-4c6d-9e5f-0a1b2c3d4e02")
+	adoptSvc := svc
+	adoptSvc.Annotations = map[string]string{
+		AdoptExistingAnnotation: "true",
+	}
+
+	ownedCert := func(owner *corev1.Service, secretName string) *cmapi.Certificate {
+		cert := prepareCertificate("test-svc", "test-ns", secretName)
+		assert.NoError(t, controllerutil.SetControllerReference(owner, cert, scheme))
+		return cert
+	}
+	foreignSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-tls",
+			Namespace: "test-ns",
+		},
+	}
+
 	tests := map[string]struct {
 		svc        corev1.Service
 		secretName string
 		err        error
+		res        controllerutil.OperationResult
 		objects    []client.Object
 	}{
 		"Create_NoError": {
-			svc:        prepareService("test-svc", "test-ns"),
+			svc:        svc,
 			secretName: "foo-tls",
 			err:        nil,
+			res:        controllerutil.OperationResultCreated,
 			objects:    []client.Object{},
 		},
-		"Update_NoError": {
-			svc:        prepareService("test-svc-2", "test-ns"),
+		"UpdateSecretName_NoError": {
+			svc:        svc,
 			secretName: "foo-tls",
 			err:        nil,
+			res:        controllerutil.OperationResultUpdated,
+			objects: []client.Object{
+				ownedCert(&svc, "old-tls"),
+			},
+		},
+		"UpdateSpec_NoError": {
+			svc:        svc,
+			secretName: "foo-tls",
+			err:        nil,
+			res:        controllerutil.OperationResultUpdated,
+			objects: []client.Object{
+				ownedCert(&svc, "foo-tls"),
+			},
+		},
+		"UnownedCertificate": {
+			svc:        svc,
+			secretName: "foo-tls",
+			err: invalidConfigErrorf("Certificate test-svc-tls already exists, set annotation %s to adopt it",
+				AdoptExistingAnnotation),
+			res: controllerutil.OperationResultNone,
 			objects: []client.Object{
 				prepareCertificate("test-svc", "test-ns", "foo-tls"),
 			},
 		},
-		"Noop_NoError": {
-			svc:        prepareService("test-svc", "test-ns"),
+		"UnownedCertificate_Adopt": {
+			svc:        adoptSvc,
 			secretName: "foo-tls",
 			err:        nil,
+			res:        controllerutil.OperationResultUpdated,
 			objects: []client.Object{
 				prepareCertificate("test-svc", "test-ns", "foo-tls"),
 			},
 		},
+		"ControlledCertificate_Adopt": {
+			svc:        adoptSvc,
+			secretName: "foo-tls",
+			err:        invalidConfigErrorf("Certificate test-svc-tls is managed by Service other-svc"),
+			res:        controllerutil.OperationResultNone,
+			objects: []client.Object{
+				ownedCert(&otherSvc, "foo-tls"),
+			},
+		},
+		"SecretUsedByCertificate": {
+			svc:        adoptSvc,
+			secretName: "foo-tls",
+			err:        invalidConfigErrorf("secret foo-tls is used by Certificate other-svc-tls"),
+			res:        controllerutil.OperationResultNone,
+			objects: []client.Object{
+				prepareCertificate("other-svc", "test-ns", "foo-tls"),
+			},
+		},
+		"ForeignSecret": {
+			svc:        svc,
+			secretName: "foo-tls",
+			err: invalidConfigErrorf("secret foo-tls already exists, set annotation %s to adopt it",
+				AdoptExistingAnnotation),
+			res: controllerutil.OperationResultNone,
+			objects: []client.Object{
+				foreignSecret,
+			},
+		},
+		"ForeignSecret_Adopt": {
+			svc:        adoptSvc,
+			secretName: "foo-tls",
+			err:        nil,
+			res:        controllerutil.OperationResultCreated,
+			objects: []client.Object{
+				foreignSecret,
+			},
+		},
 	}
 
-	for _, tc := range tests {
+	for testn, tc := range tests {
 		c := prepareTest(t, testCfg{
 			initObjs: tc.objects,
 		})
-		err := CreateCertificate(ctx, l, c, tc.svc, tc.secretName, scheme)
-		assert.Equal(t, tc.err, err)
+		res, err := CreateCertificate(ctx, l, c, tc.svc, tc.secretName, scheme, DefaultConfig(), testIssuerRef)
+		assert.Equal(t, tc.err, err, testn)
+		assert.Equal(t, tc.res, res, testn)
 		if err == nil {
 			verifyCertificate(t, ctx, c, fmt.Sprintf("%s-tls", tc.svc.Name), tc.secretName, &tc.svc)
+			// Reconciling again doesn't change the certificate
+			res, err = CreateCertificate(ctx, l, c, tc.svc, tc.secretName, scheme, DefaultConfig(), testIssuerRef)
+			assert.NoError(t, err, testn)
+			assert.Equal(t, controllerutil.OperationResultNone, res, testn)
 		}
 	}
 }
@@ -85,7 +181,7 @@ func TestCerts_newCertificate(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		err := newCertificate(ctx, c, tc.certName, tc.secretName, tc.svc, scheme)
+		err := newCertificate(ctx, c, tc.certName, tc.secretName, tc.svc, scheme, DefaultConfig(), testIssuerRef)
 		assert.Equal(t, tc.err, err)
 		if err == nil {
 			verifyCertificate(t, ctx, c, tc.certName, tc.secretName, &tc.svc)
@@ -97,7 +193,7 @@ func TestCerts_updateCertificate(t *testing.T) {
 	cert := cmapi.Certificate{}
 	cert.Name = "test-cert"
 	svc := prepareService("test-svc", "test-ns")
-	err := updateCertificate(&cert, svc, scheme)
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
 
 	assert.ErrorIs(t, err, nil)
 	assert.Equal(t, dnsNames(&svc), cert.Spec.DNSNames)
@@ -108,46 +204,195 @@ func TestCerts_updateCertificate(t *testing.T) {
 	assert.Equal(t, &metav1.Duration{Duration: time.Hour * 360}, cert.Spec.RenewBefore)
 	assert.Equal(t, map[string]string{
 		ServiceCertSecretLabelKey: "test-cert",
+		ServiceNameLabelKey:       "test-svc",
 	}, cert.Spec.SecretTemplate.Labels)
 }
 
+func TestCerts_updateCertificate_ExtraSANs(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Annotations = map[string]string{
+		ExtraSANsAnnotation: "localhost,test-svc,192.0.2.10,spiffe://cluster.local/ns/test-ns/sa/app",
+	}
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+
+	assert.NoError(t, err)
+	assert.Equal(t, append(dnsNames(&svc), "localhost"), cert.Spec.DNSNames)
+	assert.Equal(t, []string{
+		"198.51.100.10",
+		"192.0.2.10",
+	}, cert.Spec.IPAddresses)
+	assert.Equal(t, []string{"spiffe://cluster.local/ns/test-ns/sa/app"}, cert.Spec.URIs)
+}
+
+func TestCerts_updateCertificate_ClusterDomain(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	cfg := DefaultConfig()
+	cfg.ClusterDomain = "cluster.internal"
+	templates, err := ParseDNSNameTemplates([]string{"{{.Name}}.{{.Namespace}}.example.com"})
+	assert.NoError(t, err)
+	cfg.DNSNameTemplates = templates
+	err = updateCertificate(&cert, svc, scheme, cfg, testIssuerRef)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"test-svc",
+		"test-svc.test-ns",
+		"test-svc.test-ns.svc",
+		"test-svc.test-ns.svc.cluster.internal",
+		"test-svc.test-ns.example.com",
+	}, cert.Spec.DNSNames)
+}
+
+func TestCerts_updateCertificate_Headless(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	svc.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	svc.Annotations = map[string]string{
+		HeadlessWildcardAnnotation: "true",
+	}
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+
+	assert.NoError(t, err)
+	assert.Equal(t, append(dnsNames(&svc),
+		"*.test-svc.test-ns.svc",
+		"*.test-svc.test-ns.svc.cluster.local",
+	), cert.Spec.DNSNames)
+	assert.Nil(t, cert.Spec.IPAddresses)
+}
+
+func TestCerts_updateCertificate_ExternalName(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Spec.Type = corev1.ServiceTypeExternalName
+	svc.Spec.ExternalName = "db.example.com"
+	svc.Spec.ClusterIPs = nil
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+
+	assert.NoError(t, err)
+	assert.Equal(t, append(dnsNames(&svc), "db.example.com"), cert.Spec.DNSNames)
+	assert.Nil(t, cert.Spec.IPAddresses)
+}
+
+func TestCerts_updateCertificate_InvalidLifetime(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Annotations = map[string]string{
+		CertDurationAnnotation:    "24h",
+		CertRenewBeforeAnnotation: "48h",
+	}
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+
+	assert.Error(t, err)
+	assert.True(t, IsInvalidConfigError(err))
+	assert.Nil(t, cert.Spec.Duration)
+}
+
 func TestCerts_certDurationFromSvc(t *testing.T) {
 	tests := map[string]struct {
-		svc corev1.Service
-		d   metav1.Duration
-		err error
+		annotation string
+		d          *metav1.Duration
+		invalid    bool
 	}{
 		"ParseSuccess": {
-			svc: prepareService("test-svc", "test-ns"),
-			d:   prepareDuration(2160 * time.Hour),
-			err: nil,
+			d: prepareDuration(2160 * time.Hour),
+		},
+		"Annotation": {
+			annotation: "720h",
+			d:          prepareDuration(720 * time.Hour),
+		},
+		"AnnotationInvalid": {
+			annotation: "30 days",
+			invalid:    true,
+		},
+		"AnnotationTooShort": {
+			annotation: "30m",
+			invalid:    true,
+		},
+		"AnnotationTooLong": {
+			annotation: "87600h",
+			invalid:    true,
 		},
 	}
 
-	for _, tc := range tests {
-		d, err := certDurationFromSvc(&tc.svc)
-		assert.Equal(t, &tc.d, d)
-		assert.Equal(t, tc.err, err)
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != "" {
+			svc.Annotations = map[string]string{
+				CertDurationAnnotation: tc.annotation,
+			}
+		}
+		d, err := certDurationFromSvc(&svc, DefaultConfig())
+		assert.Equal(t, tc.d, d, testn)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
 	}
 }
 
 func TestCerts_certRenewBeforeFromSvc(t *testing.T) {
 	tests := map[string]struct {
-		svc corev1.Service
-		d   metav1.Duration
-		err error
+		annotation string
+		duration   time.Duration
+		d          *metav1.Duration
+		invalid    bool
 	}{
 		"ParseSuccess": {
-			svc: prepareService("test-svc", "test-ns"),
-			d:   prepareDuration(360 * time.Hour),
-			err: nil,
+			duration: 2160 * time.Hour,
+			d:        prepareDuration(360 * time.Hour),
+		},
+		"DefaultLongerThanDuration": {
+			duration: 24 * time.Hour,
+			d:        prepareDuration(8 * time.Hour),
+		},
+		"Annotation": {
+			annotation: "48h",
+			duration:   2160 * time.Hour,
+			d:          prepareDuration(48 * time.Hour),
+		},
+		"AnnotationInvalid": {
+			annotation: "two days",
+			duration:   2160 * time.Hour,
+			invalid:    true,
+		},
+		"AnnotationTooShort": {
+			annotation: "1m",
+			duration:   2160 * time.Hour,
+			invalid:    true,
+		},
+		"AnnotationTooLong": {
+			annotation: "3000h",
+			duration:   8760 * time.Hour,
+			invalid:    true,
+		},
+		"AnnotationNotShorterThanDuration": {
+			annotation: "24h",
+			duration:   24 * time.Hour,
+			invalid:    true,
 		},
 	}
 
-	for _, tc := range tests {
-		d, err := certRenewBeforeFromSvc(&tc.svc)
-		assert.Equal(t, &tc.d, d)
-		assert.Equal(t, tc.err, err)
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != "" {
+			svc.Annotations = map[string]string{
+				CertRenewBeforeAnnotation: tc.annotation,
+			}
+		}
+		d, err := certRenewBeforeFromSvc(&svc, DefaultConfig(), tc.duration)
+		assert.Equal(t, tc.d, d, testn)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
 	}
 }
 
@@ -163,6 +408,8 @@ func verifyCertificate(t *testing.T, ctx context.Context, c client.Client, certN
 	assert.Equal(t, svc.Spec.ClusterIPs, cert.Spec.IPAddresses)
 	assert.Equal(t, &metav1.Duration{Duration: 2160 * time.Hour}, cert.Spec.Duration)
 	assert.Equal(t, &metav1.Duration{Duration: 360 * time.Hour}, cert.Spec.RenewBefore)
+	assert.Equal(t, testIssuerRef, cert.Spec.IssuerRef)
+	assert.True(t, metav1.IsControlledBy(&cert, svc))
 }
 
 func dnsNames(svc *corev1.Service) []string {
@@ -201,8 +448,8 @@ func prepareCertificate(name, namespace, secretName string) *cmapi.Certificate {
 	}
 }
 
-func prepareDuration(d time.Duration) metav1.Duration {
-	return metav1.Duration{Duration: d}
+func prepareDuration(d time.Duration) *metav1.Duration {
+	return &metav1.Duration{Duration: d}
 }
 
 type testCfg struct {
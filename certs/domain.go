@@ -0,0 +1,118 @@
+package certs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultClusterDomain is the cluster domain which is used if the cluster
+// domain isn't configured and can't be detected
+const DefaultClusterDomain = "cluster.local"
+
+// DetectClusterDomain determines the cluster domain from the search domains
+// in the resolv.conf file at `path`. The cluster domain is taken from the
+// first search domain of the form `svc.<cluster domain>`.
+func DetectClusterDomain(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "search" {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			domain = strings.TrimSuffix(domain, ".")
+			if strings.HasPrefix(domain, "svc.") {
+				return strings.TrimPrefix(domain, "svc."), nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no search domain of the form `svc.<cluster domain>` in %s", path)
+}
+
+// dnsNameTemplateData is the data which is available in DNS name templates
+type dnsNameTemplateData struct {
+	// Name is the name of the Service
+	Name string
+	// Namespace is the namespace of the Service
+	Namespace string
+	// Labels are the labels of the Service
+	Labels map[string]string
+	// ClusterDomain is the cluster domain
+	ClusterDomain string
+}
+
+// ParseDNSNameTemplates parses the Go text/template DNS name templates
+func ParseDNSNameTemplates(templates []string) ([]*template.Template, error) {
+	parsed := make([]*template.Template, 0, len(templates))
+	for i, t := range templates {
+		tmpl, err := template.New(fmt.Sprintf("dns-name-%d", i)).
+			Option("missingkey=zero").
+			Parse(t)
+		if err != nil {
+			return nil, fmt.Errorf("parsing DNS name template %q: %w", t, err)
+		}
+		parsed = append(parsed, tmpl)
+	}
+	return parsed, nil
+}
+
+// templateDNSNames renders the DNS name templates for the Service.
+// Templates which render to an empty string are skipped. A template which
+// fails to execute is an error in the controller configuration and isn't
+// reported as an invalid configuration of the Service.
+func templateDNSNames(svc *corev1.Service, cfg Config) ([]string, error) {
+	data := dnsNameTemplateData{
+		Name:          svc.Name,
+		Namespace:     svc.Namespace,
+		Labels:        svc.Labels,
+		ClusterDomain: cfg.ClusterDomain,
+	}
+	names := []string{}
+	for _, tmpl := range cfg.DNSNameTemplates {
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering DNS name template %q: %w", tmpl.Root.String(), err)
+		}
+		name := strings.ToLower(strings.TrimSpace(buf.String()))
+		if name == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return nil, invalidConfigErrorf("DNS name template %q rendered invalid DNS name %q",
+				tmpl.Root.String(), name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// checkTemplateDNSNames verifies that the DNS names rendered from the DNS
+// name templates don't claim names of Services in other namespaces. The
+// templates have access to the Service's labels, which are controlled by
+// the Service's owner, so the rendered names are checked like the names in
+// annotation `service.syn.tools/extra-sans`.
+func checkTemplateDNSNames(ctx context.Context, c client.Client, svc *corev1.Service, cfg Config) error {
+	names, err := templateDNSNames(svc, cfg)
+	if err != nil {
+		return err
+	}
+	return checkSANsOwned(ctx, c, svc, cfg, "DNS name template", subjectAltNames{DNSNames: names})
+}
@@ -0,0 +1,162 @@
+package certs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_DetectClusterDomain(t *testing.T) {
+	tests := map[string]struct {
+		resolvConf string
+		domain     string
+		err        bool
+	}{
+		"ClusterLocal": {
+			resolvConf: "search test-ns.svc.cluster.local svc.cluster.local cluster.local\nnameserver 10.96.0.10\noptions ndots:5\n",
+			domain:     "cluster.local",
+		},
+		"CustomDomain": {
+			resolvConf: "nameserver 10.96.0.10\nsearch test-ns.svc.cluster.internal. svc.cluster.internal. cluster.internal. example.com\n",
+			domain:     "cluster.internal",
+		},
+		"NoClusterSearchDomain": {
+			resolvConf: "search example.com\nnameserver 192.0.2.53\n",
+			err:        true,
+		},
+	}
+
+	for testn, tc := range tests {
+		path := filepath.Join(t.TempDir(), "resolv.conf")
+		require.NoError(t, os.WriteFile(path, []byte(tc.resolvConf), 0o600))
+		domain, err := DetectClusterDomain(path)
+		assert.Equal(t, tc.err, err != nil, testn)
+		assert.Equal(t, tc.domain, domain, testn)
+	}
+}
+
+func TestCerts_DetectClusterDomain_Missing(t *testing.T) {
+	_, err := DetectClusterDomain(filepath.Join(t.TempDir(), "resolv.conf"))
+	assert.Error(t, err)
+}
+
+func TestCerts_templateDNSNames(t *testing.T) {
+	tests := map[string]struct {
+		templates []string
+		labels    map[string]string
+		names     []string
+		invalid   bool
+		err       bool
+	}{
+		"NoTemplates": {
+			names: []string{},
+		},
+		"Templates": {
+			templates: []string{
+				"{{.Name}}.{{.Namespace}}.internal.example.com",
+				"{{.Name}}.{{.Namespace}}.svc.{{.ClusterDomain}}",
+				`{{with index .Labels "app.example.com/zone"}}{{$.Name}}.{{.}}.example.com{{end}}`,
+			},
+			labels: map[string]string{
+				"app.example.com/zone": "zone-a",
+			},
+			names: []string{
+				"test-svc.test-ns.internal.example.com",
+				"test-svc.test-ns.svc.cluster.internal",
+				"test-svc.zone-a.example.com",
+			},
+		},
+		"EmptyOutputSkipped": {
+			templates: []string{
+				`{{index .Labels "missing"}}`,
+			},
+			names: []string{},
+		},
+		"InvalidName": {
+			templates: []string{
+				`{{.Name}} {{.Namespace}}`,
+			},
+			invalid: true,
+			err:     true,
+		},
+		"ExecutionError": {
+			templates: []string{
+				`{{index .Name 100}}.example.com`,
+			},
+			err: true,
+		},
+	}
+
+	for testn, tc := range tests {
+		templates, err := ParseDNSNameTemplates(tc.templates)
+		require.NoError(t, err, testn)
+		cfg := DefaultConfig()
+		cfg.ClusterDomain = "cluster.internal"
+		cfg.DNSNameTemplates = templates
+		svc := prepareService("test-svc", "test-ns")
+		svc.Labels = tc.labels
+		names, err := templateDNSNames(&svc, cfg)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		assert.Equal(t, tc.err, err != nil, testn)
+		if !tc.err {
+			assert.Equal(t, tc.names, names, testn)
+		}
+	}
+}
+
+func TestCerts_checkTemplateDNSNames(t *testing.T) {
+	ctx := context.Background()
+	otherSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "other-ns",
+		},
+	}
+	templates, err := ParseDNSNameTemplates([]string{
+		`{{with index .Labels "alias"}}{{.}}.svc{{end}}`,
+	})
+	require.NoError(t, err)
+	cfg := DefaultConfig()
+	cfg.DNSNameTemplates = templates
+
+	tests := map[string]struct {
+		alias   string
+		invalid bool
+	}{
+		"NoLabel": {},
+		"OwnNamespace": {
+			alias: "alias.test-ns",
+		},
+		"OtherNamespace": {
+			alias:   "db.other-ns",
+			invalid: true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.alias != "" {
+			svc.Labels = map[string]string{"alias": tc.alias}
+		}
+		c := prepareTest(t, testCfg{
+			initObjs: []client.Object{&svc, otherSvc},
+		})
+		err := checkTemplateDNSNames(ctx, c, &svc, cfg)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
+	}
+}
+
+func TestCerts_ParseDNSNameTemplates_Invalid(t *testing.T) {
+	_, err := ParseDNSNameTemplates([]string{"{{.Name"})
+	assert.Error(t, err)
+}
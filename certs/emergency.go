@@ -0,0 +1,347 @@
+package certs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// EmergencyRotationAnnotation is the annotation on the CA Certificate
+	// which triggers an emergency rotation of the CA. For CAs without a
+	// CA Certificate, that is imported CAs and CAs with name constraints,
+	// the annotation is set on the CA secret. Each new value of the
+	// annotation triggers a new emergency rotation.
+	EmergencyRotationAnnotation = "service.syn.tools/emergency-rotation"
+	// EmergencyRotationReportLabelKey is the label of the ConfigMaps in
+	// which the controller reports the progress of emergency rotations
+	EmergencyRotationReportLabelKey = "service.syn.tools/emergency-rotation-report"
+	// EmergencyRotationReportKey is the ConfigMap key which holds the
+	// emergency rotation report
+	EmergencyRotationReportKey = "report.yaml"
+)
+
+// EmergencyRotationPhase is the phase of an emergency rotation
+type EmergencyRotationPhase string
+
+const (
+	// EmergencyRotationWaitingForCA means that the CA is still the
+	// compromised CA. The controller regenerates the CA, except for
+	// imported CAs, which the operator must replace.
+	EmergencyRotationWaitingForCA EmergencyRotationPhase = "WaitingForNewCA"
+	// EmergencyRotationReissuing means that the certificates issued by
+	// the compromised CA are reissued
+	EmergencyRotationReissuing EmergencyRotationPhase = "Reissuing"
+	// EmergencyRotationCompleted means that all certificates have been
+	// reissued and the compromised CAs were removed from the trust bundle
+	EmergencyRotationCompleted EmergencyRotationPhase = "Completed"
+)
+
+// EmergencyRotationReport records the progress of an emergency rotation
+type EmergencyRotationReport struct {
+	// Trigger is the value of the annotation which triggered the
+	// rotation
+	Trigger string `json:"trigger"`
+	// Phase is the phase of the rotation
+	Phase EmergencyRotationPhase `json:"phase"`
+	// StartedAt and CompletedAt are RFC3339 timestamps
+	StartedAt   string `json:"startedAt"`
+	CompletedAt string `json:"completedAt,omitempty"`
+	// CompromisedCAs lists the SHA-256 fingerprints of the CA
+	// certificates which were trusted when the rotation was triggered
+	CompromisedCAs []string `json:"compromisedCAs"`
+	// CurrentCA is the SHA-256 fingerprint of the new CA certificate
+	CurrentCA string `json:"currentCA,omitempty"`
+	// Namespaces holds the progress of the reissue per namespace
+	Namespaces map[string]NamespaceProgress `json:"namespaces,omitempty"`
+}
+
+// NamespaceProgress is the progress of the reissue of the certificates in a
+// namespace during an emergency rotation
+type NamespaceProgress struct {
+	// Certificates is the number of certificates issued by the CA
+	Certificates int `json:"certificates"`
+	// Reissued is the number of certificates which are issued by the
+	// new CA
+	Reissued int `json:"reissued"`
+	// Pending lists the certificates which are still issued by a
+	// compromised CA
+	Pending []string `json:"pending,omitempty"`
+}
+
+// EmergencyRotationReportName returns the name of the ConfigMap which holds
+// the emergency rotation report of the CA with CA secret `caSecretName`
+func EmergencyRotationReportName(caSecretName string) string {
+	return fmt.Sprintf("%s-emergency-rotation", caSecretName)
+}
+
+// active returns true if the emergency rotation hasn't completed yet
+func (r *EmergencyRotationReport) active() bool {
+	return r != nil && r.Phase != EmergencyRotationCompleted
+}
+
+// Summary returns a one-line summary of the report
+func (r *EmergencyRotationReport) Summary() string {
+	certs, reissued := 0, 0
+	for _, p := range r.Namespaces {
+		certs += p.Certificates
+		reissued += p.Reissued
+	}
+	return fmt.Sprintf("%d of %d certificates in %d namespaces reissued", reissued, certs, len(r.Namespaces))
+}
+
+// reconcileEmergencyRotation starts an emergency rotation of the CA of the
+// profile if the trigger annotation has a new value, and returns the report
+// of the latest emergency rotation, or nil if there was none. Starting the
+// rotation records the fingerprints of all trusted CA certificates as
+// compromised and deletes the CA secrets, so that the CA is regenerated with
+// a new private key. Imported CAs aren't deleted, the operator must replace
+// them.
+func reconcileEmergencyRotation(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) (*EmergencyRotationReport, bool, error) {
+	report, cm, err := readEmergencyReport(ctx, c, caNamespace, profile)
+	if err != nil {
+		return nil, false, err
+	}
+	trigger, err := emergencyTrigger(ctx, c, caNamespace, profile)
+	if err != nil {
+		return nil, false, err
+	}
+	if trigger == "" || (report != nil && report.Trigger == trigger) {
+		return report, false, nil
+	}
+
+	compromised, err := trustedFingerprints(ctx, c, caNamespace, profile)
+	if err != nil {
+		return nil, false, err
+	}
+	l.Info("Starting emergency rotation of the CA", "trigger", trigger, "compromisedCAs", compromised)
+	// A staged CA is trusted already and would replace the new CA
+	staged, err := getStagedCACertificate(ctx, c, caNamespace, profile)
+	if err != nil {
+		return nil, false, err
+	}
+	if staged != nil {
+		if err := deleteCACertificateAndSecret(ctx, c, staged); err != nil {
+			return nil, false, err
+		}
+	}
+	if !profile.Import {
+		secrets := []string{profile.SecretName}
+		if profile.Intermediate {
+			secrets = append(secrets, profile.intermediateProfile().SecretName)
+		}
+		for _, name := range secrets {
+			secret := corev1.Secret{}
+			secret.Name = name
+			secret.Namespace = caNamespace
+			if err := c.Delete(ctx, &secret); err != nil && !errors.IsNotFound(err) {
+				return nil, false, err
+			}
+		}
+	}
+	report = &EmergencyRotationReport{
+		Trigger:        trigger,
+		Phase:          EmergencyRotationWaitingForCA,
+		StartedAt:      now().UTC().Format(time.RFC3339),
+		CompromisedCAs: compromised,
+	}
+	return report, true, writeEmergencyReport(ctx, c, caNamespace, profile, cm, report)
+}
+
+// propagateEmergencyRotation sets the emergency rotation annotation with
+// value `trigger` on the CAs of the profile's CA groups, so that the group
+// CAs are rotated together with the profile's CA. The CA groups are found
+// by the labels of their trust bundles.
+func propagateEmergencyRotation(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, trigger string) error {
+	cmList := corev1.ConfigMapList{}
+	if err := c.List(ctx, &cmList, client.InNamespace(caNamespace), client.HasLabels{TrustBundleLabelKey, CAGroupLabelKey}); err != nil {
+		return err
+	}
+	for _, cm := range cmList.Items {
+		group := cm.Labels[CAGroupLabelKey]
+		gp := profile.GroupProfile(group)
+		if cm.Annotations[CASecretAnnotation] != gp.SecretName {
+			// Trust bundle of another CA's group
+			continue
+		}
+		obj, key := emergencyTriggerObject(caNamespace, gp)
+		if err := c.Get(ctx, key, obj); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if obj.GetAnnotations()[EmergencyRotationAnnotation] == trigger {
+			continue
+		}
+		l.Info("Triggering emergency rotation of CA group", "group", group, "trigger", trigger)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[EmergencyRotationAnnotation] = trigger
+		obj.SetAnnotations(annotations)
+		if err := c.Update(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emergencyTriggerObject returns an empty object and the key of the object
+// which carries the emergency rotation annotation of the profile's CA: the
+// CA Certificate, or the CA secret for CAs without a CA Certificate
+func emergencyTriggerObject(caNamespace string, profile CAProfile) (client.Object, client.ObjectKey) {
+	key := client.ObjectKey{Namespace: caNamespace, Name: profile.CertificateName}
+	if profile.Import || profile.NameConstraints {
+		key.Name = profile.SecretName
+		return &corev1.Secret{}, key
+	}
+	return &cmapi.Certificate{}, key
+}
+
+// emergencyTrigger returns the value of the emergency rotation annotation on
+// the CA Certificate, or on the CA secret for CAs without a CA Certificate
+func emergencyTrigger(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) (string, error) {
+	obj, key := emergencyTriggerObject(caNamespace, profile)
+	if err := c.Get(ctx, key, obj); err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return obj.GetAnnotations()[EmergencyRotationAnnotation], nil
+}
+
+// trustedFingerprints returns the fingerprints of the CA certificates in the
+// trust bundle and in the CA secret of the profile
+func trustedFingerprints(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) ([]string, error) {
+	bundles := []byte{}
+	cm := corev1.ConfigMap{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: caNamespace, Name: TrustBundleName(profile.SecretName)}, &cm)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	bundles = append(bundles, cm.Data[cmmeta.TLSCAKey]...)
+	secret := corev1.Secret{}
+	err = c.Get(ctx, client.ObjectKey{Namespace: caNamespace, Name: profile.SecretName}, &secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	bundles = append(bundles, '\n')
+	bundles = append(bundles, secret.Data[corev1.TLSCertKey]...)
+
+	crts, err := parseCertificates(bundles)
+	if err != nil {
+		return nil, fmt.Errorf("parsing trusted CA certificates: %v", err)
+	}
+	fps := []string{}
+	for _, crt := range crts {
+		sum := sha256.Sum256(crt.Raw)
+		fps = appendUnique(fps, hex.EncodeToString(sum[:]))
+	}
+	sort.Strings(fps)
+	return fps, nil
+}
+
+// updateEmergencyReport records the result `res` of the rotation reconcile
+// and the reissue progress `progress` in the report. The emergency rotation
+// is completed once the CA isn't compromised anymore and no rotation is in
+// progress.
+func updateEmergencyReport(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, report *EmergencyRotationReport, currentCA string, progress map[string]NamespaceProgress, res *CARotation) error {
+	_, cm, err := readEmergencyReport(ctx, c, caNamespace, profile)
+	if err != nil {
+		return err
+	}
+	report.CurrentCA = currentCA
+	switch {
+	case currentCA == "" || containsString(report.CompromisedCAs, currentCA):
+		report.Phase = EmergencyRotationWaitingForCA
+		res.RequeueAfter = rotationPollInterval
+	case res.Completed || res.RequeueAfter == 0:
+		report.Phase = EmergencyRotationCompleted
+		report.CompletedAt = now().UTC().Format(time.RFC3339)
+		res.EmergencyCompleted = true
+	default:
+		report.Phase = EmergencyRotationReissuing
+	}
+	if progress != nil {
+		report.Namespaces = progress
+	}
+	res.Emergency = report
+	return writeEmergencyReport(ctx, c, caNamespace, profile, cm, report)
+}
+
+// currentCAFingerprint returns the fingerprint of the current CA
+// certificate, or an empty string if the CA isn't ready
+func currentCAFingerprint(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) string {
+	secret, err := readCASecret(ctx, c, l, caNamespace, profile)
+	if err != nil {
+		return ""
+	}
+	bundle, err := caBundle(secret, profile)
+	if err != nil {
+		return ""
+	}
+	crts, err := parseCertificates([]byte(bundle))
+	if err != nil || len(crts) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(crts[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// readEmergencyReport returns the emergency rotation report of the CA of
+// the profile and its ConfigMap. Returns a nil report if there is none.
+func readEmergencyReport(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) (*EmergencyRotationReport, *corev1.ConfigMap, error) {
+	cm := corev1.ConfigMap{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: caNamespace, Name: EmergencyRotationReportName(profile.SecretName)}, &cm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	data, ok := cm.Data[EmergencyRotationReportKey]
+	if !ok {
+		return nil, &cm, nil
+	}
+	report := EmergencyRotationReport{}
+	if err := yaml.Unmarshal([]byte(data), &report); err != nil {
+		return nil, &cm, fmt.Errorf("parsing emergency rotation report %s: %v", cm.Name, err)
+	}
+	return &report, &cm, nil
+}
+
+// writeEmergencyReport writes the report to ConfigMap `cm`, or creates the
+// ConfigMap if `cm` is nil
+func writeEmergencyReport(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, cm *corev1.ConfigMap, report *EmergencyRotationReport) error {
+	data, err := yaml.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		cm = &corev1.ConfigMap{}
+		cm.Name = EmergencyRotationReportName(profile.SecretName)
+		cm.Namespace = caNamespace
+		cm.Labels = map[string]string{EmergencyRotationReportLabelKey: "true"}
+		cm.Data = map[string]string{EmergencyRotationReportKey: string(data)}
+		return c.Create(ctx, cm)
+	}
+	if cm.Data[EmergencyRotationReportKey] == string(data) {
+		return nil
+	}
+	cm.Data = map[string]string{EmergencyRotationReportKey: string(data)}
+	return c.Update(ctx, cm)
+}
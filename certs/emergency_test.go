@@ -0,0 +1,277 @@
+package certs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_ReconcileCARotation_Emergency(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Now().Truncate(time.Second)
+	setNow(t, start)
+
+	oldCA := newTestCA(t, "service-ca", nil)
+	newCA := newTestCA(t, "service-ca", nil)
+	oldLeaf := newTestCertificate(t, "test-svc", oldCA, false)
+	newLeaf := newTestCertificate(t, "test-svc", newCA, false)
+	profile := DefaultCAProfile()
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&extv1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "certificates.cert-manager.io",
+				},
+			},
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CACertName,
+					Namespace: testCANamespace,
+					Annotations: map[string]string{
+						EmergencyRotationAnnotation: "key-leak-1",
+					},
+				},
+				Spec: newCACertificate(testCANamespace, profile).Spec,
+				Status: cmapi.CertificateStatus{
+					Conditions: []cmapi.CertificateCondition{{
+						Type:   cmapi.CertificateConditionReady,
+						Status: cmmeta.ConditionTrue,
+					}},
+				},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": oldCA.pem,
+				},
+			},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      TrustBundleName(CASecretName),
+					Namespace: testCANamespace,
+					Labels: map[string]string{
+						TrustBundleLabelKey: "true",
+					},
+					Annotations: map[string]string{
+						CASecretAnnotation:      CASecretName,
+						CAFingerprintAnnotation: bundleFingerprint(string(oldCA.pem)),
+					},
+				},
+				Data: map[string]string{
+					"ca.crt": string(oldCA.pem),
+				},
+			},
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-svc-tls",
+					Namespace: "test-ns",
+				},
+				Spec: cmapi.CertificateSpec{
+					SecretName: "test-svc-tls",
+					IssuerRef:  profile.IssuerRef(),
+				},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-svc-tls",
+					Namespace: "test-ns",
+				},
+				Data: map[string][]byte{
+					"tls.crt": oldLeaf.pem,
+				},
+			},
+		},
+	})
+	report := func() EmergencyRotationReport {
+		r, _, err := readEmergencyReport(ctx, c, testCANamespace, profile)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		return *r
+	}
+	trustBundle := func() string {
+		cm := corev1.ConfigMap{}
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: TrustBundleName(CASecretName)}, &cm))
+		return cm.Data["ca.crt"]
+	}
+
+	// The emergency rotation starts, and the CA secret is deleted so
+	// that cert-manager regenerates the CA
+	res, err := ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.True(t, res.EmergencyStarted)
+	assert.Equal(t, rotationPollInterval, res.RequeueAfter)
+	err = c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: CASecretName}, &corev1.Secret{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Equal(t, EmergencyRotationReport{
+		Trigger:        "key-leak-1",
+		Phase:          EmergencyRotationWaitingForCA,
+		StartedAt:      start.UTC().Format(time.RFC3339),
+		CompromisedCAs: []string{testFingerprint(oldCA)},
+	}, report())
+	assert.Equal(t, string(oldCA.pem), trustBundle())
+
+	// cert-manager issues the new CA, the Service certificate is
+	// reissued without grace period
+	require.NoError(t, c.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CASecretName,
+			Namespace: testCANamespace,
+		},
+		Data: map[string][]byte{
+			"tls.crt": newCA.pem,
+		},
+	}))
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.False(t, res.EmergencyStarted)
+	assert.Equal(t, []string{"test-ns/test-svc-tls"}, res.Reissued)
+	assert.Equal(t, rotationPollInterval, res.RequeueAfter)
+	assert.Equal(t, string(newCA.pem)+string(oldCA.pem), trustBundle())
+	r := report()
+	assert.Equal(t, EmergencyRotationReissuing, r.Phase)
+	assert.Equal(t, testFingerprint(newCA), r.CurrentCA)
+	assert.Equal(t, map[string]NamespaceProgress{
+		"test-ns": {Certificates: 1, Pending: []string{"test-svc-tls"}},
+	}, r.Namespaces)
+
+	// The certificate is reissued, the compromised CA is removed from the
+	// trust bundle right away
+	setSecretCertificate(t, c, "test-ns", "test-svc-tls", newLeaf.pem)
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.True(t, res.Completed)
+	assert.True(t, res.EmergencyCompleted)
+	assert.Equal(t, "1 of 1 certificates in 1 namespaces reissued", res.Emergency.Summary())
+	assert.Equal(t, string(newCA.pem), trustBundle())
+	r = report()
+	assert.Equal(t, EmergencyRotationCompleted, r.Phase)
+	assert.Equal(t, start.UTC().Format(time.RFC3339), r.CompletedAt)
+	assert.Equal(t, map[string]NamespaceProgress{
+		"test-ns": {Certificates: 1, Reissued: 1},
+	}, r.Namespaces)
+
+	// The same trigger doesn't start another emergency rotation
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{}, res)
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: CASecretName}, &corev1.Secret{}))
+}
+
+func TestCerts_ReconcileCARotation_EmergencyImport(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	ca := newTestCA(t, "imported-ca", nil)
+	profile := DefaultCAProfile()
+	profile.Import = true
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+					Annotations: map[string]string{
+						EmergencyRotationAnnotation: "key-leak-1",
+					},
+				},
+				Type: corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					"tls.crt": ca.pem,
+					"tls.key": ca.keyPEM,
+				},
+			},
+		},
+	})
+
+	// Imported CAs aren't deleted, the rotation waits for the operator
+	// to replace the CA
+	res, err := ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.True(t, res.EmergencyStarted)
+	assert.Equal(t, EmergencyRotationWaitingForCA, res.Emergency.Phase)
+	assert.Equal(t, testFingerprint(ca), res.Emergency.CurrentCA)
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: CASecretName}, &corev1.Secret{}))
+}
+
+func TestCerts_ReconcileCARotation_EmergencyGroups(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	ca := newTestCA(t, "service-ca", nil)
+	profile := DefaultCAProfile()
+	groupProfile := profile.GroupProfile("team-a")
+	named := NamedCAProfile("compliance")
+	trustBundle := func(secretName, group string) *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        TrustBundleName(secretName),
+				Namespace:   testCANamespace,
+				Labels:      map[string]string{TrustBundleLabelKey: "true", CAGroupLabelKey: group},
+				Annotations: map[string]string{CASecretAnnotation: secretName},
+			},
+		}
+		return cm
+	}
+	caCert := func(p CAProfile, trigger string) *cmapi.Certificate {
+		cert := newCACertificate(testCANamespace, p)
+		if trigger != "" {
+			cert.Annotations = map[string]string{EmergencyRotationAnnotation: trigger}
+		}
+		return &cert
+	}
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			caCert(profile, "key-leak-1"),
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": ca.pem,
+				},
+			},
+			caCert(groupProfile, ""),
+			trustBundle(groupProfile.SecretName, "team-a"),
+			// A trust bundle which doesn't belong to a group of the
+			// profile
+			caCert(named.GroupProfile("team-b"), ""),
+			trustBundle(named.GroupProfile("team-b").SecretName, "team-b"),
+		},
+	})
+
+	res, err := ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.True(t, res.EmergencyStarted)
+
+	// The emergency rotation is triggered on the CA Certificates of the
+	// profile's groups
+	cert := cmapi.Certificate{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: groupProfile.CertificateName}, &cert))
+	assert.Equal(t, "key-leak-1", cert.Annotations[EmergencyRotationAnnotation])
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: named.GroupProfile("team-b").CertificateName}, &cert))
+	assert.NotContains(t, cert.Annotations, EmergencyRotationAnnotation)
+}
+
+func testFingerprint(ca *testCA) string {
+	sum := sha256.Sum256(ca.crt.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,55 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// readImportedCASecret returns the CA secret which the operator supplied
+// for an imported CA. Returns an error if the secret doesn't contain a valid
+// CA certificate and matching key.
+func readImportedCASecret(ctx context.Context, c client.Client, log logr.Logger, caNamespace string, profile CAProfile) (*corev1.Secret, error) {
+	secret := corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{
+		Name:      profile.SecretName,
+		Namespace: caNamespace,
+	}, &secret); err != nil {
+		log.Error(err, "Fetching imported CA secret")
+		return nil, err
+	}
+	if err := validateCAKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		log.Info("Imported CA secret is invalid", "error", err.Error())
+		return nil, fmt.Errorf("imported CA secret %s/%s: %w", caNamespace, secret.Name, err)
+	}
+	return &secret, nil
+}
+
+// validateCAKeyPair checks that the first certificate in `crtPEM` is a
+// valid CA certificate, and that `keyPEM` holds its private key
+func validateCAKeyPair(crtPEM, keyPEM []byte) error {
+	pair, err := tls.X509KeyPair(crtPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate and key: %w", err)
+	}
+	crt, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !crt.BasicConstraintsValid || !crt.IsCA {
+		return fmt.Errorf("certificate %q is not a CA certificate", crt.Subject.CommonName)
+	}
+	if crt.KeyUsage != 0 && crt.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("certificate %q can't sign certificates", crt.Subject.CommonName)
+	}
+	if ts := now(); ts.Before(crt.NotBefore) || ts.After(crt.NotAfter) {
+		return fmt.Errorf("certificate %q is only valid from %s to %s", crt.Subject.CommonName,
+			crt.NotBefore.UTC(), crt.NotAfter.UTC())
+	}
+	return nil
+}
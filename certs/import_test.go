@@ -0,0 +1,188 @@
+package certs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_validateCAKeyPair(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	other := newTestCA(t, "other", nil)
+	leaf := newTestCertificate(t, "leaf", root, false)
+
+	tests := map[string]struct {
+		crt []byte
+		key []byte
+		err string
+	}{
+		"Valid": {
+			crt: root.pem,
+			key: root.keyPEM,
+		},
+		"KeyMismatch": {
+			crt: root.pem,
+			key: other.keyPEM,
+			err: "invalid certificate and key: tls: private key does not match public key",
+		},
+		"NotCA": {
+			crt: leaf.pem,
+			key: leaf.keyPEM,
+			err: `certificate "leaf" is not a CA certificate`,
+		},
+		"MissingKey": {
+			crt: root.pem,
+			err: "invalid certificate and key: tls: failed to find any PEM data in key input",
+		},
+	}
+
+	for testn, tc := range tests {
+		err := validateCAKeyPair(tc.crt, tc.key)
+		if tc.err == "" {
+			assert.NoError(t, err, testn)
+			continue
+		}
+		require.Error(t, err, testn)
+		assert.Equal(t, tc.err, err.Error(), testn)
+	}
+
+	setNow(t, time.Now().Add(2*time.Hour))
+	err := validateCAKeyPair(root.pem, root.keyPEM)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `certificate "root" is only valid from`)
+}
+
+func TestCerts_GetServiceCA_Import(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	root := newTestCA(t, "root", nil)
+	serviceCA := newTestCA(t, "service-ca", root)
+	crd := &extv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "certificates.cert-manager.io",
+		},
+	}
+	profile := DefaultCAProfile()
+	profile.Import = true
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			crd,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": concat(serviceCA.pem, root.pem),
+					"tls.key": serviceCA.keyPEM,
+				},
+			},
+		},
+	})
+	ca, err := GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(concat(serviceCA.pem, root.pem)), ca)
+
+	iss := cmapi.ClusterIssuer{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &iss))
+	assert.Equal(t, &cmapi.CAIssuer{SecretName: CASecretName}, iss.Spec.CA)
+	// Neither the self-signed issuer nor the CA certificate are created
+	err = c.Get(ctx, client.ObjectKey{Name: SelfSignedIssuerName, Namespace: testCANamespace}, &cmapi.Issuer{})
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKey{Name: CACertName, Namespace: testCANamespace}, &cmapi.Certificate{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// A secret without a matching key is rejected
+	c = prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			crd,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": serviceCA.pem,
+					"tls.key": root.keyPEM,
+				},
+			},
+		},
+	})
+	_, err = GetServiceCA(ctx, c, l, testCANamespace, profile)
+	assert.EqualError(t, err,
+		"imported CA secret cert-manager/service-ca-root: invalid certificate and key: tls: private key does not match public key")
+
+	// The secret must exist
+	c = prepareTest(t, testCfg{initObjs: []client.Object{crd}})
+	_, err = GetServiceCA(ctx, c, l, testCANamespace, profile)
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCerts_ensureProfileCA_ImportRemovesCACertificate(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	serviceCA := newTestCA(t, "service-ca", nil)
+	profile := DefaultCAProfile()
+	existing := newCACertificate(testCANamespace, profile)
+	staged := newCACertificate(testCANamespace, profile.stagedProfile())
+	importedSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CASecretName,
+			Namespace: testCANamespace,
+		},
+		Data: map[string][]byte{
+			"tls.crt": serviceCA.pem,
+			"tls.key": serviceCA.keyPEM,
+		},
+	}
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&existing,
+			&staged,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      staged.Spec.SecretName,
+					Namespace: testCANamespace,
+				},
+			},
+			importedSecret,
+		},
+	})
+	profile.Import = true
+
+	// The CA Certificates of the profile are removed, so that
+	// cert-manager doesn't overwrite the imported CA
+	_, err := ensureProfileCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	for _, obj := range []client.Object{
+		&cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: existing.Name, Namespace: testCANamespace}},
+		&cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: staged.Name, Namespace: testCANamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: staged.Spec.SecretName, Namespace: testCANamespace}},
+	} {
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		assert.True(t, apierrors.IsNotFound(err), obj.GetName())
+	}
+	secret := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(importedSecret), &secret))
+	assert.Equal(t, serviceCA.pem, secret.Data["tls.crt"])
+
+	// Other Certificates which write to the imported secret are refused
+	other := newCACertificate(testCANamespace, profile)
+	other.Name = "other-ca"
+	require.NoError(t, c.Create(ctx, &other))
+	_, err = ensureProfileCA(ctx, c, l, testCANamespace, profile)
+	require.Error(t, err)
+	assert.True(t, IsInvalidConfigError(err))
+	assert.Equal(t, "Certificate other-ca writes to CA secret service-ca-root, which isn't issued by cert-manager", err.Error())
+}
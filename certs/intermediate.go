@@ -0,0 +1,124 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// intermediateProfile returns the CA profile of the intermediate CA of a
+// two-tier CA. The intermediate CA is signed by the root CA through the
+// root Issuer, and the Service certificates are issued from the
+// intermediate CA. The intermediate CA's resources are named after the
+// root CA's resources.
+func (p *CAProfile) intermediateProfile() CAProfile {
+	return CAProfile{
+		SelfSignedIssuerName: p.SelfSignedIssuerName,
+		CertificateName:      fmt.Sprintf("%s-intermediate", p.CertificateName),
+		SecretName:           fmt.Sprintf("%s-intermediate", p.SecretName),
+		IssuerName:           p.IssuerName,
+		CommonName:           fmt.Sprintf("%s Intermediate", p.CommonName),
+		Organizations:        p.Organizations,
+		OrganizationalUnits:  p.OrganizationalUnits,
+		Countries:            p.Countries,
+		KeyAlgorithm:         p.KeyAlgorithm,
+		KeySize:              p.KeySize,
+		Duration:             p.IntermediateDuration,
+		RenewBefore:          p.IntermediateRenewBefore,
+		ParentIssuer: cmmeta.ObjectReference{
+			Name:  p.rootIssuerName(),
+			Kind:  "Issuer",
+			Group: "cert-manager.io",
+		},
+	}
+}
+
+// rootIssuerName returns the name of the namespaced CA Issuer which signs
+// the intermediate CA of a two-tier CA with the root CA
+func (p *CAProfile) rootIssuerName() string {
+	return fmt.Sprintf("%s-issuer", p.SecretName)
+}
+
+// issuingSecretName returns the name of the secret of the CA which issues
+// Service certificates
+func (p *CAProfile) issuingSecretName() string {
+	if p.Intermediate {
+		return p.intermediateProfile().SecretName
+	}
+	return p.SecretName
+}
+
+// ensureIntermediateCA ensures that the root Issuer and the intermediate
+// CA certificate of a two-tier CA exist and match the CA profile
+func ensureIntermediateCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	if err := ensureRootIssuer(ctx, c, l, caNamespace, profile); err != nil {
+		return err
+	}
+	return ensureIntermediateCertificate(ctx, c, l, caNamespace, profile.intermediateProfile())
+}
+
+// ensureIntermediateCertificate creates the intermediate CA Certificate if
+// it doesn't exist. If the Certificate exists but doesn't match the
+// intermediate CA profile, the Certificate is updated, which makes
+// cert-manager reissue the intermediate CA. This doesn't need to be staged,
+// as the trust bundle only holds the root CA, and the Service certificates
+// carry the chain to the root CA.
+func ensureIntermediateCertificate(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	caCert := cmapi.Certificate{}
+	err := c.Get(ctx, client.ObjectKey{
+		Name:      profile.CertificateName,
+		Namespace: caNamespace,
+	}, &caCert)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "while fetching intermediate CA certificate")
+		return err
+	}
+	desired := newCACertificate(caNamespace, profile)
+	if errors.IsNotFound(err) {
+		l.Info("Intermediate CA certificate doesn't exist, creating...")
+		return c.Create(ctx, &desired)
+	}
+	if !reflect.DeepEqual(caCert.Spec, desired.Spec) {
+		l.Info("Intermediate CA certificate doesn't match CA profile, updating...")
+		caCert.Spec = desired.Spec
+		return c.Update(ctx, &caCert)
+	}
+	return nil
+}
+
+// ensureRootIssuer creates the namespaced CA Issuer which issues the
+// intermediate CA certificate from the root CA secret if it doesn't exist.
+// If the Issuer exists but doesn't reference the root CA secret, the Issuer
+// is updated.
+func ensureRootIssuer(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	iss := cmapi.Issuer{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.rootIssuerName(), Namespace: caNamespace}, &iss)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "while fetching root CA issuer")
+		return err
+	}
+	desired := cmapi.IssuerConfig{
+		CA: &cmapi.CAIssuer{
+			SecretName: profile.SecretName,
+		},
+	}
+	if errors.IsNotFound(err) {
+		l.Info("Root CA issuer doesn't exist, creating...")
+		iss.Name = profile.rootIssuerName()
+		iss.Namespace = caNamespace
+		iss.Spec.IssuerConfig = desired
+		return c.Create(ctx, &iss)
+	}
+	if !reflect.DeepEqual(iss.Spec.IssuerConfig, desired) {
+		l.Info("Root CA issuer doesn't match CA profile, updating...")
+		iss.Spec.IssuerConfig = desired
+		return c.Update(ctx, &iss)
+	}
+	return nil
+}
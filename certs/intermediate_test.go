@@ -0,0 +1,226 @@
+package certs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_intermediateProfile(t *testing.T) {
+	profile := DefaultCAProfile()
+	profile.Intermediate = true
+	profile.Duration = &metav1.Duration{Duration: 87600 * time.Hour}
+	profile.IntermediateDuration = &metav1.Duration{Duration: 8760 * time.Hour}
+
+	ip := profile.intermediateProfile()
+	assert.Equal(t, "service-ca-certificate-intermediate", ip.CertificateName)
+	assert.Equal(t, "service-ca-root-intermediate", ip.SecretName)
+	assert.Equal(t, "service-ca Intermediate", ip.CommonName)
+	assert.Equal(t, profile.IntermediateDuration, ip.Duration)
+	assert.Equal(t, cmmeta.ObjectReference{
+		Name:  "service-ca-root-issuer",
+		Kind:  "Issuer",
+		Group: "cert-manager.io",
+	}, ip.caIssuerRef())
+	assert.Equal(t, "service-ca-root-intermediate", profile.issuingSecretName())
+
+	gp := profile.GroupProfile("tenant")
+	assert.Equal(t, "service-ca-root-tenant-issuer", gp.rootIssuerName())
+	assert.Equal(t, "service-ca-root-tenant-intermediate", gp.issuingSecretName())
+}
+
+func TestCerts_ensureCA_Intermediate(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	c := prepareTest(t, testCfg{})
+
+	profile := DefaultCAProfile()
+	profile.Intermediate = true
+	err := ensureCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+
+	root := cmapi.Certificate{}
+	err = c.Get(ctx, client.ObjectKey{Name: CACertName, Namespace: testCANamespace}, &root)
+	require.NoError(t, err)
+	assert.Equal(t, SelfSignedIssuerName, root.Spec.IssuerRef.Name)
+
+	rootIss := cmapi.Issuer{}
+	err = c.Get(ctx, client.ObjectKey{Name: "service-ca-root-issuer", Namespace: testCANamespace}, &rootIss)
+	require.NoError(t, err)
+	require.NotNil(t, rootIss.Spec.CA)
+	assert.Equal(t, CASecretName, rootIss.Spec.CA.SecretName)
+
+	intermediate := cmapi.Certificate{}
+	err = c.Get(ctx, client.ObjectKey{Name: "service-ca-certificate-intermediate", Namespace: testCANamespace}, &intermediate)
+	require.NoError(t, err)
+	assert.True(t, intermediate.Spec.IsCA)
+	assert.Equal(t, "service-ca Intermediate", intermediate.Spec.CommonName)
+	assert.Equal(t, "service-ca-root-intermediate", intermediate.Spec.SecretName)
+	assert.Equal(t, cmmeta.ObjectReference{
+		Name:  "service-ca-root-issuer",
+		Kind:  "Issuer",
+		Group: "cert-manager.io",
+	}, intermediate.Spec.IssuerRef)
+
+	iss := cmapi.ClusterIssuer{}
+	err = c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &iss)
+	require.NoError(t, err)
+	require.NotNil(t, iss.Spec.CA)
+	assert.Equal(t, "service-ca-root-intermediate", iss.Spec.CA.SecretName)
+}
+
+func TestCerts_GetServiceCA_Intermediate(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	root := newTestCA(t, "service-ca", nil)
+	intermediate := newTestCA(t, "service-ca Intermediate", root)
+	profile := DefaultCAProfile()
+	profile.Intermediate = true
+	c := prepareTest(t, testCfg{
+		initObjs: intermediateCAObjects(profile, root, intermediate),
+	})
+
+	ca, err := GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(root.pem), ca)
+
+	// Renewing the intermediate CA doesn't change the trust bundle
+	renewed := newTestCA(t, "service-ca Intermediate", root)
+	setSecretCertificate(t, c, testCANamespace, "service-ca-root-intermediate", renewed.pem)
+	ca, err = GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(root.pem), ca)
+}
+
+func TestCerts_ReconcileCARotation_Intermediate(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Now().Truncate(time.Second)
+	setNow(t, start)
+	profile := DefaultCAProfile()
+	profile.Intermediate = true
+
+	oldRoot := newTestCA(t, "service-ca", nil)
+	oldIntermediate := newTestCA(t, "service-ca Intermediate", oldRoot)
+	leaf := newTestCertificate(t, "test-svc", oldIntermediate, false)
+	objs := append(intermediateCAObjects(profile, oldRoot, oldIntermediate),
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-svc-tls",
+				Namespace: "test-ns",
+			},
+			Spec: cmapi.CertificateSpec{
+				SecretName: "test-svc-tls",
+				IssuerRef:  profile.IssuerRef(),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-svc-tls",
+				Namespace: "test-ns",
+			},
+			Data: map[string][]byte{
+				"tls.crt": concat(leaf.pem, oldIntermediate.pem),
+			},
+		})
+	c := prepareTest(t, testCfg{initObjs: objs})
+	_, err := GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+
+	// Leaf certificates which chain to the current root through the
+	// intermediate CA aren't reissued
+	res, err := ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{}, res)
+
+	newRoot := newTestCA(t, "service-ca", nil)
+	setSecretCertificate(t, c, testCANamespace, CASecretName, newRoot.pem)
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{RequeueAfter: 24 * time.Hour}, res)
+
+	// The intermediate CA is reissued before the leaf certificates
+	setNow(t, start.Add(24*time.Hour))
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cert-manager/service-ca-certificate-intermediate"}, res.Reissued)
+
+	newIntermediate := newTestCA(t, "service-ca Intermediate", newRoot)
+	setSecretCertificate(t, c, testCANamespace, "service-ca-root-intermediate", newIntermediate.pem)
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test-ns/test-svc-tls"}, res.Reissued)
+}
+
+// intermediateCAObjects returns the ready root and intermediate CA of a
+// two-tier CA
+func intermediateCAObjects(profile CAProfile, root, intermediate *testCA) []client.Object {
+	ready := cmapi.CertificateStatus{
+		Conditions: []cmapi.CertificateCondition{{
+			Type:   cmapi.CertificateConditionReady,
+			Status: cmmeta.ConditionTrue,
+		}},
+	}
+	ip := profile.intermediateProfile()
+	return []client.Object{
+		&extv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "certificates.cert-manager.io",
+			},
+		},
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.CertificateName,
+				Namespace: testCANamespace,
+			},
+			Spec:   newCACertificate(testCANamespace, profile).Spec,
+			Status: ready,
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.SecretName,
+				Namespace: testCANamespace,
+			},
+			Data: map[string][]byte{
+				"tls.crt": root.pem,
+				"tls.key": root.keyPEM,
+			},
+		},
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ip.CertificateName,
+				Namespace: testCANamespace,
+			},
+			Spec:   newCACertificate(testCANamespace, ip).Spec,
+			Status: ready,
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ip.SecretName,
+				Namespace: testCANamespace,
+			},
+			Data: map[string][]byte{
+				"tls.crt": intermediate.pem,
+				"tls.key": intermediate.keyPEM,
+				"ca.crt":  root.pem,
+			},
+		},
+	}
+}
+
+func setSecretCertificate(t *testing.T, c client.Client, namespace, name string, crt []byte) {
+	secret := corev1.Secret{}
+	require.NoError(t, c.Get(context.Background(), client.ObjectKey{Name: name, Namespace: namespace}, &secret))
+	secret.Data["tls.crt"] = crt
+	require.NoError(t, c.Update(context.Background(), &secret))
+}
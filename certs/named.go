@@ -0,0 +1,166 @@
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultCAName is the name which selects the default Service CA
+const DefaultCAName = "default"
+
+// CAProfiles holds the profiles of the named Service CAs by name
+type CAProfiles map[string]CAProfile
+
+// NamedCAProfile returns the default profile of the named CA `name`. The
+// resources of the named CA are named `service-ca-<name>-*`, so that they
+// don't collide with the resources of the default CA.
+func NamedCAProfile(name string) CAProfile {
+	p := DefaultCAProfile()
+	p.Name = name
+	p.CertificateName = fmt.Sprintf("%s-%s-certificate", CAName, name)
+	p.SecretName = fmt.Sprintf("%s-%s-root", CAName, name)
+	p.IssuerName = fmt.Sprintf("%s-%s-issuer", CAName, name)
+	p.CommonName = fmt.Sprintf("%s-%s", CAName, name)
+	return p
+}
+
+// LoadNamedCAProfiles reads the named CA profiles from the YAML file at
+// `path`. The file maps CA names to CA profiles. Fields which aren't present
+// in a profile keep the value of NamedCAProfile().
+func LoadNamedCAProfiles(path string) (CAProfiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := yaml.UnmarshalStrict(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing named CA profiles %s: %w", path, err)
+	}
+	profiles := CAProfiles{}
+	for name, r := range raw {
+		p := NamedCAProfile(name)
+		if err := yaml.UnmarshalStrict(r, &p); err != nil {
+			return nil, fmt.Errorf("parsing named CA profile %q in %s: %w", name, path, err)
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// Validate checks that the named CA profiles are valid, and that their
+// resource names don't collide with each other or with the resources of the
+// default CA profile `defaultProfile`.
+func (p CAProfiles) Validate(defaultProfile CAProfile) error {
+	owners := map[string]string{}
+	claim := func(ca, kind, name string) error {
+		key := kind + "/" + name
+		if other, ok := owners[key]; ok {
+			return fmt.Errorf("CA %q uses %s %q of CA %q", ca, kind, name, other)
+		}
+		owners[key] = ca
+		return nil
+	}
+	claimAll := func(ca string, profile CAProfile) error {
+		for _, err := range []error{
+			claim(ca, "certificate name", profile.CertificateName),
+			claim(ca, "secret name", profile.SecretName),
+			claim(ca, "issuer name", profile.IssuerName),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+		if !profile.Intermediate {
+			return nil
+		}
+		ip := profile.intermediateProfile()
+		for _, err := range []error{
+			claim(ca, "certificate name", ip.CertificateName),
+			claim(ca, "secret name", ip.SecretName),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(defaultProfile.Namespaces) > 0 {
+		return fmt.Errorf("namespaces can only be restricted for named CAs")
+	}
+	if err := claimAll(DefaultCAName, defaultProfile); err != nil {
+		return err
+	}
+	for _, name := range p.Names() {
+		if name == DefaultCAName {
+			return fmt.Errorf("CA name %q is reserved for the default CA", name)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid CA name %q: %v", name, errs)
+		}
+		profile := p[name]
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("CA %q: %w", name, err)
+		}
+		if err := claimAll(name, profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names returns the sorted names of the CA profiles
+func (p CAProfiles) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the profile of the named CA `name`. Returns an invalid
+// config error if no CA with the name is configured.
+func (p CAProfiles) Lookup(name string) (CAProfile, error) {
+	profile, ok := p[name]
+	if !ok {
+		return CAProfile{}, invalidConfigErrorf("unknown CA %q", name)
+	}
+	return profile, nil
+}
+
+// CheckSelectable returns an invalid config error if objects in namespace
+// `namespace`, which belongs to CA group `group`, may not select the CA of
+// the profile. If the profile lists namespaces, only those may select the
+// CA. Namespaces of a CA group may only select CAs which list them, so that
+// they can't leave the CA of their group.
+func (p *CAProfile) CheckSelectable(namespace, group string) error {
+	if MatchNamespace(p.Namespaces, namespace) {
+		return nil
+	}
+	if group != "" {
+		return invalidConfigErrorf("namespace %s belongs to CA group %s and can't select CA %q",
+			namespace, group, p.Name)
+	}
+	if len(p.Namespaces) > 0 {
+		return invalidConfigErrorf("CA %q can't be selected in namespace %s", p.Name, namespace)
+	}
+	return nil
+}
+
+// MatchNamespace returns true if namespace `ns` matches one of the shell
+// patterns in `patterns`, as supported by path.Match(). Invalid patterns
+// don't match.
+func MatchNamespace(patterns []string, ns string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, ns); ok {
+			return true
+		}
+	}
+	return false
+}
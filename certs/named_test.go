@@ -0,0 +1,235 @@
+package certs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCerts_LoadNamedCAProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cas.yaml")
+	err := os.WriteFile(path, []byte(`
+compliance:
+  commonName: Compliance CA
+  keyAlgorithm: RSA
+  keySize: 4096
+internal: {}
+`), 0o600)
+	require.NoError(t, err)
+
+	profiles, err := LoadNamedCAProfiles(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"compliance", "internal"}, profiles.Names())
+
+	expected := NamedCAProfile("compliance")
+	expected.CommonName = "Compliance CA"
+	expected.KeyAlgorithm = cmapi.RSAKeyAlgorithm
+	expected.KeySize = 4096
+	assert.Equal(t, expected, profiles["compliance"])
+	assert.Equal(t, NamedCAProfile("internal"), profiles["internal"])
+	assert.Equal(t, "service-ca-internal-certificate", profiles["internal"].CertificateName)
+	assert.Equal(t, "service-ca-internal-root", profiles["internal"].SecretName)
+	assert.Equal(t, "service-ca-internal-issuer", profiles["internal"].IssuerName)
+	assert.NoError(t, profiles.Validate(DefaultCAProfile()))
+
+	require.NoError(t, os.WriteFile(path, []byte("internal:\n  caName: foo\n"), 0o600))
+	_, err = LoadNamedCAProfiles(path)
+	assert.Error(t, err)
+}
+
+func TestCerts_CAProfilesValidate(t *testing.T) {
+	tests := map[string]struct {
+		profiles CAProfiles
+		err      string
+	}{
+		"Empty": {
+			profiles: CAProfiles{},
+		},
+		"Valid": {
+			profiles: CAProfiles{
+				"compliance": NamedCAProfile("compliance"),
+				"internal":   NamedCAProfile("internal"),
+			},
+		},
+		"ReservedName": {
+			profiles: CAProfiles{
+				"default": NamedCAProfile("default"),
+			},
+			err: `CA name "default" is reserved for the default CA`,
+		},
+		"InvalidName": {
+			profiles: CAProfiles{
+				"Compliance": NamedCAProfile("compliance"),
+			},
+			err: `invalid CA name "Compliance"`,
+		},
+		"InvalidProfile": {
+			profiles: CAProfiles{
+				"compliance": func() CAProfile {
+					p := NamedCAProfile("compliance")
+					p.CommonName = ""
+					return p
+				}(),
+			},
+			err: `CA "compliance": CA common name must not be empty`,
+		},
+		"DuplicateIssuer": {
+			profiles: CAProfiles{
+				"compliance": func() CAProfile {
+					p := NamedCAProfile("compliance")
+					p.IssuerName = ServiceIssuerName
+					return p
+				}(),
+			},
+			err: `CA "compliance" uses issuer name "service-ca-issuer" of CA "default"`,
+		},
+		"DuplicateSecret": {
+			profiles: CAProfiles{
+				"a": NamedCAProfile("a"),
+				"b": func() CAProfile {
+					p := NamedCAProfile("b")
+					p.SecretName = "service-ca-a-root"
+					return p
+				}(),
+			},
+			err: `CA "b" uses secret name "service-ca-a-root" of CA "a"`,
+		},
+		"DuplicateIntermediateSecret": {
+			profiles: CAProfiles{
+				"a": func() CAProfile {
+					p := NamedCAProfile("a")
+					p.Intermediate = true
+					return p
+				}(),
+				"b": func() CAProfile {
+					p := NamedCAProfile("b")
+					p.SecretName = "service-ca-a-root-intermediate"
+					return p
+				}(),
+			},
+			err: `CA "b" uses secret name "service-ca-a-root-intermediate" of CA "a"`,
+		},
+		"InvalidNamespacePattern": {
+			profiles: CAProfiles{
+				"compliance": func() CAProfile {
+					p := NamedCAProfile("compliance")
+					p.Namespaces = []string{"tenant-["}
+					return p
+				}(),
+			},
+			err: `CA "compliance": invalid CA namespace pattern "tenant-["`,
+		},
+	}
+
+	for testn, tc := range tests {
+		err := tc.profiles.Validate(DefaultCAProfile())
+		if tc.err == "" {
+			assert.NoError(t, err, testn)
+			continue
+		}
+		require.Error(t, err, testn)
+		assert.Contains(t, err.Error(), tc.err, testn)
+	}
+}
+
+func TestCerts_CAProfilesValidate_DefaultNamespaces(t *testing.T) {
+	profile := DefaultCAProfile()
+	profile.Namespaces = []string{"tenant-*"}
+	err := CAProfiles{}.Validate(profile)
+	require.Error(t, err)
+	assert.Equal(t, "namespaces can only be restricted for named CAs", err.Error())
+}
+
+func TestCerts_CAProfilesLookup(t *testing.T) {
+	profiles := CAProfiles{
+		"compliance": NamedCAProfile("compliance"),
+	}
+	p, err := profiles.Lookup("compliance")
+	require.NoError(t, err)
+	assert.Equal(t, NamedCAProfile("compliance"), p)
+
+	_, err = profiles.Lookup("other")
+	require.Error(t, err)
+	assert.True(t, IsInvalidConfigError(err))
+	assert.Equal(t, `unknown CA "other"`, err.Error())
+}
+
+func TestCerts_CheckSelectable(t *testing.T) {
+	open := NamedCAProfile("open")
+	restricted := NamedCAProfile("restricted")
+	restricted.Namespaces = []string{"tenant-*"}
+
+	tests := map[string]struct {
+		profile   CAProfile
+		namespace string
+		group     string
+		err       string
+	}{
+		"Open": {
+			profile:   open,
+			namespace: "app",
+		},
+		"Open_Group": {
+			profile:   open,
+			namespace: "app",
+			group:     "team-a",
+			err:       `namespace app belongs to CA group team-a and can't select CA "open"`,
+		},
+		"Restricted": {
+			profile:   restricted,
+			namespace: "tenant-a",
+		},
+		"Restricted_Group": {
+			profile:   restricted,
+			namespace: "tenant-a",
+			group:     "team-a",
+		},
+		"Restricted_NotAllowed": {
+			profile:   restricted,
+			namespace: "app",
+			err:       `CA "restricted" can't be selected in namespace app`,
+		},
+	}
+
+	for testn, tc := range tests {
+		err := tc.profile.CheckSelectable(tc.namespace, tc.group)
+		if tc.err == "" {
+			assert.NoError(t, err, testn)
+			continue
+		}
+		require.Error(t, err, testn)
+		assert.True(t, IsInvalidConfigError(err), testn)
+		assert.Equal(t, tc.err, err.Error(), testn)
+	}
+}
+
+func TestCerts_MatchNamespace(t *testing.T) {
+	tests := map[string]struct {
+		patterns []string
+		match    bool
+	}{
+		"NoPatterns": {},
+		"Exact": {
+			patterns: []string{"other", "tenant-a"},
+			match:    true,
+		},
+		"Pattern": {
+			patterns: []string{"tenant-*"},
+			match:    true,
+		},
+		"NoMatch": {
+			patterns: []string{"tenant-b", "app-*"},
+		},
+		"InvalidPattern": {
+			patterns: []string{"tenant-["},
+		},
+	}
+
+	for testn, tc := range tests {
+		assert.Equal(t, tc.match, MatchNamespace(tc.patterns, "tenant-a"), testn)
+	}
+}
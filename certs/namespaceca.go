@@ -0,0 +1,70 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CAGroupLabelKey is the namespace label which selects the CA group of the
+// namespace. Namespaces in the same CA group share a CA. The controller also
+// sets the label on the resources of the CA groups which it creates.
+const CAGroupLabelKey = "service.syn.tools/ca-group"
+
+// GroupProfile returns the CA profile of the CA of CA group `group`. The CA
+// certificate, secret and ClusterIssuer of the group are named after the
+// group.
+func (p *CAProfile) GroupProfile(group string) CAProfile {
+	gp := *p
+	gp.group = group
+	gp.CertificateName = fmt.Sprintf("%s-%s", p.CertificateName, group)
+	gp.SecretName = fmt.Sprintf("%s-%s", p.SecretName, group)
+	gp.IssuerName = fmt.Sprintf("%s-%s", p.IssuerName, group)
+	gp.CommonName = fmt.Sprintf("%s %s", p.CommonName, group)
+	return gp
+}
+
+// GetNamespaceCA returns the trust bundle of the CA of CA group `group` as a
+// string, and ensures that the group's ClusterIssuer exists. The CA
+// certificate of the group and its key are kept in `caNamespace`, like the
+// Service CA. The ClusterIssuer doesn't restrict the namespaces which may
+// use it, CertificateRequests of other namespaces are denied by the
+// CertificateRequest approval.
+// Intended to be called in the reconcile loop. Returns an error if the CA
+// certificate isn't ready yet.
+func GetNamespaceCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, group string) (string, error) {
+	if errs := validation.IsDNS1123Label(group); len(errs) > 0 {
+		return "", invalidConfigErrorf("invalid CA group %q: %v", group, errs)
+	}
+	if group == "intermediate" || group == "staged" {
+		// The names of the group's resources would collide with the
+		// intermediate or staged CA of the profile
+		return "", invalidConfigErrorf("CA group name %q is reserved", group)
+	}
+	log := l.WithValues("caNamespace", caNamespace, "caGroup", group)
+	groupProfile := profile.GroupProfile(group)
+	if err := initializeServiceCA(ctx, log, c, caNamespace, groupProfile); err != nil {
+		return "", err
+	}
+	caSecret, err := readCASecret(ctx, c, log, caNamespace, groupProfile)
+	if err != nil {
+		return "", err
+	}
+	bundle, err := caBundle(caSecret, groupProfile)
+	if err != nil {
+		return "", err
+	}
+	bundle, err = withStagedCA(ctx, c, caNamespace, groupProfile, bundle)
+	if err != nil {
+		return "", err
+	}
+	cm, err := ensureTrustBundle(ctx, c, log, caNamespace, groupProfile, group, bundle)
+	if err != nil {
+		return "", err
+	}
+	return cm.Data[cmmeta.TLSCAKey], nil
+}
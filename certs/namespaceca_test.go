@@ -0,0 +1,117 @@
+package certs
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_GroupProfile(t *testing.T) {
+	profile := DefaultCAProfile()
+	gp := profile.GroupProfile("tenant-a")
+	assert.Equal(t, "service-ca-certificate-tenant-a", gp.CertificateName)
+	assert.Equal(t, "service-ca-root-tenant-a", gp.SecretName)
+	assert.Equal(t, "service-ca tenant-a", gp.CommonName)
+	assert.Equal(t, "service-ca-issuer-tenant-a", gp.IssuerName)
+	assert.Equal(t, profile.SelfSignedIssuerName, gp.SelfSignedIssuerName)
+	assert.Equal(t, cmmeta.ObjectReference{
+		Name:  "service-ca-issuer-tenant-a",
+		Kind:  "ClusterIssuer",
+		Group: "cert-manager.io",
+	}, gp.IssuerRef())
+}
+
+func TestCerts_GetNamespaceCA(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	profile := DefaultCAProfile()
+	gp := profile.GroupProfile("tenant")
+	caObjs := []client.Object{
+		&extv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "certificates.cert-manager.io",
+			},
+		},
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      gp.CertificateName,
+				Namespace: testCANamespace,
+			},
+			Spec: newCACertificate(testCANamespace, gp).Spec,
+			Status: cmapi.CertificateStatus{
+				Conditions: []cmapi.CertificateCondition{
+					{
+						Type:   cmapi.CertificateConditionReady,
+						Status: cmmeta.ConditionTrue,
+					},
+				},
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      gp.SecretName,
+				Namespace: testCANamespace,
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				"tls.crt": []byte("TENANT_CA"),
+				"tls.key": []byte("TENANT_KEY"),
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		group string
+		err   string
+	}{
+		"CreateIssuer": {
+			group: "tenant",
+		},
+		"InvalidGroup": {
+			group: "Tenant_A",
+			err:   `invalid CA group "Tenant_A": [a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')]`,
+		},
+		"ReservedGroup": {
+			group: "staged",
+			err:   `CA group name "staged" is reserved`,
+		},
+	}
+
+	for testn, tc := range tests {
+		c := prepareTest(t, testCfg{
+			initObjs: caObjs,
+		})
+		ca, err := GetNamespaceCA(ctx, c, l, testCANamespace, profile, tc.group)
+		if tc.err != "" {
+			require.Error(t, err, testn)
+			assert.True(t, IsInvalidConfigError(err), testn)
+			assert.Equal(t, tc.err, err.Error(), testn)
+			continue
+		}
+		require.NoError(t, err, testn)
+		assert.Equal(t, "TENANT_CA", ca, testn)
+
+		// The group's ClusterIssuer issues from the CA secret in the
+		// CA namespace
+		iss := cmapi.ClusterIssuer{}
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Name: gp.IssuerName}, &iss), testn)
+		assert.Equal(t, tc.group, iss.Labels[CAGroupLabelKey], testn)
+		assert.Equal(t, &cmapi.CAIssuer{SecretName: gp.SecretName}, iss.Spec.CA, testn)
+		// The default ClusterIssuer isn't touched
+		err = c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &cmapi.ClusterIssuer{})
+		assert.True(t, apierrors.IsNotFound(err), testn)
+		// The self-signed issuer for the group CA is created in the CA
+		// namespace
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: SelfSignedIssuerName}, &cmapi.Issuer{}), testn)
+	}
+}
@@ -0,0 +1,394 @@
+package certs
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// KeystoresAnnotation is the Service annotation which lists the
+	// keystores (`pkcs12`, `jks`) which cert-manager creates in the
+	// certificate secret
+	KeystoresAnnotation = "service.syn.tools/keystores"
+	// KeystorePasswordSecretAnnotation is the Service annotation which
+	// references the secret key holding the keystore password in the form
+	// `<secret name>/<key>` or `<secret name>`
+	KeystorePasswordSecretAnnotation = "service.syn.tools/keystore-password-secret"
+	// AdditionalOutputFormatsAnnotation is the Service annotation which
+	// lists additional output formats (`CombinedPEM`, `DER`) which
+	// cert-manager writes to the certificate secret
+	AdditionalOutputFormatsAnnotation = "service.syn.tools/additional-output-formats"
+	// SecretKeyMappingAnnotation is the Service annotation which renames
+	// keys of the certificate secret, in the form
+	// `<source key>=<target key>,...`
+	SecretKeyMappingAnnotation = "service.syn.tools/secret-key-mapping"
+
+	// MappedSecretLabelKey is the label key for linking the secrets with
+	// renamed keys to the Certificate whose secret they're derived from
+	MappedSecretLabelKey = "service.syn.tools/mapped-certificate"
+	// IssuedSecretSuffix is appended to the certificate secret name of
+	// Services with a secret key mapping. cert-manager writes the
+	// certificate to the secret with the suffix, and the controller
+	// writes the secret with the requested name with the renamed keys.
+	IssuedSecretSuffix = "-issued"
+
+	defaultKeystorePasswordKey = "password"
+)
+
+// certManagerSecretKeys lists the keys which cert-manager may write to a
+// certificate secret
+var certManagerSecretKeys = []string{
+	corev1.TLSCertKey,
+	corev1.TLSPrivateKeyKey,
+	cmmeta.TLSCAKey,
+	"keystore.p12",
+	"truststore.p12",
+	"keystore.jks",
+	"truststore.jks",
+	"tls-combined.pem",
+	"key.der",
+}
+
+// keystoresFromSvc returns the keystores requested in annotation
+// `service.syn.tools/keystores`, protected by the password referenced in
+// annotation `service.syn.tools/keystore-password-secret`.
+func keystoresFromSvc(svc *corev1.Service) (*cmapi.CertificateKeystores, error) {
+	v, ok := svc.Annotations[KeystoresAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	ref, ok := svc.Annotations[KeystorePasswordSecretAnnotation]
+	if !ok {
+		return nil, invalidConfigErrorf("annotation %s requires annotation %s",
+			KeystoresAnnotation, KeystorePasswordSecretAnnotation)
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	password := cmmeta.SecretKeySelector{
+		LocalObjectReference: cmmeta.LocalObjectReference{Name: parts[0]},
+		Key:                  defaultKeystorePasswordKey,
+	}
+	if len(parts) == 2 {
+		password.Key = parts[1]
+	}
+	if errs := validation.IsDNS1123Subdomain(password.Name); len(errs) > 0 {
+		return nil, invalidConfigErrorf("annotation %s: invalid secret name %q", KeystorePasswordSecretAnnotation, password.Name)
+	}
+	if errs := validation.IsConfigMapKey(password.Key); len(errs) > 0 {
+		return nil, invalidConfigErrorf("annotation %s: invalid secret key %q", KeystorePasswordSecretAnnotation, password.Key)
+	}
+
+	keystores := &cmapi.CertificateKeystores{}
+	for _, entry := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(entry)) {
+		case "":
+		case "pkcs12":
+			keystores.PKCS12 = &cmapi.PKCS12Keystore{Create: true, PasswordSecretRef: password}
+		case "jks":
+			keystores.JKS = &cmapi.JKSKeystore{Create: true, PasswordSecretRef: password}
+		default:
+			return nil, invalidConfigErrorf("annotation %s: unknown keystore type %q, must be pkcs12 or jks",
+				KeystoresAnnotation, entry)
+		}
+	}
+	if keystores.PKCS12 == nil && keystores.JKS == nil {
+		return nil, nil
+	}
+	return keystores, nil
+}
+
+// additionalOutputFormatsFromSvc returns the additional output formats
+// requested in annotation `service.syn.tools/additional-output-formats`.
+func additionalOutputFormatsFromSvc(svc *corev1.Service) ([]cmapi.CertificateAdditionalOutputFormat, error) {
+	v, ok := svc.Annotations[AdditionalOutputFormatsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var formats []cmapi.CertificateAdditionalOutputFormat
+	seen := map[cmapi.CertificateOutputFormatType]bool{}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var f cmapi.CertificateOutputFormatType
+		switch strings.ToLower(entry) {
+		case "combinedpem":
+			f = cmapi.CertificateOutputFormatCombinedPEM
+		case "der":
+			f = cmapi.CertificateOutputFormatDER
+		default:
+			return nil, invalidConfigErrorf("annotation %s: unknown output format %q, must be CombinedPEM or DER",
+				AdditionalOutputFormatsAnnotation, entry)
+		}
+		if !seen[f] {
+			seen[f] = true
+			formats = append(formats, cmapi.CertificateAdditionalOutputFormat{Type: f})
+		}
+	}
+	return formats, nil
+}
+
+// secretKeyMappingFromSvc parses annotation
+// `service.syn.tools/secret-key-mapping` into a map from target key to
+// source key.
+func secretKeyMappingFromSvc(svc *corev1.Service) (map[string]string, error) {
+	v, ok := svc.Annotations[SecretKeyMappingAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	mapping := map[string]string{}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, invalidConfigErrorf("annotation %s: entry %q must have the form `<source key>=<target key>`",
+				SecretKeyMappingAnnotation, entry)
+		}
+		src, dst := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !containsString(certManagerSecretKeys, src) {
+			return nil, invalidConfigErrorf("annotation %s: unknown source key %q, must be one of %s",
+				SecretKeyMappingAnnotation, src, strings.Join(certManagerSecretKeys, ", "))
+		}
+		if errs := validation.IsConfigMapKey(dst); len(errs) > 0 {
+			return nil, invalidConfigErrorf("annotation %s: invalid target key %q", SecretKeyMappingAnnotation, dst)
+		}
+		if containsString(certManagerSecretKeys, dst) {
+			return nil, invalidConfigErrorf("annotation %s: target key %q is managed by cert-manager",
+				SecretKeyMappingAnnotation, dst)
+		}
+		if _, ok := mapping[dst]; ok {
+			return nil, invalidConfigErrorf("annotation %s: duplicate target key %q", SecretKeyMappingAnnotation, dst)
+		}
+		mapping[dst] = src
+	}
+	return mapping, nil
+}
+
+// issuedSecretName returns the name of the secret which cert-manager writes
+// for the certificate secret `secretName` of the Service. cert-manager
+// requires its keys in the secret, so the keys can't be renamed in place.
+// If the Service requests a secret key mapping, cert-manager writes to a
+// separate secret, see ApplySecretKeyMapping().
+func issuedSecretName(svc *corev1.Service, secretName string) (string, error) {
+	mapping, err := secretKeyMappingFromSvc(svc)
+	if err != nil {
+		return "", err
+	}
+	if len(mapping) == 0 {
+		return secretName, nil
+	}
+	return secretName + IssuedSecretSuffix, nil
+}
+
+// ApplySecretKeyMapping writes the certificate secrets of the Service with
+// the keys renamed as requested in annotation
+// `service.syn.tools/secret-key-mapping`. For each Certificate of the
+// Service, cert-manager writes the secret with suffix `-issued`, and the
+// controller copies it to the secret with the requested name, renaming the
+// mapped keys. The secrets with renamed keys are controlled by the
+// Certificate, and they're deleted if the mapping is removed, so that
+// cert-manager writes the requested secret again.
+func ApplySecretKeyMapping(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, scheme *runtime.Scheme) error {
+	mapping, err := secretKeyMappingFromSvc(&svc)
+	if err != nil {
+		return err
+	}
+
+	certs, err := serviceCertificates(ctx, c, &svc)
+	if err != nil {
+		return err
+	}
+	for i := range certs {
+		cert := &certs[i]
+		if len(mapping) == 0 || !strings.HasSuffix(cert.Spec.SecretName, IssuedSecretSuffix) {
+			if err := deleteMappedSecrets(ctx, l, c, cert); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := applySecretKeyMapping(ctx, l, c, &svc, cert, mapping, scheme); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySecretKeyMapping(ctx context.Context, l logr.Logger, c client.Client, svc *corev1.Service, cert *cmapi.Certificate, mapping map[string]string, scheme *runtime.Scheme) error {
+	name := strings.TrimSuffix(cert.Spec.SecretName, IssuedSecretSuffix)
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: cert.Namespace, Name: name}, &secret)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	if exists {
+		if err := checkMappedSecretOwnership(svc, cert, &secret); err != nil {
+			return err
+		}
+	}
+
+	issued := corev1.Secret{}
+	err = c.Get(ctx, client.ObjectKey{Namespace: cert.Namespace, Name: cert.Spec.SecretName}, &issued)
+	if errors.IsNotFound(err) {
+		if exists {
+			// Keep the certificate secret which cert-manager wrote
+			// before the mapping was requested until cert-manager has
+			// issued the certificate into the new secret, but make sure
+			// that it isn't cleaned up as a stale secret.
+			return updateMappedSecret(ctx, c, svc, cert, &secret, secret.Data, secret.Type, scheme)
+		}
+		// cert-manager hasn't issued the certificate yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data := map[string][]byte{}
+	for k, v := range issued.Data {
+		if !mapsSource(mapping, k) {
+			data[k] = v
+		}
+	}
+	for dst, src := range mapping {
+		if v, ok := issued.Data[src]; ok {
+			data[dst] = v
+		}
+	}
+	secretType := corev1.SecretTypeOpaque
+	if _, ok := data[corev1.TLSCertKey]; ok && issued.Type == corev1.SecretTypeTLS {
+		if _, ok := data[corev1.TLSPrivateKeyKey]; ok {
+			secretType = corev1.SecretTypeTLS
+		}
+	}
+	for k, v := range issued.Annotations {
+		if strings.HasPrefix(k, "cert-manager.io/") {
+			if secret.Annotations == nil {
+				secret.Annotations = map[string]string{}
+			}
+			secret.Annotations[k] = v
+		}
+	}
+
+	if !exists {
+		l.Info("Creating certificate secret with mapped keys", "secret", name)
+		secret.Name = name
+		secret.Namespace = cert.Namespace
+		return updateMappedSecret(ctx, c, svc, cert, &secret, data, secretType, scheme)
+	}
+	if secret.Type != secretType {
+		// The type of a secret can't be changed
+		l.Info("Recreating certificate secret with mapped keys", "secret", name)
+		if err := c.Delete(ctx, &secret); err != nil {
+			return err
+		}
+		secret = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   cert.Namespace,
+				Annotations: secret.Annotations,
+			},
+		}
+	}
+	return updateMappedSecret(ctx, c, svc, cert, &secret, data, secretType, scheme)
+}
+
+// updateMappedSecret sets the data, the labels and the controller of the
+// secret with mapped keys, and creates or updates the secret if it changed
+func updateMappedSecret(ctx context.Context, c client.Client, svc *corev1.Service, cert *cmapi.Certificate, secret *corev1.Secret, data map[string][]byte, secretType corev1.SecretType, scheme *runtime.Scheme) error {
+	orig := secret.DeepCopy()
+	secret.Data = data
+	secret.Type = secretType
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	// The secret is no longer written by cert-manager
+	delete(secret.Labels, ServiceCertSecretLabelKey)
+	delete(secret.Annotations, CleanupAfterAnnotation)
+	secret.Labels[MappedSecretLabelKey] = cert.Name
+	secret.Labels[ServiceNameLabelKey] = svc.Name
+	if err := controllerutil.SetControllerReference(cert, secret, scheme); err != nil {
+		return err
+	}
+	if secret.ResourceVersion == "" {
+		return c.Create(ctx, secret)
+	}
+	if reflect.DeepEqual(orig, secret) {
+		return nil
+	}
+	return c.Update(ctx, secret)
+}
+
+// checkMappedSecretOwnership verifies that the existing secret may be
+// written with the mapped keys of the Certificate. Secrets which weren't
+// written for the Certificate are only used if the Service sets annotation
+// `service.syn.tools/adopt-existing`.
+func checkMappedSecretOwnership(svc *corev1.Service, cert *cmapi.Certificate, secret *corev1.Secret) error {
+	if secret.Labels[MappedSecretLabelKey] == cert.Name ||
+		secret.Labels[ServiceCertSecretLabelKey] == cert.Name {
+		return nil
+	}
+	adopt, err := adoptExisting(svc)
+	if err != nil {
+		return err
+	}
+	if !adopt {
+		return invalidConfigErrorf("secret %s already exists, set annotation %s to adopt it",
+			secret.Name, AdoptExistingAnnotation)
+	}
+	return nil
+}
+
+// deleteMappedSecrets deletes the secrets with mapped keys of the
+// Certificate. If the secret key mapping was removed, cert-manager then
+// writes the Certificate's secret again.
+func deleteMappedSecrets(ctx context.Context, l logr.Logger, c client.Client, cert *cmapi.Certificate) error {
+	secrets := corev1.SecretList{}
+	if err := c.List(ctx, &secrets, client.InNamespace(cert.Namespace),
+		client.MatchingLabels{MappedSecretLabelKey: cert.Name}); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		l.Info("Deleting certificate secret with mapped keys", "secret", secret.Name)
+		if err := c.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapsSource returns true if `key` is the source key of an entry of the
+// secret key mapping
+func mapsSource(mapping map[string]string, key string) bool {
+	for _, src := range mapping {
+		if src == key {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package certs
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestCerts_keystoresFromSvc(t *testing.T) {
+	password := cmmeta.SecretKeySelector{
+		LocalObjectReference: cmmeta.LocalObjectReference{Name: "keystore-pw"},
+		Key:                  "password",
+	}
+	tests := map[string]struct {
+		annotations map[string]string
+		keystores   *cmapi.CertificateKeystores
+		invalid     bool
+	}{
+		"NoAnnotation": {},
+		"PKCS12": {
+			annotations: map[string]string{
+				KeystoresAnnotation:              "pkcs12",
+				KeystorePasswordSecretAnnotation: "keystore-pw",
+			},
+			keystores: &cmapi.CertificateKeystores{
+				PKCS12: &cmapi.PKCS12Keystore{Create: true, PasswordSecretRef: password},
+			},
+		},
+		"Both_CustomKey": {
+			annotations: map[string]string{
+				KeystoresAnnotation:              "PKCS12, jks",
+				KeystorePasswordSecretAnnotation: "keystore-pw/pass",
+			},
+			keystores: &cmapi.CertificateKeystores{
+				PKCS12: &cmapi.PKCS12Keystore{Create: true, PasswordSecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: password.LocalObjectReference,
+					Key:                  "pass",
+				}},
+				JKS: &cmapi.JKSKeystore{Create: true, PasswordSecretRef: cmmeta.SecretKeySelector{
+					LocalObjectReference: password.LocalObjectReference,
+					Key:                  "pass",
+				}},
+			},
+		},
+		"MissingPassword": {
+			annotations: map[string]string{
+				KeystoresAnnotation: "jks",
+			},
+			invalid: true,
+		},
+		"InvalidPasswordSecret": {
+			annotations: map[string]string{
+				KeystoresAnnotation:              "jks",
+				KeystorePasswordSecretAnnotation: "Keystore_PW",
+			},
+			invalid: true,
+		},
+		"UnknownType": {
+			annotations: map[string]string{
+				KeystoresAnnotation:              "pem",
+				KeystorePasswordSecretAnnotation: "keystore-pw",
+			},
+			invalid: true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		svc.Annotations = tc.annotations
+		keystores, err := keystoresFromSvc(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.keystores, keystores, testn)
+		}
+	}
+}
+
+func TestCerts_additionalOutputFormatsFromSvc(t *testing.T) {
+	tests := map[string]struct {
+		annotation *string
+		formats    []cmapi.CertificateAdditionalOutputFormat
+		invalid    bool
+	}{
+		"NoAnnotation": {},
+		"Both": {
+			annotation: strPtr("CombinedPEM, der, DER"),
+			formats: []cmapi.CertificateAdditionalOutputFormat{
+				{Type: cmapi.CertificateOutputFormatCombinedPEM},
+				{Type: cmapi.CertificateOutputFormatDER},
+			},
+		},
+		"Unknown": {
+			annotation: strPtr("PEM"),
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				AdditionalOutputFormatsAnnotation: *tc.annotation,
+			}
+		}
+		formats, err := additionalOutputFormatsFromSvc(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.formats, formats, testn)
+		}
+	}
+}
+
+func TestCerts_secretKeyMappingFromSvc(t *testing.T) {
+	tests := map[string]struct {
+		annotation *string
+		mapping    map[string]string
+		invalid    bool
+	}{
+		"NoAnnotation": {},
+		"PEM": {
+			annotation: strPtr("tls.crt=cert.pem, tls.key=key.pem"),
+			mapping: map[string]string{
+				"cert.pem": "tls.crt",
+				"key.pem":  "tls.key",
+			},
+		},
+		"Malformed": {
+			annotation: strPtr("tls.crt:cert.pem"),
+			invalid:    true,
+		},
+		"UnknownSource": {
+			annotation: strPtr("cert=cert.pem"),
+			invalid:    true,
+		},
+		"InvalidTarget": {
+			annotation: strPtr("tls.crt=cert/pem"),
+			invalid:    true,
+		},
+		"ManagedTarget": {
+			annotation: strPtr("tls.key=tls.crt"),
+			invalid:    true,
+		},
+		"DuplicateTarget": {
+			annotation: strPtr("tls.crt=cert.pem,ca.crt=cert.pem"),
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				SecretKeyMappingAnnotation: *tc.annotation,
+			}
+		}
+		mapping, err := secretKeyMappingFromSvc(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.mapping, mapping, testn)
+		}
+	}
+}
+
+func TestCerts_updateCertificate_OutputFormats(t *testing.T) {
+	cert := cmapi.Certificate{}
+	cert.Name = "test-cert"
+	svc := prepareService("test-svc", "test-ns")
+	svc.Annotations = map[string]string{
+		KeystoresAnnotation:               "pkcs12",
+		KeystorePasswordSecretAnnotation:  "keystore-pw",
+		AdditionalOutputFormatsAnnotation: "DER",
+	}
+	err := updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+	require.NoError(t, err)
+	require.NotNil(t, cert.Spec.Keystores)
+	assert.NotNil(t, cert.Spec.Keystores.PKCS12)
+	assert.Nil(t, cert.Spec.Keystores.JKS)
+	assert.Equal(t, []cmapi.CertificateAdditionalOutputFormat{
+		{Type: cmapi.CertificateOutputFormatDER},
+	}, cert.Spec.AdditionalOutputFormats)
+
+	svc.Annotations = map[string]string{
+		SecretKeyMappingAnnotation: "tls.crt",
+	}
+	err = updateCertificate(&cert, svc, scheme, DefaultConfig(), testIssuerRef)
+	assert.True(t, IsInvalidConfigError(err))
+}
+
+func TestCerts_ApplySecretKeyMapping(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+
+	svc := prepareService("test-svc", "test-ns")
+	svc.UID = types.UID("0d5c2b4e-7f7e-4c35-9a51-2f0e4f7a9c01")
+	svc.Annotations = map[string]string{
+		SecretKeyMappingAnnotation: "tls.crt=cert.pem,tls.key=key.pem",
+	}
+	issuedName, err := issuedSecretName(&svc, "test-svc-tls")
+	require.NoError(t, err)
+	assert.Equal(t, "test-svc-tls-issued", issuedName)
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CertificateName("test-svc"),
+			Namespace: "test-ns",
+			UID:       types.UID("5b0f2d3c-1a9e-4d8b-8f5e-6c7d8e9f0a12"),
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: issuedName,
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, cert, scheme))
+	// The secret which cert-manager wrote before the mapping was requested
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-tls",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				ServiceCertSecretLabelKey: cert.Name,
+				ServiceNameLabelKey:       "test-svc",
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": []byte("old cert"),
+			"tls.key": []byte("old key"),
+		},
+	}
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{&svc, cert, secret},
+	})
+
+	// The previous secret is kept until cert-manager issues the
+	// certificate
+	require.NoError(t, ApplySecretKeyMapping(ctx, l, c, svc, scheme))
+	updated := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(secret), &updated))
+	assert.Equal(t, secret.Data, updated.Data)
+	assert.Equal(t, map[string]string{
+		MappedSecretLabelKey: cert.Name,
+		ServiceNameLabelKey:  "test-svc",
+	}, updated.Labels)
+	assert.True(t, metav1.IsControlledBy(&updated, cert))
+
+	// The mapped keys are renamed
+	require.NoError(t, c.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      issuedName,
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				ServiceCertSecretLabelKey: cert.Name,
+				ServiceNameLabelKey:       "test-svc",
+			},
+			Annotations: map[string]string{
+				cmapi.CertificateNameKey: cert.Name,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": []byte("cert"),
+			"tls.key": []byte("key"),
+			"ca.crt":  []byte("ca"),
+		},
+	}))
+	require.NoError(t, ApplySecretKeyMapping(ctx, l, c, svc, scheme))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(secret), &updated))
+	assert.Equal(t, map[string][]byte{
+		"cert.pem": []byte("cert"),
+		"key.pem":  []byte("key"),
+		"ca.crt":   []byte("ca"),
+	}, updated.Data)
+	assert.Equal(t, corev1.SecretTypeOpaque, updated.Type)
+	assert.Equal(t, cert.Name, updated.Annotations[cmapi.CertificateNameKey])
+	assert.True(t, metav1.IsControlledBy(&updated, cert))
+
+	// Removing the annotation removes the secret with the mapped keys, so
+	// that cert-manager writes the secret again
+	svc.Annotations = nil
+	cert.Spec.SecretName = "test-svc-tls"
+	require.NoError(t, c.Update(ctx, cert))
+	require.NoError(t, ApplySecretKeyMapping(ctx, l, c, svc, scheme))
+	err = c.Get(ctx, client.ObjectKeyFromObject(secret), &updated)
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCerts_ApplySecretKeyMapping_ExistingSecret(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+
+	svc := prepareService("test-svc", "test-ns")
+	svc.UID = types.UID("0d5c2b4e-7f7e-4c35-9a51-2f0e4f7a9c01")
+	svc.Annotations = map[string]string{
+		SecretKeyMappingAnnotation: "tls.crt=cert.pem",
+	}
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CertificateName("test-svc"),
+			Namespace: "test-ns",
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: "test-svc-tls" + IssuedSecretSuffix,
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, cert, scheme))
+	other := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-tls",
+			Namespace: "test-ns",
+		},
+	}
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{&svc, cert, other},
+	})
+
+	err := ApplySecretKeyMapping(ctx, l, c, svc, scheme)
+	assert.True(t, IsInvalidConfigError(err))
+}
@@ -0,0 +1,93 @@
+package certs
+
+import (
+	"context"
+	"strconv"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AdoptExistingAnnotation is the Service annotation which allows the
+// controller to take over an existing Certificate or secret which wasn't
+// created for the Service
+const AdoptExistingAnnotation = "service.syn.tools/adopt-existing"
+
+// adoptExisting returns whether the Service allows adopting existing
+// Certificates and secrets
+func adoptExisting(svc *corev1.Service) (bool, error) {
+	v, ok := svc.Annotations[AdoptExistingAnnotation]
+	if !ok {
+		return false, nil
+	}
+	adopt, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, invalidConfigErrorf("annotation %s: %q is not a boolean", AdoptExistingAnnotation, v)
+	}
+	return adopt, nil
+}
+
+// checkCertificateOwnership verifies that the existing Certificate `cert`
+// may be managed for the Service. Certificates controlled by another object
+// are never taken over. Certificates without a controller are only taken
+// over if the Service sets annotation `service.syn.tools/adopt-existing`.
+func checkCertificateOwnership(svc *corev1.Service, cert *cmapi.Certificate) error {
+	if metav1.IsControlledBy(cert, svc) {
+		return nil
+	}
+	if owner := metav1.GetControllerOf(cert); owner != nil {
+		return invalidConfigErrorf("Certificate %s is managed by %s %s",
+			cert.Name, owner.Kind, owner.Name)
+	}
+	adopt, err := adoptExisting(svc)
+	if err != nil {
+		return err
+	}
+	if !adopt {
+		return invalidConfigErrorf("Certificate %s already exists, set annotation %s to adopt it",
+			cert.Name, AdoptExistingAnnotation)
+	}
+	return nil
+}
+
+// checkSecretOwnership verifies that the secret `secretName` may be used by
+// the Certificate `certName` of the Service. The secret must not be used by
+// another Certificate. Existing secrets which weren't issued for the
+// Certificate are only used if the Service sets annotation
+// `service.syn.tools/adopt-existing`.
+func checkSecretOwnership(ctx context.Context, c client.Client, svc *corev1.Service, certName, secretName string) error {
+	certs := cmapi.CertificateList{}
+	if err := c.List(ctx, &certs, client.InNamespace(svc.Namespace)); err != nil {
+		return err
+	}
+	for _, cert := range certs.Items {
+		if cert.Name != certName && cert.Spec.SecretName == secretName {
+			return invalidConfigErrorf("secret %s is used by Certificate %s", secretName, cert.Name)
+		}
+	}
+
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: svc.Namespace, Name: secretName}, &secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if secret.Labels[ServiceCertSecretLabelKey] == certName ||
+		secret.Annotations[cmapi.CertificateNameKey] == certName {
+		return nil
+	}
+	adopt, err := adoptExisting(svc)
+	if err != nil {
+		return err
+	}
+	if !adopt {
+		return invalidConfigErrorf("secret %s already exists, set annotation %s to adopt it",
+			secretName, AdoptExistingAnnotation)
+	}
+	return nil
+}
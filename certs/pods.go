@@ -0,0 +1,203 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PodCertServiceLabelKey is the label key which links a per-pod
+	// Certificate to the headless service for which it was issued
+	PodCertServiceLabelKey = "service.syn.tools/pod-certificate-service"
+	// PodCertPodLabelKey is the label key which holds the name of the pod
+	// for which a per-pod Certificate was issued
+	PodCertPodLabelKey = "service.syn.tools/pod-certificate-pod"
+)
+
+// PodCertificateName returns the name for the Certificate resource belonging
+// to pod `podName` behind the headless service with name `svcName`. Service
+// names can't contain dots, so the name can't collide with the Certificate
+// `<service>-tls` of a Service, nor with the per-pod Certificates of
+// another Service.
+func PodCertificateName(svcName, podName string) string {
+	return fmt.Sprintf("%s.%s-tls", svcName, podName)
+}
+
+// PodSecretName returns the name of the certificate secret for pod
+// `podName`, given the secret name requested for the headless service
+func PodSecretName(secretName, podName string) string {
+	return fmt.Sprintf("%s-%s", secretName, podName)
+}
+
+// StatefulSetPods returns the names of the pods of all StatefulSets which
+// use the headless service as their governing service. Returns no pods for
+// services which aren't headless.
+func StatefulSetPods(ctx context.Context, c client.Client, svc *corev1.Service) ([]string, error) {
+	if !IsHeadless(svc) {
+		return nil, nil
+	}
+	stsList := appsv1.StatefulSetList{}
+	if err := c.List(ctx, &stsList, client.InNamespace(svc.Namespace)); err != nil {
+		return nil, err
+	}
+	pods := []string{}
+	for _, sts := range stsList.Items {
+		if sts.Spec.ServiceName != svc.Name {
+			continue
+		}
+		replicas := int32(1)
+		if sts.Spec.Replicas != nil {
+			replicas = *sts.Spec.Replicas
+		}
+		for i := int32(0); i < replicas; i++ {
+			pods = append(pods, fmt.Sprintf("%s-%d", sts.Name, i))
+		}
+	}
+	return pods, nil
+}
+
+// ReconcilePodCertificates creates or updates a Certificate resource for each
+// pod in `pods`, which are the pods of StatefulSets which use the headless
+// service `svc` as their governing service. Per-pod Certificates of the
+// service for pods which aren't in `pods` are deleted together with their
+// secrets. The stale Certificates are deleted first, so that the secrets of
+// Certificates which were created under a previous naming scheme are
+// reissued for the Certificates with the current names.
+func ReconcilePodCertificates(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, secretName string, pods []string, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) error {
+	wanted := map[string]bool{}
+	for _, pod := range pods {
+		wanted[PodCertificateName(svc.Name, pod)] = true
+	}
+
+	existing := cmapi.CertificateList{}
+	if err := c.List(ctx, &existing, client.InNamespace(svc.Namespace),
+		client.MatchingLabels{PodCertServiceLabelKey: svc.Name}); err != nil {
+		return err
+	}
+	for i := range existing.Items {
+		cert := &existing.Items[i]
+		if wanted[cert.Name] || !metav1.IsControlledBy(cert, &svc) {
+			continue
+		}
+		l.Info("Deleting per-pod certificate for removed pod", "certificate", cert.Name)
+		if err := deleteCertificateAndSecret(ctx, c, cert); err != nil {
+			return err
+		}
+	}
+
+	for _, pod := range pods {
+		if err := createPodCertificate(ctx, l, c, svc, pod, secretName, scheme, cfg, issuer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createPodCertificate(ctx context.Context, l logr.Logger, c client.Client, svc corev1.Service, podName, secretName string, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) error {
+	certName := PodCertificateName(svc.Name, podName)
+	podSecretName, err := issuedSecretName(&svc, PodSecretName(secretName, podName))
+	if err != nil {
+		return err
+	}
+	if err := checkSecretOwnership(ctx, c, &svc, certName, podSecretName); err != nil {
+		return err
+	}
+
+	cert := cmapi.Certificate{}
+	err = c.Get(ctx, client.ObjectKey{
+		Name:      certName,
+		Namespace: svc.Namespace,
+	}, &cert)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		l.V(1).Info("Per-pod certificate resource doesn't exist, creating", "certificate", certName)
+		cert = cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      certName,
+				Namespace: svc.Namespace,
+			},
+			Spec: cmapi.CertificateSpec{
+				SecretName: podSecretName,
+			},
+		}
+		if err := updatePodCertificate(&cert, svc, podName, scheme, cfg, issuer); err != nil {
+			return err
+		}
+		return c.Create(ctx, &cert)
+	}
+
+	if err := checkCertificateOwnership(&svc, &cert); err != nil {
+		return err
+	}
+
+	origCert := cert.DeepCopy()
+	cert.Spec.SecretName = podSecretName
+	if err := updatePodCertificate(&cert, svc, podName, scheme, cfg, issuer); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(*origCert, cert) {
+		l.V(1).Info("Applying changes to existing per-pod certificate", "certificate", certName)
+		return c.Update(ctx, &cert)
+	}
+	return nil
+}
+
+// updatePodCertificate configures the per-pod Certificate like the
+// service's Certificate, and adds the DNS names of the pod's DNS record.
+func updatePodCertificate(cert *cmapi.Certificate, svc corev1.Service, podName string, scheme *runtime.Scheme, cfg Config, issuer cmmeta.ObjectReference) error {
+	if err := updateCertificate(cert, svc, scheme, cfg, issuer); err != nil {
+		return err
+	}
+	podHost := fmt.Sprintf("%s.%s", podName, svc.Name)
+	podDNSNames := cfg.dropUnpermittedDNSNames([]string{
+		podHost,
+		fmt.Sprintf("%s.%s", podHost, svc.Namespace),
+		fmt.Sprintf("%s.%s.svc", podHost, svc.Namespace),
+		fmt.Sprintf("%s.%s.svc.%s", podHost, svc.Namespace, cfg.ClusterDomain),
+	})
+	cert.Spec.DNSNames = appendUnique(podDNSNames, cert.Spec.DNSNames...)
+
+	if cert.Labels == nil {
+		cert.Labels = map[string]string{}
+	}
+	cert.Labels[PodCertServiceLabelKey] = svc.Name
+	cert.Labels[PodCertPodLabelKey] = podName
+	return nil
+}
+
+// deleteCertificateAndSecret deletes the Certificate and the secret which
+// cert-manager created for it
+func deleteCertificateAndSecret(ctx context.Context, c client.Client, cert *cmapi.Certificate) error {
+	if err := c.Delete(ctx, cert); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: cert.Namespace, Name: cert.Spec.SecretName}, &secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if secret.Labels[ServiceCertSecretLabelKey] != cert.Name {
+		// Not the secret which cert-manager created for this certificate
+		return nil
+	}
+	if err := c.Delete(ctx, &secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
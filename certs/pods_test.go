@@ -0,0 +1,127 @@
+package certs
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestCerts_PodCertificateName(t *testing.T) {
+	assert.Equal(t, "etcd.etcd-0-tls", PodCertificateName("etcd", "etcd-0"))
+	assert.Equal(t, "etcd-tls-etcd-0", PodSecretName("etcd-tls", "etcd-0"))
+}
+
+func TestCerts_ReconcilePodCertificates(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+
+	svc := prepareService("etcd", "test-ns")
+	svc.UID = types.UID("6d1a4a5e-5d4c-4bd6-9f0e-3ad0a6b1c001")
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	svc.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+
+	stale := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodCertificateName("etcd", "etcd-2"),
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				PodCertServiceLabelKey: "etcd",
+				PodCertPodLabelKey:     "etcd-2",
+			},
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: PodSecretName("etcd-tls", "etcd-2"),
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, stale, scheme))
+	staleSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodSecretName("etcd-tls", "etcd-2"),
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				ServiceCertSecretLabelKey: stale.Name,
+			},
+		},
+	}
+	// A certificate with the name which was used for per-pod
+	// certificates before
+	legacy := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "etcd-etcd-0-tls",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				PodCertServiceLabelKey: "etcd",
+				PodCertPodLabelKey:     "etcd-0",
+			},
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: PodSecretName("etcd-tls", "etcd-0"),
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(&svc, legacy, scheme))
+	legacySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PodSecretName("etcd-tls", "etcd-0"),
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				ServiceCertSecretLabelKey: legacy.Name,
+			},
+		},
+	}
+	// A certificate with the pod label which isn't owned by the service
+	foreign := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foreign-tls",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				PodCertServiceLabelKey: "etcd",
+			},
+		},
+	}
+
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{&svc, stale, staleSecret, legacy, legacySecret, foreign},
+	})
+
+	err := ReconcilePodCertificates(ctx, l, c, svc, "etcd-tls", []string{"etcd-0", "etcd-1"}, scheme, DefaultConfig(), testIssuerRef)
+	require.NoError(t, err)
+
+	for _, pod := range []string{"etcd-0", "etcd-1"} {
+		cert := cmapi.Certificate{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: PodCertificateName("etcd", pod)}, &cert)
+		require.NoError(t, err, pod)
+		assert.Equal(t, PodSecretName("etcd-tls", pod), cert.Spec.SecretName)
+		assert.Equal(t, []string{
+			pod + ".etcd",
+			pod + ".etcd.test-ns",
+			pod + ".etcd.test-ns.svc",
+			pod + ".etcd.test-ns.svc.cluster.local",
+			"etcd",
+			"etcd.test-ns",
+			"etcd.test-ns.svc",
+			"etcd.test-ns.svc.cluster.local",
+		}, cert.Spec.DNSNames)
+		assert.Nil(t, cert.Spec.IPAddresses)
+		assert.Equal(t, pod, cert.Labels[PodCertPodLabelKey])
+		assert.True(t, metav1.IsControlledBy(&cert, &svc))
+	}
+
+	err = c.Get(ctx, client.ObjectKeyFromObject(stale), &cmapi.Certificate{})
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKeyFromObject(staleSecret), &corev1.Secret{})
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKeyFromObject(legacy), &cmapi.Certificate{})
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKeyFromObject(foreign), &cmapi.Certificate{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,181 @@
+package certs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// PrivateKeyAlgorithmAnnotation is the Service annotation which sets
+	// the private key algorithm (`RSA`, `ECDSA` or `Ed25519`)
+	PrivateKeyAlgorithmAnnotation = "service.syn.tools/private-key-algorithm"
+	// PrivateKeySizeAnnotation is the Service annotation which sets the
+	// private key size in bits
+	PrivateKeySizeAnnotation = "service.syn.tools/private-key-size"
+	// PrivateKeyEncodingAnnotation is the Service annotation which sets
+	// the private key encoding (`PKCS1` or `PKCS8`)
+	PrivateKeyEncodingAnnotation = "service.syn.tools/private-key-encoding"
+	// PrivateKeyRotationPolicyAnnotation is the Service annotation which
+	// sets the private key rotation policy (`Never` or `Always`)
+	PrivateKeyRotationPolicyAnnotation = "service.syn.tools/private-key-rotation-policy"
+)
+
+// PrivateKeySpec identifies a private key type by algorithm and size
+type PrivateKeySpec struct {
+	Algorithm cmapi.PrivateKeyAlgorithm
+	// Size is the key size in bits. Always 0 for Ed25519.
+	Size int
+}
+
+func (s PrivateKeySpec) String() string {
+	if s.Algorithm == cmapi.Ed25519KeyAlgorithm {
+		return string(s.Algorithm)
+	}
+	return fmt.Sprintf("%s-%d", s.Algorithm, s.Size)
+}
+
+// DefaultAllowedPrivateKeys is the list of private key types which Services
+// may request if the controller isn't configured otherwise
+const DefaultAllowedPrivateKeys = "RSA-2048,RSA-3072,RSA-4096,ECDSA-256,ECDSA-384,ECDSA-521,Ed25519"
+
+// ParsePrivateKeySpecs parses a comma-separated list of private key types.
+// Each entry has the form `<algorithm>-<size>`, or just `Ed25519`.
+func ParsePrivateKeySpecs(list string) ([]PrivateKeySpec, error) {
+	specs := []PrivateKeySpec{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "-", 2)
+		size := ""
+		if len(parts) == 2 {
+			size = parts[1]
+		}
+		spec, err := privateKeySpec(parts[0], size)
+		if err != nil {
+			return nil, fmt.Errorf("private key type %q: %w", entry, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// privateKeySpec parses and validates a private key algorithm and size. If
+// `size` is empty, the default size for the algorithm is used.
+func privateKeySpec(alg, size string) (PrivateKeySpec, error) {
+	spec := PrivateKeySpec{}
+	switch strings.ToLower(alg) {
+	case "", "rsa":
+		spec.Algorithm = cmapi.RSAKeyAlgorithm
+		spec.Size = 2048
+	case "ecdsa":
+		spec.Algorithm = cmapi.ECDSAKeyAlgorithm
+		spec.Size = 256
+	case "ed25519":
+		spec.Algorithm = cmapi.Ed25519KeyAlgorithm
+		if size != "" {
+			return spec, fmt.Errorf("algorithm Ed25519 doesn't support a key size")
+		}
+		return spec, nil
+	default:
+		return spec, fmt.Errorf("unknown private key algorithm %q", alg)
+	}
+	if size == "" {
+		return spec, nil
+	}
+	s, err := strconv.Atoi(size)
+	if err != nil {
+		return spec, fmt.Errorf("invalid key size %q", size)
+	}
+	spec.Size = s
+	switch spec.Algorithm {
+	case cmapi.RSAKeyAlgorithm:
+		if s < 2048 || s > 8192 {
+			return spec, fmt.Errorf("RSA key size must be between 2048 and 8192")
+		}
+	case cmapi.ECDSAKeyAlgorithm:
+		if s != 256 && s != 384 && s != 521 {
+			return spec, fmt.Errorf("ECDSA key size must be one of 256, 384 or 521")
+		}
+	}
+	return spec, nil
+}
+
+// privateKeyFromSvc returns the private key configuration requested by the
+// annotations on the Service. Returns nil if the Service doesn't request a
+// specific private key and no default rotation policy is configured, in
+// which case cert-manager's defaults apply. The effective key type, which is
+// cert-manager's default RSA-2048 if the Service doesn't set the algorithm
+// or size, must be allowed in any case.
+func privateKeyFromSvc(svc *corev1.Service, cfg Config) (*cmapi.CertificatePrivateKey, error) {
+	alg, hasAlg := svc.Annotations[PrivateKeyAlgorithmAnnotation]
+	size, hasSize := svc.Annotations[PrivateKeySizeAnnotation]
+	encoding, hasEncoding := svc.Annotations[PrivateKeyEncodingAnnotation]
+	policy, hasPolicy := svc.Annotations[PrivateKeyRotationPolicyAnnotation]
+
+	spec, err := privateKeySpec(alg, size)
+	if err != nil {
+		return nil, invalidConfigErrorf("annotations %s/%s: %v",
+			PrivateKeyAlgorithmAnnotation, PrivateKeySizeAnnotation, err)
+	}
+	if !cfg.isPrivateKeyAllowed(spec) {
+		return nil, invalidConfigErrorf("private key type %s is not allowed, allowed types are %s",
+			spec, cfg.allowedPrivateKeysString())
+	}
+
+	if !hasAlg && !hasSize && !hasEncoding && !hasPolicy && cfg.DefaultRotationPolicy == "" {
+		return nil, nil
+	}
+
+	pk := &cmapi.CertificatePrivateKey{
+		RotationPolicy: cfg.DefaultRotationPolicy,
+	}
+	if hasAlg || hasSize {
+		pk.Algorithm = spec.Algorithm
+		pk.Size = spec.Size
+	}
+
+	if hasEncoding {
+		switch e := cmapi.PrivateKeyEncoding(encoding); e {
+		case cmapi.PKCS1, cmapi.PKCS8:
+			pk.Encoding = e
+		default:
+			return nil, invalidConfigErrorf("annotation %s: unknown private key encoding %q, must be %s or %s",
+				PrivateKeyEncodingAnnotation, encoding, cmapi.PKCS1, cmapi.PKCS8)
+		}
+	}
+
+	if hasPolicy {
+		switch p := cmapi.PrivateKeyRotationPolicy(policy); p {
+		case cmapi.RotationPolicyNever, cmapi.RotationPolicyAlways:
+			pk.RotationPolicy = p
+		default:
+			return nil, invalidConfigErrorf("annotation %s: unknown rotation policy %q, must be %s or %s",
+				PrivateKeyRotationPolicyAnnotation, policy, cmapi.RotationPolicyNever, cmapi.RotationPolicyAlways)
+		}
+	}
+
+	return pk, nil
+}
+
+func (cfg *Config) isPrivateKeyAllowed(spec PrivateKeySpec) bool {
+	for _, a := range cfg.AllowedPrivateKeys {
+		if a == spec {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) allowedPrivateKeysString() string {
+	allowed := make([]string, len(cfg.AllowedPrivateKeys))
+	for i, a := range cfg.AllowedPrivateKeys {
+		allowed[i] = a.String()
+	}
+	return strings.Join(allowed, ", ")
+}
@@ -0,0 +1,174 @@
+package certs
+
+import (
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCerts_ParsePrivateKeySpecs(t *testing.T) {
+	tests := map[string]struct {
+		list  string
+		specs []PrivateKeySpec
+		err   bool
+	}{
+		"Empty": {
+			list:  "",
+			specs: []PrivateKeySpec{},
+		},
+		"Default": {
+			list: DefaultAllowedPrivateKeys,
+			specs: []PrivateKeySpec{
+				{Algorithm: cmapi.RSAKeyAlgorithm, Size: 2048},
+				{Algorithm: cmapi.RSAKeyAlgorithm, Size: 3072},
+				{Algorithm: cmapi.RSAKeyAlgorithm, Size: 4096},
+				{Algorithm: cmapi.ECDSAKeyAlgorithm, Size: 256},
+				{Algorithm: cmapi.ECDSAKeyAlgorithm, Size: 384},
+				{Algorithm: cmapi.ECDSAKeyAlgorithm, Size: 521},
+				{Algorithm: cmapi.Ed25519KeyAlgorithm},
+			},
+		},
+		"Whitespace": {
+			list: " rsa-4096 , ecdsa ",
+			specs: []PrivateKeySpec{
+				{Algorithm: cmapi.RSAKeyAlgorithm, Size: 4096},
+				{Algorithm: cmapi.ECDSAKeyAlgorithm, Size: 256},
+			},
+		},
+		"UnknownAlgorithm": {
+			list: "DSA-1024",
+			err:  true,
+		},
+		"InvalidSize": {
+			list: "ECDSA-512",
+			err:  true,
+		},
+		"Ed25519WithSize": {
+			list: "Ed25519-256",
+			err:  true,
+		},
+	}
+
+	for testn, tc := range tests {
+		specs, err := ParsePrivateKeySpecs(tc.list)
+		assert.Equal(t, tc.err, err != nil, testn)
+		assert.Equal(t, tc.specs, specs, testn)
+	}
+}
+
+func TestCerts_privateKeyFromSvc(t *testing.T) {
+	tests := map[string]struct {
+		annotations    map[string]string
+		rotationPolicy cmapi.PrivateKeyRotationPolicy
+		allowed        string
+		pk             *cmapi.CertificatePrivateKey
+		invalid        bool
+	}{
+		"NoAnnotations": {
+			pk: nil,
+		},
+		"DefaultRotationPolicy": {
+			rotationPolicy: cmapi.RotationPolicyAlways,
+			pk: &cmapi.CertificatePrivateKey{
+				RotationPolicy: cmapi.RotationPolicyAlways,
+			},
+		},
+		"RSA4096": {
+			annotations: map[string]string{
+				PrivateKeyAlgorithmAnnotation: "RSA",
+				PrivateKeySizeAnnotation:      "4096",
+			},
+			pk: &cmapi.CertificatePrivateKey{
+				Algorithm: cmapi.RSAKeyAlgorithm,
+				Size:      4096,
+			},
+		},
+		"SizeOnly": {
+			annotations: map[string]string{
+				PrivateKeySizeAnnotation: "3072",
+			},
+			pk: &cmapi.CertificatePrivateKey{
+				Algorithm: cmapi.RSAKeyAlgorithm,
+				Size:      3072,
+			},
+		},
+		"Ed25519PKCS8Always": {
+			annotations: map[string]string{
+				PrivateKeyAlgorithmAnnotation:      "Ed25519",
+				PrivateKeyEncodingAnnotation:       "PKCS8",
+				PrivateKeyRotationPolicyAnnotation: "Always",
+			},
+			pk: &cmapi.CertificatePrivateKey{
+				Algorithm:      cmapi.Ed25519KeyAlgorithm,
+				Encoding:       cmapi.PKCS8,
+				RotationPolicy: cmapi.RotationPolicyAlways,
+			},
+		},
+		"AnnotationOverridesDefaultRotationPolicy": {
+			annotations: map[string]string{
+				PrivateKeyRotationPolicyAnnotation: "Never",
+			},
+			rotationPolicy: cmapi.RotationPolicyAlways,
+			pk: &cmapi.CertificatePrivateKey{
+				RotationPolicy: cmapi.RotationPolicyNever,
+			},
+		},
+		"NotAllowed": {
+			annotations: map[string]string{
+				PrivateKeyAlgorithmAnnotation: "ECDSA",
+				PrivateKeySizeAnnotation:      "521",
+			},
+			allowed: "RSA-2048,ECDSA-256",
+			invalid: true,
+		},
+		"DefaultNotAllowed": {
+			allowed: "ECDSA-256",
+			invalid: true,
+		},
+		"EncodingOnlyDefaultNotAllowed": {
+			annotations: map[string]string{
+				PrivateKeyEncodingAnnotation: "PKCS8",
+			},
+			allowed: "ECDSA-256",
+			invalid: true,
+		},
+		"InvalidSize": {
+			annotations: map[string]string{
+				PrivateKeyAlgorithmAnnotation: "RSA",
+				PrivateKeySizeAnnotation:      "large",
+			},
+			invalid: true,
+		},
+		"InvalidEncoding": {
+			annotations: map[string]string{
+				PrivateKeyEncodingAnnotation: "PEM",
+			},
+			invalid: true,
+		},
+		"InvalidRotationPolicy": {
+			annotations: map[string]string{
+				PrivateKeyRotationPolicyAnnotation: "Sometimes",
+			},
+			invalid: true,
+		},
+	}
+
+	for testn, tc := range tests {
+		cfg := DefaultConfig()
+		cfg.DefaultRotationPolicy = tc.rotationPolicy
+		if tc.allowed != "" {
+			allowed, err := ParsePrivateKeySpecs(tc.allowed)
+			assert.NoError(t, err, testn)
+			cfg.AllowedPrivateKeys = allowed
+		}
+		svc := prepareService("test-svc", "test-ns")
+		svc.Annotations = tc.annotations
+		pk, err := privateKeyFromSvc(&svc, cfg)
+		assert.Equal(t, tc.pk, pk, testn)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package certs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// minCADuration is the shortest CA lifetime accepted by cert-manager
+	minCADuration = time.Hour
+	// defaultCADuration is cert-manager's default certificate lifetime
+	defaultCADuration = 2160 * time.Hour
+)
+
+// CAProfile describes the Service CA certificate and the names of the
+// resources which the controller creates for the Service CA.
+type CAProfile struct {
+	// Name is the name of the CA, DefaultCAName for the default CA. The
+	// controller labels the CA resources with the name, so that it finds
+	// them after the resource names of the profile changed.
+	Name string `json:"-"`
+	// group is the CA group of the profiles returned by GroupProfile()
+	group string
+
+	// SelfSignedIssuerName is the name of the self-signed Issuer which
+	// signs the CA certificate
+	SelfSignedIssuerName string `json:"selfSignedIssuerName,omitempty"`
+	// CertificateName is the name of the CA Certificate resource
+	CertificateName string `json:"certificateName,omitempty"`
+	// SecretName is the name of the secret holding the CA certificate
+	// and key
+	SecretName string `json:"secretName,omitempty"`
+	// IssuerName is the name of the ClusterIssuer which issues Service
+	// certificates
+	IssuerName string `json:"issuerName,omitempty"`
+
+	// CommonName is the common name of the CA certificate
+	CommonName string `json:"commonName,omitempty"`
+	// Organizations is the list of organizations (O) of the CA certificate
+	Organizations []string `json:"organizations,omitempty"`
+	// OrganizationalUnits is the list of organizational units (OU) of the
+	// CA certificate
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+	// Countries is the list of countries (C) of the CA certificate
+	Countries []string `json:"countries,omitempty"`
+
+	// KeyAlgorithm is the private key algorithm of the CA
+	KeyAlgorithm cmapi.PrivateKeyAlgorithm `json:"keyAlgorithm,omitempty"`
+	// KeySize is the private key size of the CA in bits
+	KeySize int `json:"keySize,omitempty"`
+
+	// Duration is the lifetime of the CA certificate. If nil,
+	// cert-manager's default applies.
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// RenewBefore is how long before expiry the CA certificate is
+	// renewed. If nil, cert-manager's default applies.
+	RenewBefore *metav1.Duration `json:"renewBefore,omitempty"`
+
+	// ParentIssuer references an existing issuer which signs the CA
+	// certificate. If the name is empty, the CA certificate is signed by
+	// the self-signed Issuer, and the Service CA is a root CA. Otherwise,
+	// the Service CA is an intermediate CA of the parent issuer. Kind
+	// defaults to `ClusterIssuer` and group to `cert-manager.io`.
+	ParentIssuer cmmeta.ObjectReference `json:"parentIssuer,omitempty"`
+	// Import disables issuing the CA certificate. Instead, the operator
+	// supplies the CA certificate and key in keys `tls.crt` and `tls.key`
+	// of the CA secret.
+	Import bool `json:"import,omitempty"`
+
+	// NameConstraints enables critical X.509 name constraints on the CA
+	// certificate, which limit the CA to the cluster's DNS domains and
+	// Service IP ranges, and to PermittedDNSDomains and PermittedIPRanges.
+	// cert-manager can't issue CA certificates with name constraints, so
+	// the controller issues the self-signed CA certificate itself.
+	NameConstraints bool `json:"nameConstraints,omitempty"`
+	// PermittedDNSDomains are DNS domains which the name constraints
+	// permit in addition to the cluster's DNS domains
+	PermittedDNSDomains []string `json:"permittedDNSDomains,omitempty"`
+	// PermittedIPRanges are IP ranges in CIDR notation which the name
+	// constraints permit in addition to the cluster's Service IP ranges
+	PermittedIPRanges []string `json:"permittedIPRanges,omitempty"`
+
+	// Intermediate enables a two-tier CA. The CA of the profile is the root
+	// CA, which only signs an intermediate CA. Service certificates are
+	// issued from the intermediate CA, and the injected CA bundles contain
+	// the root CA.
+	Intermediate bool `json:"intermediate,omitempty"`
+	// IntermediateDuration is the lifetime of the intermediate CA
+	// certificate. If nil, cert-manager's default applies.
+	IntermediateDuration *metav1.Duration `json:"intermediateDuration,omitempty"`
+	// IntermediateRenewBefore is how long before expiry the intermediate CA
+	// certificate is renewed. If nil, cert-manager's default applies.
+	IntermediateRenewBefore *metav1.Duration `json:"intermediateRenewBefore,omitempty"`
+
+	// Namespaces lists the namespaces in which Services and ConfigMaps
+	// may select the named CA. Entries may be shell patterns as supported
+	// by path.Match(). If empty, the CA may be selected in all namespaces
+	// which don't belong to a CA group.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// RotationGracePeriod is how long the previous CA is kept in the trust
+	// bundle after the CA changed before certificates are reissued, and
+	// again after all certificates have been reissued. If nil, the
+	// default of 24h applies.
+	RotationGracePeriod *metav1.Duration `json:"rotationGracePeriod,omitempty"`
+}
+
+// DefaultCAProfile returns the CA profile which is used if the controller
+// isn't configured otherwise
+func DefaultCAProfile() CAProfile {
+	return CAProfile{
+		Name:                 DefaultCAName,
+		SelfSignedIssuerName: SelfSignedIssuerName,
+		CertificateName:      CACertName,
+		SecretName:           CASecretName,
+		IssuerName:           ServiceIssuerName,
+		CommonName:           CAName,
+		KeyAlgorithm:         cmapi.ECDSAKeyAlgorithm,
+		KeySize:              521,
+	}
+}
+
+// LoadCAProfile reads the YAML file at `path` into `profile`. Fields which
+// aren't present in the file keep their current value.
+func LoadCAProfile(path string, profile *CAProfile) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, profile); err != nil {
+		return fmt.Errorf("parsing CA profile %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the CA profile describes a valid CA
+func (p *CAProfile) Validate() error {
+	names := map[string]string{
+		"self-signed issuer name": p.SelfSignedIssuerName,
+		"certificate name":        p.CertificateName,
+		"secret name":             p.SecretName,
+		"issuer name":             p.IssuerName,
+	}
+	for field, name := range names {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf("invalid CA %s %q: %v", field, name, errs)
+		}
+	}
+	if p.CommonName == "" {
+		return fmt.Errorf("CA common name must not be empty")
+	}
+	if p.Import && p.hasParentIssuer() {
+		return fmt.Errorf("CA import and CA parent issuer are mutually exclusive")
+	}
+	if p.hasParentIssuer() {
+		ref := p.caIssuerRef()
+		if errs := validation.IsDNS1123Subdomain(ref.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid CA parent issuer name %q: %v", ref.Name, errs)
+		}
+		if ref.Group == "cert-manager.io" && ref.Kind != "Issuer" && ref.Kind != "ClusterIssuer" {
+			return fmt.Errorf("invalid CA parent issuer kind %q: must be Issuer or ClusterIssuer", ref.Kind)
+		}
+	}
+	if _, err := p.privateKeySpec(); err != nil {
+		return fmt.Errorf("invalid CA private key: %w", err)
+	}
+	if p.Duration != nil && p.Duration.Duration < minCADuration {
+		return fmt.Errorf("CA duration %s is shorter than %s", p.Duration.Duration, minCADuration)
+	}
+	if p.NameConstraints {
+		if err := p.validateNameConstraints(); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range p.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid CA namespace pattern %q: %w", pattern, err)
+		}
+	}
+	if p.RotationGracePeriod != nil && p.RotationGracePeriod.Duration < 0 {
+		return fmt.Errorf("CA rotation grace period %s must not be negative", p.RotationGracePeriod.Duration)
+	}
+	if p.RenewBefore != nil {
+		duration := p.duration()
+		if p.RenewBefore.Duration <= 0 || p.RenewBefore.Duration >= duration {
+			return fmt.Errorf("CA renew-before %s must be positive and shorter than the CA duration %s",
+				p.RenewBefore.Duration, duration)
+		}
+	}
+	if p.Intermediate {
+		ip := p.intermediateProfile()
+		if err := ip.Validate(); err != nil {
+			return fmt.Errorf("intermediate %w", err)
+		}
+		if ip.duration() > p.duration() {
+			return fmt.Errorf("intermediate CA duration %s is longer than the CA duration %s",
+				ip.duration(), p.duration())
+		}
+	} else if p.IntermediateDuration != nil || p.IntermediateRenewBefore != nil {
+		return fmt.Errorf("intermediate CA duration and renew-before require an intermediate CA")
+	}
+	return nil
+}
+
+// duration returns the lifetime of the CA certificate
+func (p *CAProfile) duration() time.Duration {
+	if p.Duration == nil {
+		return defaultCADuration
+	}
+	return p.Duration.Duration
+}
+
+func (p *CAProfile) privateKeySpec() (PrivateKeySpec, error) {
+	size := ""
+	if p.KeySize != 0 {
+		size = fmt.Sprint(p.KeySize)
+	}
+	return privateKeySpec(string(p.KeyAlgorithm), size)
+}
+
+// IssuerRef returns the reference to the issuer which issues Service
+// certificates from this CA
+func (p *CAProfile) IssuerRef() cmmeta.ObjectReference {
+	return cmmeta.ObjectReference{
+		Name:  p.IssuerName,
+		Kind:  "ClusterIssuer",
+		Group: "cert-manager.io",
+	}
+}
+
+// rotationGracePeriod returns the grace period of CA rotations
+func (p *CAProfile) rotationGracePeriod() time.Duration {
+	if p.RotationGracePeriod == nil {
+		return DefaultRotationGracePeriod
+	}
+	return p.RotationGracePeriod.Duration
+}
+
+// selfSigned returns true if the controller creates a self-signed Issuer
+// which signs the CA certificate
+func (p *CAProfile) selfSigned() bool {
+	return !p.Import && !p.hasParentIssuer() && !p.NameConstraints
+}
+
+// hasParentIssuer returns true if the CA certificate is signed by an
+// existing issuer instead of the self-signed Issuer
+func (p *CAProfile) hasParentIssuer() bool {
+	return p.ParentIssuer.Name != ""
+}
+
+// caIssuerRef returns the reference to the issuer which signs the CA
+// certificate
+func (p *CAProfile) caIssuerRef() cmmeta.ObjectReference {
+	if !p.hasParentIssuer() {
+		return cmmeta.ObjectReference{
+			Name:  p.SelfSignedIssuerName,
+			Kind:  "Issuer",
+			Group: "cert-manager.io",
+		}
+	}
+	ref := p.ParentIssuer
+	if ref.Kind == "" {
+		ref.Kind = "ClusterIssuer"
+	}
+	if ref.Group == "" {
+		ref.Group = "cert-manager.io"
+	}
+	return ref
+}
+
+// subject returns the X.509 subject for the CA certificate, or nil if the
+// profile doesn't set any subject fields besides the common name
+func (p *CAProfile) subject() *cmapi.X509Subject {
+	if len(p.Organizations) == 0 && len(p.OrganizationalUnits) == 0 && len(p.Countries) == 0 {
+		return nil
+	}
+	return &cmapi.X509Subject{
+		Organizations:       p.Organizations,
+		OrganizationalUnits: p.OrganizationalUnits,
+		Countries:           p.Countries,
+	}
+}
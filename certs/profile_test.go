@@ -0,0 +1,231 @@
+package certs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCerts_LoadCAProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.yaml")
+	err := os.WriteFile(path, []byte(`
+certificateName: corp-service-ca
+commonName: Corp Service CA
+organizations:
+- Example Corp
+keyAlgorithm: RSA
+keySize: 4096
+duration: 43800h
+renewBefore: 8760h
+`), 0o600)
+	require.NoError(t, err)
+
+	profile := DefaultCAProfile()
+	err = LoadCAProfile(path, &profile)
+	require.NoError(t, err)
+
+	expected := DefaultCAProfile()
+	expected.CertificateName = "corp-service-ca"
+	expected.CommonName = "Corp Service CA"
+	expected.Organizations = []string{"Example Corp"}
+	expected.KeyAlgorithm = cmapi.RSAKeyAlgorithm
+	expected.KeySize = 4096
+	expected.Duration = &metav1.Duration{Duration: 43800 * time.Hour}
+	expected.RenewBefore = &metav1.Duration{Duration: 8760 * time.Hour}
+	assert.Equal(t, expected, profile)
+	assert.NoError(t, profile.Validate())
+}
+
+func TestCerts_LoadCAProfile_UnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.yaml")
+	err := os.WriteFile(path, []byte("caName: foo\n"), 0o600)
+	require.NoError(t, err)
+
+	profile := DefaultCAProfile()
+	assert.Error(t, LoadCAProfile(path, &profile))
+}
+
+func TestCerts_CAProfileValidate(t *testing.T) {
+	tests := map[string]struct {
+		mutate func(*CAProfile)
+		valid  bool
+	}{
+		"DefaultProfile": {
+			mutate: func(*CAProfile) {},
+			valid:  true,
+		},
+		"InvalidSecretName": {
+			mutate: func(p *CAProfile) {
+				p.SecretName = "Service CA"
+			},
+			valid: false,
+		},
+		"EmptyIssuerName": {
+			mutate: func(p *CAProfile) {
+				p.IssuerName = ""
+			},
+			valid: false,
+		},
+		"EmptyCommonName": {
+			mutate: func(p *CAProfile) {
+				p.CommonName = ""
+			},
+			valid: false,
+		},
+		"Ed25519": {
+			mutate: func(p *CAProfile) {
+				p.KeyAlgorithm = cmapi.Ed25519KeyAlgorithm
+				p.KeySize = 0
+			},
+			valid: true,
+		},
+		"InvalidKeySize": {
+			mutate: func(p *CAProfile) {
+				p.KeySize = 1024
+			},
+			valid: false,
+		},
+		"DurationTooShort": {
+			mutate: func(p *CAProfile) {
+				p.Duration = &metav1.Duration{Duration: time.Minute}
+			},
+			valid: false,
+		},
+		"ParentIssuer": {
+			mutate: func(p *CAProfile) {
+				p.ParentIssuer.Name = "corp-ca"
+			},
+			valid: true,
+		},
+		"ParentIssuer_ExternalKind": {
+			mutate: func(p *CAProfile) {
+				p.ParentIssuer = cmmeta.ObjectReference{
+					Name:  "corp-ca",
+					Kind:  "AWSPCAClusterIssuer",
+					Group: "awspca.cert-manager.io",
+				}
+			},
+			valid: true,
+		},
+		"ParentIssuer_InvalidKind": {
+			mutate: func(p *CAProfile) {
+				p.ParentIssuer = cmmeta.ObjectReference{
+					Name: "corp-ca",
+					Kind: "Certificate",
+				}
+			},
+			valid: false,
+		},
+		"ParentIssuer_InvalidName": {
+			mutate: func(p *CAProfile) {
+				p.ParentIssuer.Name = "Corp CA"
+			},
+			valid: false,
+		},
+		"Import": {
+			mutate: func(p *CAProfile) {
+				p.Import = true
+			},
+			valid: true,
+		},
+		"Import_ParentIssuer": {
+			mutate: func(p *CAProfile) {
+				p.Import = true
+				p.ParentIssuer.Name = "corp-ca"
+			},
+			valid: false,
+		},
+		"RenewBeforeTooLong": {
+			mutate: func(p *CAProfile) {
+				p.RenewBefore = &metav1.Duration{Duration: 2160 * time.Hour}
+			},
+			valid: false,
+		},
+		"Intermediate": {
+			mutate: func(p *CAProfile) {
+				p.Intermediate = true
+				p.Duration = &metav1.Duration{Duration: 87600 * time.Hour}
+				p.IntermediateDuration = &metav1.Duration{Duration: 8760 * time.Hour}
+				p.IntermediateRenewBefore = &metav1.Duration{Duration: 720 * time.Hour}
+			},
+			valid: true,
+		},
+		"IntermediateOutlivesRoot": {
+			mutate: func(p *CAProfile) {
+				p.Intermediate = true
+				p.IntermediateDuration = &metav1.Duration{Duration: 8760 * time.Hour}
+			},
+			valid: false,
+		},
+		"IntermediateRenewBeforeTooLong": {
+			mutate: func(p *CAProfile) {
+				p.Intermediate = true
+				p.IntermediateRenewBefore = &metav1.Duration{Duration: 2160 * time.Hour}
+			},
+			valid: false,
+		},
+		"IntermediateDurationWithoutIntermediate": {
+			mutate: func(p *CAProfile) {
+				p.IntermediateDuration = &metav1.Duration{Duration: 720 * time.Hour}
+			},
+			valid: false,
+		},
+		"NameConstraints": {
+			mutate: func(p *CAProfile) {
+				p.NameConstraints = true
+				p.PermittedDNSDomains = []string{"cluster.local", ".example.org"}
+				p.PermittedIPRanges = []string{"10.96.0.0/12", "fd00::/108"}
+			},
+			valid: true,
+		},
+		"NameConstraintsWithoutDomains": {
+			mutate: func(p *CAProfile) {
+				p.NameConstraints = true
+			},
+			valid: false,
+		},
+		"NameConstraintsInvalidDomain": {
+			mutate: func(p *CAProfile) {
+				p.NameConstraints = true
+				p.PermittedDNSDomains = []string{"*.example.org"}
+			},
+			valid: false,
+		},
+		"NameConstraintsInvalidIPRange": {
+			mutate: func(p *CAProfile) {
+				p.NameConstraints = true
+				p.PermittedDNSDomains = []string{"cluster.local"}
+				p.PermittedIPRanges = []string{"10.96.0.1"}
+			},
+			valid: false,
+		},
+		"NameConstraints_Import": {
+			mutate: func(p *CAProfile) {
+				p.NameConstraints = true
+				p.PermittedDNSDomains = []string{"cluster.local"}
+				p.Import = true
+			},
+			valid: false,
+		},
+		"NegativeRotationGracePeriod": {
+			mutate: func(p *CAProfile) {
+				p.RotationGracePeriod = &metav1.Duration{Duration: -time.Hour}
+			},
+			valid: false,
+		},
+	}
+
+	for testn, tc := range tests {
+		profile := DefaultCAProfile()
+		tc.mutate(&profile)
+		err := profile.Validate()
+		assert.Equal(t, tc.valid, err == nil, testn)
+	}
+}
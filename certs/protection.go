@@ -0,0 +1,83 @@
+package certs
+
+import (
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProtectedLabelKey is the label which the controller sets on the objects
+// which it manages, see IsManagedResource(). The tamper protection webhook
+// only receives the requests for objects with this label.
+const ProtectedLabelKey = "service.syn.tools/protected"
+
+// IsManagedResource returns true if the object `obj` of kind `kind` is
+// managed by the controller for the CAs of profiles `profiles`. Managed
+// objects are
+//
+// * the Certificates of Services and their secrets with or without mapped keys,
+// * the CA Certificates, secrets, trust bundles and Issuers in `caNamespace`, and
+// * the ClusterIssuers of the CAs and of the CA groups.
+//
+// The CA secrets of imported CAs aren't managed, as the operator supplies
+// them.
+func IsManagedResource(kind string, obj metav1.Object, caNamespace string, profiles []CAProfile) bool {
+	labels := obj.GetLabels()
+	inCANamespace := obj.GetNamespace() == caNamespace
+	switch kind {
+	case "Secret":
+		if _, ok := labels[ServiceCertSecretLabelKey]; ok {
+			return true
+		}
+		if _, ok := labels[MappedSecretLabelKey]; ok {
+			return true
+		}
+		return inCANamespace && matchProfiles(profiles, func(p *CAProfile) bool {
+			return p.isManagedSecretName(obj.GetName())
+		})
+	case "ConfigMap":
+		_, ok := labels[TrustBundleLabelKey]
+		return ok && inCANamespace
+	case cmapi.CertificateKind:
+		if owner := metav1.GetControllerOf(obj); owner != nil && owner.Kind == "Service" && owner.APIVersion == "v1" {
+			return true
+		}
+		return inCANamespace && matchProfiles(profiles, func(p *CAProfile) bool {
+			return p.IsCACertificateName(obj.GetName())
+		})
+	case cmapi.IssuerKind:
+		return inCANamespace && matchProfiles(profiles, func(p *CAProfile) bool {
+			return obj.GetName() == p.SelfSignedIssuerName ||
+				(strings.HasPrefix(obj.GetName(), p.SecretName+"-") && strings.HasSuffix(obj.GetName(), "-issuer"))
+		})
+	case cmapi.ClusterIssuerKind:
+		return matchProfiles(profiles, func(p *CAProfile) bool {
+			if group, ok := labels[CAGroupLabelKey]; ok {
+				gp := p.GroupProfile(group)
+				return obj.GetName() == gp.IssuerName
+			}
+			return obj.GetName() == p.IssuerName
+		})
+	}
+	return false
+}
+
+// isManagedSecretName returns true if `name` is the name of a secret which
+// the controller manages for the CA of the profile. These are the CA secret,
+// the secret of the intermediate CA, and the secrets of the CA groups.
+func (p *CAProfile) isManagedSecretName(name string) bool {
+	if name == p.SecretName {
+		return !p.Import
+	}
+	return strings.HasPrefix(name, p.SecretName+"-")
+}
+
+func matchProfiles(profiles []CAProfile, match func(*CAProfile) bool) bool {
+	for i := range profiles {
+		if match(&profiles[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package certs
+
+import (
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCerts_IsManagedResource(t *testing.T) {
+	profile := DefaultCAProfile()
+	profile.Intermediate = true
+	named := NamedCAProfile("compliance")
+	imported := NamedCAProfile("imported")
+	imported.Import = true
+	profiles := []CAProfile{profile, named, imported}
+	isController := true
+
+	tests := map[string]struct {
+		kind      string
+		namespace string
+		name      string
+		labels    map[string]string
+		owner     *metav1.OwnerReference
+		managed   bool
+	}{
+		"ServiceCertSecret": {
+			kind:      "Secret",
+			namespace: "test-ns",
+			name:      "app-tls",
+			labels:    map[string]string{ServiceCertSecretLabelKey: "app-tls"},
+			managed:   true,
+		},
+		"MappedSecret": {
+			kind:      "Secret",
+			namespace: "test-ns",
+			name:      "app-tls",
+			labels:    map[string]string{MappedSecretLabelKey: "app-tls"},
+			managed:   true,
+		},
+		"OtherSecret": {
+			kind:      "Secret",
+			namespace: "test-ns",
+			name:      "app-tls",
+		},
+		"CASecret": {
+			kind:      "Secret",
+			namespace: testCANamespace,
+			name:      profile.SecretName,
+			managed:   true,
+		},
+		"IntermediateCASecret": {
+			kind:      "Secret",
+			namespace: testCANamespace,
+			name:      profile.intermediateProfile().SecretName,
+			managed:   true,
+		},
+		"GroupCASecret": {
+			kind:      "Secret",
+			namespace: testCANamespace,
+			name:      profile.GroupProfile("team-a").SecretName,
+			managed:   true,
+		},
+		"GroupCASecretCopy": {
+			kind:      "Secret",
+			namespace: "team-a-app",
+			name:      profile.SecretName,
+			labels:    map[string]string{CAGroupLabelKey: "team-a"},
+		},
+		"ImportedCASecret": {
+			kind:      "Secret",
+			namespace: testCANamespace,
+			name:      imported.SecretName,
+		},
+		"CASecretNameInOtherNamespace": {
+			kind:      "Secret",
+			namespace: "test-ns",
+			name:      profile.SecretName,
+		},
+		"OtherSecretInCANamespace": {
+			kind:      "Secret",
+			namespace: testCANamespace,
+			name:      "cert-manager-webhook-ca",
+		},
+		"TrustBundle": {
+			kind:      "ConfigMap",
+			namespace: testCANamespace,
+			name:      TrustBundleName(profile.SecretName),
+			labels:    map[string]string{TrustBundleLabelKey: "true"},
+			managed:   true,
+		},
+		"OtherConfigMap": {
+			kind:      "ConfigMap",
+			namespace: testCANamespace,
+			name:      "settings",
+		},
+		"ServiceCertificate": {
+			kind:      cmapi.CertificateKind,
+			namespace: "test-ns",
+			name:      "app-tls",
+			owner: &metav1.OwnerReference{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Name:       "app",
+				Controller: &isController,
+			},
+			managed: true,
+		},
+		"OtherCertificate": {
+			kind:      cmapi.CertificateKind,
+			namespace: "test-ns",
+			name:      "app-tls",
+		},
+		"CACertificate": {
+			kind:      cmapi.CertificateKind,
+			namespace: testCANamespace,
+			name:      named.CertificateName,
+			managed:   true,
+		},
+		"SelfSignedIssuer": {
+			kind:      cmapi.IssuerKind,
+			namespace: testCANamespace,
+			name:      profile.SelfSignedIssuerName,
+			managed:   true,
+		},
+		"RootIssuer": {
+			kind:      cmapi.IssuerKind,
+			namespace: testCANamespace,
+			name:      profile.rootIssuerName(),
+			managed:   true,
+		},
+		"GroupIssuer": {
+			kind:    cmapi.ClusterIssuerKind,
+			name:    profile.GroupProfile("team-a").IssuerName,
+			labels:  map[string]string{CAGroupLabelKey: "team-a"},
+			managed: true,
+		},
+		"NamespacedGroupIssuer": {
+			kind:      cmapi.IssuerKind,
+			namespace: "team-a-app",
+			name:      profile.IssuerName,
+			labels:    map[string]string{CAGroupLabelKey: "team-a"},
+		},
+		"OtherIssuer": {
+			kind:      cmapi.IssuerKind,
+			namespace: "test-ns",
+			name:      profile.IssuerName,
+		},
+		"ClusterIssuer": {
+			kind:    cmapi.ClusterIssuerKind,
+			name:    named.IssuerName,
+			managed: true,
+		},
+		"OtherClusterIssuer": {
+			kind: cmapi.ClusterIssuerKind,
+			name: "letsencrypt",
+		},
+	}
+
+	for testn, tc := range tests {
+		obj := metav1.ObjectMeta{
+			Name:      tc.name,
+			Namespace: tc.namespace,
+			Labels:    tc.labels,
+		}
+		if tc.owner != nil {
+			obj.OwnerReferences = []metav1.OwnerReference{*tc.owner}
+		}
+		assert.Equal(t, tc.managed, IsManagedResource(tc.kind, &obj, testCANamespace, profiles), testn)
+	}
+}
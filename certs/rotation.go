@@ -0,0 +1,464 @@
+package certs
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// TrustBundleLabelKey is the label of the ConfigMaps in which the
+	// controller tracks the trust bundle of each CA
+	TrustBundleLabelKey = "service.syn.tools/trust-bundle"
+	// CASecretAnnotation is the trust bundle annotation which holds the
+	// name of the CA secret
+	CASecretAnnotation = "service.syn.tools/ca-secret"
+	// CAFingerprintAnnotation is the trust bundle annotation which holds
+	// the fingerprint of the current CA bundle
+	CAFingerprintAnnotation = "service.syn.tools/ca-fingerprint"
+	// CARotatedAtAnnotation is the trust bundle annotation which records
+	// when the current CA replaced the previous one
+	CARotatedAtAnnotation = "service.syn.tools/ca-rotated-at"
+	// CAReissuedAtAnnotation is the trust bundle annotation which records
+	// when all certificates of the CA were first observed to be issued by
+	// the current CA
+	CAReissuedAtAnnotation = "service.syn.tools/ca-reissued-at"
+
+	// CertificateIssuerIndex is the field index of Certificates by the
+	// name of the ClusterIssuer which issues them, see
+	// IndexCertificateIssuer(). The index must be registered with the
+	// manager of the client which is passed to ReconcileCARotation().
+	CertificateIssuerIndex = "spec.issuerRef.clusterIssuerName"
+
+	// DefaultRotationGracePeriod is the default grace period of CA
+	// rotations, see CAProfile.RotationGracePeriod
+	DefaultRotationGracePeriod = 24 * time.Hour
+	// rotationPollInterval is how often the progress of a CA rotation is
+	// checked while certificates are reissued
+	rotationPollInterval = time.Minute
+	// manuallyTriggeredReason is the reason of the `Issuing` condition
+	// which makes cert-manager reissue a certificate
+	manuallyTriggeredReason = "ManuallyTriggered"
+)
+
+// CARotation is the result of a reconcile of a CA rotation
+type CARotation struct {
+	// Reissued lists the certificates whose reissue was triggered
+	Reissued []string
+	// Completed is true if the previous CAs were removed from the trust
+	// bundle
+	Completed bool
+	// RequeueAfter is when the rotation should be reconciled next. Zero
+	// if no rotation is in progress.
+	RequeueAfter time.Duration
+	// EmergencyStarted is true if an emergency rotation was triggered
+	EmergencyStarted bool
+	// EmergencyCompleted is true if an emergency rotation completed
+	EmergencyCompleted bool
+	// Emergency is the report of the emergency rotation in progress, or
+	// of the emergency rotation which just completed
+	Emergency *EmergencyRotationReport
+}
+
+// TrustBundleName returns the name of the trust bundle ConfigMap of the CA
+// with CA secret `caSecretName`
+func TrustBundleName(caSecretName string) string {
+	return fmt.Sprintf("%s-trust-bundle", caSecretName)
+}
+
+// ensureTrustBundle records the CA bundle `current` in the trust bundle
+// ConfigMap of the CA and returns the ConfigMap. If the CA bundle changed,
+// the certificates of the previous bundle are kept in the trust bundle until
+// the rotation completes, see ReconcileCARotation().
+func ensureTrustBundle(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, group, current string) (*corev1.ConfigMap, error) {
+	cm := corev1.ConfigMap{}
+	err := c.Get(ctx, client.ObjectKey{Name: TrustBundleName(profile.SecretName), Namespace: caNamespace}, &cm)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "while fetching trust bundle")
+		return nil, err
+	}
+	fp := bundleFingerprint(current)
+	if errors.IsNotFound(err) {
+		l.Info("Trust bundle doesn't exist, creating...")
+		cm.Name = TrustBundleName(profile.SecretName)
+		cm.Namespace = caNamespace
+		cm.Labels = map[string]string{TrustBundleLabelKey: "true"}
+		if group != "" {
+			cm.Labels[CAGroupLabelKey] = group
+		}
+		cm.Annotations = map[string]string{
+			CASecretAnnotation:      profile.SecretName,
+			CAFingerprintAnnotation: fp,
+		}
+		cm.Data = map[string]string{cmmeta.TLSCAKey: current}
+		return &cm, c.Create(ctx, &cm)
+	}
+	if cm.Annotations[CAFingerprintAnnotation] == fp {
+		return &cm, nil
+	}
+
+	bundle := mergeBundles(current, cm.Data[cmmeta.TLSCAKey])
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[CAFingerprintAnnotation] = fp
+	delete(cm.Annotations, CAReissuedAtAnnotation)
+	if bundle == current {
+		delete(cm.Annotations, CARotatedAtAnnotation)
+	} else {
+		l.Info("CA changed, keeping previous CA in trust bundle")
+		cm.Annotations[CARotatedAtAnnotation] = now().UTC().Format(time.RFC3339)
+	}
+	cm.Data = map[string]string{cmmeta.TLSCAKey: bundle}
+	return &cm, c.Update(ctx, &cm)
+}
+
+// ReconcileCARotation drives the rotation of the CA of the profile. While
+// the trust bundle contains previous CAs, the certificates issued by the CA
+// which aren't signed by the current CA yet are reissued once the rotation
+// grace period has passed since the rotation started, so that clients had
+// time to pick up the new trust bundle. The previous CAs are removed from
+// the trust bundle once all certificates are signed by the current CA and
+// the grace period has passed again.
+// During an emergency rotation, see EmergencyRotationAnnotation, the CA is
+// regenerated, and the grace periods are skipped once the new CA is ready.
+// The emergency rotation of a CA is propagated to the CAs of its CA groups.
+// CAs with name constraints are renewed by the controller, and a staged CA
+// replaces the CA after a profile change, so the result requeues the trust
+// bundle when the CA certificate is due for renewal or the staged CA is due
+// to replace the CA.
+func ReconcileCARotation(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, group string) (CARotation, error) {
+	log := l.WithValues("caNamespace", caNamespace, "caSecret", profile.SecretName)
+	report, started, err := reconcileEmergencyRotation(ctx, c, log, caNamespace, profile)
+	if err != nil {
+		return CARotation{}, err
+	}
+	// Renew constrained CAs and replace the CA with a staged CA when
+	// they're due
+	dueIn, err := ensureProfileCA(ctx, c, log, caNamespace, profile)
+	if err != nil {
+		return CARotation{}, err
+	}
+
+	if report.active() && group == "" {
+		// The CAs of the groups are derived from the compromised CA's
+		// profile and are rotated as well
+		if err := propagateEmergencyRotation(ctx, c, log, caNamespace, profile, report.Trigger); err != nil {
+			return CARotation{}, err
+		}
+	}
+
+	res := CARotation{}
+	if report.active() {
+		currentCA := currentCAFingerprint(ctx, c, log, caNamespace, profile)
+		var progress map[string]NamespaceProgress
+		if currentCA != "" && !containsString(report.CompromisedCAs, currentCA) {
+			// The new CA is ready, reissue the certificates and remove
+			// the compromised CAs without grace periods
+			res, progress, err = reconcileCARotation(ctx, c, l, caNamespace, profile, group, 0)
+			if err != nil {
+				return res, err
+			}
+		}
+		res.EmergencyStarted = started
+		err = updateEmergencyReport(ctx, c, caNamespace, profile, report, currentCA, progress, &res)
+	} else {
+		res, _, err = reconcileCARotation(ctx, c, l, caNamespace, profile, group, profile.rotationGracePeriod())
+	}
+	if err == nil && dueIn > 0 && (res.RequeueAfter == 0 || dueIn < res.RequeueAfter) {
+		res.RequeueAfter = dueIn
+	}
+	return res, err
+}
+
+func reconcileCARotation(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, group string, grace time.Duration) (CARotation, map[string]NamespaceProgress, error) {
+	res := CARotation{}
+	log := l.WithValues("caNamespace", caNamespace, "caSecret", profile.SecretName)
+	secret, err := readCASecret(ctx, c, log, caNamespace, profile)
+	if err != nil {
+		return res, nil, err
+	}
+	current, err := caBundle(secret, profile)
+	if err != nil {
+		return res, nil, err
+	}
+	current, err = withStagedCA(ctx, c, caNamespace, profile, current)
+	if err != nil {
+		return res, nil, err
+	}
+	cm, err := ensureTrustBundle(ctx, c, log, caNamespace, profile, group, current)
+	if err != nil {
+		return res, nil, err
+	}
+	if cm.Data[cmmeta.TLSCAKey] == current {
+		// No rotation in progress
+		return res, nil, nil
+	}
+	caCrts, err := parseCertificates([]byte(current))
+	if err != nil || len(caCrts) == 0 {
+		return res, nil, fmt.Errorf("parsing current CA certificate: %v", err)
+	}
+
+	leaves, err := caCertificates(ctx, c, caNamespace, profile)
+	if err != nil {
+		return res, nil, err
+	}
+	pending := []cmapi.Certificate{}
+	progress := map[string]NamespaceProgress{}
+	for _, cert := range leaves {
+		signed, err := signedByCA(ctx, c, &cert, caCrts[0])
+		if err != nil {
+			return res, nil, err
+		}
+		p := progress[cert.Namespace]
+		p.Certificates++
+		if signed {
+			p.Reissued++
+		} else {
+			pending = append(pending, cert)
+			p.Pending = append(p.Pending, cert.Name)
+		}
+		progress[cert.Namespace] = p
+	}
+
+	if profile.Intermediate && len(pending) > 0 && isIntermediateCertificate(&pending[0], caNamespace, profile) {
+		// The Service certificates would be reissued from the previous
+		// intermediate CA, reissue the intermediate CA first
+		pending = pending[:1]
+	}
+
+	if len(pending) > 0 {
+		if _, ok := cm.Annotations[CAReissuedAtAnnotation]; ok {
+			delete(cm.Annotations, CAReissuedAtAnnotation)
+			if err := c.Update(ctx, cm); err != nil {
+				return res, nil, err
+			}
+		}
+		remaining := remainingGrace(cm.Annotations[CARotatedAtAnnotation], grace)
+		if remaining > 0 {
+			log.V(1).Info("Waiting for clients to pick up the trust bundle", "pending", len(pending))
+			res.RequeueAfter = remaining
+			return res, progress, nil
+		}
+		for i := range pending {
+			triggered, err := triggerReissue(ctx, c, &pending[i])
+			if err != nil {
+				return res, nil, err
+			}
+			if triggered {
+				res.Reissued = append(res.Reissued, fmt.Sprintf("%s/%s", pending[i].Namespace, pending[i].Name))
+			}
+		}
+		if len(res.Reissued) > 0 {
+			log.Info("Triggered reissue of certificates for CA rotation", "certificates", res.Reissued)
+		}
+		res.RequeueAfter = rotationPollInterval
+		return res, progress, nil
+	}
+
+	if _, ok := cm.Annotations[CAReissuedAtAnnotation]; !ok {
+		log.Info("All certificates are issued by the current CA")
+		cm.Annotations[CAReissuedAtAnnotation] = now().UTC().Format(time.RFC3339)
+		if err := c.Update(ctx, cm); err != nil {
+			return res, nil, err
+		}
+	}
+	if remaining := remainingGrace(cm.Annotations[CAReissuedAtAnnotation], grace); remaining > 0 {
+		res.RequeueAfter = remaining
+		return res, progress, nil
+	}
+
+	log.Info("Removing previous CAs from trust bundle")
+	cm.Data = map[string]string{cmmeta.TLSCAKey: current}
+	delete(cm.Annotations, CARotatedAtAnnotation)
+	delete(cm.Annotations, CAReissuedAtAnnotation)
+	res.Completed = true
+	return res, progress, c.Update(ctx, cm)
+}
+
+// caCertificates returns the Certificates which are issued by the
+// ClusterIssuer of the CA profile. For a two-tier CA, the intermediate CA
+// Certificate comes first. The Certificates are looked up through field
+// index CertificateIssuerIndex.
+func caCertificates(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) ([]cmapi.Certificate, error) {
+	certs := []cmapi.Certificate{}
+	if profile.Intermediate {
+		intermediate := cmapi.Certificate{}
+		err := c.Get(ctx, client.ObjectKey{
+			Name:      profile.intermediateProfile().CertificateName,
+			Namespace: caNamespace,
+		}, &intermediate)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			certs = append(certs, intermediate)
+		}
+	}
+	certList := cmapi.CertificateList{}
+	if err := c.List(ctx, &certList, client.MatchingFields{CertificateIssuerIndex: profile.IssuerName}); err != nil {
+		return nil, err
+	}
+	for _, cert := range certList.Items {
+		// Check the issuer as well, as not all clients support field
+		// selectors
+		if clusterIssuerName(&cert) != profile.IssuerName {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// IndexCertificateIssuer indexes Certificates by the name of the
+// cert-manager ClusterIssuer which issues them, see CertificateIssuerIndex
+func IndexCertificateIssuer(obj client.Object) []string {
+	cert, ok := obj.(*cmapi.Certificate)
+	if !ok {
+		return nil
+	}
+	name := clusterIssuerName(cert)
+	if name == "" {
+		return nil
+	}
+	return []string{name}
+}
+
+// clusterIssuerName returns the name of the cert-manager ClusterIssuer which
+// issues the Certificate, or an empty string if the Certificate is issued by
+// another kind of issuer
+func clusterIssuerName(cert *cmapi.Certificate) string {
+	ref := cert.Spec.IssuerRef
+	if ref.Kind != cmapi.ClusterIssuerKind || (ref.Group != "" && ref.Group != "cert-manager.io") {
+		return ""
+	}
+	return ref.Name
+}
+
+// isIntermediateCertificate returns true if `cert` is the intermediate CA
+// Certificate of the two-tier CA of the profile
+func isIntermediateCertificate(cert *cmapi.Certificate, caNamespace string, profile CAProfile) bool {
+	return cert.Namespace == caNamespace && cert.Name == profile.intermediateProfile().CertificateName
+}
+
+// signedByCA returns true if the certificate in the Certificate's secret is
+// signed by `ca`, either directly or through the chain in the secret.
+// Certificates which haven't been issued yet, or whose
+// secret can't be parsed, don't hold up the rotation and are reported as
+// signed.
+func signedByCA(ctx context.Context, c client.Client, cert *cmapi.Certificate, ca *x509.Certificate) (bool, error) {
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: cert.Namespace, Name: cert.Spec.SecretName}, &secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	crts, err := parseCertificates(secret.Data[corev1.TLSCertKey])
+	if err != nil || len(crts) == 0 {
+		return true, nil
+	}
+	return issuedBy(crts, ca), nil
+}
+
+// triggerReissue makes cert-manager reissue the Certificate by setting its
+// `Issuing` condition. Returns false if the Certificate is already being
+// issued.
+func triggerReissue(ctx context.Context, c client.Client, cert *cmapi.Certificate) (bool, error) {
+	cond := cmapi.CertificateCondition{
+		Type:               cmapi.CertificateConditionIssuing,
+		Status:             cmmeta.ConditionTrue,
+		Reason:             manuallyTriggeredReason,
+		Message:            "Certificate re-issuance triggered by Service CA rotation",
+		LastTransitionTime: &metav1.Time{Time: now()},
+	}
+	for i, existing := range cert.Status.Conditions {
+		if existing.Type != cmapi.CertificateConditionIssuing {
+			continue
+		}
+		if existing.Status == cmmeta.ConditionTrue {
+			return false, nil
+		}
+		cert.Status.Conditions[i] = cond
+		return true, c.Status().Update(ctx, cert)
+	}
+	cert.Status.Conditions = append(cert.Status.Conditions, cond)
+	return true, c.Status().Update(ctx, cert)
+}
+
+// remainingGrace returns how long the grace period which started at RFC3339
+// timestamp `start` still lasts. An invalid timestamp starts the grace
+// period now.
+func remainingGrace(start string, grace time.Duration) time.Duration {
+	ts, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return grace
+	}
+	remaining := ts.Add(grace).Sub(now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// bundleFingerprint returns the hex-encoded SHA-256 hash of the CA bundle
+func bundleFingerprint(bundle string) string {
+	sum := sha256.Sum256([]byte(bundle))
+	return hex.EncodeToString(sum[:])
+}
+
+// mergeBundles appends the certificates of `previous` which aren't part of
+// `current` to `current`
+func mergeBundles(current, previous string) string {
+	seen := map[string]bool{}
+	for _, b := range splitBundle(current) {
+		seen[b] = true
+	}
+	merged := current
+	for _, b := range splitBundle(previous) {
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		if merged != "" && !strings.HasSuffix(merged, "\n") {
+			merged += "\n"
+		}
+		merged += b
+	}
+	return merged
+}
+
+// splitBundle returns the PEM encoded certificates of the bundle. A bundle
+// which doesn't contain PEM certificates is returned as a single entry.
+func splitBundle(bundle string) []string {
+	blocks := []string{}
+	rest := []byte(bundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			blocks = append(blocks, string(pem.EncodeToMemory(block)))
+		}
+	}
+	if len(blocks) == 0 && bundle != "" {
+		return []string{bundle}
+	}
+	return blocks
+}
@@ -0,0 +1,247 @@
+package certs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_mergeBundles(t *testing.T) {
+	a := newTestCA(t, "a", nil)
+	b := newTestCA(t, "b", nil)
+
+	assert.Equal(t, string(a.pem), mergeBundles(string(a.pem), ""))
+	assert.Equal(t, string(a.pem), mergeBundles(string(a.pem), string(a.pem)))
+	assert.Equal(t, string(concat(a.pem, b.pem)), mergeBundles(string(a.pem), string(concat(b.pem, a.pem))))
+	assert.Equal(t, "NEW_CA\nOLD_CA", mergeBundles("NEW_CA", "OLD_CA"))
+	assert.Equal(t, "NEW_CA", mergeBundles("NEW_CA", "NEW_CA"))
+}
+
+func TestCerts_ensureTrustBundle(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	setNow(t, start)
+	profile := DefaultCAProfile()
+	c := prepareTest(t, testCfg{})
+
+	cm, err := ensureTrustBundle(ctx, c, l, testCANamespace, profile, "", "OLD_CA")
+	require.NoError(t, err)
+	assert.Equal(t, "service-ca-root-trust-bundle", cm.Name)
+	assert.Equal(t, "OLD_CA", cm.Data["ca.crt"])
+	assert.Equal(t, CASecretName, cm.Annotations[CASecretAnnotation])
+
+	cm, err = ensureTrustBundle(ctx, c, l, testCANamespace, profile, "", "OLD_CA")
+	require.NoError(t, err)
+	assert.NotContains(t, cm.Annotations, CARotatedAtAnnotation)
+
+	cm, err = ensureTrustBundle(ctx, c, l, testCANamespace, profile, "", "NEW_CA")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW_CA\nOLD_CA", cm.Data["ca.crt"])
+	assert.Equal(t, "2022-05-01T12:00:00Z", cm.Annotations[CARotatedAtAnnotation])
+	assert.Equal(t, bundleFingerprint("NEW_CA"), cm.Annotations[CAFingerprintAnnotation])
+
+	stored := corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(cm), &stored))
+	assert.Equal(t, cm.Data, stored.Data)
+}
+
+func TestCerts_ReconcileCARotation(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Now().Truncate(time.Second)
+	setNow(t, start)
+
+	oldCA := newTestCA(t, "service-ca", nil)
+	newCA := newTestCA(t, "service-ca", nil)
+	oldLeaf := newTestCertificate(t, "test-svc", oldCA, false)
+	newLeaf := newTestCertificate(t, "test-svc", newCA, false)
+	profile := DefaultCAProfile()
+
+	leafSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-tls",
+			Namespace: "test-ns",
+		},
+		Data: map[string][]byte{
+			"tls.crt": oldLeaf.pem,
+		},
+	}
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&extv1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "certificates.cert-manager.io",
+				},
+			},
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CACertName,
+					Namespace: testCANamespace,
+				},
+				Spec: newCACertificate(testCANamespace, profile).Spec,
+				Status: cmapi.CertificateStatus{
+					Conditions: []cmapi.CertificateCondition{{
+						Type:   cmapi.CertificateConditionReady,
+						Status: cmmeta.ConditionTrue,
+					}},
+				},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": newCA.pem,
+				},
+			},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      TrustBundleName(CASecretName),
+					Namespace: testCANamespace,
+					Labels: map[string]string{
+						TrustBundleLabelKey: "true",
+					},
+					Annotations: map[string]string{
+						CASecretAnnotation:      CASecretName,
+						CAFingerprintAnnotation: bundleFingerprint(string(oldCA.pem)),
+					},
+				},
+				Data: map[string]string{
+					"ca.crt": string(oldCA.pem),
+				},
+			},
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-svc-tls",
+					Namespace: "test-ns",
+				},
+				Spec: cmapi.CertificateSpec{
+					SecretName: "test-svc-tls",
+					IssuerRef:  profile.IssuerRef(),
+				},
+			},
+			// Certificates of other issuers are ignored
+			&cmapi.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "other-tls",
+					Namespace: "test-ns",
+				},
+				Spec: cmapi.CertificateSpec{
+					SecretName: "other-tls",
+					IssuerRef: cmmeta.ObjectReference{
+						Name: "letsencrypt",
+						Kind: "ClusterIssuer",
+					},
+				},
+			},
+			leafSecret,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "other-tls",
+					Namespace: "test-ns",
+				},
+				Data: map[string][]byte{
+					"tls.crt": oldLeaf.pem,
+				},
+			},
+		},
+	})
+	trustBundle := func() corev1.ConfigMap {
+		cm := corev1.ConfigMap{}
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testCANamespace, Name: TrustBundleName(CASecretName)}, &cm))
+		return cm
+	}
+
+	// The rotation starts, and the old CA is kept in the trust bundle
+	res, err := ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{RequeueAfter: 24 * time.Hour}, res)
+	cm := trustBundle()
+	assert.Equal(t, string(concat(newCA.pem, oldCA.pem)), cm.Data["ca.crt"])
+	ca, err := GetServiceCA(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, string(concat(newCA.pem, oldCA.pem)), ca)
+
+	// After the grace period, the certificate is reissued
+	setNow(t, start.Add(24*time.Hour))
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{
+		Reissued:     []string{"test-ns/test-svc-tls"},
+		RequeueAfter: time.Minute,
+	}, res)
+	cert := cmapi.Certificate{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "test-ns", Name: "test-svc-tls"}, &cert))
+	require.Len(t, cert.Status.Conditions, 1)
+	assert.Equal(t, cmapi.CertificateConditionIssuing, cert.Status.Conditions[0].Type)
+	assert.Equal(t, cmmeta.ConditionTrue, cert.Status.Conditions[0].Status)
+
+	// The reissue isn't triggered again while it's in progress
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{RequeueAfter: time.Minute}, res)
+
+	// Once the certificate is reissued, the old CA is kept for another
+	// grace period
+	leafSecret.Data["tls.crt"] = newLeaf.pem
+	require.NoError(t, c.Update(ctx, leafSecret))
+	setNow(t, start.Add(25*time.Hour))
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{RequeueAfter: 24 * time.Hour}, res)
+	assert.Equal(t, start.Add(25*time.Hour).UTC().Format(time.RFC3339), trustBundle().Annotations[CAReissuedAtAnnotation])
+
+	setNow(t, start.Add(49*time.Hour))
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{Completed: true}, res)
+	cm = trustBundle()
+	assert.Equal(t, string(newCA.pem), cm.Data["ca.crt"])
+	assert.NotContains(t, cm.Annotations, CARotatedAtAnnotation)
+	assert.NotContains(t, cm.Annotations, CAReissuedAtAnnotation)
+
+	// Nothing to do once the rotation completed
+	res, err = ReconcileCARotation(ctx, c, l, testCANamespace, profile, "")
+	require.NoError(t, err)
+	assert.Equal(t, CARotation{}, res)
+}
+
+func TestCerts_IndexCertificateIssuer(t *testing.T) {
+	tcs := map[string]struct {
+		ref      cmmeta.ObjectReference
+		expected []string
+	}{
+		"ClusterIssuer": {
+			ref:      cmmeta.ObjectReference{Name: ServiceIssuerName, Kind: cmapi.ClusterIssuerKind},
+			expected: []string{ServiceIssuerName},
+		},
+		"ClusterIssuer_Group": {
+			ref:      cmmeta.ObjectReference{Name: ServiceIssuerName, Kind: cmapi.ClusterIssuerKind, Group: "cert-manager.io"},
+			expected: []string{ServiceIssuerName},
+		},
+		"Issuer": {
+			ref: cmmeta.ObjectReference{Name: ServiceIssuerName, Kind: cmapi.IssuerKind},
+		},
+		"ExternalIssuer": {
+			ref: cmmeta.ObjectReference{Name: ServiceIssuerName, Kind: cmapi.ClusterIssuerKind, Group: "example.com"},
+		},
+	}
+	for tn, tc := range tcs {
+		t.Run(tn, func(t *testing.T) {
+			cert := &cmapi.Certificate{Spec: cmapi.CertificateSpec{IssuerRef: tc.ref}}
+			assert.Equal(t, tc.expected, IndexCertificateIssuer(cert))
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ExtraSANsAnnotation is the Service annotation which lists additional
+	// DNS names, IP addresses and URIs for the Service's certificate
+	ExtraSANsAnnotation = "service.syn.tools/extra-sans"
+	// HeadlessWildcardAnnotation is the Service annotation which adds
+	// wildcard DNS names for the pod DNS records of a headless Service
+	HeadlessWildcardAnnotation = "service.syn.tools/headless-wildcard"
+	// IncludeExternalAddressesAnnotation is the Service annotation which
+	// adds the Service's external IPs and load balancer addresses to the
+	// Service's certificate
+	IncludeExternalAddressesAnnotation = "service.syn.tools/include-external-addresses"
+
+	// CertificateDNSNameIndex is the field index of the Certificates of
+	// Services by their DNS names, see IndexCertificateDNSNames(). The
+	// index must be registered with the manager of the client which is
+	// passed to the functions which check the names requested by
+	// Services.
+	CertificateDNSNameIndex = "spec.dnsNames"
+)
+
+// subjectAltNames holds the DNS names, IP addresses and URIs of a certificate
+type subjectAltNames struct {
+	DNSNames    []string
+	IPAddresses []string
+	URIs        []string
+}
+
+// IsHeadless returns true if the Service is a headless Service
+func IsHeadless(svc *corev1.Service) bool {
+	return svc.Spec.ClusterIP == corev1.ClusterIPNone ||
+		(len(svc.Spec.ClusterIPs) > 0 && svc.Spec.ClusterIPs[0] == corev1.ClusterIPNone)
+}
+
+// serviceIPAddresses returns the validated and normalized ClusterIPs of the
+// Service. Headless Services have no IP addresses. Dual-stack Services may
+// have at most one ClusterIP per IP family, and the ClusterIPs must match
+// the Service's IP families.
+func serviceIPAddresses(svc *corev1.Service) ([]string, error) {
+	if IsHeadless(svc) {
+		return nil, nil
+	}
+	ips := []string{}
+	seenFamilies := map[corev1.IPFamily]bool{}
+	for i, a := range svc.Spec.ClusterIPs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, invalidConfigErrorf("invalid ClusterIP %q", a)
+		}
+		family := corev1.IPv6Protocol
+		if ip.To4() != nil {
+			family = corev1.IPv4Protocol
+		}
+		if seenFamilies[family] {
+			return nil, invalidConfigErrorf("multiple %s ClusterIPs", family)
+		}
+		seenFamilies[family] = true
+		if i < len(svc.Spec.IPFamilies) && svc.Spec.IPFamilies[i] != family {
+			return nil, invalidConfigErrorf("ClusterIP %s doesn't match IP family %s",
+				a, svc.Spec.IPFamilies[i])
+		}
+		ips = append(ips, ip.String())
+	}
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	return ips, nil
+}
+
+// headlessWildcardDNSNames returns the wildcard DNS names for the pod DNS
+// records of a headless Service, if requested in annotation
+// `service.syn.tools/headless-wildcard`.
+func headlessWildcardDNSNames(svc *corev1.Service, cfg Config) ([]string, error) {
+	v, ok := svc.Annotations[HeadlessWildcardAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	wildcard, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, invalidConfigErrorf("annotation %s: %q is not a boolean", HeadlessWildcardAnnotation, v)
+	}
+	if !wildcard {
+		return nil, nil
+	}
+	if !IsHeadless(svc) {
+		return nil, invalidConfigErrorf("annotation %s is only supported on headless Services", HeadlessWildcardAnnotation)
+	}
+	return []string{
+		fmt.Sprintf("*.%s.%s.svc", svc.Name, svc.Namespace),
+		fmt.Sprintf("*.%s.%s.svc.%s", svc.Name, svc.Namespace, cfg.ClusterDomain),
+	}, nil
+}
+
+// externalSANsFromSvc returns the external addresses of the Service. For
+// ExternalName Services, the external name is always returned. The external
+// IPs and the load balancer ingress addresses are only returned if
+// annotation `service.syn.tools/include-external-addresses` is `true`.
+func externalSANsFromSvc(svc *corev1.Service) (subjectAltNames, error) {
+	sans := subjectAltNames{}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName && svc.Spec.ExternalName != "" {
+		sans.DNSNames = append(sans.DNSNames, strings.ToLower(strings.TrimSuffix(svc.Spec.ExternalName, ".")))
+	}
+
+	v, ok := svc.Annotations[IncludeExternalAddressesAnnotation]
+	if !ok {
+		return sans, nil
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		return sans, invalidConfigErrorf("annotation %s: %q is not a boolean", IncludeExternalAddressesAnnotation, v)
+	}
+	if !include {
+		return sans, nil
+	}
+
+	addIP := func(a string) error {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return invalidConfigErrorf("invalid external IP address %q", a)
+		}
+		sans.IPAddresses = appendUnique(sans.IPAddresses, ip.String())
+		return nil
+	}
+	for _, a := range svc.Spec.ExternalIPs {
+		if err := addIP(a); err != nil {
+			return sans, err
+		}
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			if err := addIP(ingress.IP); err != nil {
+				return sans, err
+			}
+		}
+		if ingress.Hostname != "" {
+			sans.DNSNames = appendUnique(sans.DNSNames, strings.ToLower(ingress.Hostname))
+		}
+	}
+	return sans, nil
+}
+
+// checkExternalSANs verifies that the external name and the external IPs of
+// the Service don't claim names or addresses of Services in other
+// namespaces. Both are set by the Service's owner, so they're checked like
+// the names in annotation `service.syn.tools/extra-sans`. The load balancer
+// addresses are assigned by the cluster and aren't checked.
+func checkExternalSANs(ctx context.Context, c client.Client, svc *corev1.Service, cfg Config) error {
+	sans, err := externalSANsFromSvc(svc)
+	if err != nil {
+		return err
+	}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName && len(sans.DNSNames) > 0 {
+		// The external name is the first DNS name, the others are load
+		// balancer hostnames
+		err := checkSANsOwned(ctx, c, svc, cfg, "external name",
+			subjectAltNames{DNSNames: sans.DNSNames[:1]})
+		if err != nil {
+			return err
+		}
+	}
+	externalIPs := subjectAltNames{}
+	for _, a := range svc.Spec.ExternalIPs {
+		if ip := net.ParseIP(a); ip != nil && containsString(sans.IPAddresses, ip.String()) {
+			externalIPs.IPAddresses = append(externalIPs.IPAddresses, ip.String())
+		}
+	}
+	return checkSANsOwned(ctx, c, svc, cfg, "external IPs", externalIPs)
+}
+
+// extraSANsFromSvc parses the comma-separated list of subject alternative
+// names in annotation `service.syn.tools/extra-sans`. Entries which contain
+// `://` are URIs, entries which parse as IP addresses are IP addresses, and
+// all other entries are DNS names.
+func extraSANsFromSvc(svc *corev1.Service) (subjectAltNames, error) {
+	sans := subjectAltNames{}
+	v, ok := svc.Annotations[ExtraSANsAnnotation]
+	if !ok {
+		return sans, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil || u.Scheme == "" {
+				return sans, invalidConfigErrorf("annotation %s: invalid URI %q", ExtraSANsAnnotation, entry)
+			}
+			sans.URIs = append(sans.URIs, u.String())
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			sans.IPAddresses = append(sans.IPAddresses, ip.String())
+			continue
+		}
+		name := strings.ToLower(entry)
+		if errs := validation.IsWildcardDNS1123Subdomain(name); len(errs) > 0 && len(validation.IsDNS1123Subdomain(name)) > 0 {
+			return sans, invalidConfigErrorf("annotation %s: invalid DNS name %q", ExtraSANsAnnotation, entry)
+		}
+		sans.DNSNames = append(sans.DNSNames, name)
+	}
+	return sans, nil
+}
+
+// checkExtraSANs verifies that the extra subject alternative names requested
+// by the Service don't claim names or addresses of Services in other
+// namespaces.
+func checkExtraSANs(ctx context.Context, c client.Client, svc *corev1.Service, cfg Config) error {
+	sans, err := extraSANsFromSvc(svc)
+	if err != nil {
+		return err
+	}
+	return checkSANsOwned(ctx, c, svc, cfg, "annotation "+ExtraSANsAnnotation, sans)
+}
+
+// checkSANsOwned verifies that the DNS names and IP addresses in `sans`
+// don't belong to Services in other namespaces. DNS names which aren't
+// cluster-internal belong to the namespace whose Service certificate has
+// them first. `source` describes where the names come from in the error
+// message.
+func checkSANsOwned(ctx context.Context, c client.Client, svc *corev1.Service, cfg Config, source string, sans subjectAltNames) error {
+	for _, name := range sans.DNSNames {
+		ns, svcName := serviceForDNSName(name, cfg.ClusterDomain)
+		if ns == "" {
+			if err := checkDNSNameUnclaimed(ctx, c, svc, source, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if ns == svc.Namespace {
+			continue
+		}
+		if svcName == "" {
+			return invalidConfigErrorf("%s: DNS name %q belongs to namespace %s",
+				source, name, ns)
+		}
+		// Names of the form `<service>.<namespace>` are only rejected if
+		// the Service exists, as they may also be regular DNS names.
+		other := corev1.Service{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: ns, Name: svcName}, &other)
+		if err == nil {
+			return invalidConfigErrorf("%s: DNS name %q belongs to Service %s/%s",
+				source, name, ns, svcName)
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if len(sans.IPAddresses) == 0 {
+		return nil
+	}
+	services := corev1.ServiceList{}
+	if err := c.List(ctx, &services); err != nil {
+		return err
+	}
+	for _, ip := range sans.IPAddresses {
+		for _, other := range services.Items {
+			if other.Namespace == svc.Namespace {
+				continue
+			}
+			if serviceHasIP(&other, ip) {
+				return invalidConfigErrorf("%s: IP address %s belongs to Service %s/%s",
+					source, ip, other.Namespace, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDNSNameUnclaimed verifies that the DNS name `name` isn't in the
+// certificate of a Service in another namespace
+func checkDNSNameUnclaimed(ctx context.Context, c client.Client, svc *corev1.Service, source, name string) error {
+	certList := cmapi.CertificateList{}
+	if err := c.List(ctx, &certList, client.MatchingFields{CertificateDNSNameIndex: name}); err != nil {
+		return err
+	}
+	for i := range certList.Items {
+		cert := &certList.Items[i]
+		if cert.Namespace == svc.Namespace {
+			continue
+		}
+		// Check the DNS names as well, as not all clients support field
+		// selectors
+		if containsString(IndexCertificateDNSNames(cert), name) {
+			return invalidConfigErrorf("%s: DNS name %q belongs to Service %s/%s",
+				source, name, cert.Namespace, metav1.GetControllerOf(cert).Name)
+		}
+	}
+	return nil
+}
+
+// IndexCertificateDNSNames indexes the Certificates of Services by their DNS
+// names, see CertificateDNSNameIndex. Other Certificates aren't indexed.
+func IndexCertificateDNSNames(obj client.Object) []string {
+	cert, ok := obj.(*cmapi.Certificate)
+	if !ok {
+		return nil
+	}
+	owner := metav1.GetControllerOf(cert)
+	if owner == nil || owner.Kind != "Service" || owner.APIVersion != "v1" {
+		return nil
+	}
+	names := make([]string, 0, len(cert.Spec.DNSNames))
+	for _, name := range cert.Spec.DNSNames {
+		names = appendUnique(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// serviceForDNSName returns the namespace which the cluster-internal DNS name
+// `name` belongs to. For names of the form `<service>.<namespace>`, the
+// service name is returned as well. Names in the default cluster domain
+// `cluster.local` are cluster-internal as well, as they may still resolve
+// in clusters with a different domain. Returns an empty namespace for names
+// which aren't cluster-internal.
+func serviceForDNSName(name, clusterDomain string) (namespace, svcName string) {
+	name = strings.TrimPrefix(name, "*.")
+	for _, domain := range []string{clusterDomain, DefaultClusterDomain} {
+		if strings.HasSuffix(name, "."+domain) {
+			name = strings.TrimSuffix(name, "."+domain)
+			break
+		}
+	}
+	labels := strings.Split(name, ".")
+	n := len(labels)
+	if n >= 2 && (labels[n-1] == "svc" || labels[n-1] == "pod") {
+		return labels[n-2], ""
+	}
+	if n == 2 {
+		return labels[1], labels[0]
+	}
+	return "", ""
+}
+
+func serviceHasIP(svc *corev1.Service, ip string) bool {
+	addrs := append(append([]string{}, svc.Spec.ClusterIPs...), svc.Spec.ExternalIPs...)
+	for _, a := range addrs {
+		if parsed := net.ParseIP(a); parsed != nil && parsed.String() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends the entries of `extra` which aren't present in `list`
+func appendUnique(list []string, extra ...string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, e := range list {
+		seen[e] = true
+	}
+	for _, e := range extra {
+		if !seen[e] {
+			seen[e] = true
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,434 @@
+package certs
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_extraSANsFromSvc(t *testing.T) {
+	tests := map[string]struct {
+		annotation *string
+		sans       subjectAltNames
+		invalid    bool
+	}{
+		"NoAnnotation": {
+			sans: subjectAltNames{},
+		},
+		"Mixed": {
+			annotation: strPtr(" localhost, app.example.internal,*.app.example.internal, 192.0.2.10 ,2001:DB8::1,spiffe://cluster.local/ns/test-ns/sa/app"),
+			sans: subjectAltNames{
+				DNSNames:    []string{"localhost", "app.example.internal", "*.app.example.internal"},
+				IPAddresses: []string{"192.0.2.10", "2001:db8::1"},
+				URIs:        []string{"spiffe://cluster.local/ns/test-ns/sa/app"},
+			},
+		},
+		"InvalidDNSName": {
+			annotation: strPtr("not a name"),
+			invalid:    true,
+		},
+		"InvalidURI": {
+			annotation: strPtr("://foo"),
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				ExtraSANsAnnotation: *tc.annotation,
+			}
+		}
+		sans, err := extraSANsFromSvc(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.sans, sans, testn)
+		}
+	}
+}
+
+func TestCerts_checkExtraSANs(t *testing.T) {
+	ctx := context.Background()
+	otherSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "other-ns",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIPs:  []string{"198.51.100.20"},
+			ExternalIPs: []string{"203.0.113.5"},
+		},
+	}
+	isController := true
+	serviceCert := func(namespace, svcName string, dnsNames ...string) *cmapi.Certificate {
+		return &cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      svcName,
+				Namespace: namespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Service",
+					Name:       svcName,
+					Controller: &isController,
+				}},
+			},
+			Spec: cmapi.CertificateSpec{DNSNames: dnsNames},
+		}
+	}
+
+	tests := map[string]struct {
+		annotation    string
+		clusterDomain string
+		invalid       bool
+	}{
+		"ExternalNames": {
+			annotation: "localhost,app.example.internal,192.0.2.10",
+		},
+		"OwnNamespace": {
+			annotation: "alias.test-ns,alias.test-ns.svc,*.alias.test-ns.svc.cluster.local",
+		},
+		"OwnServiceIP": {
+			annotation: "198.51.100.10",
+		},
+		"OtherNamespaceSvc": {
+			annotation: "db.other-ns.svc",
+			invalid:    true,
+		},
+		"OtherNamespaceFQDN": {
+			annotation: "*.db.other-ns.svc.cluster.local",
+			invalid:    true,
+		},
+		"OtherNamespacePod": {
+			annotation: "10-0-0-1.other-ns.pod.cluster.local",
+			invalid:    true,
+		},
+		"OtherNamespaceShortName": {
+			annotation: "db.other-ns",
+			invalid:    true,
+		},
+		"ShortNameNoService": {
+			annotation: "web.other-ns",
+		},
+		"OtherNamespaceDefaultClusterDomain": {
+			annotation:    "db.other-ns.svc.cluster.local",
+			clusterDomain: "example.internal",
+			invalid:       true,
+		},
+		"OtherNamespaceClusterDomain": {
+			annotation:    "db.other-ns.svc.example.internal",
+			clusterDomain: "example.internal",
+			invalid:       true,
+		},
+		"OtherServiceCertificateName": {
+			annotation: "API.corp.example",
+			invalid:    true,
+		},
+		"OwnServiceCertificateName": {
+			annotation: "web.corp.example",
+		},
+		"OtherServiceClusterIP": {
+			annotation: "198.51.100.20",
+			invalid:    true,
+		},
+		"OtherServiceExternalIP": {
+			annotation: "203.0.113.5",
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		svc.Annotations = map[string]string{
+			ExtraSANsAnnotation: tc.annotation,
+		}
+		c := prepareTest(t, testCfg{
+			initObjs: []client.Object{&svc, otherSvc,
+				serviceCert("other-ns", "db", "api.corp.example"),
+				serviceCert("test-ns", "web", "web.corp.example"),
+			},
+		})
+		cfg := DefaultConfig()
+		if tc.clusterDomain != "" {
+			cfg.ClusterDomain = tc.clusterDomain
+		}
+		err := checkExtraSANs(ctx, c, &svc, cfg)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
+	}
+}
+
+func TestCerts_serviceIPAddresses(t *testing.T) {
+	tests := map[string]struct {
+		clusterIP  string
+		clusterIPs []string
+		families   []corev1.IPFamily
+		ips        []string
+		invalid    bool
+	}{
+		"NoClusterIPs": {
+			ips: nil,
+		},
+		"Headless": {
+			clusterIP:  "None",
+			clusterIPs: []string{"None"},
+			ips:        nil,
+		},
+		"HeadlessClusterIPOnly": {
+			clusterIP: "None",
+			ips:       nil,
+		},
+		"SingleStack": {
+			clusterIPs: []string{"198.51.100.10"},
+			families:   []corev1.IPFamily{corev1.IPv4Protocol},
+			ips:        []string{"198.51.100.10"},
+		},
+		"DualStack": {
+			clusterIPs: []string{"2001:DB8:0:0::10", "198.51.100.10"},
+			families:   []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol},
+			ips:        []string{"2001:db8::10", "198.51.100.10"},
+		},
+		"InvalidIP": {
+			clusterIPs: []string{"198.51.100.300"},
+			invalid:    true,
+		},
+		"SameFamilyTwice": {
+			clusterIPs: []string{"198.51.100.10", "198.51.100.11"},
+			invalid:    true,
+		},
+		"FamilyMismatch": {
+			clusterIPs: []string{"198.51.100.10"},
+			families:   []corev1.IPFamily{corev1.IPv6Protocol},
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		svc.Spec.ClusterIP = tc.clusterIP
+		svc.Spec.ClusterIPs = tc.clusterIPs
+		svc.Spec.IPFamilies = tc.families
+		ips, err := serviceIPAddresses(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.ips, ips, testn)
+		}
+	}
+}
+
+func TestCerts_headlessWildcardDNSNames(t *testing.T) {
+	tests := map[string]struct {
+		headless   bool
+		annotation *string
+		names      []string
+		invalid    bool
+	}{
+		"NoAnnotation": {
+			headless: true,
+		},
+		"Disabled": {
+			headless:   true,
+			annotation: strPtr("false"),
+		},
+		"Enabled": {
+			headless:   true,
+			annotation: strPtr("true"),
+			names: []string{
+				"*.test-svc.test-ns.svc",
+				"*.test-svc.test-ns.svc.cluster.local",
+			},
+		},
+		"InvalidValue": {
+			headless:   true,
+			annotation: strPtr("yes please"),
+			invalid:    true,
+		},
+		"NotHeadless": {
+			annotation: strPtr("true"),
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.headless {
+			svc.Spec.ClusterIP = corev1.ClusterIPNone
+			svc.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+		}
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				HeadlessWildcardAnnotation: *tc.annotation,
+			}
+		}
+		names, err := headlessWildcardDNSNames(&svc, DefaultConfig())
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.names, names, testn)
+		}
+	}
+}
+
+func TestCerts_externalSANsFromSvc(t *testing.T) {
+	lbStatus := corev1.ServiceStatus{
+		LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{
+				{IP: "203.0.113.10"},
+				{Hostname: "LB-1234.elb.example.com"},
+			},
+		},
+	}
+	tests := map[string]struct {
+		svcType      corev1.ServiceType
+		externalName string
+		externalIPs  []string
+		status       corev1.ServiceStatus
+		annotation   *string
+		sans         subjectAltNames
+		invalid      bool
+	}{
+		"ClusterIP": {
+			svcType: corev1.ServiceTypeClusterIP,
+		},
+		"LoadBalancerNotIncluded": {
+			svcType: corev1.ServiceTypeLoadBalancer,
+			status:  lbStatus,
+		},
+		"LoadBalancerIncluded": {
+			svcType:     corev1.ServiceTypeLoadBalancer,
+			externalIPs: []string{"198.51.100.50", "203.0.113.10"},
+			status:      lbStatus,
+			annotation:  strPtr("true"),
+			sans: subjectAltNames{
+				DNSNames:    []string{"lb-1234.elb.example.com"},
+				IPAddresses: []string{"198.51.100.50", "203.0.113.10"},
+			},
+		},
+		"ExternalName": {
+			svcType:      corev1.ServiceTypeExternalName,
+			externalName: "db.example.com.",
+			sans: subjectAltNames{
+				DNSNames: []string{"db.example.com"},
+			},
+		},
+		"InvalidAnnotation": {
+			svcType:    corev1.ServiceTypeLoadBalancer,
+			annotation: strPtr("maybe"),
+			invalid:    true,
+		},
+		"InvalidExternalIP": {
+			svcType:     corev1.ServiceTypeClusterIP,
+			externalIPs: []string{"not-an-ip"},
+			annotation:  strPtr("true"),
+			invalid:     true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		svc.Spec.Type = tc.svcType
+		svc.Spec.ExternalName = tc.externalName
+		svc.Spec.ExternalIPs = tc.externalIPs
+		svc.Status = tc.status
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				IncludeExternalAddressesAnnotation: *tc.annotation,
+			}
+		}
+		sans, err := externalSANsFromSvc(&svc)
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.sans, sans, testn)
+		}
+	}
+}
+
+func TestCerts_checkExternalSANs(t *testing.T) {
+	ctx := context.Background()
+	otherSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: "other-ns",
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIPs: []string{"198.51.100.20"},
+		},
+	}
+
+	tests := map[string]struct {
+		svcType      corev1.ServiceType
+		externalName string
+		externalIPs  []string
+		status       corev1.ServiceStatus
+		invalid      bool
+	}{
+		"ExternalName": {
+			svcType:      corev1.ServiceTypeExternalName,
+			externalName: "db.example.com",
+		},
+		"ExternalNameOwnNamespace": {
+			svcType:      corev1.ServiceTypeExternalName,
+			externalName: "db.test-ns.svc.cluster.local",
+		},
+		"ExternalNameOtherNamespace": {
+			svcType:      corev1.ServiceTypeExternalName,
+			externalName: "db.other-ns.svc.cluster.local",
+			invalid:      true,
+		},
+		"ExternalNameOtherService": {
+			svcType:      corev1.ServiceTypeExternalName,
+			externalName: "db.other-ns",
+			invalid:      true,
+		},
+		"ExternalIP": {
+			svcType:     corev1.ServiceTypeClusterIP,
+			externalIPs: []string{"203.0.113.5"},
+		},
+		"ExternalIPOfOtherService": {
+			svcType:     corev1.ServiceTypeClusterIP,
+			externalIPs: []string{"198.51.100.20"},
+			invalid:     true,
+		},
+		"LoadBalancerAddressNotChecked": {
+			svcType: corev1.ServiceTypeLoadBalancer,
+			status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{IP: "198.51.100.20"}},
+				},
+			},
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		svc.Spec.Type = tc.svcType
+		svc.Spec.ExternalName = tc.externalName
+		svc.Spec.ExternalIPs = tc.externalIPs
+		svc.Status = tc.status
+		svc.Annotations = map[string]string{
+			IncludeExternalAddressesAnnotation: "true",
+		}
+		c := prepareTest(t, testCfg{
+			initObjs: []client.Object{&svc, otherSvc},
+		})
+		err := checkExternalSANs(ctx, c, &svc, DefaultConfig())
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,444 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// CAProfileLabelKey is the label of the CA Certificates and
+	// ClusterIssuers which the controller creates for a CA. The value is
+	// the name of the CA, see CAProfile.Name. The controller finds the
+	// resources of a CA by this label after the resource names of the
+	// profile changed.
+	CAProfileLabelKey = "service.syn.tools/ca-profile"
+	// CAStagedAtAnnotation is the annotation on a staged CA Certificate
+	// which records when the staged CA was added to the trust bundle
+	CAStagedAtAnnotation = "service.syn.tools/ca-staged-at"
+
+	// StagedCASuffix is appended to the names of the CA Certificate and
+	// secret of a staged CA
+	StagedCASuffix = "-staged"
+)
+
+// stagedProfile returns the CA profile of the staged CA which replaces the
+// CA of the profile after a profile change. The staged CA is issued into
+// its own secret, so that the current CA keeps issuing certificates until
+// clients trust the staged CA.
+func (p *CAProfile) stagedProfile() CAProfile {
+	sp := *p
+	sp.CertificateName = p.CertificateName + StagedCASuffix
+	sp.SecretName = p.SecretName + StagedCASuffix
+	return sp
+}
+
+// caLabels returns the labels of the CA Certificate and ClusterIssuer of
+// the profile. Intermediate CAs don't have a name and aren't labeled.
+func (p *CAProfile) caLabels() map[string]string {
+	if p.Name == "" {
+		return nil
+	}
+	labels := map[string]string{CAProfileLabelKey: p.Name}
+	if p.group != "" {
+		labels[CAGroupLabelKey] = p.group
+	}
+	return labels
+}
+
+// hasCALabels returns true if `obj` carries the labels of the profile's CA
+// resources
+func (p *CAProfile) hasCALabels(obj client.Object) bool {
+	labels := obj.GetLabels()
+	return labels[CAProfileLabelKey] == p.Name && labels[CAGroupLabelKey] == p.group
+}
+
+// ensureCACertificate creates the CA Certificate of the profile if it
+// doesn't exist. If the CA Certificate exists but doesn't match the profile,
+// the change is rolled out through a staged CA, see stageCACertificate().
+// Returns how long until the staged CA replaces the current CA, or zero if
+// no CA is staged.
+func ensureCACertificate(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) (time.Duration, error) {
+	caCert := cmapi.Certificate{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.CertificateName, Namespace: caNamespace}, &caCert)
+	if err != nil && !errors.IsNotFound(err) {
+		l.Error(err, "while fetching service CA certificate")
+		return 0, err
+	}
+	exists := err == nil
+	staged, err := getStagedCACertificate(ctx, c, caNamespace, profile)
+	if err != nil {
+		return 0, err
+	}
+	desired := newCACertificate(caNamespace, profile)
+
+	if !exists && staged == nil {
+		l.Info("Service CA certificate doesn't exist, creating...")
+		return 0, c.Create(ctx, &desired)
+	}
+	if exists && reflect.DeepEqual(caCert.Spec, desired.Spec) {
+		if staged != nil {
+			// The profile change was reverted, or the staged CA
+			// replaced the CA
+			l.Info("Removing staged CA certificate")
+			if err := deleteCACertificateAndSecret(ctx, c, staged); err != nil {
+				return 0, err
+			}
+		}
+		if !profile.hasCALabels(&caCert) {
+			caCert.Labels = mergeLabels(caCert.Labels, profile.caLabels())
+			return 0, c.Update(ctx, &caCert)
+		}
+		return 0, nil
+	}
+	var current *cmapi.Certificate
+	if exists {
+		current = &caCert
+	}
+	return stageCACertificate(ctx, c, l, caNamespace, profile, current, staged)
+}
+
+// stageCACertificate rolls out a change of the CA profile without breaking
+// clients which trust the current CA. Updating the CA Certificate would make
+// cert-manager reissue the CA right away, so that the issuer signs
+// certificates with a CA which clients don't trust yet. Instead, the CA is
+// issued as a staged CA into a separate secret, and the staged CA is added
+// to the trust bundle. Once the rotation grace period has passed, the
+// staged CA replaces the current CA: The CA Certificate is recreated for the
+// profile and the staged CA certificate and key are moved into the CA
+// secret, so that cert-manager keeps them. The certificates issued by the
+// previous CA are then reissued by the regular CA rotation.
+// `current` is nil if the CA Certificate doesn't exist, and `staged` is nil
+// if no CA is staged yet.
+func stageCACertificate(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile, current, staged *cmapi.Certificate) (time.Duration, error) {
+	sp := profile.stagedProfile()
+	desired := newCACertificate(caNamespace, sp)
+	if staged == nil {
+		l.Info("Service CA certificate doesn't match CA profile, staging new CA...")
+		return 0, c.Create(ctx, &desired)
+	}
+	if !reflect.DeepEqual(staged.Spec, desired.Spec) {
+		l.Info("Staged CA certificate doesn't match CA profile, restaging...")
+		staged.Spec = desired.Spec
+		delete(staged.Annotations, CAStagedAtAnnotation)
+		return 0, c.Update(ctx, staged)
+	}
+	if !isCertReady(staged) {
+		l.Info("Staged CA certificate not yet ready")
+		return 0, nil
+	}
+	stagedAt, ok := staged.Annotations[CAStagedAtAnnotation]
+	if !ok {
+		// The trust bundle includes the staged CA from now on, see
+		// stagedCABundle()
+		l.Info("Adding staged CA to the trust bundle")
+		if staged.Annotations == nil {
+			staged.Annotations = map[string]string{}
+		}
+		staged.Annotations[CAStagedAtAnnotation] = now().UTC().Format(time.RFC3339)
+		return profile.rotationGracePeriod(), c.Update(ctx, staged)
+	}
+	if remaining := remainingGrace(stagedAt, profile.rotationGracePeriod()); remaining > 0 {
+		l.V(1).Info("Waiting for clients to pick up the staged CA", "remaining", remaining)
+		return remaining, nil
+	}
+
+	l.Info("Replacing CA with staged CA")
+	// Delete the CA Certificate first, so that cert-manager doesn't
+	// reissue the CA from the previous profile once the CA secret holds
+	// the staged CA
+	if current != nil {
+		if err := client.IgnoreNotFound(c.Delete(ctx, current)); err != nil {
+			return 0, err
+		}
+	}
+	stagedSecret := corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Name: sp.SecretName, Namespace: caNamespace}, &stagedSecret); err != nil {
+		return 0, err
+	}
+	if err := copyCASecret(ctx, c, &stagedSecret, profile.SecretName, profile.CertificateName); err != nil {
+		return 0, err
+	}
+	caCert := newCACertificate(caNamespace, profile)
+	if err := c.Create(ctx, &caCert); err != nil {
+		return 0, err
+	}
+	return 0, deleteCACertificateAndSecret(ctx, c, staged)
+}
+
+// getStagedCACertificate returns the staged CA Certificate of the profile,
+// or nil if no CA is staged
+func getStagedCACertificate(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) (*cmapi.Certificate, error) {
+	staged := cmapi.Certificate{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.stagedProfile().CertificateName, Namespace: caNamespace}, &staged)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &staged, nil
+}
+
+// stagedCABundle returns the CA bundle of the staged CA of the profile once
+// the staged CA was added to the trust bundle, or an empty string
+func stagedCABundle(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) (string, error) {
+	if profile.NameConstraints {
+		return stagedConstrainedCABundle(ctx, c, caNamespace, profile)
+	}
+	staged, err := getStagedCACertificate(ctx, c, caNamespace, profile)
+	if err != nil || staged == nil {
+		return "", err
+	}
+	if _, ok := staged.Annotations[CAStagedAtAnnotation]; !ok {
+		return "", nil
+	}
+	secret := corev1.Secret{}
+	err = c.Get(ctx, client.ObjectKey{Name: staged.Spec.SecretName, Namespace: caNamespace}, &secret)
+	if err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	return caBundle(&secret, profile)
+}
+
+// stagedConstrainedCABundle returns the CA bundle of the staged CA of a CA
+// with name constraints, see stageConstrainedCA(). The staged secret
+// carries the annotation which records when the staged CA was added to the
+// trust bundle.
+func stagedConstrainedCABundle(ctx context.Context, c client.Client, caNamespace string, profile CAProfile) (string, error) {
+	secret := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.stagedProfile().SecretName, Namespace: caNamespace}, &secret)
+	if err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	if _, ok := secret.Annotations[CAStagedAtAnnotation]; !ok {
+		return "", nil
+	}
+	return caBundle(&secret, profile)
+}
+
+// withStagedCA returns the CA bundle `bundle` of the profile's CA followed
+// by the staged CA, if there is one
+func withStagedCA(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, bundle string) (string, error) {
+	staged, err := stagedCABundle(ctx, c, caNamespace, profile)
+	if err != nil || staged == "" {
+		return bundle, err
+	}
+	return mergeBundles(bundle, staged), nil
+}
+
+// migrateCAResources moves the CA of the profile to the profile's resource
+// names if they changed. The CA Certificate under its previous name is
+// found by its labels. The CA secret and trust bundle are copied to their
+// new names, so that the CA key and the rotation state are kept, and the CA
+// Certificate is recreated under its new name with the previous spec. A
+// change of the spec is then staged by ensureCACertificate(). Finally, the
+// resources under the previous names are deleted.
+func migrateCAResources(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile CAProfile) error {
+	certList := cmapi.CertificateList{}
+	if err := c.List(ctx, &certList, client.InNamespace(caNamespace),
+		client.MatchingLabels{CAProfileLabelKey: profile.Name}); err != nil {
+		return err
+	}
+	for i := range certList.Items {
+		old := &certList.Items[i]
+		if !profile.hasCALabels(old) || old.Name == profile.CertificateName ||
+			strings.HasSuffix(old.Name, StagedCASuffix) {
+			continue
+		}
+		log := l.WithValues("previousCertificate", old.Name, "previousSecret", old.Spec.SecretName)
+		log.Info("CA resource names changed, migrating CA...")
+		if err := migrateCACertificate(ctx, c, caNamespace, profile, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateCACertificate(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, old *cmapi.Certificate) error {
+	oldSecretName := old.Spec.SecretName
+	if oldSecretName != profile.SecretName {
+		secret := corev1.Secret{}
+		err := c.Get(ctx, client.ObjectKey{Name: oldSecretName, Namespace: caNamespace}, &secret)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err := copyCASecret(ctx, c, &secret, profile.SecretName, profile.CertificateName); err != nil {
+				return err
+			}
+		}
+		if err := migrateTrustBundle(ctx, c, caNamespace, profile, oldSecretName); err != nil {
+			return err
+		}
+	}
+
+	caCert := cmapi.Certificate{}
+	err := c.Get(ctx, client.ObjectKey{Name: profile.CertificateName, Namespace: caNamespace}, &caCert)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if errors.IsNotFound(err) {
+		caCert = newCACertificate(caNamespace, profile)
+		caCert.Spec = *old.Spec.DeepCopy()
+		caCert.Spec.SecretName = profile.SecretName
+		if profile.selfSigned() && old.Spec.IssuerRef.Kind == "Issuer" {
+			// A renamed self-signed Issuer signs the same CA
+			caCert.Spec.IssuerRef = profile.caIssuerRef()
+		}
+		if err := c.Create(ctx, &caCert); err != nil {
+			return err
+		}
+	}
+	if err := client.IgnoreNotFound(c.Delete(ctx, old)); err != nil {
+		return err
+	}
+
+	// Delete the previous resources which aren't used under the new names
+	oldProfile := profile
+	oldProfile.CertificateName = old.Name
+	oldProfile.SecretName = oldSecretName
+	stale := []client.Object{}
+	if oldSecretName != profile.SecretName {
+		stale = append(stale,
+			&corev1.Secret{},
+			&corev1.ConfigMap{},
+			&cmapi.Issuer{},
+			&corev1.Secret{})
+		stale[0].SetName(oldSecretName)
+		stale[1].SetName(TrustBundleName(oldSecretName))
+		stale[2].SetName(oldProfile.rootIssuerName())
+		stale[3].SetName(oldProfile.intermediateProfile().SecretName)
+	}
+	if old.Name != profile.CertificateName {
+		stale = append(stale, &cmapi.Certificate{})
+		stale[len(stale)-1].SetName(oldProfile.intermediateProfile().CertificateName)
+	}
+	for _, obj := range stale {
+		obj.SetNamespace(caNamespace)
+		if err := client.IgnoreNotFound(c.Delete(ctx, obj)); err != nil {
+			return err
+		}
+	}
+	return deleteUnusedSelfSignedIssuer(ctx, c, caNamespace, profile, old.Spec.IssuerRef)
+}
+
+// migrateTrustBundle copies the trust bundle of the CA secret
+// `oldSecretName` to the trust bundle of the profile, unless the profile's
+// trust bundle exists already
+func migrateTrustBundle(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, oldSecretName string) error {
+	old := corev1.ConfigMap{}
+	err := c.Get(ctx, client.ObjectKey{Name: TrustBundleName(oldSecretName), Namespace: caNamespace}, &old)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	cm := corev1.ConfigMap{}
+	err = c.Get(ctx, client.ObjectKey{Name: TrustBundleName(profile.SecretName), Namespace: caNamespace}, &cm)
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	cm.Name = TrustBundleName(profile.SecretName)
+	cm.Namespace = caNamespace
+	cm.Labels = old.Labels
+	cm.Annotations = old.Annotations
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[CASecretAnnotation] = profile.SecretName
+	cm.Data = old.Data
+	return c.Create(ctx, &cm)
+}
+
+// deleteUnusedSelfSignedIssuer deletes the self-signed Issuer `ref` which
+// signed a CA before the profile's names changed, unless it's the profile's
+// self-signed Issuer or another Certificate still uses it
+func deleteUnusedSelfSignedIssuer(ctx context.Context, c client.Client, caNamespace string, profile CAProfile, ref cmmeta.ObjectReference) error {
+	if ref.Kind != "Issuer" || ref.Name == profile.SelfSignedIssuerName {
+		return nil
+	}
+	iss := cmapi.Issuer{}
+	err := c.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: caNamespace}, &iss)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if iss.Spec.SelfSigned == nil {
+		return nil
+	}
+	certList := cmapi.CertificateList{}
+	if err := c.List(ctx, &certList, client.InNamespace(caNamespace)); err != nil {
+		return err
+	}
+	for _, cert := range certList.Items {
+		if cert.Spec.IssuerRef.Name == ref.Name && cert.Spec.IssuerRef.Kind == "Issuer" {
+			return nil
+		}
+	}
+	return client.IgnoreNotFound(c.Delete(ctx, &iss))
+}
+
+// copyCASecret copies the CA certificate and key in `src` to the secret
+// `name` of the CA Certificate `certName` in the same namespace. The
+// cert-manager annotations are copied as well, so that cert-manager keeps
+// the copied CA.
+func copyCASecret(ctx context.Context, c client.Client, src *corev1.Secret, name, certName string) error {
+	dst := corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: src.Namespace}, &dst)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	dst.Name = name
+	dst.Namespace = src.Namespace
+	dst.Type = src.Type
+	dst.Data = src.Data
+	for k, v := range src.Annotations {
+		if strings.HasPrefix(k, "cert-manager.io/") {
+			if dst.Annotations == nil {
+				dst.Annotations = map[string]string{}
+			}
+			dst.Annotations[k] = v
+		}
+	}
+	if dst.Annotations != nil {
+		dst.Annotations[cmapi.CertificateNameKey] = certName
+	}
+	if exists {
+		return c.Update(ctx, &dst)
+	}
+	return c.Create(ctx, &dst)
+}
+
+// deleteCACertificateAndSecret deletes the CA Certificate `cert` and its
+// secret
+func deleteCACertificateAndSecret(ctx context.Context, c client.Client, cert *cmapi.Certificate) error {
+	if err := client.IgnoreNotFound(c.Delete(ctx, cert)); err != nil {
+		return err
+	}
+	secret := corev1.Secret{}
+	secret.Name = cert.Spec.SecretName
+	secret.Namespace = cert.Namespace
+	if err := client.IgnoreNotFound(c.Delete(ctx, &secret)); err != nil {
+		return fmt.Errorf("deleting secret of CA certificate %s: %w", cert.Name, err)
+	}
+	return nil
+}
+
+// mergeLabels returns `labels` with `extra` added
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,245 @@
+package certs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCerts_ensureCACertificate_ProfileChanged(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	start := time.Now().Truncate(time.Second)
+	setNow(t, start)
+
+	oldCA := newTestCA(t, "service-ca", nil)
+	newCA := newTestCA(t, "service-ca", nil)
+	existing := newCACertificate(testCANamespace, DefaultCAProfile())
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&existing,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      CASecretName,
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": oldCA.pem,
+					"tls.key": oldCA.keyPEM,
+				},
+			},
+		},
+	})
+
+	profile := DefaultCAProfile()
+	profile.KeyAlgorithm = cmapi.RSAKeyAlgorithm
+	profile.KeySize = 4096
+	profile.Organizations = []string{"Example Corp"}
+	profile.Countries = []string{"CH"}
+	profile.Duration = &metav1.Duration{Duration: 8760 * time.Hour}
+	profile.RenewBefore = &metav1.Duration{Duration: 720 * time.Hour}
+	stagedName := CACertName + "-staged"
+	stagedSecretName := CASecretName + "-staged"
+	caCert := func(name string) (cmapi.Certificate, error) {
+		cert := cmapi.Certificate{}
+		err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: testCANamespace}, &cert)
+		return cert, err
+	}
+
+	// The CA is staged, the CA Certificate isn't changed
+	_, err := ensureCACertificate(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	cert, err := caCert(CACertName)
+	require.NoError(t, err)
+	assert.Equal(t, existing.Spec, cert.Spec)
+	staged, err := caCert(stagedName)
+	require.NoError(t, err)
+	assert.Equal(t, stagedSecretName, staged.Spec.SecretName)
+	assert.Equal(t, &cmapi.CertificatePrivateKey{
+		Algorithm: cmapi.RSAKeyAlgorithm,
+		Size:      4096,
+	}, staged.Spec.PrivateKey)
+	assert.Equal(t, &cmapi.X509Subject{
+		Organizations: []string{"Example Corp"},
+		Countries:     []string{"CH"},
+	}, staged.Spec.Subject)
+	assert.Equal(t, profile.Duration, staged.Spec.Duration)
+	assert.Equal(t, profile.RenewBefore, staged.Spec.RenewBefore)
+	bundle, err := withStagedCA(ctx, c, testCANamespace, profile, string(oldCA.pem))
+	require.NoError(t, err)
+	assert.Equal(t, string(oldCA.pem), bundle)
+
+	// cert-manager issues the staged CA, which is added to the trust
+	// bundle
+	staged.Status.Conditions = []cmapi.CertificateCondition{{
+		Type:   cmapi.CertificateConditionReady,
+		Status: cmmeta.ConditionTrue,
+	}}
+	require.NoError(t, c.Update(ctx, &staged))
+	require.NoError(t, c.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        stagedSecretName,
+			Namespace:   testCANamespace,
+			Annotations: map[string]string{"cert-manager.io/certificate-name": stagedName},
+		},
+		Data: map[string][]byte{
+			"tls.crt": newCA.pem,
+			"tls.key": newCA.keyPEM,
+		},
+	}))
+	dueIn, err := ensureCACertificate(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRotationGracePeriod, dueIn)
+	bundle, err = withStagedCA(ctx, c, testCANamespace, profile, string(oldCA.pem))
+	require.NoError(t, err)
+	assert.Equal(t, string(oldCA.pem)+string(newCA.pem), bundle)
+
+	// The CA isn't replaced during the grace period
+	setNow(t, start.Add(time.Hour))
+	dueIn, err = ensureCACertificate(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRotationGracePeriod-time.Hour, dueIn)
+	cert, err = caCert(CACertName)
+	require.NoError(t, err)
+	assert.Equal(t, existing.Spec, cert.Spec)
+
+	// The staged CA replaces the CA after the grace period
+	setNow(t, start.Add(DefaultRotationGracePeriod))
+	dueIn, err = ensureCACertificate(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	assert.Zero(t, dueIn)
+	cert, err = caCert(CACertName)
+	require.NoError(t, err)
+	assert.Equal(t, newCACertificate(testCANamespace, profile).Spec, cert.Spec)
+	secret := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: CASecretName, Namespace: testCANamespace}, &secret))
+	assert.Equal(t, newCA.pem, secret.Data["tls.crt"])
+	assert.Equal(t, newCA.keyPEM, secret.Data["tls.key"])
+	assert.Equal(t, CACertName, secret.Annotations["cert-manager.io/certificate-name"])
+	_, err = caCert(stagedName)
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKey{Name: stagedSecretName, Namespace: testCANamespace}, &corev1.Secret{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCerts_ensureCACertificate_ProfileChangeReverted(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+
+	profile := DefaultCAProfile()
+	existing := newCACertificate(testCANamespace, profile)
+	staged := newCACertificate(testCANamespace, profile.stagedProfile())
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{&existing, &staged},
+	})
+
+	_, err := ensureCACertificate(ctx, c, l, testCANamespace, profile)
+	require.NoError(t, err)
+	err = c.Get(ctx, client.ObjectKey{Name: staged.Name, Namespace: testCANamespace}, &cmapi.Certificate{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCerts_ensureCA_Renamed(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	ca := newTestCA(t, "service-ca", nil)
+
+	oldProfile := DefaultCAProfile()
+	oldProfile.SelfSignedIssuerName = "old-self-signed"
+	oldProfile.CertificateName = "old-ca"
+	oldProfile.SecretName = "old-ca-root"
+	oldProfile.IssuerName = "old-issuer"
+	oldCert := newCACertificate(testCANamespace, oldProfile)
+	c := prepareTest(t, testCfg{
+		initObjs: []client.Object{
+			&oldCert,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "old-ca-root",
+					Namespace: testCANamespace,
+				},
+				Data: map[string][]byte{
+					"tls.crt": ca.pem,
+					"tls.key": ca.keyPEM,
+				},
+			},
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      TrustBundleName("old-ca-root"),
+					Namespace: testCANamespace,
+					Labels:    map[string]string{TrustBundleLabelKey: "true"},
+					Annotations: map[string]string{
+						CASecretAnnotation: "old-ca-root",
+					},
+				},
+				Data: map[string]string{"ca.crt": string(ca.pem)},
+			},
+			&cmapi.Issuer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "old-self-signed",
+					Namespace: testCANamespace,
+				},
+				Spec: cmapi.IssuerSpec{
+					IssuerConfig: cmapi.IssuerConfig{
+						SelfSigned: &cmapi.SelfSignedIssuer{},
+					},
+				},
+			},
+			&cmapi.ClusterIssuer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "old-issuer",
+					Labels: oldProfile.caLabels(),
+				},
+			},
+			// Resources of another CA aren't touched
+			&cmapi.ClusterIssuer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "compliance-issuer",
+					Labels: map[string]string{CAProfileLabelKey: "compliance"},
+				},
+			},
+		},
+	})
+
+	profile := DefaultCAProfile()
+	require.NoError(t, ensureCA(ctx, c, l, testCANamespace, profile))
+
+	// The CA is migrated to the new names without a change of the CA
+	cert := cmapi.Certificate{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: CACertName, Namespace: testCANamespace}, &cert))
+	assert.Equal(t, newCACertificate(testCANamespace, profile).Spec, cert.Spec)
+	assert.Equal(t, profile.caLabels(), cert.Labels)
+	secret := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: CASecretName, Namespace: testCANamespace}, &secret))
+	assert.Equal(t, ca.pem, secret.Data["tls.crt"])
+	cm := corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: TrustBundleName(CASecretName), Namespace: testCANamespace}, &cm))
+	assert.Equal(t, CASecretName, cm.Annotations[CASecretAnnotation])
+	assert.Equal(t, string(ca.pem), cm.Data["ca.crt"])
+	iss := cmapi.ClusterIssuer{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: ServiceIssuerName}, &iss))
+	assert.Equal(t, profile.caLabels(), iss.Labels)
+
+	// The resources under the previous names are deleted
+	for _, obj := range []client.Object{
+		&cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: "old-ca", Namespace: testCANamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "old-ca-root", Namespace: testCANamespace}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: TrustBundleName("old-ca-root"), Namespace: testCANamespace}},
+		&cmapi.Issuer{ObjectMeta: metav1.ObjectMeta{Name: "old-self-signed", Namespace: testCANamespace}},
+		&cmapi.ClusterIssuer{ObjectMeta: metav1.ObjectMeta{Name: "old-issuer"}},
+	} {
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		assert.True(t, apierrors.IsNotFound(err), obj.GetName())
+	}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "compliance-issuer"}, &cmapi.ClusterIssuer{}))
+}
@@ -0,0 +1,104 @@
+package certs
+
+import (
+	"fmt"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CertUsagesAnnotation is the Service annotation which sets the key usages
+// of the Service's certificate as a comma-separated list
+const CertUsagesAnnotation = "service.syn.tools/cert-usages"
+
+// DefaultAllowedUsages is the list of key usages which Services may request
+// if the controller isn't configured otherwise
+const DefaultAllowedUsages = "digital signature,key encipherment,server auth,client auth"
+
+// knownUsages lists all key usages supported by cert-manager
+var knownUsages = []cmapi.KeyUsage{
+	cmapi.UsageSigning,
+	cmapi.UsageDigitalSignature,
+	cmapi.UsageContentCommitment,
+	cmapi.UsageKeyEncipherment,
+	cmapi.UsageKeyAgreement,
+	cmapi.UsageDataEncipherment,
+	cmapi.UsageCertSign,
+	cmapi.UsageCRLSign,
+	cmapi.UsageEncipherOnly,
+	cmapi.UsageDecipherOnly,
+	cmapi.UsageAny,
+	cmapi.UsageServerAuth,
+	cmapi.UsageClientAuth,
+	cmapi.UsageCodeSigning,
+	cmapi.UsageEmailProtection,
+	cmapi.UsageSMIME,
+	cmapi.UsageIPsecEndSystem,
+	cmapi.UsageIPsecTunnel,
+	cmapi.UsageIPsecUser,
+	cmapi.UsageTimestamping,
+	cmapi.UsageOCSPSigning,
+	cmapi.UsageMicrosoftSGC,
+	cmapi.UsageNetscapeSGC,
+}
+
+// ParseUsages parses a comma-separated list of cert-manager key usages
+func ParseUsages(list string) ([]cmapi.KeyUsage, error) {
+	usages := []cmapi.KeyUsage{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		u := cmapi.KeyUsage(entry)
+		if !containsUsage(knownUsages, u) {
+			return nil, fmt.Errorf("unknown key usage %q", entry)
+		}
+		if !containsUsage(usages, u) {
+			usages = append(usages, u)
+		}
+	}
+	return usages, nil
+}
+
+// usagesFromSvc returns the key usages requested in annotation
+// `service.syn.tools/cert-usages`. Returns nil if the annotation isn't
+// present, in which case cert-manager's defaults apply.
+func usagesFromSvc(svc *corev1.Service, cfg Config) ([]cmapi.KeyUsage, error) {
+	v, ok := svc.Annotations[CertUsagesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	usages, err := ParseUsages(v)
+	if err != nil {
+		return nil, invalidConfigErrorf("annotation %s: %v", CertUsagesAnnotation, err)
+	}
+	if len(usages) == 0 {
+		return nil, invalidConfigErrorf("annotation %s: no key usages given", CertUsagesAnnotation)
+	}
+	for _, u := range usages {
+		if !containsUsage(cfg.AllowedUsages, u) {
+			return nil, invalidConfigErrorf("annotation %s: key usage %q is not allowed, allowed usages are %s",
+				CertUsagesAnnotation, u, usagesString(cfg.AllowedUsages))
+		}
+	}
+	return usages, nil
+}
+
+func containsUsage(usages []cmapi.KeyUsage, u cmapi.KeyUsage) bool {
+	for _, e := range usages {
+		if e == u {
+			return true
+		}
+	}
+	return false
+}
+
+func usagesString(usages []cmapi.KeyUsage) string {
+	s := make([]string, len(usages))
+	for i, u := range usages {
+		s[i] = string(u)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,74 @@
+package certs
+
+import (
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCerts_ParseUsages(t *testing.T) {
+	usages, err := ParseUsages(DefaultAllowedUsages)
+	assert.NoError(t, err)
+	assert.Equal(t, []cmapi.KeyUsage{
+		cmapi.UsageDigitalSignature,
+		cmapi.UsageKeyEncipherment,
+		cmapi.UsageServerAuth,
+		cmapi.UsageClientAuth,
+	}, usages)
+
+	usages, err = ParseUsages(" Server Auth ,server auth,")
+	assert.NoError(t, err)
+	assert.Equal(t, []cmapi.KeyUsage{cmapi.UsageServerAuth}, usages)
+
+	_, err = ParseUsages("server auth,world domination")
+	assert.Error(t, err)
+}
+
+func TestCerts_usagesFromSvc(t *testing.T) {
+	tests := map[string]struct {
+		annotation *string
+		usages     []cmapi.KeyUsage
+		invalid    bool
+	}{
+		"NoAnnotation": {
+			usages: nil,
+		},
+		"MutualTLS": {
+			annotation: strPtr("digital signature, key encipherment, server auth, client auth"),
+			usages: []cmapi.KeyUsage{
+				cmapi.UsageDigitalSignature,
+				cmapi.UsageKeyEncipherment,
+				cmapi.UsageServerAuth,
+				cmapi.UsageClientAuth,
+			},
+		},
+		"Empty": {
+			annotation: strPtr(""),
+			invalid:    true,
+		},
+		"Unknown": {
+			annotation: strPtr("server auth,superuser"),
+			invalid:    true,
+		},
+		"NotAllowed": {
+			annotation: strPtr("server auth,cert sign"),
+			invalid:    true,
+		},
+	}
+
+	for testn, tc := range tests {
+		svc := prepareService("test-svc", "test-ns")
+		if tc.annotation != nil {
+			svc.Annotations = map[string]string{
+				CertUsagesAnnotation: *tc.annotation,
+			}
+		}
+		usages, err := usagesFromSvc(&svc, DefaultConfig())
+		assert.Equal(t, tc.invalid, IsInvalidConfigError(err), testn)
+		if !tc.invalid {
+			assert.NoError(t, err, testn)
+			assert.Equal(t, tc.usages, usages, testn)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package certs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
@@ -11,6 +14,16 @@ const (
 	// ServiceCertSecretLabelKey is the label key for linking the
 	// Certificate secret to the service for which it was issued
 	ServiceCertSecretLabelKey = "service.syn.tools/certificate"
+	// ServiceNameLabelKey is the label key for linking the Certificate
+	// secrets to the name of the service for which they were issued
+	ServiceNameLabelKey = "service.syn.tools/service"
+
+	// CertDurationAnnotation is the Service annotation which sets the
+	// lifetime of the Service's certificate
+	CertDurationAnnotation = "service.syn.tools/cert-duration"
+	// CertRenewBeforeAnnotation is the Service annotation which sets how
+	// long before expiry the Service's certificate is renewed
+	CertRenewBeforeAnnotation = "service.syn.tools/cert-renew-before"
 )
 
 // CertificateName returns the name for the Certificate resource belonging to
@@ -27,3 +40,19 @@ func isCertReady(cert *cmapi.Certificate) bool {
 	}
 	return false
 }
+
+// CAFingerprint returns the hex-encoded SHA-256 fingerprint of the first
+// certificate in the PEM bundle `caPEM`
+func CAFingerprint(caPEM []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			return "", fmt.Errorf("no certificate found in PEM data")
+		}
+		if block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			return hex.EncodeToString(sum[:]), nil
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package certs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,6 +47,21 @@ func TestCerts_isCertReady(t *testing.T) {
 	}
 }
 
+func TestCerts_CAFingerprint(t *testing.T) {
+	der := []byte("not really a certificate")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("other")})...)
+
+	fp, err := CAFingerprint(bundle)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(der)
+	assert.Equal(t, hex.EncodeToString(sum[:]), fp)
+
+	_, err = CAFingerprint([]byte("garbage"))
+	assert.Error(t, err)
+}
+
 func makeCert(hasReady, hasIssuing, ready bool) cmapi.Certificate {
 	cert := cmapi.Certificate{
 		Status: cmapi.CertificateStatus{
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"context"
+
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CAKey is the Service and ConfigMap label or annotation which selects the
+// named CA which issues the Service's certificate or whose CA certificate is
+// injected into the ConfigMap. The label takes precedence over the
+// annotation.
+const CAKey = "service.syn.tools/ca"
+
+// caName returns the name of the CA which is selected by the object, or an
+// empty string if the object doesn't select a CA
+func caName(obj client.Object) string {
+	if name, ok := obj.GetLabels()[CAKey]; ok {
+		return name
+	}
+	return obj.GetAnnotations()[CAKey]
+}
+
+// selectCA returns the CA certificate for the object, and the reference to
+// the CA's issuer. Objects which select a named CA with label or annotation
+// `service.syn.tools/ca` use that CA, `default` selects the cluster-wide
+// Service CA. The selected CA must be selectable in the object's namespace,
+// see CAProfile.CheckSelectable(). Other objects use the CA of their
+// namespace, see namespaceCA().
+func selectCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile certs.CAProfile, named certs.CAProfiles, namespaceCAs bool, obj client.Object) (string, cmmeta.ObjectReference, error) {
+	switch name := caName(obj); name {
+	case "":
+		return namespaceCA(ctx, c, l, caNamespace, profile, namespaceCAs, obj.GetNamespace())
+	case certs.DefaultCAName:
+	default:
+		var err error
+		profile, err = named.Lookup(name)
+		if err != nil {
+			return "", cmmeta.ObjectReference{}, err
+		}
+		l = l.WithValues("ca", name)
+	}
+	group, err := caGroup(ctx, c, obj.GetNamespace(), namespaceCAs)
+	if err != nil {
+		return "", cmmeta.ObjectReference{}, err
+	}
+	if err := profile.CheckSelectable(obj.GetNamespace(), group); err != nil {
+		return "", cmmeta.ObjectReference{}, err
+	}
+	ca, err := certs.GetServiceCA(ctx, c, l, caNamespace, profile)
+	return ca, profile.IssuerRef(), err
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr/testr"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSelectCA(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	profile := certs.DefaultCAProfile()
+	restricted := certs.NamedCAProfile("restricted")
+	restricted.Namespaces = []string{"tenant-*", testNs}
+	named := certs.CAProfiles{
+		"compliance": certs.NamedCAProfile("compliance"),
+		"restricted": restricted,
+	}
+	objs := append(prepareTestServiceCA(testCANamespace),
+		prepareTestCA(testCANamespace, named["compliance"], "COMPLIANCE_CA")...)
+	objs = append(objs, prepareTestCA(testCANamespace, restricted, "RESTRICTED_CA")...)
+	objs = append(objs, prepareTestGroupCA(testCANamespace, testNs, "NAMESPACE_CA")...)
+	groupProfile := profile.GroupProfile(testNs)
+
+	tests := map[string]struct {
+		svc          corev1.Service
+		namespaceCAs bool
+		ca           string
+		issuer       cmmeta.ObjectReference
+		err          string
+	}{
+		"NoSelection": {
+			svc:    prepareService("test-svc", testNs, nil),
+			ca:     "TEST_CA",
+			issuer: profile.IssuerRef(),
+		},
+		"NoSelection_NamespaceCAs": {
+			svc:          prepareService("test-svc", testNs, nil),
+			namespaceCAs: true,
+			ca:           "NAMESPACE_CA",
+			issuer:       groupProfile.IssuerRef(),
+		},
+		"Label": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "compliance",
+			}),
+			ca: "COMPLIANCE_CA",
+			issuer: cmmeta.ObjectReference{
+				Name:  "service-ca-compliance-issuer",
+				Kind:  "ClusterIssuer",
+				Group: "cert-manager.io",
+			},
+		},
+		"Annotation": {
+			svc: prepareServiceWithAnnotations("test-svc", testNs, nil, map[string]string{
+				CAKey: "compliance",
+			}),
+			ca: "COMPLIANCE_CA",
+			issuer: cmmeta.ObjectReference{
+				Name:  "service-ca-compliance-issuer",
+				Kind:  "ClusterIssuer",
+				Group: "cert-manager.io",
+			},
+		},
+		"LabelTakesPrecedence": {
+			svc: prepareServiceWithAnnotations("test-svc", testNs, map[string]string{
+				CAKey: "default",
+			}, map[string]string{
+				CAKey: "compliance",
+			}),
+			ca:     "TEST_CA",
+			issuer: profile.IssuerRef(),
+		},
+		"Label_NamespaceCAs": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "compliance",
+			}),
+			namespaceCAs: true,
+			err:          `namespace default belongs to CA group default and can't select CA "compliance"`,
+		},
+		"Default_NamespaceCAs": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "default",
+			}),
+			namespaceCAs: true,
+			err:          `namespace default belongs to CA group default and can't select CA "default"`,
+		},
+		"Restricted": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "restricted",
+			}),
+			ca: "RESTRICTED_CA",
+			issuer: cmmeta.ObjectReference{
+				Name:  "service-ca-restricted-issuer",
+				Kind:  "ClusterIssuer",
+				Group: "cert-manager.io",
+			},
+		},
+		"Restricted_NamespaceCAs": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "restricted",
+			}),
+			namespaceCAs: true,
+			ca:           "RESTRICTED_CA",
+			issuer: cmmeta.ObjectReference{
+				Name:  "service-ca-restricted-issuer",
+				Kind:  "ClusterIssuer",
+				Group: "cert-manager.io",
+			},
+		},
+		"Restricted_NamespaceNotAllowed": {
+			svc: prepareService("test-svc", "other", map[string]string{
+				CAKey: "restricted",
+			}),
+			err: `CA "restricted" can't be selected in namespace other`,
+		},
+		"Unknown": {
+			svc: prepareService("test-svc", testNs, map[string]string{
+				CAKey: "other",
+			}),
+			err: `unknown CA "other"`,
+		},
+	}
+
+	for testn, tc := range tests {
+		c, _ := prepareTest(t, objs)
+		ca, issuer, err := selectCA(ctx, c, l, testCANamespace, profile, named, tc.namespaceCAs, &tc.svc)
+		if tc.err != "" {
+			require.Error(t, err, testn)
+			assert.True(t, certs.IsInvalidConfigError(err), testn)
+			assert.Equal(t, tc.err, err.Error(), testn)
+			continue
+		}
+		require.NoError(t, err, testn)
+		assert.Equal(t, tc.ca, ca, testn)
+		assert.Equal(t, tc.issuer, issuer, testn)
+	}
+}
+
+// prepareTestCA returns the ready CA Certificate and secret of the CA
+// profile
+func prepareTestCA(caNamespace string, profile certs.CAProfile, ca string) []client.Object {
+	return []client.Object{
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.CertificateName,
+				Namespace: caNamespace,
+			},
+			Spec: cmapi.CertificateSpec{
+				SecretName: profile.SecretName,
+			},
+			Status: cmapi.CertificateStatus{
+				Conditions: []cmapi.CertificateCondition{
+					{
+						Type:   cmapi.CertificateConditionReady,
+						Status: cmmeta.ConditionTrue,
+					},
+				},
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.SecretName,
+				Namespace: caNamespace,
+			},
+			Data: map[string][]byte{
+				"tls.crt": []byte(ca),
+			},
+		},
+	}
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	reasonCertificateRequestDenied = "CertificateRequestDenied"
+
+	// approvalReason is the reason of the `Approved` and `Denied`
+	// conditions which the controller sets on CertificateRequests
+	approvalReason = "service-ca-controller"
+)
+
+// CertificateRequestReconciler approves or denies the CertificateRequests
+// for the issuers of the Service CAs. Requests for Service certificates are
+// only approved if they request names which belong to the Services in the
+// request's namespace, see certs.CheckCertificateRequest(). Requests for
+// the issuer of a CA group are only approved in the namespaces of the group,
+// and requests for other Service CAs only in the namespaces which may select
+// the CA, see certs.CAProfile.CheckSelectable().
+// Requests for the controller's CA certificates are always approved.
+// Requests for other issuers are left to other approvers.
+type CertificateRequestReconciler struct {
+	client.Client
+	CANamespace string
+	CAProfile   certs.CAProfile
+	NamedCAs    certs.CAProfiles
+	CertConfig  certs.Config
+	Recorder    record.EventRecorder
+	// NamespaceCAs enables a separate CA for each namespace which isn't
+	// part of a CA group, see ServiceReconciler
+	NamespaceCAs bool
+}
+
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests,verbs=get;list;watch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests/status,verbs=update;patch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=signers,verbs=approve,resourceNames=clusterissuers.cert-manager.io/*;issuers.cert-manager.io/*
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=clusterissuers,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Reconcile approves or denies CertificateRequests for the issuers of the
+// Service CAs which have neither been approved nor denied yet.
+func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "name", req.Name)
+
+	cr := cmapi.CertificateRequest{}
+	if err := r.Get(ctx, req.NamespacedName, &cr); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if approvalDecided(&cr) {
+		return ctrl.Result{}, nil
+	}
+
+	isCA, err := r.isCARequest(ctx, &cr)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if isCA {
+		l.Info("Approving CA certificate request")
+		return ctrl.Result{}, r.setApproval(ctx, &cr, cmapi.CertificateRequestConditionApproved,
+			"CA certificate request approved by the Service CA controller")
+	}
+	profile, group, err := r.serviceIssuer(ctx, &cr)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if profile == nil {
+		l.V(1).Info("Certificate request isn't for a Service CA")
+		return ctrl.Result{}, nil
+	}
+
+	nsGroup, err := caGroup(ctx, r.Client, cr.Namespace, r.NamespaceCAs)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if group != "" && nsGroup != group {
+		return ctrl.Result{}, r.deny(ctx, l, &cr,
+			fmt.Sprintf("namespace %s doesn't belong to CA group %s", cr.Namespace, group))
+	}
+	if group == "" {
+		if err := profile.CheckSelectable(cr.Namespace, nsGroup); err != nil {
+			return ctrl.Result{}, r.deny(ctx, l, &cr, err.Error())
+		}
+	}
+	err = certs.CheckCertificateRequest(ctx, r.Client, &cr, r.certConfig(*profile))
+	if err != nil && !certs.IsInvalidConfigError(err) {
+		return ctrl.Result{}, err
+	}
+	if err != nil {
+		return ctrl.Result{}, r.deny(ctx, l, &cr, err.Error())
+	}
+	l.Info("Approving certificate request")
+	return ctrl.Result{}, r.setApproval(ctx, &cr, cmapi.CertificateRequestConditionApproved,
+		fmt.Sprintf("Certificate request approved for the Services in namespace %s", cr.Namespace))
+}
+
+// deny denies the CertificateRequest for reason `msg`
+func (r *CertificateRequestReconciler) deny(ctx context.Context, l logr.Logger, cr *cmapi.CertificateRequest, msg string) error {
+	l.Info("Denying certificate request", "reason", msg)
+	r.Recorder.Eventf(cr, corev1.EventTypeWarning, reasonCertificateRequestDenied,
+		"Certificate request denied: %s", msg)
+	return r.setApproval(ctx, cr, cmapi.CertificateRequestConditionDenied, msg)
+}
+
+// isCARequest returns true if the CertificateRequest is for one of the
+// controller's CA Certificates. The request must be owned by an existing CA
+// Certificate of a CA profile in the CA namespace, and must be for the
+// issuer which signs the profile's CA certificates, see
+// certs.CAProfile.IsCAIssuerRef().
+func (r *CertificateRequestReconciler) isCARequest(ctx context.Context, cr *cmapi.CertificateRequest) (bool, error) {
+	if cr.Namespace != r.CANamespace || !cr.Spec.IsCA {
+		return false, nil
+	}
+	owner := metav1.GetControllerOf(cr)
+	if owner == nil || owner.Kind != cmapi.CertificateKind {
+		return false, nil
+	}
+	profiles := []certs.CAProfile{r.CAProfile}
+	for _, name := range r.NamedCAs.Names() {
+		profiles = append(profiles, r.NamedCAs[name])
+	}
+	matches := false
+	for _, profile := range profiles {
+		if profile.IsCACertificateName(owner.Name) && profile.IsCAIssuerRef(cr.Spec.IssuerRef) {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return false, nil
+	}
+	cert := cmapi.Certificate{}
+	err := r.Get(ctx, client.ObjectKey{Name: owner.Name, Namespace: r.CANamespace}, &cert)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return cert.UID == owner.UID, nil
+}
+
+// serviceIssuer returns the profile of the Service CA for whose issuer the
+// CertificateRequest is, and the CA group of the issuer. Returns a nil
+// profile if the request isn't for the issuer of a Service CA. The issuers
+// of the Service CAs are the ClusterIssuers of the CA profiles and of the CA
+// groups.
+func (r *CertificateRequestReconciler) serviceIssuer(ctx context.Context, cr *cmapi.CertificateRequest) (*certs.CAProfile, string, error) {
+	ref := cr.Spec.IssuerRef
+	if ref.Kind != cmapi.ClusterIssuerKind || (ref.Group != "" && ref.Group != cmapi.SchemeGroupVersion.Group) {
+		return nil, "", nil
+	}
+	if ref.Name == r.CAProfile.IssuerName {
+		return &r.CAProfile, "", nil
+	}
+	for _, name := range r.NamedCAs.Names() {
+		if profile := r.NamedCAs[name]; ref.Name == profile.IssuerName {
+			return &profile, "", nil
+		}
+	}
+	iss := cmapi.ClusterIssuer{}
+	if err := r.Get(ctx, client.ObjectKey{Name: ref.Name}, &iss); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	group, ok := iss.Labels[certs.CAGroupLabelKey]
+	if !ok {
+		return nil, "", nil
+	}
+	if groupProfile := r.CAProfile.GroupProfile(group); iss.Name != groupProfile.IssuerName {
+		return nil, "", nil
+	}
+	return &r.CAProfile, group, nil
+}
+
+// certConfig returns the certificate config for Service certificates from
+// the CA of profile `profile`
+func (r *CertificateRequestReconciler) certConfig(profile certs.CAProfile) certs.Config {
+	cfg := r.CertConfig
+	if profile.NameConstraints {
+		cfg.PermittedDNSDomains = profile.PermittedDNSDomains
+		cfg.PermittedIPRanges = profile.PermittedIPRanges
+	}
+	return cfg
+}
+
+// setApproval sets condition `condType` of the CertificateRequest
+func (r *CertificateRequestReconciler) setApproval(ctx context.Context, cr *cmapi.CertificateRequest, condType cmapi.CertificateRequestConditionType, message string) error {
+	now := metav1.Now()
+	cr.Status.Conditions = append(cr.Status.Conditions, cmapi.CertificateRequestCondition{
+		Type:               condType,
+		Status:             cmmeta.ConditionTrue,
+		Reason:             approvalReason,
+		Message:            message,
+		LastTransitionTime: &now,
+	})
+	return r.Status().Update(ctx, cr)
+}
+
+// approvalDecided returns true if the CertificateRequest has already been
+// approved or denied
+func approvalDecided(cr *cmapi.CertificateRequest) bool {
+	for _, c := range cr.Status.Conditions {
+		if (c.Type == cmapi.CertificateRequestConditionApproved || c.Type == cmapi.CertificateRequestConditionDenied) &&
+			c.Status == cmmeta.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CertificateRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("certificaterequest").
+		For(&cmapi.CertificateRequest{}).
+		Complete(r)
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+func TestCertificateRequestController_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	profile := certs.DefaultCAProfile()
+	named := certs.NamedCAProfile("compliance")
+	svc := prepareService("app", testNs, nil)
+	groupProfile := profile.GroupProfile("team-a")
+	groupNs := prepareNamespace("team-a-app", map[string]string{certs.CAGroupLabelKey: "team-a"})
+	groupSvc := prepareService("app", "team-a-app", nil)
+	groupIssuer := cmapi.ClusterIssuer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   groupProfile.IssuerName,
+			Labels: map[string]string{certs.CAGroupLabelKey: "team-a"},
+		},
+	}
+	plainIssuer := cmapi.ClusterIssuer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "service-ca-issuer-other",
+		},
+	}
+	rootIssuerRef := cmmeta.ObjectReference{
+		Name:  "service-ca-root-issuer",
+		Kind:  cmapi.IssuerKind,
+		Group: "cert-manager.io",
+	}
+	selfSignedIssuerRef := cmmeta.ObjectReference{
+		Name:  profile.SelfSignedIssuerName,
+		Kind:  cmapi.IssuerKind,
+		Group: "cert-manager.io",
+	}
+	caCert := cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      profile.CertificateName,
+			Namespace: testCANamespace,
+			UID:       "1234",
+		},
+	}
+	intermediateCert := cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      profile.CertificateName + "-intermediate",
+			Namespace: testCANamespace,
+			UID:       "1234",
+		},
+	}
+
+	tests := map[string]struct {
+		cr       cmapi.CertificateRequest
+		decision cmapi.CertificateRequestConditionType
+		events   int
+	}{
+		"ServiceNames": {
+			cr:       prepareCertificateRequest(t, testNs, profile.IssuerRef(), "app.default.svc"),
+			decision: cmapi.CertificateRequestConditionApproved,
+		},
+		"NamedCA": {
+			cr:       prepareCertificateRequest(t, testNs, named.IssuerRef(), "app.default.svc"),
+			decision: cmapi.CertificateRequestConditionApproved,
+		},
+		"OtherNamespace": {
+			cr:       prepareCertificateRequest(t, testNs, profile.IssuerRef(), "db.other.svc"),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"GroupIssuer": {
+			cr:       prepareCertificateRequest(t, "team-a-app", groupProfile.IssuerRef(), "app.team-a-app.svc"),
+			decision: cmapi.CertificateRequestConditionApproved,
+		},
+		"GroupIssuer_OtherNamespaceNames": {
+			cr:       prepareCertificateRequest(t, "team-a-app", groupProfile.IssuerRef(), "db.default.svc"),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"GroupIssuer_NamespaceNotInGroup": {
+			cr:       prepareCertificateRequest(t, testNs, groupProfile.IssuerRef(), "app.default.svc"),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"NamedCA_GroupNamespace": {
+			cr:       prepareCertificateRequest(t, "team-a-app", named.IssuerRef(), "app.team-a-app.svc"),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"DefaultCA_GroupNamespace": {
+			cr:       prepareCertificateRequest(t, "team-a-app", profile.IssuerRef(), "app.team-a-app.svc"),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"UnmanagedIssuer": {
+			cr: prepareCertificateRequest(t, testNs, cmmeta.ObjectReference{
+				Name:  "service-ca-issuer-other",
+				Kind:  cmapi.ClusterIssuerKind,
+				Group: "cert-manager.io",
+			}, "app.default.svc"),
+		},
+		"NamespacedIssuer": {
+			cr: prepareCertificateRequest(t, testNs, cmmeta.ObjectReference{
+				Name:  profile.IssuerName,
+				Kind:  cmapi.IssuerKind,
+				Group: "cert-manager.io",
+			}, "app.default.svc"),
+		},
+		"OtherClusterIssuer": {
+			cr: prepareCertificateRequest(t, testNs, cmmeta.ObjectReference{
+				Name:  "letsencrypt",
+				Kind:  cmapi.ClusterIssuerKind,
+				Group: "cert-manager.io",
+			}, "www.example.com"),
+		},
+		"AlreadyDenied": {
+			cr: func() cmapi.CertificateRequest {
+				cr := prepareCertificateRequest(t, testNs, profile.IssuerRef(), "app.default.svc")
+				cr.Status.Conditions = []cmapi.CertificateRequestCondition{{
+					Type:   cmapi.CertificateRequestConditionDenied,
+					Status: cmmeta.ConditionTrue,
+				}}
+				return cr
+			}(),
+			decision: cmapi.CertificateRequestConditionDenied,
+		},
+		"CACertificate": {
+			cr:       prepareCACertificateRequest(t, profile.CertificateName, "1234", selfSignedIssuerRef),
+			decision: cmapi.CertificateRequestConditionApproved,
+		},
+		"IntermediateCACertificate": {
+			cr:       prepareCACertificateRequest(t, profile.CertificateName+"-intermediate", "1234", rootIssuerRef),
+			decision: cmapi.CertificateRequestConditionApproved,
+		},
+		"OtherCACertificate": {
+			cr: prepareCACertificateRequest(t, "other-ca", "1234", selfSignedIssuerRef),
+		},
+		"CACertificate_ServiceIssuer": {
+			cr:       prepareCACertificateRequest(t, profile.CertificateName, "1234", profile.IssuerRef()),
+			decision: cmapi.CertificateRequestConditionDenied,
+			events:   1,
+		},
+		"CACertificate_OtherIssuer": {
+			cr: prepareCACertificateRequest(t, profile.CertificateName, "1234", cmmeta.ObjectReference{
+				Name:  "letsencrypt",
+				Kind:  cmapi.ClusterIssuerKind,
+				Group: "cert-manager.io",
+			}),
+		},
+		"CACertificate_MissingCertificate": {
+			cr: prepareCACertificateRequest(t, profile.CertificateName+"-staged", "1234", selfSignedIssuerRef),
+		},
+		"CACertificate_OtherOwnerUID": {
+			cr: prepareCACertificateRequest(t, profile.CertificateName, "5678", selfSignedIssuerRef),
+		},
+	}
+
+	for testn, tc := range tests {
+		t.Run(testn, func(t *testing.T) {
+			cr := tc.cr
+			c, _ := prepareTest(t, []client.Object{
+				&svc, &groupNs, &groupSvc, &groupIssuer, &plainIssuer, &caCert, &intermediateCert, &cr,
+			})
+			r := CertificateRequestReconciler{
+				Client:      c,
+				CANamespace: testCANamespace,
+				CAProfile:   profile,
+				NamedCAs:    certs.CAProfiles{"compliance": named},
+				CertConfig:  certs.DefaultConfig(),
+				Recorder:    record.NewFakeRecorder(10),
+			}
+			res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(&cr)})
+			require.NoError(t, err)
+			assert.Equal(t, ctrl.Result{}, res)
+
+			updated := cmapi.CertificateRequest{}
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(&cr), &updated))
+			if tc.decision == "" {
+				assert.Empty(t, updated.Status.Conditions)
+			} else {
+				require.Len(t, updated.Status.Conditions, 1)
+				assert.Equal(t, tc.decision, updated.Status.Conditions[0].Type)
+				assert.Equal(t, cmmeta.ConditionTrue, updated.Status.Conditions[0].Status)
+			}
+			assert.Len(t, recordedEvents(r.Recorder), tc.events)
+		})
+	}
+}
+
+func TestCertificateRequestController_SignerApprovalRBAC(t *testing.T) {
+	data, err := os.ReadFile("../config/rbac/role.yaml")
+	require.NoError(t, err)
+	role := rbacv1.ClusterRole{}
+	require.NoError(t, yaml.Unmarshal(data, &role))
+
+	profile := certs.DefaultCAProfile()
+	named := certs.NamedCAProfile("compliance")
+	named.SecretName = "compliance-ca"
+	group := named.GroupProfile("team-a")
+	tests := map[string]struct {
+		ref       cmmeta.ObjectReference
+		namespace string
+	}{
+		"ServiceCA": {
+			ref:       profile.IssuerRef(),
+			namespace: "cert-manager",
+		},
+		"NamedCA": {
+			ref:       named.IssuerRef(),
+			namespace: "cert-manager",
+		},
+		"GroupCA": {
+			ref:       group.IssuerRef(),
+			namespace: "cert-manager",
+		},
+		"RootIssuer_OtherCANamespace": {
+			ref: cmmeta.ObjectReference{
+				Name:  "compliance-ca-team-a-issuer",
+				Kind:  cmapi.IssuerKind,
+				Group: "cert-manager.io",
+			},
+			namespace: "service-ca",
+		},
+	}
+
+	for testn, tc := range tests {
+		assert.True(t, approvesSigner(role, tc.ref, tc.namespace), testn)
+	}
+}
+
+// approvesSigner returns true if the ClusterRole grants `approve` on the
+// signer of issuer `ref`, like cert-manager checks it before it accepts an
+// approval: the signer name is `<kind>s.<group>/<name>` for ClusterIssuers
+// and `<kind>s.<group>/<namespace>.<name>` for Issuers, and
+// `<kind>s.<group>/*` matches all issuers of the kind.
+func approvesSigner(role rbacv1.ClusterRole, ref cmmeta.ObjectReference, namespace string) bool {
+	resource := fmt.Sprintf("%ss.%s", strings.ToLower(ref.Kind), ref.Group)
+	name := resource + "/" + ref.Name
+	if ref.Kind == cmapi.IssuerKind {
+		name = fmt.Sprintf("%s/%s.%s", resource, namespace, ref.Name)
+	}
+	for _, rule := range role.Rules {
+		if !containsString(rule.APIGroups, "cert-manager.io") || !containsString(rule.Resources, "signers") ||
+			!containsString(rule.Verbs, "approve") {
+			continue
+		}
+		if containsString(rule.ResourceNames, name) || containsString(rule.ResourceNames, resource+"/*") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func prepareCertificateRequest(t *testing.T, namespace string, issuerRef cmmeta.ObjectReference, dnsNames ...string) cmapi.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: dnsNames}, key)
+	require.NoError(t, err)
+	return cmapi.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: namespace,
+		},
+		Spec: cmapi.CertificateRequestSpec{
+			IssuerRef: issuerRef,
+			Request:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+		},
+	}
+}
+
+func prepareCACertificateRequest(t *testing.T, certName string, certUID types.UID, issuerRef cmmeta.ObjectReference) cmapi.CertificateRequest {
+	cr := prepareCertificateRequest(t, testCANamespace, issuerRef)
+	cr.Spec.IsCA = true
+	isController := true
+	cr.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: cmapi.SchemeGroupVersion.String(),
+		Kind:       cmapi.CertificateKind,
+		Name:       certName,
+		UID:        certUID,
+		Controller: &isController,
+	}}
+	return cr
+}
@@ -25,15 +25,23 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
 	// InjectLabelKey is the label which indicates that the Service CA
 	// certificate should be injected into the ConfigMap
 	InjectLabelKey = "service.syn.tools/inject-ca-bundle"
+
+	reasonCABundleInjected     = "CABundleInjected"
+	reasonInvalidLabel         = "InvalidLabel"
+	reasonCABundleUpdateFailed = "CABundleUpdateFailed"
 )
 
 // ConfigMapReconciler injects the service CA certificate into field `ca.crt`
@@ -43,14 +51,29 @@ type ConfigMapReconciler struct {
 	client.Client
 	Scheme      *runtime.Scheme
 	CANamespace string
+	CAProfile   certs.CAProfile
+	Recorder    record.EventRecorder
+	// Namespaces restricts the namespaces in which CA bundles are
+	// injected
+	Namespaces NamespacePolicy
+	// NamespaceCAs enables a separate CA for each namespace which isn't
+	// part of a CA group
+	NamespaceCAs bool
+	// NamedCAs holds the profiles of the named CAs which can be selected
+	// with label or annotation `service.syn.tools/ca`
+	NamedCAs certs.CAProfiles
 }
 
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=configmaps/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile injects the service CA certificate into ConfigMaps which have the
-// `service.syn.tools/inject-ca-bundle` label set to `true`.
+// `service.syn.tools/inject-ca-bundle` label set to `true`. ConfigMaps which
+// select a named CA with label or annotation `service.syn.tools/ca` get the
+// named CA's certificate. In namespaces which have a CA of their own, the
+// namespace's CA certificate is injected.
 // Please note that the reconciler will requeue requests until the Service CA
 // is created an ready.
 func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -85,6 +108,8 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	ok, err = strconv.ParseBool(inject)
 	if err != nil {
 		l.V(1).Info("Failed to parse label value as boolean", "value", inject)
+		r.Recorder.Eventf(&cm, corev1.EventTypeWarning, reasonInvalidLabel,
+			"Not injecting CA bundle, value %q of label %s is not a boolean", inject, InjectLabelKey)
 		// don't requeue
 		return ctrl.Result{}, nil
 	}
@@ -94,8 +119,23 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, nil
 	}
 
-	serviceCA, err := certs.GetServiceCA(ctx, r.Client, l, r.CANamespace)
+	if !r.Namespaces.Allowed(cm.Namespace) {
+		l.V(1).Info("CA bundle injection isn't allowed in namespace")
+		r.Recorder.Eventf(&cm, corev1.EventTypeWarning, reasonNamespaceNotAllowed,
+			"Not injecting CA bundle, CA bundle injection is not allowed in namespace %s", cm.Namespace)
+		// don't requeue
+		return ctrl.Result{}, nil
+	}
+
+	serviceCA, _, err := selectCA(ctx, r.Client, l, r.CANamespace, r.CAProfile, r.NamedCAs, r.NamespaceCAs, &cm)
 	if err != nil {
+		if certs.IsInvalidConfigError(err) {
+			l.Info("Invalid CA configuration", "error", err.Error())
+			r.Recorder.Eventf(&cm, corev1.EventTypeWarning, reasonInvalidConfig,
+				"Not injecting CA bundle: %v", err)
+			// don't requeue
+			return ctrl.Result{}, nil
+		}
 		l.Info("Service CA not ready yet, requeuing request")
 		return ctrl.Result{}, err
 	}
@@ -108,7 +148,13 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	if !reflect.DeepEqual(cm.Data, origCM.Data) {
 		// Only update CM if we're actually making changes
 		l.Info("Updating Service CA in key `ca.crt`")
-		r.Update(ctx, &cm)
+		if err := r.Update(ctx, &cm); err != nil {
+			r.Recorder.Eventf(origCM, corev1.EventTypeWarning, reasonCABundleUpdateFailed,
+				"Failed to inject CA bundle: %v", err)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(&cm, corev1.EventTypeNormal, reasonCABundleInjected,
+			"Injected Service CA bundle in key `ca.crt`")
 	}
 
 	return ctrl.Result{}, nil
@@ -118,5 +164,48 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.ConfigMap{}).
+		// Trigger reconcile for the labeled ConfigMaps in a namespace
+		// if the namespace's labels change, so that the CA bundle
+		// follows the namespace's CA group
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.namespaceToConfigMaps)).
+		// Trigger reconcile for all labeled ConfigMaps if a CA's trust
+		// bundle changes, so that CA rotations are propagated
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.trustBundleToConfigMaps)).
 		Complete(r)
 }
+
+// trustBundleToConfigMaps maps the trust bundle of a CA to all ConfigMaps
+// which have label `service.syn.tools/inject-ca-bundle`
+func (r *ConfigMapReconciler) trustBundleToConfigMaps(obj client.Object) []reconcile.Request {
+	if _, ok := obj.GetLabels()[certs.TrustBundleLabelKey]; !ok || obj.GetNamespace() != r.CANamespace {
+		return nil
+	}
+	return r.labeledConfigMaps("")
+}
+
+// namespaceToConfigMaps maps a namespace to the ConfigMaps in the namespace
+// which have label `service.syn.tools/inject-ca-bundle`
+func (r *ConfigMapReconciler) namespaceToConfigMaps(obj client.Object) []reconcile.Request {
+	return r.labeledConfigMaps(obj.GetName())
+}
+
+// labeledConfigMaps returns requests for the ConfigMaps in `namespace`
+// which have label `service.syn.tools/inject-ca-bundle`. If `namespace` is
+// empty, the ConfigMaps of all namespaces are returned.
+func (r *ConfigMapReconciler) labeledConfigMaps(namespace string) []reconcile.Request {
+	cmList := corev1.ConfigMapList{}
+	if err := r.List(context.Background(), &cmList, client.InNamespace(namespace),
+		client.HasLabels{InjectLabelKey}); err != nil {
+		log.Log.Error(err, "Unable to list labeled configmaps", "namespace", namespace)
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(cmList.Items))
+	for _, cm := range cmList.Items {
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&cm),
+		})
+	}
+	return reqs
+}
@@ -12,6 +12,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -44,6 +45,9 @@ func TestCMController_Reconcile(t *testing.T) {
 		err          error
 		res          ctrl.Result
 		expectedData string
+		events       []string
+		namespaces   NamespacePolicy
+		namespaceCAs bool
 	}{
 		"UnlabeledCM": {
 			objects: []client.Object{
@@ -76,6 +80,9 @@ func TestCMController_Reconcile(t *testing.T) {
 			err:          nil,
 			res:          ctrl.Result{},
 			expectedData: "",
+			events: []string{
+				`Warning InvalidLabel Not injecting CA bundle, value "foo" of label service.syn.tools/inject-ca-bundle is not a boolean`,
+			},
 		},
 		"LabeledCMTrue": {
 			objects: []client.Object{
@@ -84,6 +91,33 @@ func TestCMController_Reconcile(t *testing.T) {
 			err:          nil,
 			res:          ctrl.Result{},
 			expectedData: "TEST_CA",
+			events: []string{
+				"Normal CABundleInjected Injected Service CA bundle in key `ca.crt`",
+			},
+		},
+		"LabeledCMTrue_DeniedNamespace": {
+			objects: []client.Object{
+				&labeledConfigMapTrue,
+			},
+			err:          nil,
+			res:          ctrl.Result{},
+			expectedData: "",
+			namespaces:   NamespacePolicy{Allow: []string{"platform-*"}},
+			events: []string{
+				"Warning NamespaceNotAllowed Not injecting CA bundle, CA bundle injection is not allowed in namespace default",
+			},
+		},
+		"LabeledCMTrue_NamespaceCA": {
+			objects: append([]client.Object{
+				&labeledConfigMapTrue,
+			}, prepareTestGroupCA(serviceCANamespace, testNs, "NAMESPACE_CA")...),
+			err:          nil,
+			res:          ctrl.Result{},
+			expectedData: "NAMESPACE_CA",
+			namespaceCAs: true,
+			events: []string{
+				"Normal CABundleInjected Injected Service CA bundle in key `ca.crt`",
+			},
 		},
 	}
 
@@ -91,9 +125,13 @@ func TestCMController_Reconcile(t *testing.T) {
 		objs := append(tc.objects, serviceCA_objects...)
 		c, scheme := prepareTest(t, objs)
 		r := ConfigMapReconciler{
-			Client:      c,
-			Scheme:      scheme,
-			CANamespace: serviceCANamespace,
+			Client:       c,
+			Scheme:       scheme,
+			CANamespace:  serviceCANamespace,
+			CAProfile:    certs.DefaultCAProfile(),
+			Recorder:     record.NewFakeRecorder(10),
+			Namespaces:   tc.namespaces,
+			NamespaceCAs: tc.namespaceCAs,
 		}
 		res, err := r.Reconcile(ctx, ctrl.Request{
 			NamespacedName: client.ObjectKey{
@@ -103,6 +141,7 @@ func TestCMController_Reconcile(t *testing.T) {
 		})
 		assert.Equal(t, tc.err, err)
 		assert.Equal(t, tc.res, res)
+		assert.Equal(t, tc.events, recordedEvents(r.Recorder))
 
 		if tc.expectedData != "" {
 			cm := corev1.ConfigMap{}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"text/template"
+
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// AutoServingCertLabelKey is the namespace label which enables
+	// certificates for all Services in the namespace if set to `true`
+	AutoServingCertLabelKey = "service.syn.tools/auto-serving-cert"
+	// ServingCertExcludeLabelKey is the Service label which excludes the
+	// Service from automatic certificates if set to `true`
+	ServingCertExcludeLabelKey = "service.syn.tools/serving-cert-exclude"
+
+	// DefaultAutoSecretNameTemplate is the default template for the
+	// certificate secret names of Services in namespaces with automatic
+	// certificates
+	DefaultAutoSecretNameTemplate = "{{ .Name }}-tls"
+)
+
+// NamespacePolicy restricts the namespaces in which the controller issues
+// certificates and injects CA bundles
+type NamespacePolicy struct {
+	// Allow lists the namespaces in which the controller is active. If
+	// empty, all namespaces which aren't denied are allowed.
+	Allow []string
+	// Deny lists the namespaces in which the controller is never active.
+	// Deny takes precedence over Allow.
+	Deny []string
+	// CleanupDenied enables the removal of existing certificates in
+	// namespaces which aren't allowed. Otherwise, they're left untouched.
+	CleanupDenied bool
+}
+
+// Allowed returns true if the controller is active in namespace `ns`.
+// Entries of the allow and deny lists may be shell patterns as supported by
+// path.Match().
+func (p NamespacePolicy) Allowed(ns string) bool {
+	if certs.MatchNamespace(p.Deny, ns) {
+		return false
+	}
+	return len(p.Allow) == 0 || certs.MatchNamespace(p.Allow, ns)
+}
+
+// Validate checks that the allow and deny lists contain valid patterns
+func (p NamespacePolicy) Validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ParseAutoSecretNameTemplate parses the template for the certificate secret
+// names of Services in namespaces with automatic certificates. The template
+// has access to fields `.Name` and `.Namespace` of the Service.
+func ParseAutoSecretNameTemplate(tmpl string) (*template.Template, error) {
+	return template.New("auto-secret-name").Option("missingkey=zero").Parse(tmpl)
+}
+
+// servingCertSecretName returns the name of the certificate secret which is
+// requested for the service. Label `service.syn.tools/serving-cert-secret-name`
+// takes precedence. Otherwise, services in namespaces with label
+// `service.syn.tools/auto-serving-cert` get a secret name generated from
+// the auto secret name template, unless they're excluded with label
+// `service.syn.tools/serving-cert-exclude`. Returns false if no certificate
+// is requested for the service.
+func (r *ServiceReconciler) servingCertSecretName(ctx context.Context, svc *corev1.Service) (string, bool, error) {
+	auto, err := r.autoServingCerts(ctx, svc.Namespace)
+	if err != nil {
+		return "", false, err
+	}
+	return r.requestedSecretName(svc, auto)
+}
+
+// requestedSecretName returns the name of the certificate secret which is
+// requested for the service, see servingCertSecretName(). `auto` indicates
+// whether the service's namespace has automatic certificates.
+func (r *ServiceReconciler) requestedSecretName(svc *corev1.Service, auto bool) (string, bool, error) {
+	if secretName, ok := svc.Labels[ServingCertLabelKey]; ok {
+		return secretName, true, nil
+	}
+	if !auto || isTrue(svc.Labels[ServingCertExcludeLabelKey]) {
+		return "", false, nil
+	}
+
+	tmpl := r.AutoSecretNameTemplate
+	if tmpl == nil {
+		var err error
+		if tmpl, err = ParseAutoSecretNameTemplate(DefaultAutoSecretNameTemplate); err != nil {
+			return "", false, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct{ Name, Namespace string }{svc.Name, svc.Namespace}); err != nil {
+		return "", false, err
+	}
+	return buf.String(), true, nil
+}
+
+// autoServingCerts returns true if namespace `ns` has label
+// `service.syn.tools/auto-serving-cert` set to `true`
+func (r *ServiceReconciler) autoServingCerts(ctx context.Context, ns string) (bool, error) {
+	namespace := corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: ns}, &namespace); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return isTrue(namespace.Labels[AutoServingCertLabelKey]), nil
+}
+
+// isTrue returns true if `v` parses as boolean `true`
+func isTrue(v string) bool {
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+// namespaceCA returns the CA certificate which issues certificates in
+// namespace `ns`, and the reference to its issuer. Namespaces with label
+// `service.syn.tools/ca-group` use the CA of the group. If `namespaceCAs`
+// is true, all other namespaces use a CA of their own. Otherwise, they use
+// the cluster-wide Service CA.
+func namespaceCA(ctx context.Context, c client.Client, l logr.Logger, caNamespace string, profile certs.CAProfile, namespaceCAs bool, ns string) (string, cmmeta.ObjectReference, error) {
+	group, err := caGroup(ctx, c, ns, namespaceCAs)
+	if err != nil {
+		return "", cmmeta.ObjectReference{}, err
+	}
+	if group == "" {
+		ca, err := certs.GetServiceCA(ctx, c, l, caNamespace, profile)
+		return ca, profile.IssuerRef(), err
+	}
+	ca, err := certs.GetNamespaceCA(ctx, c, l, caNamespace, profile, group)
+	groupProfile := profile.GroupProfile(group)
+	return ca, groupProfile.IssuerRef(), err
+}
+
+// caGroup returns the CA group of namespace `ns`, or an empty string if the
+// namespace uses the cluster-wide Service CA
+func caGroup(ctx context.Context, c client.Reader, ns string, namespaceCAs bool) (string, error) {
+	namespace := corev1.Namespace{}
+	if err := c.Get(ctx, client.ObjectKey{Name: ns}, &namespace); err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	if group, ok := namespace.Labels[certs.CAGroupLabelKey]; ok {
+		return group, nil
+	}
+	if namespaceCAs {
+		return ns, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestNamespacePolicy_Allowed(t *testing.T) {
+	tests := map[string]struct {
+		policy  NamespacePolicy
+		allowed map[string]bool
+	}{
+		"Empty": {
+			policy: NamespacePolicy{},
+			allowed: map[string]bool{
+				"default":     true,
+				"kube-system": true,
+			},
+		},
+		"Deny": {
+			policy: NamespacePolicy{
+				Deny: []string{"kube-system", "tenant-*"},
+			},
+			allowed: map[string]bool{
+				"default":     true,
+				"kube-system": false,
+				"tenant-a":    false,
+			},
+		},
+		"AllowAndDeny": {
+			policy: NamespacePolicy{
+				Allow: []string{"platform-*", "tenant-*"},
+				Deny:  []string{"tenant-b"},
+			},
+			allowed: map[string]bool{
+				"default":        false,
+				"platform-mesh":  true,
+				"tenant-a":       true,
+				"tenant-b":       false,
+				"tenant-b-extra": true,
+			},
+		},
+	}
+
+	for testn, tc := range tests {
+		require.NoError(t, tc.policy.Validate(), testn)
+		for ns, allowed := range tc.allowed {
+			assert.Equal(t, allowed, tc.policy.Allowed(ns), "%s: %s", testn, ns)
+		}
+	}
+
+	assert.Error(t, NamespacePolicy{Deny: []string{"tenant-["}}.Validate())
+}
+
+func TestSvcController_servingCertSecretName(t *testing.T) {
+	ctx := context.Background()
+	autoNs := prepareNamespace("auto", map[string]string{
+		AutoServingCertLabelKey: "true",
+	})
+	manualNs := prepareNamespace("manual", nil)
+
+	tests := map[string]struct {
+		svc        corev1.Service
+		template   string
+		secretName string
+		requested  bool
+	}{
+		"Labeled": {
+			svc: prepareService("test-svc", "manual", map[string]string{
+				ServingCertLabelKey: "foo-tls",
+			}),
+			secretName: "foo-tls",
+			requested:  true,
+		},
+		"Unlabeled": {
+			svc:       prepareService("test-svc", "manual", nil),
+			requested: false,
+		},
+		"Auto": {
+			svc:        prepareService("test-svc", "auto", nil),
+			secretName: "test-svc-tls",
+			requested:  true,
+		},
+		"Auto_CustomTemplate": {
+			svc:        prepareService("test-svc", "auto", nil),
+			template:   "{{ .Namespace }}-{{ .Name }}-cert",
+			secretName: "auto-test-svc-cert",
+			requested:  true,
+		},
+		"Auto_Labeled": {
+			svc: prepareService("test-svc", "auto", map[string]string{
+				ServingCertLabelKey: "foo-tls",
+			}),
+			secretName: "foo-tls",
+			requested:  true,
+		},
+		"Auto_Excluded": {
+			svc: prepareService("test-svc", "auto", map[string]string{
+				ServingCertExcludeLabelKey: "true",
+			}),
+			requested: false,
+		},
+		"NamespaceNotFound": {
+			svc:       prepareService("test-svc", "missing", nil),
+			requested: false,
+		},
+	}
+
+	for testn, tc := range tests {
+		c, _ := prepareTest(t, []client.Object{&autoNs, &manualNs})
+		r := ServiceReconciler{Client: c}
+		if tc.template != "" {
+			tmpl, err := ParseAutoSecretNameTemplate(tc.template)
+			require.NoError(t, err, testn)
+			r.AutoSecretNameTemplate = tmpl
+		}
+		secretName, requested, err := r.servingCertSecretName(ctx, &tc.svc)
+		require.NoError(t, err, testn)
+		assert.Equal(t, tc.requested, requested, testn)
+		assert.Equal(t, tc.secretName, secretName, testn)
+	}
+}
+
+func TestNamespaceCA(t *testing.T) {
+	ctx := context.Background()
+	l := testr.New(t)
+	profile := certs.DefaultCAProfile()
+	objs := append(prepareTestServiceCA(testCANamespace),
+		prepareTestGroupCA(testCANamespace, "tenant", "TENANT_CA")...)
+	objs = append(objs, prepareTestGroupCA(testCANamespace, "tenant-b", "TENANT_B_CA")...)
+	tenantA := prepareNamespace("tenant-a", map[string]string{
+		certs.CAGroupLabelKey: "tenant",
+	})
+	tenantB := prepareNamespace("tenant-b", nil)
+	objs = append(objs, &tenantA, &tenantB)
+
+	tests := map[string]struct {
+		namespace    string
+		namespaceCAs bool
+		ca           string
+		issuer       string
+	}{
+		"ClusterCA": {
+			namespace: "tenant-b",
+			ca:        "TEST_CA",
+			issuer:    certs.ServiceIssuerName,
+		},
+		"NamespaceCA": {
+			namespace:    "tenant-b",
+			namespaceCAs: true,
+			ca:           "TENANT_B_CA",
+			issuer:       certs.ServiceIssuerName + "-tenant-b",
+		},
+		"GroupCA": {
+			namespace: "tenant-a",
+			ca:        "TENANT_CA",
+			issuer:    certs.ServiceIssuerName + "-tenant",
+		},
+		"GroupCA_NamespaceCAs": {
+			namespace:    "tenant-a",
+			namespaceCAs: true,
+			ca:           "TENANT_CA",
+			issuer:       certs.ServiceIssuerName + "-tenant",
+		},
+	}
+
+	for testn, tc := range tests {
+		c, _ := prepareTest(t, objs)
+		ca, issuer, err := namespaceCA(ctx, c, l, testCANamespace, profile, tc.namespaceCAs, tc.namespace)
+		require.NoError(t, err, testn)
+		assert.Equal(t, tc.ca, ca, testn)
+		assert.Equal(t, "ClusterIssuer", issuer.Kind, testn)
+		assert.Equal(t, tc.issuer, issuer.Name, testn)
+		// The group CA's key isn't copied into the namespace
+		err = c.Get(ctx, client.ObjectKey{Namespace: tc.namespace, Name: certs.CASecretName}, &corev1.Secret{})
+		assert.True(t, apierrors.IsNotFound(err), testn)
+	}
+}
+
+// prepareTestGroupCA returns the ready CA Certificate and secret of CA group
+// `group`
+func prepareTestGroupCA(caNamespace, group, ca string) []client.Object {
+	profile := certs.DefaultCAProfile()
+	return prepareTestCA(caNamespace, profile.GroupProfile(group), ca)
+}
+
+func prepareNamespace(name string, labels map[string]string) corev1.Namespace {
+	return corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// protectedKinds are the kinds of the objects which the tamper protection
+// webhook protects, with a constructor for an empty object of the kind
+var protectedKinds = map[string]func() client.Object{
+	"Secret":                func() client.Object { return &corev1.Secret{} },
+	"ConfigMap":             func() client.Object { return &corev1.ConfigMap{} },
+	cmapi.CertificateKind:   func() client.Object { return &cmapi.Certificate{} },
+	cmapi.IssuerKind:        func() client.Object { return &cmapi.Issuer{} },
+	cmapi.ClusterIssuerKind: func() client.Object { return &cmapi.ClusterIssuer{} },
+}
+
+// ProtectionLabelReconciler sets label `service.syn.tools/protected` on the
+// objects of kind Kind which the controller manages, see
+// certs.IsManagedResource(). The tamper protection webhook only receives the
+// requests for objects with the label, so that it doesn't block changes of
+// all objects of these kinds while the controller is unavailable.
+type ProtectionLabelReconciler struct {
+	client.Client
+	CANamespace string
+	CAProfile   certs.CAProfile
+	NamedCAs    certs.CAProfiles
+	// Kind is the kind of the objects which the reconciler labels, see
+	// protectedKinds
+	Kind string
+}
+
+// Reconcile sets the protection label on the object if it's managed by the
+// controller
+func (r *ProtectionLabelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("kind", r.Kind, "namespace", req.Namespace, "name", req.Name)
+
+	obj := protectedKinds[r.Kind]()
+	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if obj.GetLabels()[certs.ProtectedLabelKey] == "true" ||
+		!certs.IsManagedResource(r.Kind, obj, r.CANamespace, caProfiles(r.CAProfile, r.NamedCAs)) {
+		return ctrl.Result{}, nil
+	}
+	l.V(1).Info("Labeling managed object for tamper protection")
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[certs.ProtectedLabelKey] = "true"
+	obj.SetLabels(labels)
+	return ctrl.Result{}, r.Patch(ctx, obj, patch)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ProtectionLabelReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("protection-label-" + strings.ToLower(r.Kind)).
+		For(protectedKinds[r.Kind]()).
+		Complete(r)
+}
+
+// SetupProtectionLabelReconcilers sets up a ProtectionLabelReconciler like
+// `base` for each of the protected kinds
+func SetupProtectionLabelReconcilers(mgr ctrl.Manager, base ProtectionLabelReconciler) error {
+	for kind := range protectedKinds {
+		r := base
+		r.Kind = kind
+		if err := r.SetupWithManager(mgr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// caProfiles returns the profiles of all configured CAs
+func caProfiles(profile certs.CAProfile, named certs.CAProfiles) []certs.CAProfile {
+	profiles := []certs.CAProfile{profile}
+	for _, name := range named.Names() {
+		profiles = append(profiles, named[name])
+	}
+	return profiles
+}
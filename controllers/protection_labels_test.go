@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestProtectionLabelReconciler_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	profile := certs.DefaultCAProfile()
+
+	tests := map[string]struct {
+		kind      string
+		obj       client.Object
+		protected bool
+	}{
+		"ServiceCertSecret": {
+			kind: "Secret",
+			obj: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-tls",
+				Namespace: testNs,
+				Labels:    map[string]string{certs.ServiceCertSecretLabelKey: "app-tls"},
+			}},
+			protected: true,
+		},
+		"OtherSecret": {
+			kind: "Secret",
+			obj: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-credentials",
+				Namespace: testNs,
+			}},
+		},
+		"CASecret": {
+			kind: "Secret",
+			obj: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.SecretName,
+				Namespace: testCANamespace,
+			}},
+			protected: true,
+		},
+		"TrustBundle": {
+			kind: "ConfigMap",
+			obj: &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Name:      certs.TrustBundleName(profile.SecretName),
+				Namespace: testCANamespace,
+				Labels:    map[string]string{certs.TrustBundleLabelKey: "true"},
+			}},
+			protected: true,
+		},
+		"CACertificate": {
+			kind: cmapi.CertificateKind,
+			obj: &cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.CertificateName,
+				Namespace: testCANamespace,
+			}},
+			protected: true,
+		},
+		"SelfSignedIssuer": {
+			kind: cmapi.IssuerKind,
+			obj: &cmapi.Issuer{ObjectMeta: metav1.ObjectMeta{
+				Name:      profile.SelfSignedIssuerName,
+				Namespace: testCANamespace,
+			}},
+			protected: true,
+		},
+		"ServiceIssuer": {
+			kind:      cmapi.ClusterIssuerKind,
+			obj:       &cmapi.ClusterIssuer{ObjectMeta: metav1.ObjectMeta{Name: profile.IssuerName}},
+			protected: true,
+		},
+		"OtherClusterIssuer": {
+			kind: cmapi.ClusterIssuerKind,
+			obj:  &cmapi.ClusterIssuer{ObjectMeta: metav1.ObjectMeta{Name: "letsencrypt"}},
+		},
+	}
+
+	for testn, tc := range tests {
+		t.Run(testn, func(t *testing.T) {
+			c, _ := prepareTest(t, []client.Object{tc.obj})
+			r := ProtectionLabelReconciler{
+				Client:      c,
+				CANamespace: testCANamespace,
+				CAProfile:   profile,
+				Kind:        tc.kind,
+			}
+			res, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tc.obj)})
+			require.NoError(t, err)
+			assert.Equal(t, ctrl.Result{}, res)
+
+			updated := protectedKinds[tc.kind]()
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(tc.obj), updated))
+			if tc.protected {
+				assert.Equal(t, "true", updated.GetLabels()[certs.ProtectedLabelKey])
+				for k, v := range tc.obj.GetLabels() {
+					assert.Equal(t, v, updated.GetLabels()[k])
+				}
+			} else {
+				assert.NotContains(t, updated.GetLabels(), certs.ProtectedLabelKey)
+			}
+		})
+	}
+}
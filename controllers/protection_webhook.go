@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ProtectionWebhookPath is the path at which the webhook server serves the
+// ProtectionWebhook
+const ProtectionWebhookPath = "/validate-managed-resources"
+
+// ProtectionWebhook is a validating admission webhook which denies changes
+// to and deletions of the objects which the controller manages, see
+// certs.IsManagedResource(), unless they're made by one of the allowed
+// users.
+type ProtectionWebhook struct {
+	CANamespace string
+	CAProfile   certs.CAProfile
+	NamedCAs    certs.CAProfiles
+	// AllowedUsers lists the users which may change managed objects.
+	// These are usually the controller's and cert-manager's
+	// ServiceAccounts, and the Kubernetes garbage collector and namespace
+	// controller.
+	AllowedUsers []string
+	// EmergencyRotationGroups lists the groups whose members may trigger
+	// an emergency rotation of a CA, see
+	// certs.EmergencyRotationAnnotation. The allowed users may always
+	// trigger emergency rotations.
+	EmergencyRotationGroups []string
+}
+
+//+kubebuilder:webhook:path=/validate-managed-resources,mutating=false,failurePolicy=fail,sideEffects=None,groups="";cert-manager.io,resources=secrets;configmaps;certificates;issuers;clusterissuers,verbs=update;delete,versions=v1,name=managed-resources.service.syn.tools,admissionReviewVersions=v1
+
+// Handle denies UPDATE and DELETE requests for managed objects from users
+// which aren't allowed to change them.
+func (w *ProtectionWebhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Update && req.Operation != admissionv1.Delete {
+		return admission.Allowed("")
+	}
+	for _, user := range w.AllowedUsers {
+		if req.UserInfo.Username == user {
+			return admission.Allowed("")
+		}
+	}
+	obj := metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(req.OldObject.Raw, &obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !certs.IsManagedResource(req.Kind.Kind, &obj, w.CANamespace, caProfiles(w.CAProfile, w.NamedCAs)) {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Update && onlyEmergencyTriggerChanged(req.OldObject.Raw, req.Object.Raw) &&
+		w.mayTriggerEmergencyRotation(req.UserInfo.Groups) {
+		return admission.Allowed("emergency rotation trigger")
+	}
+	log.FromContext(ctx).Info("Denying change of managed object",
+		"kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "user", req.UserInfo.Username)
+	return admission.Denied(fmt.Sprintf("%s %s is managed by the Service CA controller and can't be changed by %s",
+		req.Kind.Kind, objectName(req.Namespace, req.Name), req.UserInfo.Username))
+}
+
+// mayTriggerEmergencyRotation returns true if one of the user's groups
+// `groups` may trigger emergency rotations
+func (w *ProtectionWebhook) mayTriggerEmergencyRotation(groups []string) bool {
+	for _, g := range groups {
+		for _, allowed := range w.EmergencyRotationGroups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onlyEmergencyTriggerChanged returns true if the objects `oldRaw` and
+// `newRaw` only differ in the emergency rotation annotation, so that the
+// members of the emergency rotation groups can trigger emergency rotations
+// of protected CAs.
+func onlyEmergencyTriggerChanged(oldRaw, newRaw []byte) bool {
+	oldObj, newObj := map[string]interface{}{}, map[string]interface{}{}
+	if err := json.Unmarshal(oldRaw, &oldObj); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(newRaw, &newObj); err != nil {
+		return false
+	}
+	for _, obj := range []map[string]interface{}{oldObj, newObj} {
+		meta, ok := obj["metadata"].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		delete(meta, "resourceVersion")
+		delete(meta, "managedFields")
+		if annotations, ok := meta["annotations"].(map[string]interface{}); ok {
+			delete(annotations, certs.EmergencyRotationAnnotation)
+			if len(annotations) == 0 {
+				delete(meta, "annotations")
+			}
+		}
+	}
+	return reflect.DeepEqual(oldObj, newObj)
+}
+
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
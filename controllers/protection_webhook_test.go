@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestProtectionWebhook_Handle(t *testing.T) {
+	ctx := context.Background()
+	w := ProtectionWebhook{
+		CANamespace:             testCANamespace,
+		CAProfile:               certs.DefaultCAProfile(),
+		AllowedUsers:            []string{"system:serviceaccount:service-ca:controller", "system:serviceaccount:cert-manager:cert-manager"},
+		EmergencyRotationGroups: []string{"ca-admins"},
+	}
+	managed := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-tls",
+			Namespace: testNs,
+			Labels:    map[string]string{certs.ServiceCertSecretLabelKey: "app-tls"},
+		},
+	}
+	trigger := func() *corev1.Secret {
+		s := managed.DeepCopy()
+		s.Annotations = map[string]string{certs.EmergencyRotationAnnotation: "key-leak-1"}
+		return s
+	}()
+	other := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-credentials",
+			Namespace: testNs,
+		},
+	}
+
+	tests := map[string]struct {
+		operation admissionv1.Operation
+		obj       *corev1.Secret
+		newObj    *corev1.Secret
+		user      string
+		groups    []string
+		allowed   bool
+	}{
+		"UpdateByAdmin": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			user:      "kubernetes-admin",
+			allowed:   false,
+		},
+		"DeleteByAdmin": {
+			operation: admissionv1.Delete,
+			obj:       &managed,
+			user:      "kubernetes-admin",
+			allowed:   false,
+		},
+		"UpdateByController": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			user:      "system:serviceaccount:service-ca:controller",
+			allowed:   true,
+		},
+		"UpdateByCertManager": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			user:      "system:serviceaccount:cert-manager:cert-manager",
+			allowed:   true,
+		},
+		"CreateByAdmin": {
+			operation: admissionv1.Create,
+			obj:       &managed,
+			user:      "kubernetes-admin",
+			allowed:   true,
+		},
+		"TriggerEmergencyRotation": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			newObj:    trigger,
+			user:      "kubernetes-admin",
+			groups:    []string{"system:authenticated", "ca-admins"},
+			allowed:   true,
+		},
+		"TriggerEmergencyRotationByAllowedUser": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			newObj:    trigger,
+			user:      "system:serviceaccount:service-ca:controller",
+			allowed:   true,
+		},
+		"TriggerEmergencyRotationOutsideGroups": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			newObj:    trigger,
+			user:      "kubernetes-admin",
+			groups:    []string{"system:authenticated", "system:masters"},
+			allowed:   false,
+		},
+		"TriggerEmergencyRotationWithOtherChange": {
+			operation: admissionv1.Update,
+			obj:       &managed,
+			newObj: func() *corev1.Secret {
+				s := managed.DeepCopy()
+				s.Annotations = map[string]string{certs.EmergencyRotationAnnotation: "key-leak-1"}
+				s.Data = map[string][]byte{"tls.crt": []byte("forged")}
+				return s
+			}(),
+			user:    "kubernetes-admin",
+			groups:  []string{"ca-admins"},
+			allowed: false,
+		},
+		"UpdateUnmanaged": {
+			operation: admissionv1.Update,
+			obj:       &other,
+			user:      "kubernetes-admin",
+			allowed:   true,
+		},
+	}
+
+	for testn, tc := range tests {
+		t.Run(testn, func(t *testing.T) {
+			raw, err := json.Marshal(tc.obj)
+			require.NoError(t, err)
+			newObj := tc.newObj
+			if newObj == nil {
+				newObj = tc.obj.DeepCopy()
+				newObj.Labels = nil
+			}
+			newRaw, err := json.Marshal(newObj)
+			require.NoError(t, err)
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+				Namespace: tc.obj.Namespace,
+				Name:      tc.obj.Name,
+				Operation: tc.operation,
+				UserInfo:  authenticationv1.UserInfo{Username: tc.user, Groups: tc.groups},
+				OldObject: runtime.RawExtension{Raw: raw},
+				Object:    runtime.RawExtension{Raw: newRaw},
+			}}
+			res := w.Handle(ctx, req)
+			assert.Equal(t, tc.allowed, res.Allowed)
+			if !tc.allowed {
+				assert.Equal(t, "Secret default/app-tls is managed by the Service CA controller and can't be changed by kubernetes-admin",
+					string(res.Result.Reason))
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	reasonReissuingCertificates      = "ReissuingCertificates"
+	reasonCARotationCompleted        = "CARotationCompleted"
+	reasonEmergencyRotationStarted   = "EmergencyRotationStarted"
+	reasonEmergencyRotationCompleted = "EmergencyRotationCompleted"
+)
+
+// CARotationReconciler reconciles the trust bundle ConfigMaps of the CAs,
+// and drives CA rotations, see certs.ReconcileCARotation().
+type CARotationReconciler struct {
+	client.Client
+	CANamespace string
+	CAProfile   certs.CAProfile
+	NamedCAs    certs.CAProfiles
+	Recorder    record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates/status,verbs=get;update;patch
+
+// Reconcile keeps the previous CA certificates in the CA's trust bundle
+// while the certificates issued by the CA are reissued by the current CA.
+func (r *CARotationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx).WithValues("namespace", req.Namespace, "name", req.Name)
+
+	cm := corev1.ConfigMap{}
+	if err := r.Get(ctx, req.NamespacedName, &cm); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	profile, group, ok := r.caProfile(&cm)
+	if !ok {
+		l.V(1).Info("Trust bundle doesn't belong to a configured CA")
+		return ctrl.Result{}, nil
+	}
+
+	res, err := certs.ReconcileCARotation(ctx, r.Client, l, r.CANamespace, profile, group)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if res.EmergencyStarted {
+		r.Recorder.Eventf(&cm, corev1.EventTypeWarning, reasonEmergencyRotationStarted,
+			"Emergency rotation started, distrusting CA certificates %s",
+			strings.Join(res.Emergency.CompromisedCAs, ", "))
+	}
+	if len(res.Reissued) > 0 {
+		r.Recorder.Eventf(&cm, corev1.EventTypeNormal, reasonReissuingCertificates,
+			"Reissuing certificates which aren't issued by the current CA: %s", strings.Join(res.Reissued, ", "))
+	}
+	if res.Completed {
+		r.Recorder.Event(&cm, corev1.EventTypeNormal, reasonCARotationCompleted,
+			"Removed previous CA certificates from the trust bundle")
+	}
+	if res.EmergencyCompleted {
+		r.Recorder.Eventf(&cm, corev1.EventTypeNormal, reasonEmergencyRotationCompleted,
+			"Emergency rotation completed, %s. See ConfigMap %s/%s for the report",
+			res.Emergency.Summary(), r.CANamespace, certs.EmergencyRotationReportName(profile.SecretName))
+	}
+	return ctrl.Result{RequeueAfter: res.RequeueAfter}, nil
+}
+
+// caProfile returns the profile of the CA to which the trust bundle
+// belongs, and the CA group for trust bundles of CA groups
+func (r *CARotationReconciler) caProfile(cm *corev1.ConfigMap) (certs.CAProfile, string, bool) {
+	secretName := cm.Annotations[certs.CASecretAnnotation]
+	if group, ok := cm.Labels[certs.CAGroupLabelKey]; ok {
+		profile := r.CAProfile.GroupProfile(group)
+		return profile, group, profile.SecretName == secretName
+	}
+	if r.CAProfile.SecretName == secretName {
+		return r.CAProfile, "", true
+	}
+	for _, name := range r.NamedCAs.Names() {
+		if profile := r.NamedCAs[name]; profile.SecretName == secretName {
+			return profile, "", true
+		}
+	}
+	return certs.CAProfile{}, "", false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CARotationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &cmapi.Certificate{},
+		certs.CertificateIssuerIndex, certs.IndexCertificateIssuer)
+	if err != nil {
+		return err
+	}
+	isTrustBundle := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		_, ok := obj.GetLabels()[certs.TrustBundleLabelKey]
+		return ok && obj.GetNamespace() == r.CANamespace
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("carotation").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isTrustBundle)).
+		// Trigger reconcile for the trust bundle if cert-manager renews
+		// the CA. The mapping only needs the secret's name, so only the
+		// secrets' metadata is cached.
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.caSecretToTrustBundle),
+			builder.OnlyMetadata).
+		// Trigger reconcile for the trust bundle if an emergency
+		// rotation is requested on the CA Certificate
+		Watches(&source.Kind{Type: &cmapi.Certificate{}},
+			handler.EnqueueRequestsFromMapFunc(r.caCertificateToTrustBundle)).
+		Complete(r)
+}
+
+// caSecretToTrustBundle maps a CA secret, or the secret of a staged CA, to
+// the CA's trust bundle
+func (r *CARotationReconciler) caSecretToTrustBundle(obj client.Object) []reconcile.Request {
+	if obj.GetNamespace() != r.CANamespace {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: r.CANamespace,
+			Name:      certs.TrustBundleName(strings.TrimSuffix(obj.GetName(), certs.StagedCASuffix)),
+		},
+	}}
+}
+
+// caCertificateToTrustBundle maps a CA Certificate, or the Certificate of a
+// staged CA, to the CA's trust bundle
+func (r *CARotationReconciler) caCertificateToTrustBundle(obj client.Object) []reconcile.Request {
+	cert, ok := obj.(*cmapi.Certificate)
+	if !ok || cert.Namespace != r.CANamespace || !cert.Spec.IsCA {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: r.CANamespace,
+			Name:      certs.TrustBundleName(strings.TrimSuffix(cert.Spec.SecretName, certs.StagedCASuffix)),
+		},
+	}}
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestCARotationController_caProfile(t *testing.T) {
+	profile := certs.DefaultCAProfile()
+	r := CARotationReconciler{
+		CANamespace: testCANamespace,
+		CAProfile:   profile,
+		NamedCAs: certs.CAProfiles{
+			"compliance": certs.NamedCAProfile("compliance"),
+		},
+	}
+
+	tests := map[string]struct {
+		cm      corev1.ConfigMap
+		profile certs.CAProfile
+		group   string
+		ok      bool
+	}{
+		"Default": {
+			cm:      prepareTrustBundle("service-ca-root", nil),
+			profile: profile,
+			ok:      true,
+		},
+		"Named": {
+			cm:      prepareTrustBundle("service-ca-compliance-root", nil),
+			profile: certs.NamedCAProfile("compliance"),
+			ok:      true,
+		},
+		"Group": {
+			cm: prepareTrustBundle("service-ca-root-team-a", map[string]string{
+				certs.CAGroupLabelKey: "team-a",
+			}),
+			profile: profile.GroupProfile("team-a"),
+			group:   "team-a",
+			ok:      true,
+		},
+		"GroupMismatch": {
+			cm: prepareTrustBundle("service-ca-root", map[string]string{
+				certs.CAGroupLabelKey: "team-a",
+			}),
+			ok: false,
+		},
+		"Unknown": {
+			cm: prepareTrustBundle("removed-ca-root", nil),
+			ok: false,
+		},
+	}
+
+	for testn, tc := range tests {
+		t.Run(testn, func(t *testing.T) {
+			p, group, ok := r.caProfile(&tc.cm)
+			assert.Equal(t, tc.ok, ok)
+			if tc.ok {
+				assert.Equal(t, tc.profile, p)
+				assert.Equal(t, tc.group, group)
+			}
+		})
+	}
+}
+
+func TestCARotationController_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	cm := prepareTrustBundle("service-ca-root", nil)
+	unknown := prepareTrustBundle("removed-ca-root", nil)
+	objs := append(prepareTestServiceCA(testCANamespace), &cm, &unknown)
+	c, _ := prepareTest(t, objs)
+	r := CARotationReconciler{
+		Client:      c,
+		CANamespace: testCANamespace,
+		CAProfile:   certs.DefaultCAProfile(),
+		Recorder:    record.NewFakeRecorder(10),
+	}
+
+	for _, name := range []string{cm.Name, unknown.Name, "missing-trust-bundle"} {
+		res, err := r.Reconcile(ctx, ctrl.Request{
+			NamespacedName: client.ObjectKey{Namespace: testCANamespace, Name: name},
+		})
+		require.NoError(t, err, name)
+		assert.Equal(t, ctrl.Result{}, res, name)
+	}
+	assert.Empty(t, recordedEvents(r.Recorder))
+}
+
+func TestCARotationController_caSecretToTrustBundle(t *testing.T) {
+	r := CARotationReconciler{CANamespace: testCANamespace}
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "service-ca-root",
+			Namespace: testCANamespace,
+		},
+	}
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: testCANamespace,
+			Name:      "service-ca-root-trust-bundle",
+		},
+	}}, r.caSecretToTrustBundle(&secret))
+
+	// The secret of a staged CA maps to the trust bundle of the CA
+	secret.Name = "service-ca-root-staged"
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: testCANamespace,
+			Name:      "service-ca-root-trust-bundle",
+		},
+	}}, r.caSecretToTrustBundle(&secret))
+
+	secret.Namespace = testNs
+	assert.Empty(t, r.caSecretToTrustBundle(&secret))
+}
+
+func prepareTrustBundle(secretName string, labels map[string]string) corev1.ConfigMap {
+	l := map[string]string{
+		certs.TrustBundleLabelKey: "true",
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      certs.TrustBundleName(secretName),
+			Namespace: testCANamespace,
+			Labels:    l,
+			Annotations: map[string]string{
+				certs.CASecretAnnotation: secretName,
+			},
+		},
+		Data: map[string]string{
+			"ca.crt": "TEST_CA",
+		},
+	}
+}
+
+func TestCARotationController_caCertificateToTrustBundle(t *testing.T) {
+	r := CARotationReconciler{CANamespace: testCANamespace}
+	cert := cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "service-ca",
+			Namespace: testCANamespace,
+		},
+		Spec: cmapi.CertificateSpec{
+			IsCA:       true,
+			SecretName: "service-ca-root",
+		},
+	}
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: testCANamespace,
+			Name:      "service-ca-root-trust-bundle",
+		},
+	}}, r.caCertificateToTrustBundle(&cert))
+
+	cert.Spec.IsCA = false
+	assert.Empty(t, r.caCertificateToTrustBundle(&cert))
+	cert.Spec.IsCA = true
+	cert.Namespace = testNs
+	assert.Empty(t, r.caCertificateToTrustBundle(&cert))
+}
@@ -18,17 +18,31 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
 
+	"github.com/go-logr/logr"
 	"github.com/projectsyn/k8s-service-ca-controller/certs"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 )
 
 const (
@@ -36,6 +50,21 @@ const (
 	// to create a secret. The label value is used as the secret name
 	// for the generated Certificate.
 	ServingCertLabelKey = "service.syn.tools/serving-cert-secret-name"
+	// ServingCertErrorAnnotation is the annotation in which the controller
+	// reports invalid certificate configurations on the Service.
+	ServingCertErrorAnnotation = "service.syn.tools/serving-cert-error"
+	reasonCertificateCreated   = "CertificateCreated"
+	reasonCertificateUpdated   = "CertificateUpdated"
+	reasonCertificateReady     = "CertificateReady"
+	reasonCertificateNotReady  = "CertificateNotReady"
+	reasonCertificateFailed    = "CertificateFailed"
+	reasonInvalidConfig        = "InvalidConfiguration"
+	reasonWaitingForCA         = "WaitingForCA"
+	reasonNamespaceNotAllowed  = "NamespaceNotAllowed"
+
+	// secretNameIndex is the field index of services by the value of
+	// label `service.syn.tools/serving-cert-secret-name`
+	secretNameIndex = "metadata.labels.serving-cert-secret-name"
 )
 
 // ServiceReconciler reconcile Service objects which have the label
@@ -44,19 +73,41 @@ type ServiceReconciler struct {
 	client.Client
 	Scheme      *runtime.Scheme
 	CANamespace string
+	CAProfile   certs.CAProfile
+	CertConfig  certs.Config
+	Recorder    record.EventRecorder
+	// Namespaces restricts the namespaces in which certificates are
+	// issued
+	Namespaces NamespacePolicy
+	// AutoSecretNameTemplate generates the certificate secret names for
+	// Services in namespaces with automatic certificates. If nil,
+	// DefaultAutoSecretNameTemplate is used.
+	AutoSecretNameTemplate *template.Template
+	// NamespaceCAs enables a separate CA for each namespace which isn't
+	// part of a CA group
+	NamespaceCAs bool
+	// NamedCAs holds the profiles of the named CAs which can be selected
+	// with label or annotation `service.syn.tools/ca`
+	NamedCAs certs.CAProfiles
 }
 
-//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups="",resources=services/status,verbs=get
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;delete;update;patch
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
 //+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=cert-manager.io,resources=certificates/status,verbs=get;update;patch;delete
 
 // Reconcile creates or updates a cert-manager Certificate resource for
 // services which have label `service.syn.tools/serving-cert-secret-name` set.
-// The Certificate resource is configured to use the Service CA cluster
-// issuer, and the value of the `service.syn.tools/serving-cert-secret-name`
+// The Certificate resource is configured to use the issuer of the CA which
+// the service selects with label or annotation `service.syn.tools/ca`, or
+// the issuer of the namespace's CA, and the value of the `service.syn.tools/serving-cert-secret-name`
 // label is used as the certificate secret name.
+// If the label is removed, the Certificates of the service are deleted after
+// the cleanup grace period.
 // Please note that the reconciler will requeue requests until the Service CA
 // is created an ready.
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -76,40 +127,356 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
-	labels := svc.Labels
-	if labels == nil {
-		// nothing to do if service has no labels
-		return ctrl.Result{}, nil
+	secretName, ok, err := r.servingCertSecretName(ctx, &svc)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
-	secretName, ok := labels[ServingCertLabelKey]
 	if !ok {
-		// nothing to do, if the service isn't labeled
-		return ctrl.Result{}, nil
+		// Clean up the certificates if the label was removed
+		return r.cleanupCertificates(ctx, l, &svc, "")
+	}
+	if !r.Namespaces.Allowed(svc.Namespace) {
+		l.V(1).Info("Certificates aren't allowed in namespace")
+		msg := fmt.Sprintf("certificates are not allowed in namespace %s", svc.Namespace)
+		if r.Namespaces.CleanupDenied {
+			return r.cleanupCertificates(ctx, l, &svc, msg)
+		}
+		return ctrl.Result{}, r.reportNamespaceNotAllowed(ctx, &svc, msg)
+	}
+	if errs := validation.IsDNS1123Subdomain(secretName); len(errs) > 0 {
+		return ctrl.Result{}, r.reportInvalidConfig(ctx, &svc,
+			fmt.Sprintf("invalid certificate secret name %q: %s", secretName, strings.Join(errs, ", ")))
+	}
+
+	others, err := r.servicesWithSecretName(ctx, svc.Namespace, secretName, svc.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(others) > 0 {
+		// The other services report the conflict as well when they're
+		// reconciled, see servicesWithSameSecretName().
+		l.Info("Certificate secret name is requested by multiple services", "services", others)
+		return ctrl.Result{}, r.reportInvalidConfig(ctx, &svc,
+			fmt.Sprintf("secret name %s is also requested by Service(s) %s", secretName, strings.Join(others, ", ")))
 	}
 
 	l.V(1).Info("Reconciling Service CA")
-	_, err = certs.GetServiceCA(ctx, r.Client, l, r.CANamespace)
+	_, issuer, err := selectCA(ctx, r.Client, l, r.CANamespace, r.CAProfile, r.NamedCAs, r.NamespaceCAs, &svc)
 	if err != nil {
+		if certs.IsInvalidConfigError(err) {
+			l.Info("Invalid CA configuration", "error", err.Error())
+			return ctrl.Result{}, r.reportInvalidConfig(ctx, &svc, err.Error())
+		}
 		l.Info("Service CA not ready yet, requeuing request")
+		if svc.Annotations[CertReadyAnnotation] != certStateWaitingForCA {
+			r.Recorder.Eventf(&svc, corev1.EventTypeNormal, reasonWaitingForCA, "Waiting for the Service CA: %v", err)
+		}
+		if err := r.setAnnotations(ctx, &svc, map[string]string{
+			CertReadyAnnotation: certStateWaitingForCA,
+		}); err != nil {
+			return ctrl.Result{}, err
+		}
 		return ctrl.Result{}, err
 	}
 
 	l.V(1).Info("Reconciling certificate for service")
 
-	err = certs.CreateCertificate(ctx, l, r.Client, svc, secretName, r.Scheme)
+	err = r.reconcileCertificates(ctx, l, svc, secretName, issuer)
+	if err != nil {
+		if certs.IsInvalidConfigError(err) {
+			// Retrying won't help until the service is changed, report
+			// the error on the service and don't requeue.
+			l.Info("Invalid certificate configuration on service", "error", err.Error())
+			return ctrl.Result{}, r.reportInvalidConfig(ctx, &svc, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+
+	requeue, err := certs.CleanupStaleSecrets(ctx, l, r.Client, svc, r.CertConfig)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status, msg, err := r.certificateStatus(ctx, &svc)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	r.reportStateChange(&svc, status[CertNameAnnotation], status[CertReadyAnnotation], msg)
 
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: requeue}, r.setAnnotations(ctx, &svc, status)
+}
+
+// cleanupCertificates removes the Certificates of a service for which no
+// certificate is requested anymore. If `msg` isn't empty, it's reported as
+// the reason in annotation `service.syn.tools/serving-cert-error`.
+func (r *ServiceReconciler) cleanupCertificates(ctx context.Context, l logr.Logger, svc *corev1.Service, msg string) (ctrl.Result, error) {
+	requeue, err := certs.CleanupCertificates(ctx, l, r.Client, *svc, r.CertConfig)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if msg != "" && svc.Annotations[ServingCertErrorAnnotation] != msg {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, reasonNamespaceNotAllowed, msg)
+	}
+	status := clearedStatus()
+	status[ServingCertErrorAnnotation] = msg
+	return ctrl.Result{RequeueAfter: requeue}, r.setAnnotations(ctx, svc, status)
+}
+
+// reconcileCertificates creates or updates the Certificate for the service,
+// which is issued by `issuer`. For headless services, a Certificate is
+// managed for each pod of the StatefulSets which use the service as their
+// governing service.
+func (r *ServiceReconciler) reconcileCertificates(ctx context.Context, l logr.Logger, svc corev1.Service, secretName string, issuer cmmeta.ObjectReference) error {
+	cfg := r.certConfig(&svc)
+	res, err := certs.CreateCertificate(ctx, l, r.Client, svc, secretName, r.Scheme, cfg, issuer)
+	if err != nil {
+		return err
+	}
+	switch res {
+	case controllerutil.OperationResultCreated:
+		r.Recorder.Eventf(&svc, corev1.EventTypeNormal, reasonCertificateCreated,
+			"Created Certificate %s", certs.CertificateName(svc.Name))
+	case controllerutil.OperationResultUpdated:
+		r.Recorder.Eventf(&svc, corev1.EventTypeNormal, reasonCertificateUpdated,
+			"Updated Certificate %s", certs.CertificateName(svc.Name))
+	}
+
+	pods, err := certs.StatefulSetPods(ctx, r.Client, &svc)
+	if err != nil {
+		return err
+	}
+	err = certs.ReconcilePodCertificates(ctx, l, r.Client, svc, secretName, pods, r.Scheme, cfg, issuer)
+	if err != nil {
+		return err
+	}
+	return certs.ApplySecretKeyMapping(ctx, l, r.Client, svc, r.Scheme)
+}
+
+// certConfig returns the certificate configuration for the service's
+// certificates, which are restricted to the names which the name
+// constraints of the service's CA permit
+func (r *ServiceReconciler) certConfig(svc *corev1.Service) certs.Config {
+	cfg := r.CertConfig
+	profile := r.CAProfile
+	if name := caName(svc); name != "" && name != certs.DefaultCAName {
+		profile = r.NamedCAs[name]
+	}
+	if profile.NameConstraints {
+		cfg.PermittedDNSDomains = profile.PermittedDNSDomains
+		cfg.PermittedIPRanges = profile.PermittedIPRanges
+	}
+	return cfg
+}
+
+// servicesWithSecretName returns the names of the services in `namespace`,
+// except `exclude`, which request certificate secret `secretName`, either
+// with label `service.syn.tools/serving-cert-secret-name` or through the
+// namespace's automatic certificates
+func (r *ServiceReconciler) servicesWithSecretName(ctx context.Context, namespace, secretName, exclude string) ([]string, error) {
+	auto, err := r.autoServingCerts(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	opts := []client.ListOption{client.InNamespace(namespace)}
+	if !auto {
+		// Only services with the label can request the secret
+		opts = append(opts, client.MatchingFields{secretNameIndex: secretName})
+	}
+	svcList := corev1.ServiceList{}
+	if err := r.List(ctx, &svcList, opts...); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for i := range svcList.Items {
+		svc := &svcList.Items[i]
+		if svc.Name == exclude {
+			continue
+		}
+		// Check the secret name as well, as not all clients support
+		// field selectors
+		name, ok, err := r.requestedSecretName(svc, auto)
+		if err != nil {
+			return nil, err
+		}
+		if ok && name == secretName {
+			names = append(names, svc.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// reportStateChange emits an event on the service if the state of the
+// service's Certificate changed since the last reconcile. The previous state
+// is taken from annotation `service.syn.tools/cert-ready`.
+func (r *ServiceReconciler) reportStateChange(svc *corev1.Service, certName, state, msg string) {
+	prevState := svc.Annotations[CertReadyAnnotation]
+	if state == prevState {
+		return
+	}
+	switch {
+	case state == certStateReady:
+		r.Recorder.Eventf(svc, corev1.EventTypeNormal, reasonCertificateReady,
+			"Certificate %s is ready", certName)
+	case state == certStateFailed:
+		r.Recorder.Eventf(svc, corev1.EventTypeWarning, reasonCertificateFailed,
+			"Issuing Certificate %s failed: %s", certName, msg)
+	case prevState == certStateReady:
+		r.Recorder.Eventf(svc, corev1.EventTypeWarning, reasonCertificateNotReady,
+			"Certificate %s is not ready: %s", certName, msg)
+	}
+}
+
+// reportNamespaceNotAllowed reports in annotation
+// `service.syn.tools/serving-cert-error` that certificates aren't allowed in
+// the service's namespace. An event is emitted if the error changed.
+func (r *ServiceReconciler) reportNamespaceNotAllowed(ctx context.Context, svc *corev1.Service, msg string) error {
+	if svc.Annotations[ServingCertErrorAnnotation] != msg {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, reasonNamespaceNotAllowed, msg)
+	}
+	return r.setAnnotations(ctx, svc, map[string]string{
+		ServingCertErrorAnnotation: msg,
+	})
+}
+
+// reportInvalidConfig reports an invalid certificate configuration in
+// annotation `service.syn.tools/serving-cert-error` on the service. An
+// event is emitted if the error changed.
+func (r *ServiceReconciler) reportInvalidConfig(ctx context.Context, svc *corev1.Service, msg string) error {
+	if svc.Annotations[ServingCertErrorAnnotation] != msg {
+		r.Recorder.Event(svc, corev1.EventTypeWarning, reasonInvalidConfig, msg)
+	}
+	return r.setAnnotations(ctx, svc, map[string]string{
+		ServingCertErrorAnnotation: msg,
+	})
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Service{}, secretNameIndex, indexSecretName)
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &cmapi.Certificate{},
+		certs.CertificateDNSNameIndex, certs.IndexCertificateDNSNames)
+	if err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
+		// Services are reconciled on any change, including status
+		// changes, so that certificates which include the load balancer
+		// addresses are updated when the addresses change.
 		For(&corev1.Service{}).
 		// Trigger reconcile for the service if the owned Certificate
 		// is modified/deleted
 		Owns(&cmapi.Certificate{}).
+		// Trigger reconcile for the services which request the same
+		// secret name as a changed service, so that conflicts are
+		// reported and resolved on all of them
+		Watches(&source.Kind{Type: &corev1.Service{}},
+			handler.EnqueueRequestsFromMapFunc(r.servicesWithSameSecretName)).
+		// Trigger reconcile for all services in a namespace if the
+		// namespace's labels change
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.namespaceToServices)).
+		// Trigger reconcile for the governing service if a StatefulSet
+		// is created, scaled or deleted. On updates, the service of
+		// the previous StatefulSet is enqueued as well, so that a
+		// service which is no longer the governing service removes
+		// its per-pod certificates.
+		Watches(&source.Kind{Type: &appsv1.StatefulSet{}},
+			handler.EnqueueRequestsFromMapFunc(statefulSetToService)).
+		// Trigger reconcile for the service if cert-manager updates a
+		// certificate secret, so that the secret key mapping is
+		// reapplied. The mapping only needs the secret's labels, so
+		// only the secrets' metadata is cached.
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(secretToService),
+			builder.OnlyMetadata).
 		Complete(r)
 }
+
+// secretToService maps a certificate secret to the service for which it was
+// issued
+func secretToService(obj client.Object) []reconcile.Request {
+	svcName, ok := obj.GetLabels()[certs.ServiceNameLabelKey]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: obj.GetNamespace(),
+			Name:      svcName,
+		},
+	}}
+}
+
+// indexSecretName indexes services by the value of label
+// `service.syn.tools/serving-cert-secret-name`
+func indexSecretName(obj client.Object) []string {
+	secretName, ok := obj.GetLabels()[ServingCertLabelKey]
+	if !ok {
+		return nil
+	}
+	return []string{secretName}
+}
+
+// servicesWithSameSecretName maps a service to the other services which
+// request the same certificate secret name
+func (r *ServiceReconciler) servicesWithSameSecretName(obj client.Object) []reconcile.Request {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+	secretName, ok, err := r.servingCertSecretName(ctx, svc)
+	if err != nil {
+		log.Log.Error(err, "Unable to determine the certificate secret name", "namespace", obj.GetNamespace(), "name", obj.GetName())
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	names, err := r.servicesWithSecretName(ctx, obj.GetNamespace(), secretName, obj.GetName())
+	if err != nil {
+		log.Log.Error(err, "Unable to list services with the same secret name", "namespace", obj.GetNamespace(), "name", obj.GetName())
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(names))
+	for _, name := range names {
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name},
+		})
+	}
+	return reqs
+}
+
+// namespaceToServices maps a namespace to all services in the namespace
+func (r *ServiceReconciler) namespaceToServices(obj client.Object) []reconcile.Request {
+	svcList := corev1.ServiceList{}
+	if err := r.List(context.Background(), &svcList, client.InNamespace(obj.GetName())); err != nil {
+		log.Log.Error(err, "Unable to list services in namespace", "namespace", obj.GetName())
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(svcList.Items))
+	for _, svc := range svcList.Items {
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&svc),
+		})
+	}
+	return reqs
+}
+
+// statefulSetToService maps a StatefulSet to its governing service
+func statefulSetToService(obj client.Object) []reconcile.Request {
+	sts, ok := obj.(*appsv1.StatefulSet)
+	if !ok || sts.Spec.ServiceName == "" {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: client.ObjectKey{
+			Namespace: sts.Namespace,
+			Name:      sts.Spec.ServiceName,
+		},
+	}}
+}
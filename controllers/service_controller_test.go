@@ -4,19 +4,28 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var (
@@ -28,6 +37,37 @@ var (
 	labeledService = prepareService("test-svc", testNs, map[string]string{
 		ServingCertLabelKey: "foo-tls",
 	})
+	invalidLifetimeService = prepareServiceWithAnnotations("test-svc", testNs, map[string]string{
+		ServingCertLabelKey: "foo-tls",
+	}, map[string]string{
+		certs.CertDurationAnnotation: "1y",
+	})
+	fixedLifetimeService = prepareServiceWithAnnotations("test-svc", testNs, map[string]string{
+		ServingCertLabelKey: "foo-tls",
+	}, map[string]string{
+		certs.CertDurationAnnotation: "720h",
+		ServingCertErrorAnnotation:   "previous error",
+	})
+
+	duplicateSecretService = prepareService("other-svc", testNs, map[string]string{
+		ServingCertLabelKey: "foo-tls",
+	})
+
+	autoDuplicateSecretService = prepareService("other-svc", testNs, map[string]string{
+		ServingCertLabelKey: "test-svc-tls",
+	})
+
+	invalidSecretNameService = prepareService("test-svc", testNs, map[string]string{
+		ServingCertLabelKey: "Foo_TLS",
+	})
+	autoNamespace = prepareNamespace(testNs, map[string]string{
+		AutoServingCertLabelKey: "true",
+	})
+
+	headlessService = prepareHeadlessService("etcd", testNs, map[string]string{
+		ServingCertLabelKey: "etcd-tls",
+	})
+	etcdStatefulSet = prepareStatefulSet("etcd", testNs, "etcd", 2)
 
 	testCANamespace = "service-ca"
 
@@ -46,6 +86,12 @@ func TestSvcController_Reconcile(t *testing.T) {
 		err             error
 		res             ctrl.Result
 		expectedCertKey *client.ObjectKey
+		expectedError   string
+		svcName         string
+		podCerts        []string
+		events          []string
+		namespaces      NamespacePolicy
+		secretName      string
 	}{
 		"UnlabeledService": {
 			objects: []client.Object{
@@ -70,6 +116,9 @@ func TestSvcController_Reconcile(t *testing.T) {
 			},
 			err: fmt.Errorf("CA certificate not yet ready"),
 			res: ctrl.Result{},
+			events: []string{
+				"Normal WaitingForCA Waiting for the Service CA: CA certificate not yet ready",
+			},
 		},
 		"LabeledService_CAReady": {
 			objects: append(
@@ -84,20 +133,160 @@ func TestSvcController_Reconcile(t *testing.T) {
 				Name:      "test-svc-tls",
 				Namespace: testNs,
 			},
+			events: []string{
+				"Normal CertificateCreated Created Certificate test-svc-tls",
+			},
+		},
+		"HeadlessService_StatefulSet": {
+			objects: append(
+				[]client.Object{
+					&headlessService,
+					&etcdStatefulSet,
+				},
+				caObjs...,
+			),
+			err:     nil,
+			res:     ctrl.Result{},
+			svcName: "etcd",
+			podCerts: []string{
+				"etcd.etcd-0-tls",
+				"etcd.etcd-1-tls",
+			},
+			events: []string{
+				"Normal CertificateCreated Created Certificate etcd-tls",
+			},
+		},
+		"InvalidLifetime": {
+			objects: append(
+				[]client.Object{
+					&invalidLifetimeService,
+				},
+				caObjs...,
+			),
+			err:           nil,
+			res:           ctrl.Result{},
+			expectedError: `Error parsing certificate duration from service: annotation service.syn.tools/cert-duration: time: unknown unit "y" in duration "1y"`,
+			events: []string{
+				`Warning InvalidConfiguration Error parsing certificate duration from service: annotation service.syn.tools/cert-duration: time: unknown unit "y" in duration "1y"`,
+			},
+		},
+		"DuplicateSecretName": {
+			objects: append(
+				[]client.Object{
+					&labeledService,
+					&duplicateSecretService,
+				},
+				caObjs...,
+			),
+			err:           nil,
+			res:           ctrl.Result{},
+			expectedError: "secret name foo-tls is also requested by Service(s) other-svc",
+			events: []string{
+				"Warning InvalidConfiguration secret name foo-tls is also requested by Service(s) other-svc",
+			},
+		},
+		"DeniedNamespace": {
+			objects: append(
+				[]client.Object{
+					&labeledService,
+				},
+				caObjs...,
+			),
+			err:           nil,
+			res:           ctrl.Result{},
+			namespaces:    NamespacePolicy{Deny: []string{testNs}},
+			expectedError: "certificates are not allowed in namespace default",
+			events: []string{
+				"Warning NamespaceNotAllowed certificates are not allowed in namespace default",
+			},
+		},
+		"AutoNamespace": {
+			objects: append(
+				[]client.Object{
+					&unlabeledService,
+					&autoNamespace,
+				},
+				caObjs...,
+			),
+			err: nil,
+			res: ctrl.Result{},
+			expectedCertKey: &client.ObjectKey{
+				Name:      "test-svc-tls",
+				Namespace: testNs,
+			},
+			secretName: "test-svc-tls",
+			events: []string{
+				"Normal CertificateCreated Created Certificate test-svc-tls",
+			},
+		},
+		"AutoNamespace_DuplicateSecretName": {
+			objects: append(
+				[]client.Object{
+					&unlabeledService,
+					&autoNamespace,
+					&autoDuplicateSecretService,
+				},
+				caObjs...,
+			),
+			err:           nil,
+			res:           ctrl.Result{},
+			expectedError: "secret name test-svc-tls is also requested by Service(s) other-svc",
+			events: []string{
+				"Warning InvalidConfiguration secret name test-svc-tls is also requested by Service(s) other-svc",
+			},
+		},
+		"InvalidSecretName": {
+			objects: append(
+				[]client.Object{
+					&invalidSecretNameService,
+				},
+				caObjs...,
+			),
+			err:           nil,
+			res:           ctrl.Result{},
+			expectedError: `invalid certificate secret name "Foo_TLS": a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+			events: []string{
+				`Warning InvalidConfiguration invalid certificate secret name "Foo_TLS": a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+			},
+		},
+		"FixedLifetime": {
+			objects: append(
+				[]client.Object{
+					&fixedLifetimeService,
+				},
+				caObjs...,
+			),
+			err: nil,
+			res: ctrl.Result{},
+			expectedCertKey: &client.ObjectKey{
+				Name:      "test-svc-tls",
+				Namespace: testNs,
+			},
+			events: []string{
+				"Normal CertificateCreated Created Certificate test-svc-tls",
+			},
 		},
 	}
 
 	for _, tc := range tests {
+		svcName := "test-svc"
+		if tc.svcName != "" {
+			svcName = tc.svcName
+		}
 		c, scheme := prepareTest(t, tc.objects)
 		r := ServiceReconciler{
 			Client:      c,
 			Scheme:      scheme,
 			CANamespace: testCANamespace,
+			CAProfile:   certs.DefaultCAProfile(),
+			CertConfig:  certs.DefaultConfig(),
+			Recorder:    record.NewFakeRecorder(10),
+			Namespaces:  tc.namespaces,
 		}
 		res, err := r.Reconcile(ctx, ctrl.Request{
 			NamespacedName: client.ObjectKey{
 				Namespace: testNs,
-				Name:      "test-svc",
+				Name:      svcName,
 			},
 		})
 		assert.Equal(t, tc.err, err)
@@ -107,8 +296,288 @@ func TestSvcController_Reconcile(t *testing.T) {
 			cert := cmapi.Certificate{}
 			err = c.Get(ctx, *tc.expectedCertKey, &cert)
 			require.NoError(t, err)
-			assert.Equal(t, cert.Spec.SecretName,
-				labeledService.Labels[ServingCertLabelKey])
+			secretName := labeledService.Labels[ServingCertLabelKey]
+			if tc.secretName != "" {
+				secretName = tc.secretName
+			}
+			assert.Equal(t, secretName, cert.Spec.SecretName)
+		}
+
+		for _, name := range tc.podCerts {
+			cert := cmapi.Certificate{}
+			err = c.Get(ctx, client.ObjectKey{Namespace: testNs, Name: name}, &cert)
+			assert.NoError(t, err)
+		}
+
+		svc := corev1.Service{}
+		err = c.Get(ctx, client.ObjectKey{Namespace: testNs, Name: svcName}, &svc)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedError, svc.Annotations[ServingCertErrorAnnotation])
+		if tc.expectedCertKey != nil {
+			assert.Equal(t, tc.expectedCertKey.Name, svc.Annotations[CertNameAnnotation])
+			assert.Equal(t, "False", svc.Annotations[CertReadyAnnotation])
+		}
+		assert.Equal(t, tc.events, recordedEvents(r.Recorder))
+	}
+}
+
+func TestSvcController_Reconcile_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	svc := labeledService.DeepCopy()
+	c, scheme := prepareTest(t, append([]client.Object{svc}, prepareTestServiceCA(testCANamespace)...))
+	r := ServiceReconciler{
+		Client:      c,
+		Scheme:      scheme,
+		CANamespace: testCANamespace,
+		CAProfile:   certs.DefaultCAProfile(),
+		CertConfig:  certs.DefaultConfig(),
+		Recorder:    record.NewFakeRecorder(10),
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+	certKey := client.ObjectKey{Namespace: testNs, Name: "test-svc-tls"}
+
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, res)
+	// Simulate the secret which cert-manager creates
+	cert := cmapi.Certificate{}
+	require.NoError(t, c.Get(ctx, certKey, &cert))
+	require.NoError(t, c.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo-tls",
+			Namespace: testNs,
+			Labels:    cert.Spec.SecretTemplate.Labels,
+		},
+	}))
+
+	// Renaming the secret moves the certificate, and keeps the previous
+	// secret for the grace period
+	require.NoError(t, c.Get(ctx, req.NamespacedName, svc))
+	svc.Labels[ServingCertLabelKey] = "bar-tls"
+	require.NoError(t, c.Update(ctx, svc))
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	assert.Greater(t, res.RequeueAfter, 59*time.Minute)
+	require.NoError(t, c.Get(ctx, certKey, &cert))
+	assert.Equal(t, "bar-tls", cert.Spec.SecretName)
+	oldSecret := corev1.Secret{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: testNs, Name: "foo-tls"}, &oldSecret))
+	assert.Contains(t, oldSecret.Annotations, certs.CleanupAfterAnnotation)
+
+	// Removing the label without grace period deletes the certificate
+	// and all its secrets
+	r.CertConfig.CleanupGracePeriod = 0
+	require.NoError(t, c.Get(ctx, req.NamespacedName, svc))
+	delete(svc.Labels, ServingCertLabelKey)
+	require.NoError(t, c.Update(ctx, svc))
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, res)
+	err = c.Get(ctx, certKey, &cert)
+	assert.True(t, apierrors.IsNotFound(err))
+	err = c.Get(ctx, client.ObjectKey{Namespace: testNs, Name: "foo-tls"}, &oldSecret)
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSvcController_Reconcile_DeniedNamespace(t *testing.T) {
+	ctx := context.Background()
+	for _, cleanup := range []bool{false, true} {
+		svc := labeledService.DeepCopy()
+		c, scheme := prepareTest(t, append([]client.Object{svc}, prepareTestServiceCA(testCANamespace)...))
+		cfg := certs.DefaultConfig()
+		cfg.CleanupGracePeriod = 0
+		r := ServiceReconciler{
+			Client:      c,
+			Scheme:      scheme,
+			CANamespace: testCANamespace,
+			CAProfile:   certs.DefaultCAProfile(),
+			CertConfig:  cfg,
+			Recorder:    record.NewFakeRecorder(10),
+		}
+		req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+		certKey := client.ObjectKey{Namespace: testNs, Name: "test-svc-tls"}
+		_, err := r.Reconcile(ctx, req)
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, certKey, &cmapi.Certificate{}))
+
+		// Existing certificates are only removed if cleanup of denied
+		// namespaces is enabled
+		r.Namespaces = NamespacePolicy{
+			Deny:          []string{testNs},
+			CleanupDenied: cleanup,
+		}
+		_, err = r.Reconcile(ctx, req)
+		require.NoError(t, err)
+		err = c.Get(ctx, certKey, &cmapi.Certificate{})
+		assert.Equal(t, cleanup, apierrors.IsNotFound(err), cleanup)
+		require.NoError(t, c.Get(ctx, req.NamespacedName, svc))
+		assert.Equal(t, "certificates are not allowed in namespace default", svc.Annotations[ServingCertErrorAnnotation])
+	}
+}
+
+func TestSvcController_Reconcile_WaitingForCA(t *testing.T) {
+	ctx := context.Background()
+	svc := labeledService.DeepCopy()
+	c, scheme := prepareTest(t, []client.Object{&cmCRD, svc})
+	r := ServiceReconciler{
+		Client:      c,
+		Scheme:      scheme,
+		CANamespace: testCANamespace,
+		CAProfile:   certs.DefaultCAProfile(),
+		CertConfig:  certs.DefaultConfig(),
+		Recorder:    record.NewFakeRecorder(10),
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(svc)}
+
+	// The event is only emitted when the service starts waiting for the
+	// CA, not on every retry
+	_, err := r.Reconcile(ctx, req)
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"Normal WaitingForCA Waiting for the Service CA: CA certificate not yet ready",
+	}, recordedEvents(r.Recorder))
+	require.NoError(t, c.Get(ctx, req.NamespacedName, svc))
+	assert.Equal(t, "WaitingForCA", svc.Annotations[CertReadyAnnotation])
+
+	_, err = r.Reconcile(ctx, req)
+	assert.Error(t, err)
+	assert.Empty(t, recordedEvents(r.Recorder))
+}
+
+func TestSvcController_reportStateChange(t *testing.T) {
+	r := ServiceReconciler{
+		Recorder: record.NewFakeRecorder(10),
+	}
+	svc := labeledService.DeepCopy()
+
+	tests := []struct {
+		state  string
+		msg    string
+		events []string
+	}{
+		{
+			state: "WaitingForCA",
+		},
+		{
+			state: "False",
+			msg:   "Issuing certificate as Secret does not exist",
+		},
+		{
+			state:  "True",
+			msg:    "Certificate is up to date and has not expired",
+			events: []string{"Normal CertificateReady Certificate test-svc-tls is ready"},
+		},
+		{
+			state: "True",
+			msg:   "Certificate is up to date and has not expired",
+		},
+		{
+			state:  "False",
+			msg:    "Certificate expired",
+			events: []string{"Warning CertificateNotReady Certificate test-svc-tls is not ready: Certificate expired"},
+		},
+		{
+			state:  "Failed",
+			msg:    "The certificate request has failed to complete and will be retried: issuer not found",
+			events: []string{"Warning CertificateFailed Issuing Certificate test-svc-tls failed: The certificate request has failed to complete and will be retried: issuer not found"},
+		},
+	}
+	for i, tc := range tests {
+		r.reportStateChange(svc, "test-svc-tls", tc.state, tc.msg)
+		assert.Equal(t, tc.events, recordedEvents(r.Recorder), i)
+		svc.Annotations = map[string]string{CertReadyAnnotation: tc.state}
+	}
+}
+
+func TestSvcController_servicesWithSameSecretName(t *testing.T) {
+	c, _ := prepareTest(t, []client.Object{
+		&labeledService,
+		&duplicateSecretService,
+	})
+	r := ServiceReconciler{Client: c}
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{Namespace: testNs, Name: "other-svc"},
+	}}, r.servicesWithSameSecretName(&labeledService))
+	assert.Empty(t, r.servicesWithSameSecretName(&unlabeledService))
+
+	// Services in namespaces with automatic certificates request the
+	// generated secret name
+	c, _ = prepareTest(t, []client.Object{
+		&autoNamespace,
+		&unlabeledService,
+		&autoDuplicateSecretService,
+	})
+	r = ServiceReconciler{Client: c}
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{Namespace: testNs, Name: "test-svc"},
+	}}, r.servicesWithSameSecretName(&autoDuplicateSecretService))
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{Namespace: testNs, Name: "other-svc"},
+	}}, r.servicesWithSameSecretName(&unlabeledService))
+}
+
+func TestSvcController_statefulSetToService(t *testing.T) {
+	reqs := statefulSetToService(&etcdStatefulSet)
+	assert.Equal(t, []reconcile.Request{{
+		NamespacedName: client.ObjectKey{Namespace: testNs, Name: "etcd"},
+	}}, reqs)
+
+	noSvc := prepareStatefulSet("other", testNs, "", 1)
+	assert.Empty(t, statefulSetToService(&noSvc))
+
+	// The previous governing service is reconciled as well if the
+	// service name changes
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer q.ShutDown()
+	moved := prepareStatefulSet("etcd", testNs, "etcd-headless", 3)
+	handler.EnqueueRequestsFromMapFunc(statefulSetToService).Update(event.UpdateEvent{
+		ObjectOld: &etcdStatefulSet,
+		ObjectNew: &moved,
+	}, q)
+	enqueued := []string{}
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		enqueued = append(enqueued, item.(reconcile.Request).Name)
+		q.Done(item)
+	}
+	assert.ElementsMatch(t, []string{"etcd", "etcd-headless"}, enqueued)
+}
+
+func TestSvcController_certConfig(t *testing.T) {
+	constrained := certs.NamedCAProfile("constrained")
+	constrained.NameConstraints = true
+	constrained.PermittedDNSDomains = []string{"cluster.local"}
+	constrained.PermittedIPRanges = []string{"10.96.0.0/12"}
+	r := ServiceReconciler{
+		CertConfig: certs.DefaultConfig(),
+		CAProfile:  certs.DefaultCAProfile(),
+		NamedCAs: certs.CAProfiles{
+			"constrained": constrained,
+		},
+	}
+
+	svc := prepareService("test-svc", testNs, nil)
+	cfg := r.certConfig(&svc)
+	assert.Empty(t, cfg.PermittedDNSDomains)
+	assert.Empty(t, cfg.PermittedIPRanges)
+
+	svc = prepareService("test-svc", testNs, map[string]string{CAKey: "constrained"})
+	cfg = r.certConfig(&svc)
+	assert.Equal(t, []string{"cluster.local"}, cfg.PermittedDNSDomains)
+	assert.Equal(t, []string{"10.96.0.0/12"}, cfg.PermittedIPRanges)
+}
+
+// recordedEvents returns the events which were recorded by the fake recorder
+// since the last call
+func recordedEvents(recorder record.EventRecorder) []string {
+	var events []string
+	ch := recorder.(*record.FakeRecorder).Events
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		default:
+			return events
 		}
 	}
 }
@@ -129,11 +598,36 @@ func prepareTest(t *testing.T, initObjs []client.Object) (client.Client, *runtim
 }
 
 func prepareService(name, namespace string, labels map[string]string) corev1.Service {
-	return corev1.Service{
+	return prepareServiceWithAnnotations(name, namespace, labels, nil)
+}
+
+func prepareHeadlessService(name, namespace string, labels map[string]string) corev1.Service {
+	svc := prepareService(name, namespace, labels)
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	svc.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	return svc
+}
+
+func prepareStatefulSet(name, namespace, serviceName string, replicas int32) appsv1.StatefulSet {
+	return appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
-			Labels:    labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: serviceName,
+			Replicas:    &replicas,
+		},
+	}
+}
+
+func prepareServiceWithAnnotations(name, namespace string, labels, annotations map[string]string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: corev1.ServiceSpec{
 			ClusterIPs: []string{
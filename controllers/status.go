@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// CertReadyAnnotation is the annotation in which the controller
+	// reports the state of the Service's Certificate: `True` if the
+	// certificate is ready, `Failed` if cert-manager failed to issue the
+	// certificate, `WaitingForCA` if the Service's CA isn't ready yet,
+	// and `False` otherwise.
+	CertReadyAnnotation = "service.syn.tools/cert-ready"
+	// CertNameAnnotation is the annotation in which the controller reports
+	// the name of the Service's Certificate
+	CertNameAnnotation = "service.syn.tools/cert-name"
+	// CertNotAfterAnnotation is the annotation in which the controller
+	// reports the expiry time of the Service's certificate
+	CertNotAfterAnnotation = "service.syn.tools/cert-not-after"
+	// CertLastRenewalAnnotation is the annotation in which the controller
+	// reports when the Service's certificate was last issued
+	CertLastRenewalAnnotation = "service.syn.tools/cert-last-renewal"
+	// CertCAHashAnnotation is the annotation in which the controller
+	// reports the SHA-256 fingerprint of the CA which signed the
+	// Service's certificate
+	CertCAHashAnnotation = "service.syn.tools/cert-ca-hash"
+
+	certStateReady        = "True"
+	certStateNotReady     = "False"
+	certStateFailed       = "Failed"
+	certStateWaitingForCA = "WaitingForCA"
+
+	// issuingFailedReason is the reason of the Certificate's `Issuing`
+	// condition after cert-manager failed to issue the certificate
+	issuingFailedReason = "Failed"
+)
+
+// certificateStatus returns the status annotations for the service's
+// Certificate, and the message of the cert-manager condition which
+// determines the Certificate's state.
+func (r *ServiceReconciler) certificateStatus(ctx context.Context, svc *corev1.Service) (map[string]string, string, error) {
+	cert := cmapi.Certificate{}
+	certName := certs.CertificateName(svc.Name)
+	err := r.Get(ctx, client.ObjectKey{Namespace: svc.Namespace, Name: certName}, &cert)
+	if err != nil {
+		return nil, "", err
+	}
+
+	status := clearedStatus()
+	status[CertNameAnnotation] = certName
+	if cert.Status.NotAfter != nil {
+		status[CertNotAfterAnnotation] = cert.Status.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if cert.Status.NotBefore != nil {
+		status[CertLastRenewalAnnotation] = cert.Status.NotBefore.UTC().Format(time.RFC3339)
+	}
+	caHash, err := r.caHash(ctx, &cert)
+	if err != nil {
+		return nil, "", err
+	}
+	status[CertCAHashAnnotation] = caHash
+
+	state, msg := certificateState(&cert)
+	status[CertReadyAnnotation] = state
+	return status, msg, nil
+}
+
+// caHash returns the fingerprint of the CA certificate in the Certificate's
+// secret, or an empty string if the secret doesn't exist yet
+func (r *ServiceReconciler) caHash(ctx context.Context, cert *cmapi.Certificate) (string, error) {
+	secret := corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: cert.Namespace, Name: cert.Spec.SecretName}, &secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	caPEM, ok := secret.Data[cmmeta.TLSCAKey]
+	if !ok {
+		return "", nil
+	}
+	fp, err := certs.CAFingerprint(caPEM)
+	if err != nil {
+		// Not worth failing the reconcile over, the secret is managed
+		// by cert-manager
+		return "", nil
+	}
+	return fp, nil
+}
+
+// clearedStatus returns the status annotations with empty values, which
+// removes them from the service
+func clearedStatus() map[string]string {
+	return map[string]string{
+		ServingCertErrorAnnotation: "",
+		CertReadyAnnotation:        "",
+		CertNameAnnotation:         "",
+		CertNotAfterAnnotation:     "",
+		CertLastRenewalAnnotation:  "",
+		CertCAHashAnnotation:       "",
+	}
+}
+
+// certificateState returns the state of the Certificate, and the message of
+// the cert-manager condition which determines the state
+func certificateState(cert *cmapi.Certificate) (string, string) {
+	state, msg := certStateNotReady, ""
+	for _, c := range cert.Status.Conditions {
+		switch {
+		case c.Type == cmapi.CertificateConditionIssuing && c.Status == cmmeta.ConditionFalse &&
+			c.Reason == issuingFailedReason:
+			// A failed renewal is reported even if the current
+			// certificate is still valid
+			return certStateFailed, c.Message
+		case c.Type == cmapi.CertificateConditionReady:
+			msg = c.Message
+			if c.Status == cmmeta.ConditionTrue {
+				state = certStateReady
+			}
+		}
+	}
+	return state, msg
+}
+
+// setAnnotations sets the given annotations on the service. Annotations with
+// an empty value are removed. The service is only patched if the annotations
+// change.
+func (r *ServiceReconciler) setAnnotations(ctx context.Context, svc *corev1.Service, annotations map[string]string) error {
+	patch := client.MergeFrom(svc.DeepCopy())
+	changed := false
+	for k, v := range annotations {
+		if svc.Annotations[k] == v {
+			continue
+		}
+		changed = true
+		if v == "" {
+			delete(svc.Annotations, k)
+			continue
+		}
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[k] = v
+	}
+	if !changed {
+		return nil
+	}
+	return r.Patch(ctx, svc, patch)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSvcController_certificateStatus(t *testing.T) {
+	ctx := context.Background()
+	cert := cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-svc-tls",
+			Namespace: testNs,
+		},
+	}
+	c, _ := prepareTest(t, []client.Object{&cert})
+	r := ServiceReconciler{
+		Client: c,
+	}
+	svc := labeledService.DeepCopy()
+
+	tests := []struct {
+		conditions []cmapi.CertificateCondition
+		state      string
+		msg        string
+	}{
+		{
+			conditions: []cmapi.CertificateCondition{
+				{Type: cmapi.CertificateConditionReady, Status: cmmeta.ConditionFalse, Message: "Issuing certificate as Secret does not exist"},
+			},
+			state: "False",
+			msg:   "Issuing certificate as Secret does not exist",
+		},
+		{
+			conditions: []cmapi.CertificateCondition{
+				{Type: cmapi.CertificateConditionReady, Status: cmmeta.ConditionTrue, Message: "Certificate is up to date and has not expired"},
+			},
+			state: "True",
+			msg:   "Certificate is up to date and has not expired",
+		},
+		{
+			conditions: []cmapi.CertificateCondition{
+				{Type: cmapi.CertificateConditionReady, Status: cmmeta.ConditionFalse, Message: "Certificate expired"},
+				{Type: cmapi.CertificateConditionIssuing, Status: cmmeta.ConditionFalse, Reason: "Failed", Message: "The certificate request has failed to complete and will be retried: issuer not found"},
+			},
+			state: "Failed",
+			msg:   "The certificate request has failed to complete and will be retried: issuer not found",
+		},
+	}
+	for i, tc := range tests {
+		cert.Status.Conditions = tc.conditions
+		require.NoError(t, c.Update(ctx, &cert))
+		status, msg, err := r.certificateStatus(ctx, svc)
+		require.NoError(t, err)
+		assert.Equal(t, tc.state, status[CertReadyAnnotation], i)
+		assert.Equal(t, tc.msg, msg, i)
+	}
+
+	// Issued certificate
+	notBefore := metav1.NewTime(time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC))
+	notAfter := metav1.NewTime(time.Date(2022, 7, 30, 12, 0, 0, 0, time.UTC))
+	cert.Spec.SecretName = "foo-tls"
+	cert.Status.NotBefore = &notBefore
+	cert.Status.NotAfter = &notAfter
+	require.NoError(t, c.Update(ctx, &cert))
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("ca")})
+	require.NoError(t, c.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-tls", Namespace: testNs},
+		Data: map[string][]byte{
+			"ca.crt": caPEM,
+		},
+	}))
+	caHash, err := certs.CAFingerprint(caPEM)
+	require.NoError(t, err)
+	status, _, err := r.certificateStatus(ctx, svc)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		ServingCertErrorAnnotation: "",
+		CertReadyAnnotation:        "Failed",
+		CertNameAnnotation:         "test-svc-tls",
+		CertNotAfterAnnotation:     "2022-07-30T12:00:00Z",
+		CertLastRenewalAnnotation:  "2022-05-01T12:00:00Z",
+		CertCAHashAnnotation:       caHash,
+	}, status)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
+)
+
+// stringListValue is a flag.Value for a comma-separated list of strings
+type stringListValue struct {
+	list *[]string
+}
+
+func (v stringListValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v stringListValue) Set(s string) error {
+	*v.list = nil
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			*v.list = append(*v.list, e)
+		}
+	}
+	return nil
+}
+
+// stringArrayValue is a flag.Value for a list of strings which is built by
+// repeating the flag
+type stringArrayValue struct {
+	list *[]string
+}
+
+func (v stringArrayValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, " ")
+}
+
+func (v stringArrayValue) Set(s string) error {
+	*v.list = append(*v.list, s)
+	return nil
+}
+
+// durationValue is a flag.Value for an optional duration. The duration is
+// nil unless the flag is set.
+type durationValue struct {
+	d **metav1.Duration
+}
+
+func (v durationValue) String() string {
+	if v.d == nil || *v.d == nil {
+		return ""
+	}
+	return (*v.d).Duration.String()
+}
+
+func (v durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v.d = &metav1.Duration{Duration: d}
+	return nil
+}
+
+// keyAlgorithmValue is a flag.Value for a private key algorithm
+type keyAlgorithmValue struct {
+	alg *cmapi.PrivateKeyAlgorithm
+}
+
+func (v keyAlgorithmValue) String() string {
+	if v.alg == nil {
+		return ""
+	}
+	return string(*v.alg)
+}
+
+func (v keyAlgorithmValue) Set(s string) error {
+	*v.alg = cmapi.PrivateKeyAlgorithm(s)
+	return nil
+}
+
+// caProfileFlags lists the names of the flags which configure the CA profile
+var caProfileFlags = map[string]bool{}
+
+// bindCAProfileFlags registers the flags which configure the CA profile
+func bindCAProfileFlags(fs *flag.FlagSet, p *certs.CAProfile) {
+	register := func(name string) string {
+		caProfileFlags[name] = true
+		return name
+	}
+	fs.StringVar(&p.SelfSignedIssuerName, register("ca-self-signed-issuer-name"), p.SelfSignedIssuerName,
+		"The name of the self-signed Issuer which signs the CA certificate.")
+	fs.StringVar(&p.CertificateName, register("ca-certificate-name"), p.CertificateName,
+		"The name of the CA Certificate resource.")
+	fs.StringVar(&p.SecretName, register("ca-secret-name"), p.SecretName,
+		"The name of the secret which holds the CA certificate and key.")
+	fs.StringVar(&p.IssuerName, register("ca-issuer-name"), p.IssuerName,
+		"The name of the ClusterIssuer which issues Service certificates.")
+	fs.StringVar(&p.CommonName, register("ca-common-name"), p.CommonName,
+		"The common name of the CA certificate.")
+	fs.Var(stringListValue{&p.Organizations}, register("ca-organizations"),
+		"Comma-separated list of organizations (O) of the CA certificate.")
+	fs.Var(stringListValue{&p.OrganizationalUnits}, register("ca-organizational-units"),
+		"Comma-separated list of organizational units (OU) of the CA certificate.")
+	fs.Var(stringListValue{&p.Countries}, register("ca-countries"),
+		"Comma-separated list of countries (C) of the CA certificate.")
+	fs.Var(keyAlgorithmValue{&p.KeyAlgorithm}, register("ca-key-algorithm"),
+		"The private key algorithm (RSA, ECDSA or Ed25519) of the CA. (default ECDSA)")
+	fs.IntVar(&p.KeySize, register("ca-key-size"), p.KeySize,
+		"The private key size of the CA in bits.")
+	fs.Var(durationValue{&p.Duration}, register("ca-duration"),
+		"The lifetime of the CA certificate. If not set, cert-manager's default applies.")
+	fs.Var(durationValue{&p.RenewBefore}, register("ca-renew-before"),
+		"The time before expiry at which the CA certificate is renewed. If not set, cert-manager's default applies.")
+	fs.Var(durationValue{&p.RotationGracePeriod}, register("ca-rotation-grace-period"),
+		"How long the previous CA is kept in the trust bundle after a CA rotation before certificates are reissued, "+
+			"and again after all certificates have been reissued. (default "+certs.DefaultRotationGracePeriod.String()+")")
+	fs.BoolVar(&p.Import, register("ca-import"), p.Import,
+		"Use the CA certificate and key which the operator supplies in the CA secret instead of issuing the CA certificate.")
+	fs.BoolVar(&p.NameConstraints, register("ca-name-constraints"), p.NameConstraints,
+		"Issue the CA certificate with critical name constraints which limit the CA to the cluster domain, "+
+			"the internal zones, the Service IP ranges, and the permitted DNS domains and IP ranges.")
+	fs.Var(stringListValue{&p.PermittedDNSDomains}, register("ca-permitted-dns-domains"),
+		"Comma-separated list of additional DNS domains which the CA name constraints permit.")
+	fs.Var(stringListValue{&p.PermittedIPRanges}, register("ca-permitted-ip-ranges"),
+		"Comma-separated list of additional IP ranges in CIDR notation which the CA name constraints permit.")
+	fs.BoolVar(&p.Intermediate, register("ca-intermediate"), p.Intermediate,
+		"Issue Service certificates from an intermediate CA which is signed by the CA.")
+	fs.Var(durationValue{&p.IntermediateDuration}, register("ca-intermediate-duration"),
+		"The lifetime of the intermediate CA certificate. If not set, cert-manager's default applies.")
+	fs.Var(durationValue{&p.IntermediateRenewBefore}, register("ca-intermediate-renew-before"),
+		"The time before expiry at which the intermediate CA certificate is renewed. If not set, cert-manager's default applies.")
+	fs.StringVar(&p.ParentIssuer.Name, register("ca-parent-issuer-name"), p.ParentIssuer.Name,
+		"The name of an existing issuer which signs the CA certificate. "+
+			"If not set, the CA certificate is self-signed.")
+	fs.StringVar(&p.ParentIssuer.Kind, register("ca-parent-issuer-kind"), p.ParentIssuer.Kind,
+		"The kind of the issuer which signs the CA certificate. (default ClusterIssuer)")
+	fs.StringVar(&p.ParentIssuer.Group, register("ca-parent-issuer-group"), p.ParentIssuer.Group,
+		"The API group of the issuer which signs the CA certificate. (default cert-manager.io)")
+}
+
+// loadCAProfile reads the CA profile file at `path` into `p`. Flags which
+// configure the CA profile and are set explicitly take precedence over the
+// values in the file.
+func loadCAProfile(fs *flag.FlagSet, path string, p *certs.CAProfile) error {
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if caProfileFlags[f.Name] {
+			set[f.Name] = f.Value.String()
+		}
+	})
+	*p = certs.DefaultCAProfile()
+	if err := certs.LoadCAProfile(path, p); err != nil {
+		return err
+	}
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
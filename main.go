@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -25,16 +26,20 @@ import (
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
 
+	"github.com/projectsyn/k8s-service-ca-controller/certs"
 	"github.com/projectsyn/k8s-service-ca-controller/controllers"
 	//+kubebuilder:scaffold:imports
 )
@@ -52,8 +57,8 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
-//+kubebuilder:rbac:groups=cert-manager.io,resources=issuers,verbs=get;list;watch;create;update;patch
-//+kubebuilder:rbac:groups=cert-manager.io,resources=clusterissuers,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=cert-manager.io,resources=issuers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cert-manager.io,resources=clusterissuers,verbs=get;list;watch;create;update;patch;delete
 
 //go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen object paths="./..."
 //go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen rbac:roleName=k8s-service-ca-controller paths="./..."
@@ -63,6 +68,28 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var caNamespace string
+	var allowedPrivateKeys string
+	var rotationPolicy string
+	var allowedUsages string
+	var caProfileFile string
+	var namedCAProfilesFile string
+	var clusterDomain string
+	var dnsNameTemplates []string
+	var autoSecretNameTemplate string
+	var namespaces controllers.NamespacePolicy
+	var namespaceCAs bool
+	var internalZones []string
+	var serviceCIDRs []string
+	var approveRequests bool
+	var protectResources bool
+	var emergencyRotationGroups []string
+	protectionAllowedUsers := []string{
+		"system:serviceaccount:cert-manager:cert-manager",
+		"system:serviceaccount:kube-system:generic-garbage-collector",
+		"system:serviceaccount:kube-system:namespace-controller",
+	}
+	certConfig := certs.DefaultConfig()
+	caProfile := certs.DefaultCAProfile()
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -71,6 +98,78 @@ func main() {
 	flag.StringVar(&caNamespace, "ca-namespace", "cert-manager",
 		"The namespace in which the controller will create the CA certificate. "+
 			"For most setups, this should be the namespace in which cert-manager is deployed.")
+	flag.DurationVar(&certConfig.DefaultDuration, "cert-duration", certConfig.DefaultDuration,
+		"The default lifetime of Service certificates.")
+	flag.DurationVar(&certConfig.DefaultRenewBefore, "cert-renew-before", certConfig.DefaultRenewBefore,
+		"The default time before expiry at which Service certificates are renewed.")
+	flag.DurationVar(&certConfig.MinDuration, "cert-min-duration", certConfig.MinDuration,
+		"The shortest certificate lifetime which Services may request.")
+	flag.DurationVar(&certConfig.MaxDuration, "cert-max-duration", certConfig.MaxDuration,
+		"The longest certificate lifetime which Services may request.")
+	flag.DurationVar(&certConfig.MinRenewBefore, "cert-min-renew-before", certConfig.MinRenewBefore,
+		"The shortest renew-before value which Services may request.")
+	flag.DurationVar(&certConfig.MaxRenewBefore, "cert-max-renew-before", certConfig.MaxRenewBefore,
+		"The longest renew-before value which Services may request.")
+	flag.DurationVar(&certConfig.CleanupGracePeriod, "cleanup-grace-period", certConfig.CleanupGracePeriod,
+		"How long certificates and secrets which a Service no longer uses are kept before they're deleted. "+
+			"If 0, they're deleted immediately.")
+	flag.StringVar(&allowedPrivateKeys, "allowed-private-keys", certs.DefaultAllowedPrivateKeys,
+		"Comma-separated list of private key types which Services may request. "+
+			"Each entry has the form <algorithm>-<size> (for example RSA-4096 or ECDSA-256) or is Ed25519. "+
+			"Must include RSA-2048, cert-manager's default, unless all Services set the private key algorithm or size.")
+	flag.StringVar(&rotationPolicy, "private-key-rotation-policy", "",
+		"The default private key rotation policy (Never or Always) for Service certificates. "+
+			"If empty, cert-manager's default applies.")
+	flag.StringVar(&allowedUsages, "allowed-cert-usages", certs.DefaultAllowedUsages,
+		"Comma-separated list of cert-manager key usages which Services may request.")
+	flag.StringVar(&clusterDomain, "cluster-domain", "",
+		"The DNS domain of the cluster. If empty, the cluster domain is detected from /etc/resolv.conf, "+
+			"and "+certs.DefaultClusterDomain+" is used if detection fails.")
+	flag.Var(stringListValue{&internalZones}, "internal-zones",
+		"Comma-separated list of internal DNS zones of the cluster. "+
+			"CA name constraints permit the cluster domain and the internal zones.")
+	flag.Var(stringListValue{&serviceCIDRs}, "service-cidrs",
+		"Comma-separated list of the cluster's Service IP ranges in CIDR notation. "+
+			"CA name constraints permit the Service IP ranges.")
+	flag.Var(stringArrayValue{&dnsNameTemplates}, "dns-name-template",
+		"Go text/template which generates an additional DNS name for each Service certificate. "+
+			"The template has access to fields .Name, .Namespace, .Labels and .ClusterDomain. "+
+			"Templates which render to an empty string are skipped. Can be repeated.")
+	flag.StringVar(&autoSecretNameTemplate, "auto-secret-name-template", controllers.DefaultAutoSecretNameTemplate,
+		"Go text/template which generates the certificate secret name for Services in namespaces with label "+
+			controllers.AutoServingCertLabelKey+"=true. "+
+			"The template has access to fields .Name and .Namespace of the Service.")
+	flag.Var(stringListValue{&namespaces.Allow}, "namespace-allowlist",
+		"Comma-separated list of namespace patterns in which the controller issues certificates and injects CA bundles. "+
+			"If empty, all namespaces which aren't in the deny list are allowed.")
+	flag.Var(stringListValue{&namespaces.Deny}, "namespace-denylist",
+		"Comma-separated list of namespace patterns in which the controller never issues certificates or injects CA bundles. "+
+			"Takes precedence over the allow list.")
+	flag.BoolVar(&namespaces.CleanupDenied, "cleanup-denied-namespaces", false,
+		"Remove existing certificates of Services in namespaces which aren't allowed by the allow and deny lists. "+
+			"If false, existing certificates in those namespaces are left untouched.")
+	flag.BoolVar(&namespaceCAs, "namespace-cas", false,
+		"Issue certificates from a separate CA for each namespace. "+
+			"Namespaces with label "+certs.CAGroupLabelKey+" share the CA of the group regardless of this flag.")
+	flag.StringVar(&caProfileFile, "ca-profile", "",
+		"Path to a YAML file which configures the Service CA profile. "+
+			"Flags which configure the CA profile take precedence over the file.")
+	flag.StringVar(&namedCAProfilesFile, "named-ca-profiles", "",
+		"Path to a YAML file which maps the names of additional Service CAs to their CA profiles. "+
+			"Services and ConfigMaps select a named CA with label or annotation "+controllers.CAKey+".")
+	flag.BoolVar(&approveRequests, "approve-certificate-requests", false,
+		"Approve CertificateRequests for the Service CA issuers only if they request names of the Services in the request's namespace, "+
+			"and deny all others. Requires that cert-manager's own approver doesn't approve requests for the Service CA issuers.")
+	flag.BoolVar(&protectResources, "protect-managed-resources", false,
+		"Serve a validating webhook which denies changes to the objects which the controller manages "+
+			"by anyone but the controller and the users in --protection-allowed-users.")
+	flag.Var(stringListValue{&protectionAllowedUsers}, "protection-allowed-users",
+		"Comma-separated list of users besides the controller which may change the objects which the controller manages.")
+	flag.Var(stringListValue{&emergencyRotationGroups}, "emergency-rotation-groups",
+		"Comma-separated list of groups whose members may trigger emergency CA rotations "+
+			"while the objects which the controller manages are protected. "+
+			"The users in --protection-allowed-users may always trigger them.")
+	bindCAProfileFlags(flag.CommandLine, &caProfile)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -79,6 +178,76 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	allowedKeys, err := certs.ParsePrivateKeySpecs(allowedPrivateKeys)
+	if err != nil {
+		setupLog.Error(err, "invalid list of allowed private keys")
+		os.Exit(1)
+	}
+	certConfig.AllowedPrivateKeys = allowedKeys
+	certConfig.DefaultRotationPolicy = cmapi.PrivateKeyRotationPolicy(rotationPolicy)
+	certConfig.AllowedUsages, err = certs.ParseUsages(allowedUsages)
+	if err != nil {
+		setupLog.Error(err, "invalid list of allowed key usages")
+		os.Exit(1)
+	}
+	if clusterDomain == "" {
+		clusterDomain, err = certs.DetectClusterDomain("/etc/resolv.conf")
+		if err != nil {
+			setupLog.Info("unable to detect cluster domain, using default",
+				"error", err.Error(), "clusterDomain", certs.DefaultClusterDomain)
+			clusterDomain = certs.DefaultClusterDomain
+		}
+	}
+	certConfig.ClusterDomain = clusterDomain
+	certConfig.DNSNameTemplates, err = certs.ParseDNSNameTemplates(dnsNameTemplates)
+	if err != nil {
+		setupLog.Error(err, "invalid DNS name template")
+		os.Exit(1)
+	}
+	setupLog.Info("using cluster domain", "clusterDomain", certConfig.ClusterDomain)
+	if err := certConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid certificate configuration")
+		os.Exit(1)
+	}
+	autoSecretName, err := controllers.ParseAutoSecretNameTemplate(autoSecretNameTemplate)
+	if err != nil {
+		setupLog.Error(err, "invalid auto secret name template")
+		os.Exit(1)
+	}
+	if err := namespaces.Validate(); err != nil {
+		setupLog.Error(err, "invalid namespace allow or deny list")
+		os.Exit(1)
+	}
+	if caProfileFile != "" {
+		if err := loadCAProfile(flag.CommandLine, caProfileFile, &caProfile); err != nil {
+			setupLog.Error(err, "unable to load CA profile")
+			os.Exit(1)
+		}
+	}
+	// Permit `<service>.<namespace>.svc` names besides the cluster domain
+	clusterDomains := append([]string{clusterDomain, "svc"}, internalZones...)
+	caProfile.AddClusterNameConstraints(clusterDomains, serviceCIDRs)
+	if err := caProfile.Validate(); err != nil {
+		setupLog.Error(err, "invalid CA profile")
+		os.Exit(1)
+	}
+	namedCAs := certs.CAProfiles{}
+	if namedCAProfilesFile != "" {
+		namedCAs, err = certs.LoadNamedCAProfiles(namedCAProfilesFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load named CA profiles")
+			os.Exit(1)
+		}
+	}
+	for name, p := range namedCAs {
+		p.AddClusterNameConstraints(clusterDomains, serviceCIDRs)
+		namedCAs[name] = p
+	}
+	if err := namedCAs.Validate(caProfile); err != nil {
+		setupLog.Error(err, "invalid named CA profiles")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -86,6 +255,10 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "238cfff4.syn.tools",
+		// Secrets are read from the API server, so that the cache
+		// doesn't hold the data of all secrets in the cluster. The
+		// controllers only watch the secrets' metadata.
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -95,22 +268,86 @@ func main() {
 	ctx := ctrl.SetupSignalHandler()
 
 	if err = (&controllers.ServiceReconciler{
-		Client:      mgr.GetClient(),
-		Scheme:      mgr.GetScheme(),
-		CANamespace: caNamespace,
+		Client:                 mgr.GetClient(),
+		Scheme:                 mgr.GetScheme(),
+		CANamespace:            caNamespace,
+		CAProfile:              caProfile,
+		CertConfig:             certConfig,
+		Recorder:               mgr.GetEventRecorderFor("service-ca-controller"),
+		Namespaces:             namespaces,
+		AutoSecretNameTemplate: autoSecretName,
+		NamespaceCAs:           namespaceCAs,
+		NamedCAs:               namedCAs,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.ConfigMapReconciler{
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		CANamespace:  caNamespace,
+		CAProfile:    caProfile,
+		Recorder:     mgr.GetEventRecorderFor("service-ca-controller"),
+		Namespaces:   namespaces,
+		NamespaceCAs: namespaceCAs,
+		NamedCAs:     namedCAs,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+		os.Exit(1)
+	}
+	if err = (&controllers.CARotationReconciler{
 		Client:      mgr.GetClient(),
-		Scheme:      mgr.GetScheme(),
 		CANamespace: caNamespace,
+		CAProfile:   caProfile,
+		NamedCAs:    namedCAs,
+		Recorder:    mgr.GetEventRecorderFor("service-ca-controller"),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+		setupLog.Error(err, "unable to create controller", "controller", "CARotation")
 		os.Exit(1)
 	}
+	if approveRequests {
+		if err = (&controllers.CertificateRequestReconciler{
+			Client:       mgr.GetClient(),
+			CANamespace:  caNamespace,
+			CAProfile:    caProfile,
+			NamedCAs:     namedCAs,
+			CertConfig:   certConfig,
+			Recorder:     mgr.GetEventRecorderFor("service-ca-controller"),
+			NamespaceCAs: namespaceCAs,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CertificateRequest")
+			os.Exit(1)
+		}
+	}
+	if protectResources {
+		// The controller's own ServiceAccount is passed through the
+		// downward API
+		ns, sa := os.Getenv("POD_NAMESPACE"), os.Getenv("SERVICE_ACCOUNT_NAME")
+		if ns == "" || sa == "" {
+			setupLog.Error(fmt.Errorf("POD_NAMESPACE and SERVICE_ACCOUNT_NAME must be set"),
+				"unable to determine the controller's ServiceAccount")
+			os.Exit(1)
+		}
+		if err = controllers.SetupProtectionLabelReconcilers(mgr, controllers.ProtectionLabelReconciler{
+			Client:      mgr.GetClient(),
+			CANamespace: caNamespace,
+			CAProfile:   caProfile,
+			NamedCAs:    namedCAs,
+		}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ProtectionLabel")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(controllers.ProtectionWebhookPath, &webhook.Admission{
+			Handler: &controllers.ProtectionWebhook{
+				CANamespace:             caNamespace,
+				CAProfile:               caProfile,
+				NamedCAs:                namedCAs,
+				AllowedUsers:            append([]string{fmt.Sprintf("system:serviceaccount:%s:%s", ns, sa)}, protectionAllowedUsers...),
+				EmergencyRotationGroups: emergencyRotationGroups,
+			},
+		})
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {